@@ -0,0 +1,42 @@
+package pps
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrListenerFailed is returned by Run if a listener failed permanently and is no longer
+// able to accept new connections
+var ErrListenerFailed = errors.New("listener failed")
+
+// Limits of the exponential backoff of the accept loop after temporary accept errors
+const (
+	acceptBackoffMin = time.Millisecond * 5
+	acceptBackoffMax = time.Second
+)
+
+// temporary is implemented by errors that might resolve themselves, like the accept
+// errors caused by running out of file descriptors (EMFILE/ENFILE)
+type temporary interface {
+	Temporary() bool
+}
+
+// isTemporary reports whether the given accept error is temporary, so that accepting
+// new connections can be retried
+func isTemporary(err error) bool {
+	var te temporary
+	return errors.As(err, &te) && te.Temporary()
+}
+
+// nextAcceptBackoff returns the delay before the next accept after a temporary accept
+// error, doubling the given previous delay up to acceptBackoffMax
+func nextAcceptBackoff(d time.Duration) time.Duration {
+	if d == 0 {
+		return acceptBackoffMin
+	}
+	d *= 2
+	if d > acceptBackoffMax {
+		d = acceptBackoffMax
+	}
+	return d
+}
@@ -0,0 +1,115 @@
+package pps
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// errListener is a pipeListener that returns the queued accept errors first
+type errListener struct {
+	*pipeListener
+	errs chan error
+}
+
+// Accept satisfies the net.Listener interface for the errListener
+func (l *errListener) Accept() (net.Conn, error) {
+	select {
+	case err := <-l.errs:
+		return nil, err
+	default:
+		return l.pipeListener.Accept()
+	}
+}
+
+// TestNextAcceptBackoff tests the exponential backoff of the accept loop
+func TestNextAcceptBackoff(t *testing.T) {
+	tt := []struct {
+		prev time.Duration
+		want time.Duration
+	}{
+		{0, acceptBackoffMin},
+		{acceptBackoffMin, acceptBackoffMin * 2},
+		{time.Millisecond * 400, time.Millisecond * 800},
+		{time.Millisecond * 800, acceptBackoffMax},
+		{acceptBackoffMax, acceptBackoffMax},
+	}
+	for _, tc := range tt {
+		if d := nextAcceptBackoff(tc.prev); d != tc.want {
+			t.Errorf("unexpected backoff after %s => expected: %s, got: %s", tc.prev, tc.want, d)
+		}
+	}
+}
+
+// TestIsTemporary tests the detection of temporary accept errors
+func TestIsTemporary(t *testing.T) {
+	tt := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"EMFILE", &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}, true},
+		{"closed listener", &net.OpError{Op: "accept", Net: "tcp", Err: net.ErrClosed}, false},
+		{"plain error", errors.New("listener broken"), false},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if isTemporary(tc.err) != tc.want {
+				t.Errorf("unexpected result for %s => expected: %t, got: %t", tc.err, tc.want, !tc.want)
+			}
+		})
+	}
+}
+
+// TestServe_temporaryAcceptError tests that the accept loop keeps serving after temporary
+// accept errors
+func TestServe_temporaryAcceptError(t *testing.T) {
+	l := &errListener{pipeListener: newPipeListener(), errs: make(chan error, 3)}
+	for i := 0; i < 3; i++ {
+		l.errs <- &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	}
+	b := &syncBuffer{}
+	s := New(WithLogOutput(b))
+	ctx, cancel := context.WithCancel(context.Background())
+	ec := make(chan error, 1)
+	go func() { ec <- s.Serve(ctx, l, Hi{r: RespOk}) }()
+
+	conn := l.dial()
+	if r := testRequest(t, conn, bufio.NewReader(conn), exampleReq); r != "action=OK\n" {
+		t.Errorf("unexpected server response => expected: %q, got: %q", "action=OK\n", r)
+	}
+	_ = conn.Close()
+	cancel()
+	if err := <-ec; err != nil {
+		t.Errorf("Serve failed: %s", err)
+	}
+	if n := strings.Count(b.String(), "failed to accept new connection, retrying in"); n != 3 {
+		t.Errorf("unexpected number of accept retries logged => expected: %d, got: %d", 3, n)
+	}
+}
+
+// TestServe_fatalAcceptError tests that Serve returns ErrListenerFailed if the listener
+// failed permanently
+func TestServe_fatalAcceptError(t *testing.T) {
+	l := &errListener{pipeListener: newPipeListener(), errs: make(chan error, 1)}
+	l.errs <- errors.New("listener broken")
+	s := New()
+	ctx := context.WithValue(context.Background(), CtxNoLog, true)
+	ec := make(chan error, 1)
+	go func() { ec <- s.Serve(ctx, l, Hi{r: RespOk}) }()
+
+	select {
+	case err := <-ec:
+		if !errors.Is(err, ErrListenerFailed) {
+			t.Errorf("Serve was supposed to fail with ErrListenerFailed, got: %v", err)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatalf("Serve did not return after a fatal accept error")
+	}
+}
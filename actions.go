@@ -0,0 +1,75 @@
+package pps
+
+import (
+	"strings"
+)
+
+// KnownActions is the list of documented postfix actions that can be returned by a policy
+// server. See http://www.postfix.org/access.5.html. Numerical reply codes (4NN and 5NN
+// text) are valid as well, but are not part of the list
+var KnownActions = []string{
+	string(RespOk), string(RespReject), string(RespDefer), string(RespDeferIfReject),
+	string(RespDeferIfPermit), string(RespDiscard), string(RespDunno), string(RespHold),
+	string(RespInfo), string(RespWarn), string(TextRespFilter), string(TextRespPrepend),
+	string(TextRespRedirect), "BCC",
+}
+
+// actionArgs defines for the known actions whether they require an argument (1), accept
+// an optional text (0) or must not have any argument (-1)
+var actionArgs = map[string]int{
+	string(RespOk):            -1,
+	string(RespDunno):         -1,
+	string(RespReject):        0,
+	string(RespDefer):         0,
+	string(RespDeferIfReject): 0,
+	string(RespDeferIfPermit): 0,
+	string(RespDiscard):       0,
+	string(RespHold):          0,
+	string(RespInfo):          0,
+	string(RespWarn):          0,
+	string(TextRespFilter):    1,
+	string(TextRespPrepend):   1,
+	string(TextRespRedirect):  1,
+	"BCC":                     1,
+}
+
+// IsValidAction returns true if the given string is a valid postfix action. It recognizes
+// the bare actions, the actions with an (optional or required) argument, like
+// "REJECT text" or "FILTER transport:destination", and numerical reply codes, like
+// "450 4.7.1 text". Action names are case-insensitive
+func IsValidAction(s string) bool {
+	a, arg := s, ""
+	if i := strings.IndexAny(s, " \t"); i >= 0 {
+		a, arg = s[:i], strings.TrimSpace(s[i+1:])
+	}
+	if a == "" || strings.ContainsAny(s, "\r\n") {
+		return false
+	}
+	if isNumeric(a) {
+		// 4NN and 5NN reply codes are followed by an optional text. Other all-numerical
+		// actions are treated like OK by postfix
+		return (len(a) == 3 && (a[0] == '4' || a[0] == '5')) || arg == ""
+	}
+	na, ok := actionArgs[strings.ToUpper(a)]
+	if !ok {
+		return false
+	}
+	switch na {
+	case -1:
+		return arg == ""
+	case 1:
+		return arg != ""
+	default:
+		return true
+	}
+}
+
+// isNumeric returns true if the given string consists of decimal digits only
+func isNumeric(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
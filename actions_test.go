@@ -0,0 +1,60 @@
+package pps
+
+import (
+	"testing"
+)
+
+// TestIsValidAction tests the IsValidAction() method with valid and invalid actions
+func TestIsValidAction(t *testing.T) {
+	testTable := []struct {
+		testName string
+		action   string
+		valid    bool
+	}{
+		{`Bare OK`, "OK", true},
+		{`Bare DUNNO`, "DUNNO", true},
+		{`Bare REJECT`, "REJECT", true},
+		{`Bare DEFER_IF_PERMIT`, "DEFER_IF_PERMIT", true},
+		{`Lower-case action`, "reject", true},
+		{`REJECT with text`, "REJECT go away", true},
+		{`HOLD with text`, "HOLD check later", true},
+		{`FILTER with destination`, "FILTER smtp:[127.0.0.1]:10025", true},
+		{`PREPEND with header`, "PREPEND X-Policy: checked", true},
+		{`REDIRECT with address`, "REDIRECT abuse@example.com", true},
+		{`BCC with address`, "BCC archive@example.com", true},
+		{`Reply code with text`, "450 4.7.1 try again later", true},
+		{`Bare reply code`, "554", true},
+		{`All-numerical action`, "200", true},
+		{`FILTER without destination`, "FILTER", false},
+		{`REDIRECT with blank argument`, "REDIRECT  ", false},
+		{`OK with text`, "OK fine", false},
+		{`Unknown action`, "ACCEPT", false},
+		{`Empty string`, "", false},
+		{`Leading space`, " OK", false},
+		{`Line break`, "REJECT a\nb", false},
+		{`Numerical action with text`, "200 fine", false},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			if v := IsValidAction(tc.action); v != tc.valid {
+				t.Errorf("unexpected validation result for %q => expected: %t, got: %t", tc.action, tc.valid, v)
+			}
+		})
+	}
+}
+
+// TestKnownActions tests that all KnownActions are valid
+func TestKnownActions(t *testing.T) {
+	for _, a := range KnownActions {
+		if _, ok := actionArgs[a]; !ok {
+			t.Errorf("known action %s has no argument definition", a)
+		}
+		arg := ""
+		if actionArgs[a] == 1 {
+			arg = " argument"
+		}
+		if !IsValidAction(a + arg) {
+			t.Errorf("known action %s is not valid", a)
+		}
+	}
+}
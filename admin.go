@@ -0,0 +1,130 @@
+package pps
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// adminShutdownTimeout is the time the admin HTTP server has to finish its requests on
+// shutdown
+const adminShutdownTimeout = time.Second * 5
+
+// WithAdminHTTP starts a minimal admin HTTP server on the given address alongside the
+// policy listener. It is stopped when the policy server stops. The admin server exposes:
+//
+//	/healthz: returns 200 OK while the server is healthy (see Server.Healthy)
+//	/readyz:  returns 200 OK while the server is ready (see Server.Ready)
+//	/stats:   the Stats snapshot of the server as JSON object
+//	/metrics: the Stats snapshot and the decision latency histogram in the Prometheus
+//	          text exposition format or, if requested via the Accept header, in the
+//	          OpenMetrics format with trace id exemplars (see WithTraceID)
+func WithAdminHTTP(addr string) ServerOpt {
+	return func(s *Server) {
+		s.adminAddr = addr
+	}
+}
+
+// adminHandler returns the http.Handler of the admin HTTP server
+func (s *Server) adminHandler() http.Handler {
+	m := http.NewServeMux()
+	m.HandleFunc("/healthz", probeHandler(s.Healthy))
+	m.HandleFunc("/readyz", probeHandler(s.Ready))
+	m.HandleFunc("/stats", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(s.Stats())
+	})
+	m.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		om := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+		if om {
+			w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		}
+		s.writeMetrics(w, om)
+	})
+	return m
+}
+
+// writeMetrics writes the Stats snapshot and the decision latency histogram to the given
+// writer. If openMetrics is true, the OpenMetrics text format is used, which includes the
+// trace id exemplars of the histogram (see WithTraceID). Otherwise the Prometheus text
+// exposition format is used
+func (s *Server) writeMetrics(w io.Writer, openMetrics bool) {
+	st := s.Stats()
+	counter := func(name string, v uint64) {
+		if openMetrics {
+			_, _ = fmt.Fprintf(w, "# TYPE %s counter\n%s_total %d\n", name, name, v)
+			return
+		}
+		_, _ = fmt.Fprintf(w, "# TYPE %s_total counter\n%s_total %d\n", name, name, v)
+	}
+	gauge := func(name string, v int64) {
+		_, _ = fmt.Fprintf(w, "# TYPE %s gauge\n%s %d\n", name, name, v)
+	}
+	counter("pps_connections", st.Connections)
+	counter("pps_requests", st.Requests)
+	gauge("pps_active_handlers", st.ActiveHandlers)
+	counter("pps_audit_dropped", st.AuditDropped)
+	counter("pps_write_timeouts", st.WriteTimeouts)
+	counter("pps_read_timeouts", st.ReadTimeouts)
+	counter("pps_idle_timeouts", st.IdleTimeouts)
+	gauge("pps_open_connections", st.OpenConnections)
+	counter("pps_connection_limit_hits", st.ConnectionLimitHits)
+	counter("pps_connections_rejected", st.ConnectionsRejected)
+	counter("pps_handler_panics", st.HandlerPanics)
+	counter("pps_request_limit_hits", st.RequestLimitHits)
+	if openMetrics {
+		_, _ = fmt.Fprint(w, "# TYPE pps_connection_terminations counter\n")
+	} else {
+		_, _ = fmt.Fprint(w, "# TYPE pps_connection_terminations_total counter\n")
+	}
+	for _, tc := range terminationCauses {
+		_, _ = fmt.Fprintf(w, "pps_connection_terminations_total{cause=%q} %d\n", tc, st.Terminations[tc])
+	}
+	s.stats.latency.write(w, openMetrics)
+	if openMetrics {
+		_, _ = fmt.Fprint(w, "# EOF\n")
+	}
+}
+
+// probeHandler returns a http.HandlerFunc that answers with 200 OK if the given probe
+// succeeds and with 503 Service Unavailable otherwise
+func probeHandler(probe func() bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if !probe() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("NOT OK\n"))
+			return
+		}
+		_, _ = w.Write([]byte("OK\n"))
+	}
+}
+
+// startAdmin starts the admin HTTP server and returns a function that stops it
+func (s *Server) startAdmin(ctx context.Context) (func(), error) {
+	l, err := net.Listen("tcp", s.adminAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start admin HTTP server: %w", err)
+	}
+	hs := &http.Server{Handler: s.adminHandler(), ReadHeaderTimeout: time.Second * 10}
+	ec := make(chan error, 1)
+	go func() { ec <- hs.Serve(l) }()
+	return func() {
+		sctx, cancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
+		defer cancel()
+		if err := hs.Shutdown(sctx); err != nil {
+			s.logf(ctx, LogLevelError, "failed to shut down admin HTTP server: %s", err)
+		}
+		if err := <-ec; err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logf(ctx, LogLevelError, "admin HTTP server failed: %s", err)
+		}
+	}, nil
+}
@@ -0,0 +1,84 @@
+package pps
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestWithAdminHTTP tests that the /stats endpoint of the admin HTTP server reflects the
+// served requests and that the admin server is stopped with the policy server
+func TestWithAdminHTTP(t *testing.T) {
+	aa := net.JoinHostPort("127.0.0.1", freePort(t))
+	s := New(WithAdminHTTP(aa))
+	addr, stop := testServer(t, &s, Hi{})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	rb := bufio.NewReader(conn)
+	for i := 0; i < 3; i++ {
+		_ = testRequest(t, conn, rb, exampleReq)
+	}
+	_ = conn.Close()
+
+	var resp *http.Response
+	for dl := time.Now().Add(time.Second * 2); time.Now().Before(dl); time.Sleep(time.Millisecond * 10) {
+		if resp, err = http.Get("http://" + aa + "/stats"); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		stop()
+		t.Fatalf("failed to request admin stats: %s", err)
+	}
+	var st Stats
+	err = json.NewDecoder(resp.Body).Decode(&st)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Errorf("failed to decode admin stats: %s", err)
+	}
+	if st.Requests != 3 || st.Connections != 1 {
+		t.Errorf("unexpected admin stats => expected: 3 requests/1 connection, got: %+v", st)
+	}
+
+	stop()
+	if _, err := http.Get("http://" + aa + "/healthz"); err == nil {
+		t.Errorf("admin HTTP server still running after the policy server stopped")
+	}
+}
+
+// TestAdminHandler tests the /healthz, /readyz and /metrics endpoints of the admin HTTP
+// server of a stopped server
+func TestAdminHandler(t *testing.T) {
+	s := New()
+	h := s.adminHandler()
+	testTable := []struct {
+		path    string
+		expCode int
+		expBody string
+	}{
+		{"/healthz", http.StatusServiceUnavailable, "NOT OK\n"},
+		{"/readyz", http.StatusServiceUnavailable, "NOT OK\n"},
+		{"/metrics", http.StatusOK, "pps_requests_total 0\n"},
+		{"/metrics", http.StatusOK, "pps_connection_terminations_total{cause=\"read_timeout\"} 0\n"},
+		{"/metrics", http.StatusOK, "pps_open_connections 0\n"},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.path, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.path, nil))
+			b, _ := io.ReadAll(rr.Body)
+			if rr.Code != tc.expCode || !strings.Contains(string(b), tc.expBody) {
+				t.Errorf("unexpected admin response => expected: %d %q, got: %d %q", tc.expCode, tc.expBody,
+					rr.Code, b)
+			}
+		})
+	}
+}
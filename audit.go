@@ -0,0 +1,76 @@
+package pps
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// AuditEvent represents a policy decision of the server that is sent to the audit
+// channel (see WithAuditChannel). The QueueID is only present in protocol states in
+// which postfix has already assigned a queue id (i. e. DATA and END-OF-MESSAGE) and
+// allows the correlation of the decision with the postfix mail log. The Latency is the time
+// the server took for the decision and the TraceID links the decision to its trace (see
+// WithTraceID).
+// Fallback is true if the Action has not been decided by the Handler, but by a fallback
+// path of the server (i. e. an exceeded response budget or the stress fallback). A spike
+// of fallback decisions is a strong signal of handler trouble. If an address redactor is
+// set (see WithAddressRedactor), Client is nil and ClientRedacted holds the redacted address
+type AuditEvent struct {
+	ConnID         string        `json:"conn_id"`
+	Seq            uint64        `json:"seq"`
+	QueueID        string        `json:"queue_id,omitempty"`
+	Client         net.IP        `json:"client,omitempty"`
+	ClientRedacted string        `json:"client_redacted,omitempty"`
+	Sender         string        `json:"sender"`
+	Recipient      string        `json:"recipient"`
+	Action         PostfixResp   `json:"action"`
+	Time           time.Time     `json:"time"`
+	Latency        time.Duration `json:"latency"`
+	TraceID        string        `json:"trace_id,omitempty"`
+	Fallback       bool          `json:"fallback,omitempty"`
+}
+
+// WithAuditChannel sets a channel that receives an AuditEvent after each policy decision.
+// Events are sent non-blocking, so that a slow consumer does not slow down the request
+// handling. If the channel is full, the event is dropped and counted in the AuditDropped
+// field of the server Stats
+func WithAuditChannel(ch chan<- AuditEvent) ServerOpt {
+	return func(s *Server) {
+		s.auditCh = ch
+	}
+}
+
+// audit sends an AuditEvent for the given decision to the audit channel and the decision
+// webhook
+func (s *Server) audit(ps *PolicySet, r Response, lat time.Duration) {
+	if s.auditCh == nil && s.webhook == nil {
+		return
+	}
+	ev := AuditEvent{
+		ConnID:    ps.PPSConnId,
+		Seq:       ps.PPSRequestSeq,
+		QueueID:   ps.QueueId,
+		Client:    ps.ClientAddress,
+		Sender:    ps.Sender,
+		Recipient: ps.Recipient,
+		Action:    r.action(),
+		Time:      time.Now(),
+		Latency:   lat,
+		TraceID:   s.traceID(ps),
+		Fallback:  r.fallback,
+	}
+	if s.addrRedactor != nil && ps.ClientAddress != nil {
+		ev.Client = nil
+		ev.ClientRedacted = s.addrRedactor(ps.ClientAddress)
+	}
+	s.notifyWebhook(ev)
+	if s.auditCh == nil {
+		return
+	}
+	select {
+	case s.auditCh <- ev:
+	default:
+		atomic.AddUint64(&s.stats.auditDropped, 1)
+	}
+}
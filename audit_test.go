@@ -0,0 +1,177 @@
+package pps
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestWithAuditChannel tests that audit events arrive on the audit channel
+func TestWithAuditChannel(t *testing.T) {
+	ch := make(chan AuditEvent, 10)
+	s := New(WithAuditChannel(ch))
+	addr, stop := testServer(t, &s, Hi{r: RespReject})
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = testRequest(t, conn, bufio.NewReader(conn), exampleReq)
+
+	select {
+	case ev := <-ch:
+		if ev.Action != RespReject {
+			t.Errorf("unexpected audit event action => expected: %s, got: %s", RespReject, ev.Action)
+		}
+		if ev.Sender != "tester@example.com" || ev.Recipient != "tester@localhost.tld" {
+			t.Errorf("unexpected audit event sender/recipient => got: %s/%s", ev.Sender, ev.Recipient)
+		}
+		if !ev.Client.Equal(net.ParseIP("127.0.0.1")) {
+			t.Errorf("unexpected audit event client => expected: 127.0.0.1, got: %s", ev.Client)
+		}
+		if ev.ConnID == "" || ev.Time.IsZero() {
+			t.Errorf("audit event is missing connection id or time => got: %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("no audit event received")
+	}
+}
+
+// TestAuditEventSeq tests that multiple requests on a single connection result in audit
+// events with distinct sequence numbers
+func TestAuditEventSeq(t *testing.T) {
+	ch := make(chan AuditEvent, 10)
+	s := New(WithAuditChannel(ch))
+	addr, stop := testServer(t, &s, Hi{})
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	rb := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		_ = testRequest(t, conn, rb, exampleReq)
+	}
+
+	var evs []AuditEvent
+	for i := 0; i < 2; i++ {
+		select {
+		case ev := <-ch:
+			evs = append(evs, ev)
+		case <-time.After(time.Second):
+			t.Fatalf("no audit event received")
+		}
+	}
+	if evs[0].ConnID != evs[1].ConnID {
+		t.Errorf("audit events of the same connection have different connection ids => got: %s/%s",
+			evs[0].ConnID, evs[1].ConnID)
+	}
+	if evs[0].Seq != 1 || evs[1].Seq != 2 {
+		t.Errorf("unexpected audit event sequence numbers => expected: 1/2, got: %d/%d", evs[0].Seq,
+			evs[1].Seq)
+	}
+}
+
+// TestAuditEventQueueID tests that the queue id of the request propagates into the audit
+// event when present
+func TestAuditEventQueueID(t *testing.T) {
+	testTable := []struct {
+		testName string
+		state    string
+		queueId  string
+	}{
+		{`RCPT without queue id`, StateRcpt, ""},
+		{`END-OF-MESSAGE with queue id`, StateEndOfMessage, "4Xyz1234abc"},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			ch := make(chan AuditEvent, 1)
+			s := New(WithAuditChannel(ch))
+			addr, stop := testServer(t, &s, Hi{})
+			defer stop()
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("failed to connect to running server: %s", err)
+			}
+			defer func() { _ = conn.Close() }()
+			req := strings.Replace(exampleReq, "protocol_state=RCPT\n", "protocol_state="+tc.state+"\n", 1)
+			req = strings.Replace(req, "queue_id=\n", "queue_id="+tc.queueId+"\n", 1)
+			_ = testRequest(t, conn, bufio.NewReader(conn), req)
+
+			select {
+			case ev := <-ch:
+				if ev.QueueID != tc.queueId {
+					t.Errorf("unexpected audit event queue id => expected: %q, got: %q", tc.queueId, ev.QueueID)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("no audit event received")
+			}
+		})
+	}
+}
+
+// TestWithAuditChannelDrops tests that audit events are dropped and counted if the consumer
+// is too slow
+func TestWithAuditChannelDrops(t *testing.T) {
+	ch := make(chan AuditEvent, 1)
+	s := New(WithAuditChannel(ch))
+	addr, stop := testServer(t, &s, Hi{})
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	rb := bufio.NewReader(conn)
+	for i := 0; i < 3; i++ {
+		_ = testRequest(t, conn, rb, exampleReq)
+	}
+
+	if len(ch) != 1 {
+		t.Errorf("unexpected number of queued audit events => expected: 1, got: %d", len(ch))
+	}
+	if d := s.Stats().AuditDropped; d != 2 {
+		t.Errorf("unexpected number of dropped audit events => expected: 2, got: %d", d)
+	}
+}
+
+// TestAuditEventFallback tests that the Fallback flag of the audit event is only set if
+// the response has not been decided by the handler
+func TestAuditEventFallback(t *testing.T) {
+	testTable := []struct {
+		testName    string
+		delay       time.Duration
+		expFallback bool
+	}{
+		{`Handler decision`, 0, false},
+		{`Handler exceeds response budget`, time.Second, true},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			ch := make(chan AuditEvent, 1)
+			s := New(WithAuditChannel(ch), WithResponseBudget(time.Millisecond*100))
+			addr, stop := testServer(t, &s, sleepHandler{d: tc.delay, r: RespReject})
+			defer stop()
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("failed to connect to running server: %s", err)
+			}
+			defer func() { _ = conn.Close() }()
+			_ = testRequest(t, conn, bufio.NewReader(conn), exampleReq)
+
+			select {
+			case ev := <-ch:
+				if ev.Fallback != tc.expFallback {
+					t.Errorf("unexpected audit event fallback flag => expected: %t, got: %t",
+						tc.expFallback, ev.Fallback)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("no audit event received")
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package pps
+
+import (
+	"sync"
+	"time"
+)
+
+// Defaults of the BatchingHandler
+const (
+	DefaultBatchWindow = time.Millisecond * 5
+	DefaultBatchSize   = 64
+)
+
+// BatchHandler is the interface for handlers that process several policy requests at
+// once, i. e. with a single bulk database lookup. HandleBatch must return the responses in
+// the order of the given requests
+type BatchHandler interface {
+	HandleBatch([]*PolicySet) []PostfixResp
+}
+
+// BatchingHandler is a Handler that collects the requests of all connections for a short
+// window and hands them to a BatchHandler together. The responses are handed back to the
+// connections of the corresponding requests. Requests for which the BatchHandler returns
+// no response are answered with RespDunno. Use NewBatchingHandler to create it
+type BatchingHandler struct {
+	h      BatchHandler
+	window time.Duration
+	size   int
+
+	mu  sync.Mutex
+	cur *batch
+}
+
+// batch is a batch of requests that is collected by the BatchingHandler
+type batch struct {
+	ps []*PolicySet
+	rc []chan batchResult
+	t  *time.Timer
+}
+
+// batchResult is the result of a request of a batch. If the BatchHandler panicked, p
+// holds the recovered value
+type batchResult struct {
+	r PostfixResp
+	p interface{}
+}
+
+// NewBatchingHandler returns a BatchingHandler that collects requests for up to window
+// and hands them to the given BatchHandler once the window has passed or size requests
+// have been collected. A window or size of 0 falls back to DefaultBatchWindow and
+// DefaultBatchSize
+func NewBatchingHandler(h BatchHandler, window time.Duration, size int) *BatchingHandler {
+	if window <= 0 {
+		window = DefaultBatchWindow
+	}
+	if size <= 0 {
+		size = DefaultBatchSize
+	}
+	return &BatchingHandler{h: h, window: window, size: size}
+}
+
+// Handle satisfies the Handler interface for the BatchingHandler. If the context of the
+// PolicySet is cancelled while the request waits for its batch, RespDunno is returned. If
+// the BatchHandler panics, the panic is repeated in the Handle call of every request of
+// the batch, so that each of them is answered with the panic response of the server (see
+// WithPanicResponse)
+func (bh *BatchingHandler) Handle(ps *PolicySet) PostfixResp {
+	rc := make(chan batchResult, 1)
+	bh.mu.Lock()
+	b := bh.cur
+	if b == nil {
+		b = &batch{}
+		bh.cur = b
+		b.t = time.AfterFunc(bh.window, func() { bh.flush(b) })
+	}
+	b.ps = append(b.ps, ps)
+	b.rc = append(b.rc, rc)
+	full := len(b.ps) >= bh.size
+	bh.mu.Unlock()
+	if full {
+		b.t.Stop()
+		bh.flush(b)
+	}
+
+	select {
+	case br := <-rc:
+		if br.p != nil {
+			panic(br.p)
+		}
+		return br.r
+	case <-ps.Context().Done():
+		return RespDunno
+	}
+}
+
+// flush hands the given batch to the BatchHandler, unless it has already been flushed. A
+// panic of the BatchHandler is recovered and handed to all requests of the batch, since
+// flush may run in the goroutine of the batch timer
+func (bh *BatchingHandler) flush(b *batch) {
+	bh.mu.Lock()
+	if bh.cur != b {
+		bh.mu.Unlock()
+		return
+	}
+	bh.cur = nil
+	bh.mu.Unlock()
+
+	defer func() {
+		if p := recover(); p != nil {
+			for _, rc := range b.rc {
+				rc <- batchResult{p: p}
+			}
+		}
+	}()
+	rl := bh.h.HandleBatch(b.ps)
+	for i, rc := range b.rc {
+		r := RespDunno
+		if i < len(rl) && rl[i] != "" {
+			r = rl[i]
+		}
+		rc <- batchResult{r: r}
+	}
+}
@@ -0,0 +1,116 @@
+package pps
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordBatchHandler is a BatchHandler that records the sizes of its batches and rejects
+// the recipients of each request by echoing them in the response
+type recordBatchHandler struct {
+	mu    sync.Mutex
+	sizes []int
+}
+
+// HandleBatch is the function required by the BatchHandler Interface
+func (h *recordBatchHandler) HandleBatch(pl []*PolicySet) []PostfixResp {
+	h.mu.Lock()
+	h.sizes = append(h.sizes, len(pl))
+	h.mu.Unlock()
+	rl := make([]PostfixResp, 0, len(pl))
+	for _, ps := range pl {
+		rl = append(rl, TextResponseOpt(RespReject, ps.Recipient))
+	}
+	return rl
+}
+
+// TestBatchingHandler tests that concurrent requests of several connections are handed to
+// the BatchHandler together and that each connection gets its corresponding response
+func TestBatchingHandler(t *testing.T) {
+	bh := &recordBatchHandler{}
+	s := New()
+	addr, stop := testServer(t, &s, NewBatchingHandler(bh, time.Millisecond*200, 4))
+	defer stop()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Errorf("failed to connect to running server: %s", err)
+				return
+			}
+			defer func() { _ = conn.Close() }()
+			rcpt := string(rune('a'+i)) + "@example.com"
+			req := strings.Replace(exampleReq, "recipient=tester@localhost.tld", "recipient="+rcpt, 1)
+			exp := "action=REJECT " + rcpt + "\n"
+			if r := testRequest(t, conn, bufio.NewReader(conn), req); r != exp {
+				t.Errorf("unexpected server response => expected: %q, got: %q", exp, r)
+			}
+		}(i)
+	}
+	wg.Wait()
+	bh.mu.Lock()
+	defer bh.mu.Unlock()
+	if len(bh.sizes) != 1 || bh.sizes[0] != 4 {
+		t.Errorf("requests were not batched => got batch sizes: %v", bh.sizes)
+	}
+}
+
+// TestBatchingHandlerWindow tests that an incomplete batch is handed to the BatchHandler
+// once the window has passed and that missing responses fall back to RespDunno
+func TestBatchingHandlerWindow(t *testing.T) {
+	h := NewBatchingHandler(batchFunc(func([]*PolicySet) []PostfixResp { return nil }),
+		time.Millisecond*50, 10)
+	st := time.Now()
+	if r := h.Handle(&PolicySet{}); r != RespDunno {
+		t.Errorf("unexpected response => expected: %s, got: %s", RespDunno, r)
+	}
+	if d := time.Since(st); d < time.Millisecond*50 {
+		t.Errorf("batch was handled before the window passed after %s", d)
+	}
+}
+
+// TestBatchingHandlerPanic tests that a panic of the BatchHandler in the batch window
+// timer doesn't crash the server and that every request of the batch is answered with the
+// panic response
+func TestBatchingHandlerPanic(t *testing.T) {
+	h := NewBatchingHandler(batchFunc(func([]*PolicySet) []PostfixResp { panic("batch failure") }),
+		time.Millisecond*100, 10)
+	s := New(WithLogOutput(&syncBuffer{}))
+	addr, stop := testServer(t, &s, h)
+	defer stop()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Errorf("failed to connect to running server: %s", err)
+				return
+			}
+			defer func() { _ = conn.Close() }()
+			if r := testRequest(t, conn, bufio.NewReader(conn), exampleReq); r != "action=DEFER_IF_PERMIT\n" {
+				t.Errorf("unexpected server response => expected: %q, got: %q", "action=DEFER_IF_PERMIT\n", r)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := s.Stats().HandlerPanics; n != 3 {
+		t.Errorf("unexpected number of handler panics => expected: %d, got: %d", 3, n)
+	}
+}
+
+// batchFunc is an adapter to use ordinary functions as BatchHandler
+type batchFunc func([]*PolicySet) []PostfixResp
+
+// HandleBatch is the function required by the BatchHandler Interface
+func (f batchFunc) HandleBatch(pl []*PolicySet) []PostfixResp {
+	return f(pl)
+}
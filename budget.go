@@ -0,0 +1,76 @@
+package pps
+
+import (
+	"context"
+	"time"
+)
+
+// WithResponseBudget sets the maximum time between the moment a request has been read
+// completely and the moment its response is written. The budget covers the time the
+// request waits for a free worker (see WithWorkers), the enrichers (see WithEnricher) and
+// the Handler. If they do not return within the budget, the Handler is preempted and
+// RespDunno is sent instead, so that postfix continues with its remaining restrictions
+// instead of running into its smtpd_policy_service_timeout. The context of the PolicySet
+// carries the budget as deadline and is cancelled once the Handler has been preempted.
+// The preempted Handler keeps running in the background and its response is discarded.
+// Until it returns, it still counts as active handler, for the overload watermarks (see
+// WithHandlerWatermarks) and it keeps its worker (see WithWorkers). A value of 0 disables
+// the budget, which is the default
+func WithResponseBudget(d time.Duration) ServerOpt {
+	return func(s *Server) {
+		s.respBudget = d
+	}
+}
+
+// handleWithBudget enriches the PolicySet, hands it to the Handler and returns RespDunno if
+// the enrichers and the Handler do not return within the response budget. The budget
+// starts once the request has been read, so the time a request waits for a free worker
+// (see WithWorkers) is part of it. If the Handler has been preempted, the returned
+// channel is closed once it has returned. Otherwise, the returned channel is nil
+func (s *Server) handleWithBudget(ps *PolicySet, h Handler) (Response, <-chan struct{}) {
+	if s.respBudget <= 0 {
+		return s.enrichAndHandle(ps.Context(), ps, h), nil
+	}
+	dl := s.budgetDeadline(ps)
+	if !time.Now().Before(dl) {
+		s.logf(ps.Context(), LogLevelWarn, "request %s: response budget of %s exceeded before the "+
+			"handler was called", ps.RequestID(), s.respBudget)
+		return Response{Action: RespDunno, fallback: true}, nil
+	}
+
+	// The enrichers and the Handler work on a copy of the PolicySet, so that a preempted
+	// Handler does not race with the response of the server
+	psc := ps.clone()
+	ctx, cancel := context.WithDeadline(ps.Context(), dl)
+	psc.ctx = ctx
+	rc := make(chan Response, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer cancel()
+		rc <- s.enrichAndHandle(ctx, &psc, h)
+	}()
+	t := time.NewTimer(time.Until(dl))
+	defer t.Stop()
+	select {
+	case r := <-rc:
+		psc.ctx = ps.ctx
+		*ps = psc
+		return r, nil
+	case <-t.C:
+		cancel()
+		s.logf(ps.Context(), LogLevelWarn, "request %s: handler exceeded the response budget of %s",
+			ps.RequestID(), s.respBudget)
+		return Response{Action: RespDunno, fallback: true}, done
+	}
+}
+
+// budgetDeadline returns the time by which the response for the given PolicySet has to be
+// written according to the response budget
+func (s *Server) budgetDeadline(ps *PolicySet) time.Time {
+	st := ps.readAt
+	if st.IsZero() {
+		st = time.Now()
+	}
+	return st.Add(s.respBudget)
+}
@@ -0,0 +1,149 @@
+package pps
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// sleepHandler is a Handler that sleeps for the given duration before it responds
+type sleepHandler struct {
+	d time.Duration
+	r PostfixResp
+}
+
+// Handle is the function required by the Handler Interface
+func (h sleepHandler) Handle(ps *PolicySet) PostfixResp {
+	time.Sleep(h.d)
+	ps.CloseAfterResponse()
+	return h.r
+}
+
+// TestWithResponseBudget tests that a slow handler is preempted and the fallback response
+// is sent within the response budget
+func TestWithResponseBudget(t *testing.T) {
+	testTable := []struct {
+		testName string
+		delay    time.Duration
+		expResp  string
+	}{
+		{`Handler within budget`, 0, "action=REJECT\n"},
+		{`Handler exceeds budget`, time.Second * 2, "action=DUNNO\n"},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			s := New(WithResponseBudget(time.Millisecond * 200))
+			addr, stop := testServer(t, &s, sleepHandler{d: tc.delay, r: RespReject})
+			defer stop()
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("failed to connect to running server: %s", err)
+			}
+			defer func() { _ = conn.Close() }()
+			st := time.Now()
+			if r := testRequest(t, conn, bufio.NewReader(conn), exampleReq); r != tc.expResp {
+				t.Errorf("unexpected server response => expected: %q, got: %q", tc.expResp, r)
+			}
+			if d := time.Since(st); d > time.Millisecond*250 {
+				t.Errorf("response was not sent within the budget => took: %s", d)
+			}
+		})
+	}
+}
+
+// TestWithResponseBudgetPreempted tests that a preempted Handler still counts as active
+// handler and keeps its worker until it returns
+func TestWithResponseBudgetPreempted(t *testing.T) {
+	h := &drainHandler{started: make(chan struct{}, 2), release: make(chan struct{})}
+	s := New(WithResponseBudget(time.Millisecond*100), WithWorkers(1))
+	addr, stop := testServer(t, &s, h)
+	defer stop()
+	released := false
+	defer func() {
+		if !released {
+			close(h.release)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if r := testRequest(t, conn, bufio.NewReader(conn), exampleReq); r != "action=DUNNO\n" {
+		t.Errorf("unexpected server response => expected: %q, got: %q", "action=DUNNO\n", r)
+	}
+	if n := s.Stats().ActiveHandlers; n != 1 {
+		t.Errorf("unexpected number of active handlers => expected: %d, got: %d", 1, n)
+	}
+
+	// The only worker is still occupied by the preempted Handler, so the budget of the
+	// next request passes while it waits for a free worker
+	conn2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = conn2.Close() }()
+	rb := bufio.NewReader(conn2)
+	st := time.Now()
+	if r := testRequest(t, conn2, rb, exampleReq); r != "action=DUNNO\n" {
+		t.Errorf("unexpected server response => expected: %q, got: %q", "action=DUNNO\n", r)
+	}
+	if d := time.Since(st); d > time.Millisecond*150 {
+		t.Errorf("queued request was not answered within the budget => took: %s", d)
+	}
+	if n := atomic.LoadInt64(&h.calls); n != 1 {
+		t.Errorf("handler was called while the only worker was occupied => calls: %d", n)
+	}
+
+	close(h.release)
+	released = true
+	if r := testRequest(t, conn2, rb, exampleReq); r != "action=OK\n" {
+		t.Errorf("unexpected server response => expected: %q, got: %q", "action=OK\n", r)
+	}
+	for dl := time.Now().Add(time.Second); s.Stats().ActiveHandlers > 0 && time.Now().Before(dl); {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if n := s.Stats().ActiveHandlers; n != 0 {
+		t.Errorf("unexpected number of active handlers => expected: %d, got: %d", 0, n)
+	}
+}
+
+// TestWithResponseBudgetEnricher tests that the response budget covers the enrichers
+func TestWithResponseBudgetEnricher(t *testing.T) {
+	slow := func(ctx context.Context, _ *PolicySet) {
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second * 2):
+		}
+	}
+	s := New(WithResponseBudget(time.Millisecond*200), WithEnricher(slow), WithEnricherTimeout(time.Second*5))
+	addr, stop := testServer(t, &s, Hi{r: RespReject})
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	st := time.Now()
+	if r := testRequest(t, conn, bufio.NewReader(conn), exampleReq); r != "action=DUNNO\n" {
+		t.Errorf("unexpected server response => expected: %q, got: %q", "action=DUNNO\n", r)
+	}
+	if d := time.Since(st); d > time.Millisecond*250 {
+		t.Errorf("response was not sent within the budget => took: %s", d)
+	}
+}
+
+// TestPolicySet_clone tests that a clone of a PolicySet does not share the Extra
+// attributes with the original, so that a preempted Handler can't modify them
+func TestPolicySet_clone(t *testing.T) {
+	ps := &PolicySet{Extra: map[string]string{"key": "value"}}
+	psc := ps.clone()
+	psc.Extra["key"] = "changed"
+	if ps.Extra["key"] != "value" {
+		t.Errorf("Extra attributes of the clone are shared with the original => got: %s", ps.Extra["key"])
+	}
+}
@@ -0,0 +1,63 @@
+package pps
+
+import (
+	"sync"
+)
+
+// WithPerClientConcurrency limits the number of concurrently active handlers per client
+// address (see PolicySet.ClientAddress) to n, so that a single noisy client can't occupy
+// all handlers. Requests of a client that already has n active handlers are answered with
+// the given shed response without invoking the Handler. Requests without a client address
+// are not limited. A value of 0 or below disables the limit, which is the default
+func WithPerClientConcurrency(n int, shed PostfixResp) ServerOpt {
+	return func(s *Server) {
+		if n <= 0 {
+			s.clientLimit = nil
+			return
+		}
+		s.clientLimit = &clientLimiter{max: n, shed: shed}
+	}
+}
+
+// clientLimiter tracks the number of active handlers per client address. Clients without
+// active handlers are removed, so that the memory is bound to the active clients
+type clientLimiter struct {
+	max  int
+	shed PostfixResp
+
+	mu     sync.Mutex
+	active map[string]int
+}
+
+// acquire reserves a handler slot for the given client. It returns false if the client
+// has no free slot left
+func (cl *clientLimiter) acquire(k string) bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.active == nil {
+		cl.active = make(map[string]int)
+	}
+	if cl.active[k] >= cl.max {
+		return false
+	}
+	cl.active[k]++
+	return true
+}
+
+// release frees a handler slot of the given client
+func (cl *clientLimiter) release(k string) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.active[k] <= 1 {
+		delete(cl.active, k)
+		return
+	}
+	cl.active[k]--
+}
+
+// clients returns the number of clients with active handlers
+func (cl *clientLimiter) clients() int {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return len(cl.active)
+}
@@ -0,0 +1,52 @@
+package pps
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestWithPerClientConcurrency tests that a client with all handler slots in use is shed,
+// while a second client proceeds unaffected, and that the counters are cleaned up
+func TestWithPerClientConcurrency(t *testing.T) {
+	s := New(WithPerClientConcurrency(2, RespDeferIfPermit))
+	busy, other := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	started, release := make(chan struct{}, 2), make(chan struct{})
+	h := HandlerFunc(func(ps *PolicySet) PostfixResp {
+		if ps.ClientAddress.Equal(busy) {
+			started <- struct{}{}
+			<-release
+		}
+		return RespOk
+	})
+
+	rc := make(chan PostfixResp, 2)
+	for i := 0; i < 2; i++ {
+		go func() { rc <- s.handle(&PolicySet{ClientAddress: busy}, h).Action }()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(time.Second * 5):
+			t.Fatal("handler has not been called")
+		}
+	}
+	if r := s.handle(&PolicySet{ClientAddress: busy}, h); r.Action != RespDeferIfPermit || !r.fallback {
+		t.Errorf("saturated client => expected: %s, got: %s", RespDeferIfPermit, r.Action)
+	}
+	if r := s.handle(&PolicySet{ClientAddress: other}, h); r.Action != RespOk {
+		t.Errorf("second client => expected: %s, got: %s", RespOk, r.Action)
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if r := <-rc; r != RespOk {
+			t.Errorf("saturating request => expected: %s, got: %s", RespOk, r)
+		}
+	}
+	if n := s.clientLimit.clients(); n != 0 {
+		t.Errorf("client counters were not cleaned up => expected: 0, got: %d", n)
+	}
+	if r := s.handle(&PolicySet{ClientAddress: busy}, h); r.Action != RespOk {
+		t.Errorf("released client => expected: %s, got: %s", RespOk, r.Action)
+	}
+}
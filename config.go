@@ -0,0 +1,161 @@
+package pps
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// redacted is the placeholder for secret values in the Config
+const redacted = "[REDACTED]"
+
+// Config represents the effective configuration of a Server after all options and
+// setters have been applied. Secret values are redacted
+type Config struct {
+	Addr                  string
+	Port                  string
+	Network               string
+	ListenAddrs           string
+	PartialBind           bool
+	SystemdSocket         bool
+	TLS                   bool
+	ReusePort             int
+	AcceptRateLimit       float64
+	AcceptBurst           int
+	StageActionValidation bool
+	LogLevel              LogLevel
+	LogRequests           bool
+	RunTimeout            time.Duration
+	Pipelining            int
+	Workers               int
+	AdminHTTP             string
+	Framing               Framing
+	KeepAliveIdle         time.Duration
+	ReadTimeout           time.Duration
+	WriteTimeout          time.Duration
+	SocketReadBuffer      int
+	SocketWriteBuffer     int
+	MaxLineLength         int
+	MaxAttributes         int
+	MaxRequestSize        int
+	RequestLimitBan       time.Duration
+	ResponseBudget        time.Duration
+	StressFallback        PostfixResp
+	ShutdownResponse      PostfixResp
+	PanicResponse         PostfixResp
+	StoreFailureMode      StoreFailureMode
+	AllowedPeers          string
+	TrustedProxyHops      int
+	MaxConnections        int
+	HandlerHighWatermark  int
+	HandlerLowWatermark   int
+	SharedSecretAttr      string
+	SharedSecret          string
+	SharedSecretAction    PostfixResp
+}
+
+// Config returns the effective configuration of the Server
+func (s *Server) Config() Config {
+	c := Config{
+		Addr:                  s.la,
+		Port:                  s.lp,
+		Network:               s.ln,
+		ListenAddrs:           strings.Join(s.listenAddrs, ","),
+		PartialBind:           s.partialBind,
+		SystemdSocket:         s.systemd,
+		TLS:                   s.tlsConf != nil,
+		ReusePort:             s.reusePort,
+		StageActionValidation: s.stageCheck,
+		LogLevel:              s.logLevel,
+		LogRequests:           s.logReqs,
+		RunTimeout:            s.runTimeout,
+		Pipelining:            s.pipeline,
+		Workers:               s.workers,
+		AdminHTTP:             s.adminAddr,
+		Framing:               s.framing,
+		KeepAliveIdle:         s.keepAliveIdle,
+		ReadTimeout:           s.readTimeout,
+		WriteTimeout:          s.writeTimeout,
+		SocketReadBuffer:      s.readBuf,
+		SocketWriteBuffer:     s.writeBuf,
+		MaxLineLength:         s.reqLimits.line,
+		MaxAttributes:         s.reqLimits.attrs,
+		MaxRequestSize:        s.reqLimits.size,
+		ResponseBudget:        s.respBudget,
+		StressFallback:        s.stressResp,
+		ShutdownResponse:      s.shutdownResp,
+		PanicResponse:         s.panicResp,
+		StoreFailureMode:      s.storeFail,
+		AllowedPeers:          joinNets(s.peers),
+		TrustedProxyHops:      s.proxyHops,
+		MaxConnections:        cap(s.connSem),
+		HandlerHighWatermark:  s.hwm,
+		HandlerLowWatermark:   s.lwm,
+		SharedSecretAttr:      s.secretAttr,
+		SharedSecretAction:    s.secretAction,
+	}
+	if s.acceptLimit != nil {
+		c.AcceptRateLimit = s.acceptLimit.rate
+		c.AcceptBurst = int(s.acceptLimit.burst)
+	}
+	if s.bans != nil {
+		c.RequestLimitBan = s.bans.d
+	}
+	if s.secret != "" {
+		c.SharedSecret = redacted
+	}
+	return c
+}
+
+// String satisfies the fmt.Stringer interface for the Config
+func (c Config) String() string {
+	sl := []string{
+		fmt.Sprintf("addr=%s", c.Addr),
+		fmt.Sprintf("port=%s", c.Port),
+		fmt.Sprintf("network=%s", c.Network),
+		fmt.Sprintf("listen_addrs=%s", c.ListenAddrs),
+		fmt.Sprintf("partial_bind=%t", c.PartialBind),
+		fmt.Sprintf("systemd_socket=%t", c.SystemdSocket),
+		fmt.Sprintf("tls=%t", c.TLS),
+		fmt.Sprintf("reuse_port=%d", c.ReusePort),
+		fmt.Sprintf("accept_rate_limit=%g", c.AcceptRateLimit),
+		fmt.Sprintf("accept_burst=%d", c.AcceptBurst),
+		fmt.Sprintf("stage_action_validation=%t", c.StageActionValidation),
+		fmt.Sprintf("log_level=%s", c.LogLevel),
+		fmt.Sprintf("log_requests=%t", c.LogRequests),
+		fmt.Sprintf("run_timeout=%s", c.RunTimeout),
+		fmt.Sprintf("pipelining=%d", c.Pipelining),
+		fmt.Sprintf("workers=%d", c.Workers),
+		fmt.Sprintf("admin_http=%s", c.AdminHTTP),
+		fmt.Sprintf("framing=%s", c.Framing),
+		fmt.Sprintf("keepalive_idle=%s", c.KeepAliveIdle),
+		fmt.Sprintf("read_timeout=%s", c.ReadTimeout),
+		fmt.Sprintf("write_timeout=%s", c.WriteTimeout),
+		fmt.Sprintf("socket_buffers=%d/%d", c.SocketReadBuffer, c.SocketWriteBuffer),
+		fmt.Sprintf("request_limits=%d/%d/%d", c.MaxLineLength, c.MaxAttributes, c.MaxRequestSize),
+		fmt.Sprintf("request_limit_ban=%s", c.RequestLimitBan),
+		fmt.Sprintf("response_budget=%s", c.ResponseBudget),
+		fmt.Sprintf("stress_fallback=%s", c.StressFallback),
+		fmt.Sprintf("shutdown_response=%s", c.ShutdownResponse),
+		fmt.Sprintf("panic_response=%s", c.PanicResponse),
+		fmt.Sprintf("store_failure_mode=%s", c.StoreFailureMode),
+		fmt.Sprintf("allowed_peers=%s", c.AllowedPeers),
+		fmt.Sprintf("trusted_proxy_hops=%d", c.TrustedProxyHops),
+		fmt.Sprintf("max_connections=%d", c.MaxConnections),
+		fmt.Sprintf("handler_watermarks=%d/%d", c.HandlerHighWatermark, c.HandlerLowWatermark),
+		fmt.Sprintf("shared_secret_attr=%s", c.SharedSecretAttr),
+		fmt.Sprintf("shared_secret=%s", c.SharedSecret),
+		fmt.Sprintf("shared_secret_action=%s", c.SharedSecretAction),
+	}
+	return strings.Join(sl, " ")
+}
+
+// joinNets returns the comma-separated list of the given networks
+func joinNets(nl []*net.IPNet) string {
+	sl := make([]string, 0, len(nl))
+	for _, n := range nl {
+		sl = append(sl, n.String())
+	}
+	return strings.Join(sl, ",")
+}
@@ -0,0 +1,52 @@
+package pps
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestServerConfig tests that the Config() method reports the applied options
+func TestServerConfig(t *testing.T) {
+	s := New(WithAddr("127.0.0.1"), WithAcceptRateLimit(100, 10), WithStageActionValidation(),
+		WithSharedSecret("pps_token", "s3cret"), WithRunTimeout(time.Minute))
+	s.SetPort("1234")
+	c := s.Config()
+	exp := Config{
+		Addr:                  "127.0.0.1",
+		Port:                  "1234",
+		Network:               DefaultNetwork,
+		AcceptRateLimit:       100,
+		AcceptBurst:           10,
+		StageActionValidation: true,
+		LogLevel:              DefaultLogLevel,
+		RunTimeout:            time.Minute,
+		WriteTimeout:          DefaultWriteTimeout,
+		PanicResponse:         RespDeferIfPermit,
+		SharedSecretAttr:      "pps_token",
+		SharedSecret:          redacted,
+		SharedSecretAction:    RespDefer,
+	}
+	if c != exp {
+		t.Errorf("unexpected server config => expected: %+v, got: %+v", exp, c)
+	}
+	if strings.Contains(c.String(), "s3cret") {
+		t.Errorf("server config string contains the shared secret: %s", c)
+	}
+	if !strings.Contains(c.String(), "addr=127.0.0.1 port=1234") {
+		t.Errorf("unexpected server config string => got: %s", c)
+	}
+}
+
+// TestServerConfigDefaults tests that the Config() method reports the defaults
+func TestServerConfigDefaults(t *testing.T) {
+	s := New()
+	c := s.Config()
+	if c.Addr != DefaultAddr || c.Port != DefaultPort {
+		t.Errorf("unexpected server config => expected: %s:%s, got: %s:%s", DefaultAddr, DefaultPort,
+			c.Addr, c.Port)
+	}
+	if c.SharedSecret != "" {
+		t.Errorf("unexpected shared secret in server config => got: %s", c.SharedSecret)
+	}
+}
@@ -0,0 +1,185 @@
+package pps
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// countConn is a net.Conn that counts the bytes read from and written to the connection
+type countConn struct {
+	net.Conn
+	read    uint64
+	written uint64
+}
+
+// Read satisfies the io.Reader interface for the countConn
+func (c *countConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.read, uint64(n))
+	return n, err
+}
+
+// Write satisfies the io.Writer interface for the countConn
+func (c *countConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.written, uint64(n))
+	return n, err
+}
+
+// BytesReadFromContext returns the number of bytes that have been read from the connection
+// of the given connection context (see PolicySet.Context). The counter accumulates over all
+// requests of the connection. If the context is not a connection context, 0 is returned
+func BytesReadFromContext(ctx context.Context) uint64 {
+	cc, ok := ctx.Value(ctxConnCounters).(*countConn)
+	if !ok {
+		return 0
+	}
+	return atomic.LoadUint64(&cc.read)
+}
+
+// BytesWrittenFromContext returns the number of bytes that have been written to the
+// connection of the given connection context (see PolicySet.Context). The counter
+// accumulates over all responses of the connection. If the context is not a connection
+// context, 0 is returned
+func BytesWrittenFromContext(ctx context.Context) uint64 {
+	cc, ok := ctx.Value(ctxConnCounters).(*countConn)
+	if !ok {
+		return 0
+	}
+	return atomic.LoadUint64(&cc.written)
+}
+
+// closeWriter is implemented by connections that support half-closing their write side,
+// like *net.TCPConn, *net.UnixConn and *tls.Conn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeWrite half-closes the write side of the given connection if supported
+func closeWrite(c net.Conn) {
+	if cc, ok := c.(*countConn); ok {
+		c = cc.Conn
+	}
+	if cw, ok := c.(closeWriter); ok {
+		_ = cw.CloseWrite()
+	}
+}
+
+// WithErrorHandler sets a function that is called with the error that terminated a
+// connection, i. e. a malformed request or a failed read, write or deadline operation.
+// Clean disconnects of the client are not reported. The error is wrapped with the
+// connection id
+func WithErrorHandler(f func(ctx context.Context, err error)) ServerOpt {
+	return func(s *Server) {
+		s.errHandler = f
+	}
+}
+
+// DefaultWriteTimeout is the default maximum time to write a response (see WithWriteTimeout)
+const DefaultWriteTimeout = time.Second
+
+// WithWriteTimeout sets the maximum time to write a response to the client. If the client
+// doesn't read the response within the timeout, the connection is closed (see
+// ErrWriteTimeout). Defaults to DefaultWriteTimeout
+func WithWriteTimeout(d time.Duration) ServerOpt {
+	return func(s *Server) {
+		if d <= 0 {
+			d = DefaultWriteTimeout
+		}
+		s.writeTimeout = d
+	}
+}
+
+// ErrWriteTimeout is returned if the write deadline of a connection is exceeded while the
+// response is written, i. e. because the client stalled. The connection is closed, as the
+// client may have received a partial response
+var ErrWriteTimeout = errors.New("write deadline exceeded")
+
+// ErrReadTimeout is returned if the read deadline of a connection is exceeded, i. e.
+// because the connection has been idle for longer than the keep-alive idle limit (see
+// WithKeepAliveIdle). Read timeouts are expected and logged at debug level
+var ErrReadTimeout = errors.New("read deadline exceeded")
+
+// isDisconnect returns true if the given error is caused by a client that has closed or
+// reset the connection
+func isDisconnect(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// terminationCause returns the cause of the termination of the given connection that has
+// been terminated with the given error
+func (s *Server) terminationCause(ctx context.Context, c *connection, err error) string {
+	c.mu.Lock()
+	quit := c.quit || c.closing
+	c.mu.Unlock()
+	switch {
+	case c.werr:
+		return TerminationWriteError
+	case errors.Is(err, ErrReadTimeout):
+		return TerminationReadTimeout
+	case ctx.Err() != nil || quit:
+		return TerminationShutdown
+	case errors.Is(c.gone, syscall.ECONNRESET):
+		return TerminationReset
+	case errors.Is(c.gone, net.ErrClosed):
+		return TerminationServerClose
+	case c.gone != nil:
+		return TerminationEOF
+	case err != nil:
+		return TerminationError
+	default:
+		return TerminationServerClose
+	}
+}
+
+// logConnErr logs the error that terminated the given connection. Errors that are caused
+// by a client that disconnected early are expected under load and logged at debug level
+func (s *Server) logConnErr(ctx context.Context, c *connection, connId string, err error) {
+	le := s.logErr(err, c.conn)
+	if isDisconnect(err) {
+		s.logf(ctx, LogLevelDebug, "connection %s closed by client: %s", connId, le)
+		return
+	}
+	if errors.Is(err, ErrReadTimeout) {
+		s.logf(ctx, LogLevelDebug, "connection %s timed out: %s", connId, le)
+		return
+	}
+	if errors.Is(err, ErrWriteTimeout) {
+		s.logf(ctx, LogLevelWarn, "connection %s stalled: %s", connId, le)
+		return
+	}
+	s.logf(ctx, LogLevelError, "failed to handle connection %s: %s", connId, le)
+}
+
+// logEarlyDisconnect logs at debug level if the client closed the connection before it
+// sent a request, which happens frequently during connection storms
+func (s *Server) logEarlyDisconnect(ctx context.Context, c *connection, connId string) {
+	if c.seq > 0 || c.gone == nil {
+		return
+	}
+	s.logf(ctx, LogLevelDebug, "connection %s closed by client before sending a request: %s", connId,
+		s.logErr(c.gone, c.conn))
+}
+
+// writeFull writes the complete buffer to the connection. Writes that return fewer bytes
+// than requested without an error are continued until the buffer has been written, the
+// write deadline has passed or no progress is made
+func writeFull(c net.Conn, b []byte) error {
+	for len(b) > 0 {
+		n, err := c.Write(b)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		b = b[n:]
+	}
+	return nil
+}
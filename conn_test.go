@@ -0,0 +1,457 @@
+package pps
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestBytesFromContext tests that the byte counters in the connection context reflect the
+// request and response sizes of a connection
+func TestBytesFromContext(t *testing.T) {
+	type counters struct{ read, written uint64 }
+	ch := make(chan counters, 2)
+	h := HandlerFunc(func(ps *PolicySet) PostfixResp {
+		ch <- counters{BytesReadFromContext(ps.Context()), BytesWrittenFromContext(ps.Context())}
+		return RespDunno
+	})
+	s := New()
+	addr, stop := testServer(t, &s, h)
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	rb := bufio.NewReader(conn)
+	_ = testRequest(t, conn, rb, exampleReq)
+	_ = testRequest(t, conn, rb, exampleReq)
+
+	respLen := uint64(len(fmt.Sprintf("action=%s\n\n", RespDunno)))
+	reqLen := uint64(len(exampleReq))
+	exp := []counters{{reqLen, 0}, {reqLen * 2, respLen}}
+	for i, e := range exp {
+		c := <-ch
+		if c != e {
+			t.Errorf("unexpected byte counters for request %d => expected: %+v, got: %+v", i+1, e, c)
+		}
+	}
+}
+
+// TestBytesFromContextEmpty tests the byte counter functions with a non-connection context
+func TestBytesFromContextEmpty(t *testing.T) {
+	ps := &PolicySet{}
+	if n := BytesReadFromContext(ps.Context()); n != 0 {
+		t.Errorf("unexpected bytes read => expected: 0, got: %d", n)
+	}
+	if n := BytesWrittenFromContext(context.Background()); n != 0 {
+		t.Errorf("unexpected bytes written => expected: 0, got: %d", n)
+	}
+}
+
+// TestCloseAfterResponse tests that the write side of the connection is half-closed after
+// the response for a handler that requested it
+func TestCloseAfterResponse(t *testing.T) {
+	h := HandlerFunc(func(ps *PolicySet) PostfixResp {
+		ps.CloseAfterResponse()
+		return RespOk
+	})
+	s := New()
+	addr, stop := testServer(t, &s, h)
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	rb := bufio.NewReader(conn)
+	resp := testRequest(t, conn, rb, exampleReq)
+	if exresp := fmt.Sprintf("action=%s\n", RespOk); resp != exresp {
+		t.Errorf("unexpected server response => expected: %s, got: %s", exresp, resp)
+	}
+	if _, err := rb.ReadByte(); !errors.Is(err, io.EOF) {
+		t.Errorf("connection not closed after response => expected: %s, got: %v", io.EOF, err)
+	}
+}
+
+// TestCloseWrite tests that closeWrite() half-closes the write side of a TCP connection
+func TestCloseWrite(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create new TCP listener: %s", err)
+	}
+	defer func() { _ = l.Close() }()
+	cc := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			close(cc)
+			return
+		}
+		cc <- c
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect to listener: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	sc, ok := <-cc
+	if !ok {
+		t.Fatalf("failed to accept connection")
+	}
+	defer func() { _ = sc.Close() }()
+
+	closeWrite(&countConn{Conn: sc})
+	if _, err := bufio.NewReader(conn).ReadByte(); !errors.Is(err, io.EOF) {
+		t.Errorf("write side not half-closed => expected: %s, got: %v", io.EOF, err)
+	}
+	// The read side of the server connection must still be open
+	if _, err := conn.Write([]byte("test")); err != nil {
+		t.Errorf("failed to write to half-closed connection: %s", err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(sc, b); err != nil || string(b) != "test" {
+		t.Errorf("failed to read from half-closed connection => got: %q, err: %v", b, err)
+	}
+}
+
+// TestFastDisconnect tests that clients that disconnect right after connecting are handled
+// quietly at debug level
+func TestFastDisconnect(t *testing.T) {
+	testTable := []struct {
+		testName string
+		reset    bool
+	}{
+		{`Client closes the connection`, false},
+		{`Client resets the connection`, true},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			b := &syncBuffer{}
+			s := New(WithLogOutput(b), WithLogLevel(LogLevelDebug))
+			addr, stop := testServer(t, &s, Hi{})
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("failed to connect to running server: %s", err)
+			}
+			if tc.reset {
+				if err := conn.(*net.TCPConn).SetLinger(0); err != nil {
+					t.Fatalf("failed to set linger on client connection: %s", err)
+				}
+			}
+			_ = conn.Close()
+			for dl := time.Now().Add(time.Second); time.Now().Before(dl); time.Sleep(time.Millisecond * 10) {
+				if strings.Contains(b.String(), "closed by client") {
+					break
+				}
+			}
+			stop()
+			if strings.Contains(b.String(), "failed to handle connection") {
+				t.Errorf("fast disconnect was logged at error level => got: %s", b.String())
+			}
+			if !strings.Contains(b.String(), "DEBUG: connection") ||
+				!strings.Contains(b.String(), "closed by client before sending a request") {
+				t.Errorf("fast disconnect was not logged at debug level => got: %s", b.String())
+			}
+		})
+	}
+}
+
+// failWriteConn is a net.Conn that fails all writes
+type failWriteConn struct {
+	net.Conn
+}
+
+// Write satisfies the io.Writer interface for the failWriteConn
+func (c failWriteConn) Write([]byte) (int, error) {
+	return 0, errors.New("induced write error")
+}
+
+// TestWithErrorHandler tests that a write error is handed to the error handler
+func TestWithErrorHandler(t *testing.T) {
+	ec := make(chan error, 1)
+	var s Server
+	s = New(WithErrorHandler(func(_ context.Context, err error) { ec <- err }),
+		WithDispatcher(func(ctx context.Context, c net.Conn) {
+			go func() { _ = s.ServeConn(ctx, failWriteConn{Conn: c}) }()
+		}))
+	addr, stop := testServer(t, &s, Hi{})
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	if _, err := conn.Write([]byte(exampleReq)); err != nil {
+		t.Errorf("failed to send request to server: %s", err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	_ = conn.Close()
+
+	select {
+	case err := <-ec:
+		if !strings.Contains(err.Error(), "induced write error") || !strings.HasPrefix(err.Error(), "connection ") {
+			t.Errorf("unexpected error in error handler => got: %s", err)
+		}
+	case <-time.After(time.Second * 2):
+		t.Errorf("error handler was not called")
+	}
+}
+
+// chunkConn is a net.Conn that writes at most size bytes per Write call
+type chunkConn struct {
+	net.Conn
+	size int
+}
+
+// Write satisfies the io.Writer interface for the chunkConn
+func (c chunkConn) Write(b []byte) (int, error) {
+	if len(b) > c.size {
+		b = b[:c.size]
+	}
+	return c.Conn.Write(b)
+}
+
+// stuckConn is a net.Conn that never writes any bytes
+type stuckConn struct {
+	net.Conn
+}
+
+// Write satisfies the io.Writer interface for the stuckConn
+func (stuckConn) Write([]byte) (int, error) {
+	return 0, nil
+}
+
+// TestPartialWrites tests that the full response is delivered on a connection that
+// accepts the bytes in small chunks
+func TestPartialWrites(t *testing.T) {
+	var s Server
+	s = New(WithDispatcher(func(ctx context.Context, c net.Conn) {
+		go func() { _ = s.ServeConn(ctx, chunkConn{Conn: c, size: 3}) }()
+	}))
+	addr, stop := testServer(t, &s, Hi{r: TextResponseOpt(RespReject, "this is a longer text")})
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	rb := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		if r := testRequest(t, conn, rb, exampleReq); r != "action=REJECT this is a longer text\n" {
+			t.Errorf("unexpected server response => expected: %q, got: %q",
+				"action=REJECT this is a longer text\n", r)
+		}
+	}
+
+	if err := writeFull(stuckConn{}, []byte("action=DUNNO\n\n")); !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("unexpected error for stuck connection => expected: %s, got: %v", io.ErrShortWrite, err)
+	}
+}
+
+// timeoutConn is a net.Conn that stalls after writing part of the response and then
+// exceeds its write deadline
+type timeoutConn struct {
+	net.Conn
+}
+
+// Write satisfies the io.Writer interface for the timeoutConn
+func (c timeoutConn) Write(b []byte) (int, error) {
+	n, _ := c.Conn.Write(b[:len(b)/2])
+	return n, os.ErrDeadlineExceeded
+}
+
+// TestWriteTimeout tests that a response that exceeds the write deadline is classified as
+// ErrWriteTimeout, closes the connection and is counted in the server Stats
+func TestWriteTimeout(t *testing.T) {
+	ec := make(chan error, 1)
+	var s Server
+	s = New(WithErrorHandler(func(_ context.Context, err error) { ec <- err }),
+		WithDispatcher(func(ctx context.Context, c net.Conn) {
+			go func() { _ = s.ServeConn(ctx, timeoutConn{Conn: c}) }()
+		}))
+	addr, stop := testServer(t, &s, Hi{})
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if _, err := conn.Write([]byte(exampleReq + exampleReq)); err != nil {
+		t.Errorf("failed to send request to server: %s", err)
+	}
+
+	select {
+	case err := <-ec:
+		if !errors.Is(err, ErrWriteTimeout) {
+			t.Errorf("unexpected error classification => expected: %s, got: %s", ErrWriteTimeout, err)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatalf("error handler was not called")
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Errorf("connection was not closed after the write timeout: %s", err)
+	}
+	if string(b) != "action=" {
+		t.Errorf("unexpected partial response => expected: %q, got: %q", "action=", b)
+	}
+	if n := s.Stats().WriteTimeouts; n != 1 {
+		t.Errorf("unexpected number of write timeouts => expected: 1, got: %d", n)
+	}
+}
+
+// TestReadErrorClassification tests that read timeouts, connection resets and unexpected
+// read errors are handled distinctly
+func TestReadErrorClassification(t *testing.T) {
+	testTable := []struct {
+		testName   string
+		opts       []ServerOpt
+		client     func(*net.TCPConn)
+		expErr     error
+		expHook    bool
+		expLog     string
+		expTimeout uint64
+	}{
+		{`Idle read timeout`, []ServerOpt{WithKeepAliveIdle(time.Millisecond * 100)},
+			func(*net.TCPConn) { time.Sleep(time.Millisecond * 300) }, ErrReadTimeout, true,
+			"DEBUG: connection", 1},
+		{`Connection reset`, nil, func(c *net.TCPConn) {
+			_ = c.SetLinger(0)
+			_ = c.Close()
+		}, nil, false, "", 0},
+		{`Unexpected read error`, []ServerOpt{WithFraming(FramingLengthPrefixed)}, func(c *net.TCPConn) {
+			_, _ = c.Write([]byte{0xff, 0xff, 0xff, 0xff})
+			time.Sleep(time.Millisecond * 100)
+		}, nil, true, "ERROR: failed to handle connection", 0},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			ec := make(chan error, 1)
+			b := &syncBuffer{}
+			s := New(append(tc.opts, WithLogOutput(b), WithLogLevel(LogLevelDebug), WithErrorHandler(func(_ context.Context, err error) {
+				ec <- err
+			}))...)
+			addr, stop := testServer(t, &s, Hi{})
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				stop()
+				t.Fatalf("failed to connect to running server: %s", err)
+			}
+			tc.client(conn.(*net.TCPConn))
+			_ = conn.Close()
+			stop()
+
+			select {
+			case err := <-ec:
+				if !tc.expHook {
+					t.Errorf("unexpected error handler call => got: %s", err)
+				}
+				if tc.expErr != nil && !errors.Is(err, tc.expErr) {
+					t.Errorf("unexpected error classification => expected: %s, got: %s", tc.expErr, err)
+				}
+				if tc.expErr == nil && errors.Is(err, ErrReadTimeout) {
+					t.Errorf("unexpected read timeout classification => got: %s", err)
+				}
+			default:
+				if tc.expHook {
+					t.Errorf("error handler was not called")
+				}
+			}
+			l := b.String()
+			if tc.expLog != "" && !strings.Contains(l, tc.expLog) {
+				t.Errorf("unexpected log => expected: %q, got: %s", tc.expLog, l)
+			}
+			if tc.expLog == "" && strings.Contains(l, "ERROR") {
+				t.Errorf("unexpected error log => got: %s", l)
+			}
+			if tc.expErr != nil && strings.Contains(l, "ERROR") {
+				t.Errorf("read timeout logged as error => got: %s", l)
+			}
+			if n := s.Stats().ReadTimeouts; n != tc.expTimeout {
+				t.Errorf("unexpected number of read timeouts => expected: %d, got: %d", tc.expTimeout, n)
+			}
+		})
+	}
+}
+
+// TestTerminationCauses tests that connection terminations are counted by their cause
+func TestTerminationCauses(t *testing.T) {
+	testTable := []struct {
+		testName string
+		opts     []ServerOpt
+		handler  Handler
+		client   func(*net.TCPConn)
+		expCause string
+	}{
+		{`Clean EOF`, nil, Hi{}, func(c *net.TCPConn) {
+			_ = testRequest(t, c, bufio.NewReader(c), exampleReq)
+		}, TerminationEOF},
+		{`Read timeout`, []ServerOpt{WithKeepAliveIdle(time.Millisecond * 100)}, Hi{},
+			func(*net.TCPConn) { time.Sleep(time.Millisecond * 300) }, TerminationReadTimeout},
+		{`Peer reset`, nil, Hi{}, func(c *net.TCPConn) {
+			_ = testRequest(t, c, bufio.NewReader(c), exampleReq)
+			_ = c.SetLinger(0)
+		}, TerminationReset},
+		{`Server close`, nil, sleepHandler{r: RespOk}, func(c *net.TCPConn) {
+			rb := bufio.NewReader(c)
+			_ = testRequest(t, c, rb, exampleReq)
+			_, _ = rb.ReadString('\n')
+			_, _ = rb.ReadString('\n')
+		}, TerminationServerClose},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			s := New(tc.opts...)
+			addr, stop := testServer(t, &s, tc.handler)
+			defer stop()
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("failed to connect to running server: %s", err)
+			}
+			tc.client(conn.(*net.TCPConn))
+			_ = conn.Close()
+
+			var st Stats
+			for dl := time.Now().Add(time.Second * 2); time.Now().Before(dl); {
+				if st = s.Stats(); st.Terminations[tc.expCause] > 0 {
+					break
+				}
+				time.Sleep(time.Millisecond * 10)
+			}
+			for _, c := range terminationCauses {
+				exp := uint64(0)
+				if c == tc.expCause {
+					exp = 1
+				}
+				if st.Terminations[c] != exp {
+					t.Errorf("unexpected %s terminations => expected: %d, got: %d", c, exp, st.Terminations[c])
+				}
+			}
+		})
+	}
+}
+
+// TestTerminationShutdown tests that connections closed by the shutdown of the server are
+// counted as such
+func TestTerminationShutdown(t *testing.T) {
+	s := New()
+	addr, stop := testServer(t, &s, Hi{})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = testRequest(t, conn, bufio.NewReader(conn), exampleReq)
+	stop()
+	if n := s.Stats().Terminations[TerminationShutdown]; n != 1 {
+		t.Errorf("unexpected shutdown terminations => expected: 1, got: %d", n)
+	}
+}
@@ -0,0 +1,50 @@
+package pps
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Dispatcher is a function that is called for every accepted connection. It decides how
+// the connection is processed, i. e. by handing it to a pool of worker goroutines. The
+// connection must eventually be served with Server.ServeConn using the given context
+type Dispatcher func(context.Context, net.Conn)
+
+// WithDispatcher replaces the default dispatcher, which serves every accepted connection
+// in its own goroutine. Connections are registered with the server before they are handed
+// to the dispatcher: they count towards the connection limit (see WithMaxConnections) and
+// the open connections of the Stats, they are closed by Server.Shutdown and the Run
+// methods of the server only return once all of them have been served with ServeConn
+func WithDispatcher(d func(context.Context, net.Conn)) ServerOpt {
+	return func(s *Server) {
+		s.dispatch = d
+	}
+}
+
+// dispatched is a connection that has been handed to a Dispatcher. release frees the
+// resources that have been reserved for the connection by the accept loop
+type dispatched struct {
+	conn    *connection
+	once    sync.Once
+	release func()
+}
+
+// ServeConn processes the policy requests on a connection that has been handed to a
+// Dispatcher. The given context must be the one that has been passed to the Dispatcher,
+// the given connection is the connection of the Dispatcher or a wrapper of it. The
+// connection is closed and released from the server when ServeConn returns
+func (s *Server) ServeConn(ctx context.Context, c net.Conn) error {
+	d, ok := ctx.Value(ctxDispatched).(*dispatched)
+	if !ok {
+		_ = c.Close()
+		return fmt.Errorf("failed to retrieve dispatched connection from context")
+	}
+	defer d.once.Do(d.release)
+	d.conn.mu.Lock()
+	d.conn.conn, d.conn.rb = c, bufio.NewReader(c)
+	d.conn.mu.Unlock()
+	return s.connHandler(ctx, d.conn)
+}
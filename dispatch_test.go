@@ -0,0 +1,110 @@
+package pps
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestWithDispatcher tests a custom dispatcher that routes the accepted connections to a
+// fixed-size set of workers
+func TestWithDispatcher(t *testing.T) {
+	type job struct {
+		ctx  context.Context
+		conn net.Conn
+	}
+	jc := make(chan job)
+	var dispatched int64
+	s := New(WithDispatcher(func(ctx context.Context, c net.Conn) {
+		atomic.AddInt64(&dispatched, 1)
+		jc <- job{ctx: ctx, conn: c}
+	}))
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jc {
+				if err := s.ServeConn(j.ctx, j.conn); err != nil {
+					t.Errorf("failed to serve connection: %s", err)
+				}
+			}
+		}()
+	}
+	addr, stop := testServer(t, &s, Hi{r: RespOk})
+
+	for i := 0; i < 4; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("failed to connect to running server: %s", err)
+		}
+		if r := testRequest(t, conn, bufio.NewReader(conn), exampleReq); r != "action=OK\n" {
+			t.Errorf("unexpected server response => expected: %q, got: %q", "action=OK\n", r)
+		}
+		_ = conn.Close()
+	}
+	stop()
+	close(jc)
+	wg.Wait()
+	if n := atomic.LoadInt64(&dispatched); n != 4 {
+		t.Errorf("unexpected number of dispatched connections => expected: 4, got: %d", n)
+	}
+}
+
+// TestServeConnWithoutDispatcherContext tests that ServeConn fails for a context that has
+// not been provided by the dispatcher
+func TestServeConnWithoutDispatcherContext(t *testing.T) {
+	s := New()
+	c1, c2 := net.Pipe()
+	defer func() { _ = c2.Close() }()
+	if err := s.ServeConn(context.Background(), c1); err == nil {
+		t.Errorf("ServeConn with invalid context was supposed to fail")
+	}
+}
+
+// TestWithDispatcherLifecycle tests that dispatched connections count towards the
+// connection limit and the open connections and that they are closed by Shutdown
+func TestWithDispatcherLifecycle(t *testing.T) {
+	var s Server
+	s = New(WithMaxConnections(1, RespDeferIfPermit), WithDispatcher(func(ctx context.Context, c net.Conn) {
+		go func() { _ = s.ServeConn(ctx, c) }()
+	}))
+	addr, stop := testServer(t, &s, Hi{r: RespOk})
+	defer stop()
+
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = first.Close() }()
+	rb := bufio.NewReader(first)
+	if r := testRequest(t, first, rb, exampleReq); r != "action=OK\n" {
+		t.Errorf("unexpected server response => expected: %q, got: %q", "action=OK\n", r)
+	}
+	if n := s.Stats().OpenConnections; n != 1 {
+		t.Errorf("dispatched connection not counted => expected 1 open connection, got: %d", n)
+	}
+
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = second.Close() }()
+	if r := testRequest(t, second, bufio.NewReader(second), exampleReq); r != "action=DEFER_IF_PERMIT\n" {
+		t.Errorf("dispatched connections not limited => expected: %q, got: %q", "action=DEFER_IF_PERMIT\n", r)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown failed: %s", err)
+	}
+	_ = first.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := rb.ReadByte(); err == nil || isTimeout(err) {
+		t.Errorf("dispatched connection was not closed by Shutdown => got: %v", err)
+	}
+}
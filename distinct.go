@@ -0,0 +1,127 @@
+package pps
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultDistinctWindow is the default window of the DistinctRecipientLimiter
+const DefaultDistinctWindow = time.Hour
+
+// DistinctRecipientLimiter is a Handler that limits the number of distinct recipients per
+// client IP address within a sliding window of the configured duration. Repeated queries
+// for the same recipient within the window are only counted once. Once the number of
+// distinct recipients of a client exceeds MaxRecipients, all requests of the client are
+// answered with the configured Action until enough recipients have left the window.
+//
+// The sliding window is approximated with two buckets of the window duration: the
+// recipients of the previous bucket are weighted by the part of the previous bucket that
+// still overlaps with the window, the recipients of the current bucket are fully counted
+type DistinctRecipientLimiter struct {
+	// Store holds the per-client recipient sets and counters. Defaults to a MemoryStore of
+	// the DistinctRecipientLimiter
+	Store Store
+
+	// MaxRecipients is the maximum number of distinct recipients per client within the
+	// window
+	MaxRecipients int64
+
+	// Window is the duration of the sliding window. Defaults to DefaultDistinctWindow
+	Window time.Duration
+
+	// Action is the response for clients over the limit. Defaults to RespDefer with an
+	// informative text
+	Action PostfixResp
+
+	// FailureMode controls the response if the Store fails. Defaults to the store failure
+	// mode of the server (see WithStoreFailureMode)
+	FailureMode StoreFailureMode
+
+	// Next is the Handler that is called for clients within the limit. If Next is nil,
+	// RespDunno is returned
+	Next Handler
+
+	now func() time.Time
+	mem defaultStore
+}
+
+// Handle satisfies the Handler interface for the DistinctRecipientLimiter
+func (l *DistinctRecipientLimiter) Handle(ps *PolicySet) PostfixResp {
+	if ps.ClientAddress == nil || ps.Recipient == "" {
+		return l.next(ps)
+	}
+	w := l.Window
+	if w <= 0 {
+		w = DefaultDistinctWindow
+	}
+	now := time.Now()
+	if l.now != nil {
+		now = l.now()
+	}
+	ws := now.Truncate(w)
+	f := float64(now.Sub(ws)) / float64(w)
+
+	// The keys of a bucket are kept for two windows, since the bucket is the previous
+	// bucket of the following window
+	ttl := ws.Add(2 * w).Sub(now)
+	if ttl <= 0 {
+		ttl = w
+	}
+	k := "distinct:" + ps.ClientAddress.String() + ":"
+	ck, pk := k+strconv.FormatInt(ws.Unix(), 10), k+strconv.FormatInt(ws.Add(-w).Unix(), 10)
+
+	n, err := l.count(l.mem.get(l.Store), ck, pk, strings.ToLower(ps.Recipient), ttl, f)
+	if (err != nil && !failClosed(ps, l.FailureMode)) || (err == nil && n <= float64(l.MaxRecipients)) {
+		return l.next(ps)
+	}
+	if l.Action == "" {
+		return TextResponseOpt(RespDefer, "Too many distinct recipients, try again later")
+	}
+	return l.Action
+}
+
+// count records the recipient in the current bucket and returns the estimated number of
+// distinct recipients in the sliding window. The previous bucket is weighted by f, the
+// elapsed part of the current bucket. Recipients of the current bucket that have been
+// seen in the previous bucket as well are only counted once
+func (l *DistinctRecipientLimiter) count(st Store, ck, pk, rcpt string, ttl time.Duration,
+	f float64) (float64, error) {
+	m, err := st.Incr(ck+":r:"+rcpt, ttl)
+	if err != nil {
+		return 0, err
+	}
+	if m == 1 {
+		if _, err := st.Incr(ck+":n", ttl); err != nil {
+			return 0, err
+		}
+		_, seen, err := st.Get(pk + ":r:" + rcpt)
+		if err != nil {
+			return 0, err
+		}
+		if seen {
+			if _, err := st.Incr(ck+":o", ttl); err != nil {
+				return 0, err
+			}
+		}
+	}
+	var c [3]int64
+	for i, key := range []string{ck + ":n", pk + ":n", ck + ":o"} {
+		v, ok, err := st.Get(key)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			c[i], _ = strconv.ParseInt(v, 10, 64)
+		}
+	}
+	return float64(c[0]) + float64(c[1]-c[2])*(1-f), nil
+}
+
+// next hands the request to the Next handler
+func (l *DistinctRecipientLimiter) next(ps *PolicySet) PostfixResp {
+	if l.Next == nil {
+		return RespDunno
+	}
+	return l.Next.Handle(ps)
+}
@@ -0,0 +1,97 @@
+package pps
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestDistinctRecipientLimiter tests that only distinct recipients are counted and that the
+// limit is enforced once the threshold is crossed
+func TestDistinctRecipientLimiter(t *testing.T) {
+	now := time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC)
+	l := &DistinctRecipientLimiter{Store: NewMemoryStore(), MaxRecipients: 3, now: func() time.Time { return now }}
+	client := net.ParseIP("192.0.2.1")
+	testTable := []struct {
+		testName  string
+		recipient string
+		expDefer  bool
+	}{
+		{`First recipient`, "rcpt1@example.com", false},
+		{`Repeated recipient`, "rcpt1@example.com", false},
+		{`Repeated recipient with different case`, "RCPT1@example.com", false},
+		{`Second recipient`, "rcpt2@example.com", false},
+		{`Third recipient`, "rcpt3@example.com", false},
+		{`Fourth recipient crosses the threshold`, "rcpt4@example.com", true},
+		{`Known recipient after the threshold`, "rcpt1@example.com", true},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			r := l.Handle(&PolicySet{ClientAddress: client, Recipient: tc.recipient})
+			if d := respAction(r) == string(RespDefer); d != tc.expDefer {
+				t.Errorf("unexpected response => expected defer: %t, got: %s", tc.expDefer, r)
+			}
+		})
+	}
+
+	// Other clients are not affected
+	r := l.Handle(&PolicySet{ClientAddress: net.ParseIP("192.0.2.2"), Recipient: "rcpt1@example.com"})
+	if r != RespDunno {
+		t.Errorf("unexpected response for other client => expected: %s, got: %s", RespDunno, r)
+	}
+}
+
+// TestDistinctRecipientLimiterWindow tests that the recipients are counted in a sliding
+// window, so that the limit holds across bucket boundaries and the count resets once the
+// recipients have left the window
+func TestDistinctRecipientLimiterWindow(t *testing.T) {
+	start := time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC)
+	now := start
+	l := &DistinctRecipientLimiter{Store: NewMemoryStore(), MaxRecipients: 2, Action: RespDefer,
+		now: func() time.Time { return now }}
+	testTable := []struct {
+		testName  string
+		offset    time.Duration
+		recipient int
+		expResp   PostfixResp
+	}{
+		{`First recipient at the end of a bucket`, time.Minute * 50, 1, RespDunno},
+		{`Second recipient at the end of a bucket`, time.Minute * 50, 2, RespDunno},
+		{`Third recipient crosses the threshold`, time.Minute * 50, 3, RespDefer},
+		{`New recipient right after the bucket boundary`, time.Minute * 70, 4, RespDefer},
+		{`New recipient once the first bucket left the window`, time.Minute * 170, 5, RespDunno},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			now = start.Add(tc.offset)
+			ps := &PolicySet{ClientAddress: net.ParseIP("192.0.2.1"),
+				Recipient: fmt.Sprintf("rcpt%d@example.com", tc.recipient)}
+			if r := l.Handle(ps); r != tc.expResp {
+				t.Errorf("unexpected response => expected: %s, got: %s", tc.expResp, r)
+			}
+		})
+	}
+}
+
+// TestDistinctRecipientLimiterOverlap tests that recipients that are seen in the previous
+// and the current bucket are only counted once
+func TestDistinctRecipientLimiterOverlap(t *testing.T) {
+	now := time.Date(2022, 1, 1, 10, 50, 0, 0, time.UTC)
+	l := &DistinctRecipientLimiter{Store: NewMemoryStore(), MaxRecipients: 2, Action: RespDefer,
+		now: func() time.Time { return now }}
+	ps := func(i int) *PolicySet {
+		return &PolicySet{ClientAddress: net.ParseIP("192.0.2.1"), Recipient: fmt.Sprintf("rcpt%d@example.com", i)}
+	}
+	for _, ts := range []time.Duration{0, time.Minute * 15} {
+		now = now.Add(ts)
+		for i := 1; i <= 2; i++ {
+			if r := l.Handle(ps(i)); r != RespDunno {
+				t.Errorf("unexpected response for recipient %d => expected: %s, got: %s", i, RespDunno, r)
+			}
+		}
+	}
+	if r := l.Handle(ps(3)); r != RespDefer {
+		t.Errorf("recipient over the limit not deferred => got: %s", r)
+	}
+}
@@ -0,0 +1,106 @@
+package pps
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"sync"
+)
+
+// DomainSet is a set of domains that can be safely reloaded while it is in use. Domains are
+// compared case-insensitively and without trailing dot. The zero value is an empty set
+type DomainSet struct {
+	mu sync.RWMutex
+	m  map[string]struct{}
+}
+
+// NewDomainSet returns a new DomainSet with the given domains
+func NewDomainSet(domains ...string) *DomainSet {
+	ds := &DomainSet{}
+	ds.Set(domains...)
+	return ds
+}
+
+// Set replaces the domains of the DomainSet with the given domains
+func (ds *DomainSet) Set(domains ...string) {
+	m := make(map[string]struct{}, len(domains))
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(d), "."))
+		if d != "" {
+			m[d] = struct{}{}
+		}
+	}
+	ds.mu.Lock()
+	ds.m = m
+	ds.mu.Unlock()
+}
+
+// Load replaces the domains of the DomainSet with the domains in the given list, which
+// holds one domain per line. Empty lines and comments starting with "#" are ignored. Its
+// signature allows the use as callback of WatchFile, so the DomainSet is reloaded whenever
+// the domain list file changes
+func (ds *DomainSet) Load(b []byte) error {
+	var dl []string
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		l := sc.Text()
+		if i := strings.IndexByte(l, '#'); i >= 0 {
+			l = l[:i]
+		}
+		dl = append(dl, strings.Fields(l)...)
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	ds.Set(dl...)
+	return nil
+}
+
+// Contains returns true if the given domain is part of the DomainSet
+func (ds *DomainSet) Contains(d string) bool {
+	d = strings.ToLower(strings.TrimSuffix(d, "."))
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	_, ok := ds.m[d]
+	return ok
+}
+
+// LocalDomainHandler is a Handler that distinguishes recipients in the local domains from
+// recipients in relay (foreign) domains and hands the request to the corresponding
+// sub-handler. Requests with a recipient without a domain part are answered with the
+// InvalidAction
+type LocalDomainHandler struct {
+	// Domains is the set of local domains. It can be reloaded while the handler is in use
+	Domains *DomainSet
+
+	// Local is the Handler that is called for recipients in the local domains. If Local is
+	// nil, RespDunno is returned
+	Local Handler
+
+	// Relay is the Handler that is called for recipients in all other domains. If Relay is
+	// nil, RespDunno is returned
+	Relay Handler
+
+	// InvalidAction is the response returned for recipients without a domain part.
+	// Defaults to RespDunno
+	InvalidAction PostfixResp
+}
+
+// Handle satisfies the Handler interface for the LocalDomainHandler
+func (h LocalDomainHandler) Handle(ps *PolicySet) PostfixResp {
+	d := ps.RecipientDomain()
+	if d == "" {
+		if h.InvalidAction == "" {
+			return RespDunno
+		}
+		return h.InvalidAction
+	}
+	n := h.Relay
+	if h.Domains != nil && h.Domains.Contains(d) {
+		n = h.Local
+	}
+	if n == nil {
+		return RespDunno
+	}
+	return n.Handle(ps)
+}
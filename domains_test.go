@@ -0,0 +1,60 @@
+package pps
+
+import (
+	"testing"
+)
+
+// TestLocalDomainHandler tests that the LocalDomainHandler hands local and relay
+// recipients to the corresponding sub-handlers
+func TestLocalDomainHandler(t *testing.T) {
+	h := LocalDomainHandler{
+		Domains:       NewDomainSet("example.com", "Example.ORG."),
+		Local:         OKHandler,
+		Relay:         RejectHandler(""),
+		InvalidAction: RespDefer,
+	}
+	testTable := []struct {
+		testName string
+		rcpt     string
+		expResp  PostfixResp
+	}{
+		{`Local recipient`, "tester@example.com", RespOk},
+		{`Local recipient with different case and trailing dot`, "tester@EXAMPLE.org.", RespOk},
+		{`Relay recipient`, "tester@example.net", RespReject},
+		{`Subdomain of a local domain`, "tester@sub.example.com", RespReject},
+		{`Recipient without domain`, "postmaster", RespDefer},
+		{`Empty recipient`, "", RespDefer},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			if r := h.Handle(&PolicySet{Recipient: tc.rcpt}); r != tc.expResp {
+				t.Errorf("unexpected response => expected: %s, got: %s", tc.expResp, r)
+			}
+		})
+	}
+}
+
+// TestDomainSetLoad tests that reloading a DomainSet replaces its domains
+func TestDomainSetLoad(t *testing.T) {
+	ds := NewDomainSet("example.com")
+	h := LocalDomainHandler{Domains: ds, Local: OKHandler}
+	if err := ds.Load([]byte("# local domains\nexample.net\n\nexample.org # secondary\n")); err != nil {
+		t.Fatalf("failed to load domain list: %s", err)
+	}
+	testTable := []struct {
+		domain string
+		local  bool
+	}{
+		{"example.com", false},
+		{"example.net", true},
+		{"example.org", true},
+	}
+	for _, tc := range testTable {
+		if ds.Contains(tc.domain) != tc.local {
+			t.Errorf("unexpected domain set membership of %s => expected: %t", tc.domain, tc.local)
+		}
+	}
+	if r := h.Handle(&PolicySet{Recipient: "tester@example.com"}); r != RespDunno {
+		t.Errorf("unexpected response for removed local domain => expected: %s, got: %s", RespDunno, r)
+	}
+}
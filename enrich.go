@@ -0,0 +1,86 @@
+package pps
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultEnricherTimeout is the default time an enricher may take (see WithEnricher)
+const DefaultEnricherTimeout = time.Second
+
+// Enricher is a function that modifies the PolicySet before it is handed to the Handler,
+// i. e. to add a GeoIP lookup or a reputation score to the Extra map
+type Enricher func(context.Context, *PolicySet)
+
+// WithEnricher adds an Enricher that is invoked after a request has been parsed and before
+// it is handed to the Handler. Enrichers run in the order they have been added. Each
+// enricher is bounded by the enricher timeout (see WithEnricherTimeout) that is reflected
+// in the deadline of its context. If an enricher does not return in time or panics, its
+// modifications are discarded and the request is processed without them
+func WithEnricher(f func(context.Context, *PolicySet)) ServerOpt {
+	return func(s *Server) {
+		if f != nil {
+			s.enrichers = append(s.enrichers, f)
+		}
+	}
+}
+
+// WithEnricherTimeout overrides the DefaultEnricherTimeout
+func WithEnricherTimeout(d time.Duration) ServerOpt {
+	return func(s *Server) {
+		s.enrichTimeout = d
+	}
+}
+
+// enrich runs the enrichers on the given PolicySet
+func (s *Server) enrich(ctx context.Context, ps *PolicySet) {
+	to := s.enrichTimeout
+	if to <= 0 {
+		to = DefaultEnricherTimeout
+	}
+	for _, f := range s.enrichers {
+		s.runEnricher(ctx, f, ps, to)
+	}
+}
+
+// runEnricher runs a single enricher on a copy of the PolicySet and applies its
+// modifications if it returned within the timeout
+func (s *Server) runEnricher(ctx context.Context, f Enricher, ps *PolicySet, to time.Duration) {
+	ectx, cancel := context.WithTimeout(ctx, to)
+	defer cancel()
+	psc := ps.clone()
+	dc := make(chan bool, 1)
+	go func() {
+		ok := false
+		defer func() {
+			if r := recover(); r != nil {
+				s.logf(ctx, LogLevelError, "request %s: enricher panicked: %v", ps.RequestID(), r)
+			}
+			dc <- ok
+		}()
+		f(ectx, &psc)
+		ok = true
+	}()
+	select {
+	case ok := <-dc:
+		if ok {
+			psc.ctx, psc.closeConn = ps.ctx, ps.closeConn
+			*ps = psc
+		}
+	case <-ectx.Done():
+		s.logf(ctx, LogLevelWarn, "request %s: enricher did not return within %s", ps.RequestID(), to)
+	}
+}
+
+// clone returns a copy of the PolicySet that does not share the Extra attributes with
+// the original
+func (ps *PolicySet) clone() PolicySet {
+	psc := *ps
+	if ps.Extra != nil {
+		psc.Extra = make(map[string]string, len(ps.Extra))
+		for k, v := range ps.Extra {
+			psc.Extra[k] = v
+		}
+	}
+	return psc
+}
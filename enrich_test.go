@@ -0,0 +1,69 @@
+package pps
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// extraHandler is a Handler that returns the value of the given Extra attribute as text
+type extraHandler struct {
+	attr string
+}
+
+// Handle is the function required by the Handler Interface
+func (h extraHandler) Handle(ps *PolicySet) PostfixResp {
+	return TextResponseOpt(RespInfo, ps.Extra[h.attr])
+}
+
+// TestWithEnricher tests that the Handler sees the modifications of an enricher
+func TestWithEnricher(t *testing.T) {
+	geoip := func(_ context.Context, ps *PolicySet) {
+		if ps.Extra == nil {
+			ps.Extra = make(map[string]string)
+		}
+		ps.Extra["geoip_country"] = "DE"
+	}
+	s := New(WithEnricher(geoip))
+	addr, stop := testServer(t, &s, extraHandler{attr: "geoip_country"})
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if r := testRequest(t, conn, bufio.NewReader(conn), exampleReq); r != "action=INFO DE\n" {
+		t.Errorf("unexpected server response => expected: %q, got: %q", "action=INFO DE\n", r)
+	}
+}
+
+// TestEnricherOrderAndFailures tests that enrichers run in order and that the
+// modifications of slow and panicking enrichers are discarded
+func TestEnricherOrderAndFailures(t *testing.T) {
+	set := func(v string) Enricher {
+		return func(_ context.Context, ps *PolicySet) {
+			if ps.Extra == nil {
+				ps.Extra = make(map[string]string)
+			}
+			ps.Extra["order"] += v
+		}
+	}
+	slow := func(ctx context.Context, ps *PolicySet) {
+		ps.Extra["order"] += "slow"
+		<-ctx.Done()
+		time.Sleep(time.Millisecond * 10)
+	}
+	panicking := func(_ context.Context, ps *PolicySet) {
+		ps.Extra["order"] += "panic"
+		panic("enricher failure")
+	}
+	s := New(WithEnricher(set("a")), WithEnricher(slow), WithEnricher(panicking), WithEnricher(set("b")),
+		WithEnricherTimeout(time.Millisecond*50), WithLogOutput(&syncBuffer{}))
+	ps := &PolicySet{}
+	s.enrich(context.Background(), ps)
+	if o := ps.Extra["order"]; o != "ab" {
+		t.Errorf("unexpected enrichment result => expected: %s, got: %s", "ab", o)
+	}
+}
@@ -0,0 +1,124 @@
+package pps
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Environment variables that are read by NewFromEnv
+const (
+	EnvAddr             = "PPS_ADDR"
+	EnvPort             = "PPS_PORT"
+	EnvNetwork          = "PPS_NETWORK"
+	EnvRunTimeout       = "PPS_RUN_TIMEOUT"
+	EnvKeepAliveIdle    = "PPS_KEEPALIVE_IDLE"
+	EnvReadTimeout      = "PPS_READ_TIMEOUT"
+	EnvWriteTimeout     = "PPS_WRITE_TIMEOUT"
+	EnvResponseBudget   = "PPS_RESPONSE_BUDGET"
+	EnvAcceptRateLimit  = "PPS_ACCEPT_RATE_LIMIT"
+	EnvAcceptBurst      = "PPS_ACCEPT_BURST"
+	EnvPipelining       = "PPS_PIPELINING"
+	EnvAdminHTTP        = "PPS_ADMIN_HTTP"
+	EnvSharedSecretAttr = "PPS_SHARED_SECRET_ATTR"
+	EnvSharedSecret     = "PPS_SHARED_SECRET"
+)
+
+// NewFromEnv returns a new server object that is configured from the PPS_* environment
+// variables (see the Env* constants). Durations use the time.ParseDuration format. Unset
+// variables fall back to the defaults of the server. The given options are applied after
+// the environment, so they take precedence. An error is returned if any of the variables
+// holds a malformed value
+func NewFromEnv(options ...ServerOpt) (*Server, error) {
+	var ol []ServerOpt
+	if v, ok := os.LookupEnv(EnvAddr); ok {
+		ol = append(ol, WithAddr(v))
+	}
+	if v, ok := os.LookupEnv(EnvPort); ok {
+		p, err := strconv.ParseUint(v, 10, 16)
+		if err != nil || p == 0 {
+			return nil, fmt.Errorf("invalid value %q for %s: not a valid port", v, EnvPort)
+		}
+		ol = append(ol, WithPort(v))
+	}
+	if v, ok := os.LookupEnv(EnvNetwork); ok {
+		switch v {
+		case "tcp", "tcp4", "tcp6", "unix":
+		default:
+			return nil, fmt.Errorf("invalid value %q for %s: unsupported network", v, EnvNetwork)
+		}
+		ol = append(ol, WithNetwork(v))
+	}
+	for k, f := range map[string]func(time.Duration) ServerOpt{
+		EnvRunTimeout:     WithRunTimeout,
+		EnvKeepAliveIdle:  WithKeepAliveIdle,
+		EnvReadTimeout:    WithReadTimeout,
+		EnvWriteTimeout:   WithWriteTimeout,
+		EnvResponseBudget: WithResponseBudget,
+	} {
+		d, ok, err := envDuration(k)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			ol = append(ol, f(d))
+		}
+	}
+	if v, ok := os.LookupEnv(EnvAcceptRateLimit); ok {
+		r, err := strconv.ParseFloat(v, 64)
+		if err != nil || r < 0 {
+			return nil, fmt.Errorf("invalid value %q for %s: not a valid rate", v, EnvAcceptRateLimit)
+		}
+		b, _, err := envInt(EnvAcceptBurst)
+		if err != nil {
+			return nil, err
+		}
+		ol = append(ol, WithAcceptRateLimit(r, b))
+	}
+	n, ok, err := envInt(EnvPipelining)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		ol = append(ol, WithPipelining(n))
+	}
+	if v, ok := os.LookupEnv(EnvAdminHTTP); ok {
+		ol = append(ol, WithAdminHTTP(v))
+	}
+	if v, ok := os.LookupEnv(EnvSharedSecret); ok {
+		a := os.Getenv(EnvSharedSecretAttr)
+		if a == "" {
+			return nil, fmt.Errorf("%s requires %s to be set", EnvSharedSecret, EnvSharedSecretAttr)
+		}
+		ol = append(ol, WithSharedSecret(a, v))
+	}
+	s := New(append(ol, options...)...)
+	return &s, nil
+}
+
+// envDuration returns the non-negative duration of the given environment variable
+func envDuration(k string) (time.Duration, bool, error) {
+	v, ok := os.LookupEnv(k)
+	if !ok {
+		return 0, false, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, false, fmt.Errorf("invalid value %q for %s: not a valid duration", v, k)
+	}
+	return d, true, nil
+}
+
+// envInt returns the non-negative integer of the given environment variable
+func envInt(k string) (int, bool, error) {
+	v, ok := os.LookupEnv(k)
+	if !ok {
+		return 0, false, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, false, fmt.Errorf("invalid value %q for %s: not a valid number", v, k)
+	}
+	return n, true, nil
+}
@@ -0,0 +1,91 @@
+package pps
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestNewFromEnv tests that NewFromEnv applies the environment variables
+func TestNewFromEnv(t *testing.T) {
+	t.Setenv(EnvAddr, "127.0.0.1")
+	t.Setenv(EnvPort, "12345")
+	t.Setenv(EnvNetwork, "tcp4")
+	t.Setenv(EnvRunTimeout, "1m")
+	t.Setenv(EnvResponseBudget, "500ms")
+	t.Setenv(EnvReadTimeout, "10s")
+	t.Setenv(EnvWriteTimeout, "2s")
+	t.Setenv(EnvAcceptRateLimit, "100")
+	t.Setenv(EnvAcceptBurst, "10")
+	t.Setenv(EnvPipelining, "4")
+	t.Setenv(EnvSharedSecretAttr, "pps_token")
+	t.Setenv(EnvSharedSecret, "s3cret")
+	s, err := NewFromEnv(WithAddr("127.0.0.2"))
+	if err != nil {
+		t.Fatalf("NewFromEnv failed: %s", err)
+	}
+	c := s.Config()
+	exp := Config{
+		Addr:               "127.0.0.2",
+		Port:               "12345",
+		Network:            "tcp4",
+		AcceptRateLimit:    100,
+		AcceptBurst:        10,
+		LogLevel:           DefaultLogLevel,
+		RunTimeout:         time.Minute,
+		Pipelining:         4,
+		ResponseBudget:     time.Millisecond * 500,
+		ReadTimeout:        time.Second * 10,
+		WriteTimeout:       time.Second * 2,
+		PanicResponse:      RespDeferIfPermit,
+		SharedSecretAttr:   "pps_token",
+		SharedSecret:       redacted,
+		SharedSecretAction: RespDefer,
+	}
+	if c != exp {
+		t.Errorf("unexpected server config => expected: %+v, got: %+v", exp, c)
+	}
+}
+
+// TestNewFromEnvDefaults tests that NewFromEnv falls back to the defaults for unset
+// variables
+func TestNewFromEnvDefaults(t *testing.T) {
+	s, err := NewFromEnv()
+	if err != nil {
+		t.Fatalf("NewFromEnv failed: %s", err)
+	}
+	d := New()
+	if s.Config() != d.Config() {
+		t.Errorf("unexpected server config => expected: %s, got: %s", d.Config(), s.Config())
+	}
+}
+
+// TestNewFromEnvInvalid tests that NewFromEnv fails for malformed values
+func TestNewFromEnvInvalid(t *testing.T) {
+	testTable := []struct {
+		testName string
+		key      string
+		value    string
+	}{
+		{`Non-numeric port`, EnvPort, "smtp"},
+		{`Port out of range`, EnvPort, "70000"},
+		{`Unsupported network`, EnvNetwork, "udp"},
+		{`Malformed duration`, EnvRunTimeout, "10"},
+		{`Negative duration`, EnvKeepAliveIdle, "-1s"},
+		{`Malformed rate`, EnvAcceptRateLimit, "fast"},
+		{`Malformed number`, EnvPipelining, "four"},
+		{`Secret without attribute`, EnvSharedSecret, "s3cret"},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			t.Setenv(tc.key, tc.value)
+			_, err := NewFromEnv()
+			if err == nil {
+				t.Fatalf("NewFromEnv with %s=%s was supposed to fail", tc.key, tc.value)
+			}
+			if !strings.Contains(err.Error(), tc.key) {
+				t.Errorf("error does not name the variable => expected: %s, got: %s", tc.key, err)
+			}
+		})
+	}
+}
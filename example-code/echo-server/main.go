@@ -20,7 +20,6 @@ package main
 */
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/wneessen/postfix-policy-server"
@@ -44,12 +43,8 @@ func (h Hi) Handle(ps *pps.PolicySet) pps.PostfixResp {
 
 // main starts the server
 func main() {
-	s := pps.New()
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	h := Hi{}
 	log.Println("Starting policy echo server...")
-	if err := s.Run(ctx, h); err != nil {
+	if err := pps.ListenAndServe(":"+pps.DefaultPort, Hi{}); err != nil {
 		log.Fatalf("could not run server: %s", err)
 	}
 }
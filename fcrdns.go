@@ -0,0 +1,141 @@
+package pps
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// DefaultFCrDNSTimeout is the default time limit of the DNS lookups of the FCrDNSHandler
+const DefaultFCrDNSTimeout = time.Second * 2
+
+// DefaultFCrDNSTTL is the default time the FCrDNSHandler caches the result for a client IP
+const DefaultFCrDNSTTL = time.Hour
+
+// maxFCrDNSNames is the maximum number of PTR names that are verified by the FCrDNSHandler
+const maxFCrDNSNames = 10
+
+// Resolver is the DNS resolver used by the DNS based handlers. It is satisfied by
+// *net.Resolver
+type Resolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// FCrDNSHandler is a Handler that performs a forward-confirmed reverse DNS check of the
+// client IP. The client passes the check if any of the PTR names of its IP resolves back
+// to that IP. Clients that fail the check are answered with the configured Action, all
+// other requests are handed to the Next handler. Resolver errors (other than non-existent
+// records) fail open and are not cached
+type FCrDNSHandler struct {
+	// Resolver performs the DNS lookups. Defaults to net.DefaultResolver
+	Resolver Resolver
+
+	// Timeout is the time limit of the DNS lookups of a request. Defaults to
+	// DefaultFCrDNSTimeout
+	Timeout time.Duration
+
+	// Store caches the check results per client IP. If Store is nil, the results are not
+	// cached
+	Store Store
+
+	// TTL is the time a check result is cached. Defaults to DefaultFCrDNSTTL
+	TTL time.Duration
+
+	// Action is the response returned for clients that fail the check. Defaults to
+	// RespReject with an informative text
+	Action PostfixResp
+
+	// Next is the Handler that is called for clients that pass the check. If Next is nil,
+	// RespDunno is returned
+	Next Handler
+}
+
+// Handle satisfies the Handler interface for the FCrDNSHandler
+func (h *FCrDNSHandler) Handle(ps *PolicySet) PostfixResp {
+	if ps.ClientAddress == nil || h.confirmed(ps) {
+		if h.Next == nil {
+			return RespDunno
+		}
+		return h.Next.Handle(ps)
+	}
+	if h.Action == "" {
+		return TextResponseOpt(RespReject, "Client host rejected: reverse DNS does not match")
+	}
+	return h.Action
+}
+
+// confirmed returns true if the client IP of the PolicySet passes the check, using the
+// cached result if available
+func (h *FCrDNSHandler) confirmed(ps *PolicySet) bool {
+	k := "fcrdns:" + ps.ClientAddress.String()
+	if h.Store != nil {
+		if v, ok, err := h.Store.Get(k); err == nil && ok {
+			return v == "1"
+		}
+	}
+	to := h.Timeout
+	if to == 0 {
+		to = DefaultFCrDNSTimeout
+	}
+	ctx, cancel := context.WithTimeout(ps.Context(), to)
+	defer cancel()
+	ok, err := h.check(ctx, ps.ClientAddress)
+	if err != nil {
+		return true
+	}
+	if h.Store != nil {
+		ttl := h.TTL
+		if ttl == 0 {
+			ttl = DefaultFCrDNSTTL
+		}
+		v := "0"
+		if ok {
+			v = "1"
+		}
+		_ = h.Store.Set(k, v, ttl)
+	}
+	return ok
+}
+
+// check performs the forward-confirmed reverse DNS lookups for the given IP. An error is
+// returned if the result could not be determined
+func (h *FCrDNSHandler) check(ctx context.Context, ip net.IP) (bool, error) {
+	var r Resolver = net.DefaultResolver
+	if h.Resolver != nil {
+		r = h.Resolver
+	}
+	nl, err := r.LookupAddr(ctx, ip.String())
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if len(nl) > maxFCrDNSNames {
+		nl = nl[:maxFCrDNSNames]
+	}
+	var ferr error
+	for _, n := range nl {
+		al, err := r.LookupIPAddr(ctx, n)
+		if err != nil {
+			if !isNotFound(err) {
+				ferr = err
+			}
+			continue
+		}
+		for _, a := range al {
+			if a.IP.Equal(ip) {
+				return true, nil
+			}
+		}
+	}
+	return false, ferr
+}
+
+// isNotFound returns true if the given error is a DNS error for a non-existent record
+func isNotFound(err error) bool {
+	var de *net.DNSError
+	return errors.As(err, &de) && de.IsNotFound
+}
@@ -0,0 +1,92 @@
+package pps
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+// fakeResolver is a Resolver with static records that counts its lookups
+type fakeResolver struct {
+	ptr   map[string][]string
+	a     map[string][]net.IPAddr
+	err   error
+	calls int
+}
+
+// LookupAddr is the function required by the Resolver Interface
+func (r *fakeResolver) LookupAddr(_ context.Context, addr string) ([]string, error) {
+	r.calls++
+	if r.err != nil {
+		return nil, r.err
+	}
+	nl, ok := r.ptr[addr]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+	}
+	return nl, nil
+}
+
+// LookupIPAddr is the function required by the Resolver Interface
+func (r *fakeResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	al, ok := r.a[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return al, nil
+}
+
+// TestFCrDNSHandler tests the FCrDNSHandler with matching, mismatching and missing records
+// and with resolver errors
+func TestFCrDNSHandler(t *testing.T) {
+	r := &fakeResolver{
+		ptr: map[string][]string{
+			"192.0.2.1": {"mail.example.com."},
+			"192.0.2.2": {"spoofed.example.com."},
+		},
+		a: map[string][]net.IPAddr{
+			"mail.example.com.":    {{IP: net.ParseIP("192.0.2.1")}},
+			"spoofed.example.com.": {{IP: net.ParseIP("198.51.100.1")}},
+		},
+	}
+	testTable := []struct {
+		testName string
+		ip       string
+		err      error
+		expResp  PostfixResp
+	}{
+		{`Matching forward and reverse DNS`, "192.0.2.1", nil, RespOk},
+		{`Mismatching forward and reverse DNS`, "192.0.2.2", nil, RespReject},
+		{`Missing PTR record`, "192.0.2.3", nil, RespReject},
+		{`Resolver error fails open`, "192.0.2.2", errors.New("SERVFAIL"), RespOk},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			r.err = tc.err
+			h := &FCrDNSHandler{Resolver: r, Action: RespReject, Next: OKHandler}
+			ps := &PolicySet{ClientAddress: net.ParseIP(tc.ip)}
+			if resp := h.Handle(ps); resp != tc.expResp {
+				t.Errorf("unexpected response => expected: %s, got: %s", tc.expResp, resp)
+			}
+		})
+	}
+}
+
+// TestFCrDNSHandlerCache tests that the FCrDNSHandler caches the results, but not resolver
+// errors
+func TestFCrDNSHandlerCache(t *testing.T) {
+	r := &fakeResolver{err: errors.New("SERVFAIL")}
+	h := &FCrDNSHandler{Resolver: r, Store: NewMemoryStore()}
+	ps := &PolicySet{ClientAddress: net.ParseIP("192.0.2.3")}
+	_ = h.Handle(ps)
+	r.err = nil
+	for i := 0; i < 3; i++ {
+		if resp := h.Handle(ps); respAction(resp) != string(RespReject) {
+			t.Errorf("unexpected response => expected: %s, got: %s", RespReject, resp)
+		}
+	}
+	if r.calls != 2 {
+		t.Errorf("unexpected number of lookups => expected: 2, got: %d", r.calls)
+	}
+}
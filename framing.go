@@ -0,0 +1,195 @@
+package pps
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Framing is the wire format of the requests and responses on a policy connection
+type Framing int
+
+// Supported framings
+const (
+	// FramingPostfix is the line-based postfix policy delegation protocol. This is the
+	// default framing
+	FramingPostfix Framing = iota
+
+	// FramingLengthPrefixed frames each request and response with a 4-byte big-endian
+	// length prefix. The payload of a request holds the "name=value" lines of the postfix
+	// protocol, the terminating empty line is optional. The payload of a response is the
+	// response of the postfix protocol
+	FramingLengthPrefixed
+
+	// FramingJSON expects a stream of JSON objects that map the postfix attribute names to
+	// their values. Each request is answered with a JSON object holding the "action" and
+	// optional "extra" lines, followed by a newline
+	FramingJSON
+)
+
+// maxFrameSize is the maximum payload size of a length-prefixed request
+const maxFrameSize = 1 << 20
+
+// String satisfies the fmt.Stringer interface for the Framing
+func (f Framing) String() string {
+	switch f {
+	case FramingPostfix:
+		return "postfix"
+	case FramingLengthPrefixed:
+		return "length-prefixed"
+	case FramingJSON:
+		return "json"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(f))
+	}
+}
+
+// WithFraming sets the wire format of the policy connections. This allows the reuse of the
+// Handler for non-postfix clients that do not want to emulate the postfix line protocol
+func WithFraming(f Framing) ServerOpt {
+	return func(s *Server) {
+		s.framing = f
+	}
+}
+
+// RequestReader reads a single policy request from a connection and returns the
+// corresponding PolicySet. It abstracts the parsing of the requests, so that protocol
+// changes or alternate request formats can be supported without changes to the server.
+// ReadRequest must return io.EOF if the connection has been closed before a request has
+// been read
+type RequestReader interface {
+	ReadRequest(*bufio.Reader) (*PolicySet, error)
+}
+
+// RequestReaderFunc is an adapter to allow the use of ordinary functions as RequestReader
+type RequestReaderFunc func(*bufio.Reader) (*PolicySet, error)
+
+// ReadRequest satisfies the RequestReader interface for the RequestReaderFunc
+func (f RequestReaderFunc) ReadRequest(r *bufio.Reader) (*PolicySet, error) {
+	return f(r)
+}
+
+// PostfixRequestReader is the RequestReader of the postfix policy delegation protocol
+// (see ParsePolicySet). Unlike the built-in framing of the server, which logs and skips
+// malformed lines, it fails requests with malformed lines
+var PostfixRequestReader RequestReader = RequestReaderFunc(ParsePolicySet)
+
+// WithRequestReader sets the RequestReader that parses the requests of the policy
+// connections. It takes precedence over the request framing of the server (see
+// WithFraming), while the responses are still written in the configured framing
+func WithRequestReader(r RequestReader) ServerOpt {
+	return func(s *Server) {
+		s.reqReader = r
+	}
+}
+
+// jsonResp is the response of the FramingJSON
+type jsonResp struct {
+	Action string   `json:"action"`
+	Extra  []string `json:"extra,omitempty"`
+}
+
+// readRequest reads the next request from the connection in the configured framing.
+// Malformed attributes of the built-in framings do not fail the request, but are recorded
+// in the connection, so that the request is still answered
+func (s *Server) readRequest(c *connection) (*PolicySet, error) {
+	if s.reqReader != nil {
+		return s.reqReader.ReadRequest(c.rb)
+	}
+	c.malformed = c.malformed[:0]
+	skip := func(l string) { c.malformed = append(c.malformed, l) }
+	switch s.framing {
+	case FramingLengthPrefixed:
+		return readLengthPrefixed(c.rb, s.reqLimits, skip)
+	case FramingJSON:
+		if c.dec == nil {
+			c.dec = json.NewDecoder(c.rb)
+		}
+		return readJSON(c.dec, skip)
+	default:
+		return parsePolicySet(c.rb, s.reqLimits, skip)
+	}
+}
+
+// renderResp returns the wire representation of the Response in the configured framing
+func (s *Server) renderResp(r Response) []byte {
+	switch s.framing {
+	case FramingLengthPrefixed:
+		p := r.render()
+		b := make([]byte, 4, 4+len(p))
+		binary.BigEndian.PutUint32(b, uint32(len(p)))
+		return append(b, p...)
+	case FramingJSON:
+		jr := jsonResp{Action: string(sanitizeResp(r.action()))}
+		for _, e := range r.Extra {
+			jr.Extra = append(jr.Extra, string(sanitizeResp(PostfixResp(e))))
+		}
+		b, err := json.Marshal(jr)
+		if err != nil {
+			return nil
+		}
+		return append(b, '\n')
+	default:
+		return r.render()
+	}
+}
+
+// readLengthPrefixed reads a length-prefixed request from the given reader. The request
+// limits apply to the payload of the frame
+func readLengthPrefixed(r *bufio.Reader, lim requestLimits, skip func(string)) (*PolicySet, error) {
+	var h [4]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(h[:])
+	if n > maxFrameSize {
+		return nil, fmt.Errorf("request frame of %d bytes exceeds the maximum of %d bytes", n, maxFrameSize)
+	}
+	if lim.size > 0 && n > uint32(lim.size) {
+		return nil, fmt.Errorf("%w: request exceeds %d bytes", ErrRequestLimit, lim.size)
+	}
+	p := make([]byte, n)
+	if _, err := io.ReadFull(r, p); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	ps, err := parsePolicySet(bufio.NewReader(bytes.NewReader(p)), lim, skip)
+	switch {
+	case errors.Is(err, io.EOF):
+		return &PolicySet{}, nil
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return ps, nil
+	}
+	return ps, err
+}
+
+// readJSON reads a JSON object request from the given decoder
+func readJSON(dec *json.Decoder, skip func(string)) (*PolicySet, error) {
+	var m map[string]string
+	if err := dec.Decode(&m); err != nil {
+		return nil, err
+	}
+	ps := &PolicySet{}
+	var perr error
+	for k, v := range m {
+		if strings.Contains(k, "=") {
+			if skip != nil {
+				skip(k)
+				continue
+			}
+			if perr == nil {
+				perr = fmt.Errorf("%w: invalid attribute name %q", ErrMalformedAttr, k)
+			}
+			continue
+		}
+		perr = parseAttr(ps, k+"="+v, perr)
+	}
+	return ps, perr
+}
@@ -0,0 +1,177 @@
+package pps
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// senderHandler is a Handler that rejects the given sender
+type senderHandler struct {
+	sender string
+}
+
+// Handle is the function required by the Handler Interface
+func (h senderHandler) Handle(ps *PolicySet) PostfixResp {
+	if ps.Sender == h.sender {
+		return TextResponseOpt(RespReject, "sender "+ps.Sender+" rejected")
+	}
+	return RespDunno
+}
+
+// TestFramingLengthPrefixed tests a round-trip of multiple requests with the
+// FramingLengthPrefixed
+func TestFramingLengthPrefixed(t *testing.T) {
+	s := New(WithFraming(FramingLengthPrefixed))
+	addr, stop := testServer(t, &s, senderHandler{sender: "tester@example.com"})
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
+	rb := bufio.NewReader(conn)
+
+	testTable := []struct {
+		testName string
+		payload  string
+		expResp  string
+	}{
+		{`Request with terminating empty line`, exampleReq, "action=REJECT sender tester@example.com rejected\n\n"},
+		{`Request without terminating empty line`, "request=smtpd_access_policy\nsender=other@example.com\n",
+			"action=DUNNO\n\n"},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			f := make([]byte, 4, 4+len(tc.payload))
+			binary.BigEndian.PutUint32(f, uint32(len(tc.payload)))
+			if _, err := conn.Write(append(f, tc.payload...)); err != nil {
+				t.Fatalf("failed to send request to server: %s", err)
+			}
+			var h [4]byte
+			if _, err := io.ReadFull(rb, h[:]); err != nil {
+				t.Fatalf("failed to read response frame header: %s", err)
+			}
+			p := make([]byte, binary.BigEndian.Uint32(h[:]))
+			if _, err := io.ReadFull(rb, p); err != nil {
+				t.Fatalf("failed to read response frame: %s", err)
+			}
+			if string(p) != tc.expResp {
+				t.Errorf("unexpected server response => expected: %q, got: %q", tc.expResp, string(p))
+			}
+		})
+	}
+}
+
+// TestFramingJSON tests a round-trip of multiple requests with the FramingJSON
+func TestFramingJSON(t *testing.T) {
+	s := New(WithFraming(FramingJSON))
+	addr, stop := testServer(t, &s, senderHandler{sender: "tester@example.com"})
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
+	dec := json.NewDecoder(conn)
+
+	testTable := []struct {
+		testName  string
+		req       string
+		expAction string
+	}{
+		{`Rejected sender`, `{"request":"smtpd_access_policy","sender":"tester@example.com"}`,
+			"REJECT sender tester@example.com rejected"},
+		{`Other sender`, `{"request":"smtpd_access_policy","sender":"other@example.com"}`, "DUNNO"},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			if _, err := conn.Write([]byte(tc.req)); err != nil {
+				t.Fatalf("failed to send request to server: %s", err)
+			}
+			var r jsonResp
+			if err := dec.Decode(&r); err != nil {
+				t.Fatalf("failed to decode server response: %s", err)
+			}
+			if r.Action != tc.expAction {
+				t.Errorf("unexpected server response => expected: %q, got: %q", tc.expAction, r.Action)
+			}
+		})
+	}
+
+	// Invalid JSON closes the connection
+	if _, err := conn.Write([]byte(`{"request":`)); err != nil {
+		t.Fatalf("failed to send request to server: %s", err)
+	}
+	_ = conn.(*net.TCPConn).CloseWrite()
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Errorf("expected connection to be closed cleanly => got: %s", err)
+	}
+}
+
+// TestRenderRespFraming tests the rendering of responses with extra lines in the
+// different framings
+func TestRenderRespFraming(t *testing.T) {
+	r := Response{Action: RespOk, Message: "fine", Extra: []string{"foo=bar"}}
+	testTable := []struct {
+		framing Framing
+		expWire string
+	}{
+		{FramingPostfix, "action=OK fine\nfoo=bar\n\n"},
+		{FramingLengthPrefixed, "\x00\x00\x00\x18action=OK fine\nfoo=bar\n\n"},
+		{FramingJSON, `{"action":"OK fine","extra":["foo=bar"]}` + "\n"},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.framing.String(), func(t *testing.T) {
+			s := New(WithFraming(tc.framing))
+			if w := string(s.renderResp(r)); w != tc.expWire {
+				t.Errorf("unexpected rendered response => expected: %q, got: %q", tc.expWire, w)
+			}
+		})
+	}
+}
+
+// TestWithRequestReader tests a custom RequestReader that parses a trivial alternate
+// request format of one "sender|recipient" line per request
+func TestWithRequestReader(t *testing.T) {
+	rr := RequestReaderFunc(func(r *bufio.Reader) (*PolicySet, error) {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		f := strings.SplitN(strings.TrimSuffix(l, "\n"), "|", 2)
+		if len(f) != 2 {
+			return nil, ErrMalformedAttr
+		}
+		return &PolicySet{Request: "smtpd_access_policy", ProtocolState: StateRcpt, Sender: f[0],
+			Recipient: f[1]}, nil
+	})
+	s := New(WithRequestReader(rr))
+	addr, stop := testServer(t, &s, senderHandler{sender: "spam@example.com"})
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	rb := bufio.NewReader(conn)
+	testTable := []struct {
+		req     string
+		expResp string
+	}{
+		{"spam@example.com|tester@localhost.tld\n", "action=REJECT sender spam@example.com rejected\n"},
+		{"tester@example.com|tester@localhost.tld\n", "action=DUNNO\n"},
+	}
+	for _, tc := range testTable {
+		if r := testRequest(t, conn, rb, tc.req); r != tc.expResp {
+			t.Errorf("unexpected server response => expected: %q, got: %q", tc.expResp, r)
+		}
+	}
+}
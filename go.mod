@@ -2,4 +2,9 @@ module github.com/wneessen/postfix-policy-server
 
 go 1.17
 
-require github.com/rs/xid v1.4.0
+require (
+	github.com/fsnotify/fsnotify v1.7.0
+	github.com/rs/xid v1.4.0
+)
+
+require golang.org/x/sys v0.4.0 // indirect
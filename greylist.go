@@ -0,0 +1,163 @@
+package pps
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default values for the Greylister
+const (
+	DefaultGreylistDelay  = time.Minute * 5
+	DefaultGreylistExpiry = time.Hour * 24 * 7
+)
+
+// Greylister is a Handler that implements greylisting based on the (client address,
+// sender, recipient) triplet. The first delivery attempt for a triplet is deferred and
+// retries are accepted once the Delay has passed. Clients in the AllowedNetworks and
+// senders of the AllowedSenderDomains bypass the greylisting without recording a triplet
+type Greylister struct {
+	// Store holds the triplets. Defaults to a MemoryStore of the Greylister
+	Store Store
+
+	// Delay is the time a client has to wait before a retry is accepted. Defaults to
+	// DefaultGreylistDelay
+	Delay time.Duration
+
+	// Expiry is the time a triplet is remembered. Defaults to DefaultGreylistExpiry
+	Expiry time.Duration
+
+	// Action is the response for greylisted requests. Defaults to DEFER_IF_PERMIT with
+	// an informative text
+	Action PostfixResp
+
+	// AllowedNetworks is a list of networks that bypass the greylisting
+	AllowedNetworks []*net.IPNet
+
+	// AllowedSenderDomains is a list of sender domains (including their sub-domains) that
+	// bypass the greylisting
+	AllowedSenderDomains []string
+
+	// FailureMode controls the response if the Store fails. Defaults to the store failure
+	// mode of the server (see WithStoreFailureMode)
+	FailureMode StoreFailureMode
+
+	// Next is the Handler that is called for requests that passed the greylisting. If Next
+	// is nil, RespDunno is returned
+	Next Handler
+
+	now func() time.Time
+	mem defaultStore
+}
+
+// Handle satisfies the Handler interface for the Greylister
+func (g *Greylister) Handle(ps *PolicySet) PostfixResp {
+	if ps.Recipient == "" || g.allowed(ps) {
+		return g.next(ps)
+	}
+
+	now := time.Now()
+	if g.now != nil {
+		now = g.now()
+	}
+	d, e := g.Delay, g.Expiry
+	if d == 0 {
+		d = DefaultGreylistDelay
+	}
+	if e == 0 {
+		e = DefaultGreylistExpiry
+	}
+
+	k := fmt.Sprintf("greylist:%s/%s/%s", ps.ClientAddress, strings.ToLower(ps.Sender),
+		strings.ToLower(ps.Recipient))
+	st := g.mem.get(g.Store)
+	v, ok, err := st.Get(k)
+	if err != nil {
+		return g.storeFailed(ps)
+	}
+	if !ok {
+		if err := st.Set(k, strconv.FormatInt(now.Unix(), 10), e); err != nil {
+			return g.storeFailed(ps)
+		}
+		return g.action()
+	}
+	fs, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || now.Sub(time.Unix(fs, 0)) >= d {
+		return g.next(ps)
+	}
+	return g.action()
+}
+
+// allowed returns true if the client address or the sender domain is allowlisted
+func (g *Greylister) allowed(ps *PolicySet) bool {
+	for _, n := range g.AllowedNetworks {
+		if ps.ClientAddress != nil && n.Contains(ps.ClientAddress) {
+			return true
+		}
+	}
+	sd := ps.SenderDomain()
+	if sd == "" {
+		return false
+	}
+	for _, d := range g.AllowedSenderDomains {
+		d = strings.ToLower(strings.TrimPrefix(d, "."))
+		if sd == d || strings.HasSuffix(sd, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// action returns the response for greylisted requests
+func (g *Greylister) action() PostfixResp {
+	if g.Action == "" {
+		return TextResponseOpt(RespDeferIfPermit, "Greylisted, please try again later")
+	}
+	return g.Action
+}
+
+// storeFailed returns the response for a request whose processing failed due to a
+// Store error
+func (g *Greylister) storeFailed(ps *PolicySet) PostfixResp {
+	if failClosed(ps, g.FailureMode) {
+		return g.action()
+	}
+	return g.next(ps)
+}
+
+// next hands the request to the Next handler
+func (g *Greylister) next(ps *PolicySet) PostfixResp {
+	if g.Next == nil {
+		return RespDunno
+	}
+	return g.Next.Handle(ps)
+}
+
+// ParseCIDRs parses the given list of CIDR notated networks. Plain IP addresses are
+// accepted as single-host networks
+func ParseCIDRs(cidrs ...string) ([]*net.IPNet, error) {
+	nl := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("failed to parse network %q: invalid IP address", c)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nl = append(nl, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse network %q: %w", c, err)
+		}
+		nl = append(nl, n)
+	}
+	return nl, nil
+}
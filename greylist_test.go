@@ -0,0 +1,97 @@
+package pps
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestGreylister tests that the Greylister defers the first attempt of a triplet and
+// accepts retries after the delay
+func TestGreylister(t *testing.T) {
+	now := time.Now()
+	g := &Greylister{Store: NewMemoryStore(), now: func() time.Time { return now }}
+	ps := &PolicySet{
+		ClientAddress: net.ParseIP("192.0.2.1"),
+		Sender:        "sender@example.com",
+		Recipient:     "rcpt@example.org",
+	}
+	if r := g.Handle(ps); respAction(r) != string(RespDeferIfPermit) {
+		t.Errorf("first attempt not greylisted => expected: %s, got: %s", RespDeferIfPermit, r)
+	}
+	now = now.Add(time.Minute)
+	if r := g.Handle(ps); respAction(r) != string(RespDeferIfPermit) {
+		t.Errorf("early retry not greylisted => expected: %s, got: %s", RespDeferIfPermit, r)
+	}
+	now = now.Add(DefaultGreylistDelay)
+	if r := g.Handle(ps); r != RespDunno {
+		t.Errorf("retry after delay greylisted => expected: %s, got: %s", RespDunno, r)
+	}
+}
+
+// TestGreylisterAllowlist tests that allowlisted clients and sender domains bypass the
+// Greylister without recording a triplet, while others are deferred
+func TestGreylisterAllowlist(t *testing.T) {
+	nl, err := ParseCIDRs("192.0.2.0/24", "2001:db8::/32", "198.51.100.7")
+	if err != nil {
+		t.Fatalf("failed to parse allowed networks: %s", err)
+	}
+	testTable := []struct {
+		testName string
+		client   string
+		sender   string
+		expResp  PostfixResp
+	}{
+		{`Allowed IPv4 network`, "192.0.2.55", "sender@example.com", RespOk},
+		{`Allowed IPv6 network`, "2001:db8::25", "sender@example.com", RespOk},
+		{`Allowed single host`, "198.51.100.7", "sender@example.com", RespOk},
+		{`Allowed sender domain`, "203.0.113.1", "list@lists.example.net", RespOk},
+		{`Allowed sender sub-domain`, "203.0.113.1", "bounce@mail.lists.example.net", RespOk},
+		{`Not allowed client`, "203.0.113.1", "sender@example.com", RespDefer},
+		{`Similar sender domain`, "203.0.113.1", "sender@notlists.example.net", RespDefer},
+		{`Null sender`, "203.0.113.1", "", RespDefer},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			st := NewMemoryStore()
+			g := &Greylister{
+				Store:                st,
+				Action:               RespDefer,
+				AllowedNetworks:      nl,
+				AllowedSenderDomains: []string{"lists.example.net"},
+				Next:                 OKHandler,
+			}
+			ps := &PolicySet{
+				ClientAddress: net.ParseIP(tc.client),
+				Sender:        tc.sender,
+				Recipient:     "rcpt@example.org",
+			}
+			if r := g.Handle(ps); r != tc.expResp {
+				t.Errorf("unexpected greylist response => expected: %s, got: %s", tc.expResp, r)
+			}
+			if n := len(st.m); tc.expResp == RespOk && n != 0 {
+				t.Errorf("allowlisted request recorded a triplet")
+			}
+		})
+	}
+}
+
+// TestParseCIDRs tests the ParseCIDRs() method with valid and invalid networks
+func TestParseCIDRs(t *testing.T) {
+	nl, err := ParseCIDRs("10.0.0.0/8", "192.0.2.1", "::1")
+	if err != nil {
+		t.Fatalf("failed to parse networks: %s", err)
+	}
+	if len(nl) != 3 {
+		t.Errorf("unexpected number of networks => expected: 3, got: %d", len(nl))
+	}
+	if nl[1].String() != "192.0.2.1/32" || nl[2].String() != "::1/128" {
+		t.Errorf("unexpected single-host networks => got: %s, %s", nl[1], nl[2])
+	}
+	if _, err := ParseCIDRs("10.0.0.0/33"); err == nil {
+		t.Errorf("invalid network was parsed successfully")
+	}
+	if _, err := ParseCIDRs("not-an-ip"); err == nil {
+		t.Errorf("invalid IP address was parsed successfully")
+	}
+}
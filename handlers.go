@@ -0,0 +1,427 @@
+package pps
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// HandlerFunc is an adapter to allow the use of ordinary functions as Handler
+type HandlerFunc func(*PolicySet) PostfixResp
+
+// Handle satisfies the Handler interface for the HandlerFunc
+func (f HandlerFunc) Handle(ps *PolicySet) PostfixResp {
+	return f(ps)
+}
+
+// DunnoHandler is a Handler that always returns RespDunno
+var DunnoHandler Handler = HandlerFunc(func(*PolicySet) PostfixResp { return RespDunno })
+
+// OKHandler is a Handler that always returns RespOk
+var OKHandler Handler = HandlerFunc(func(*PolicySet) PostfixResp { return RespOk })
+
+// RejectHandler returns a Handler that always returns RespReject with the given message.
+// If the message is empty, a plain RespReject is returned
+func RejectHandler(msg string) Handler {
+	r := RespReject
+	if msg != "" {
+		r = TextResponseOpt(RespReject, msg)
+	}
+	return HandlerFunc(func(*PolicySet) PostfixResp { return r })
+}
+
+// chain is a list of Handler that is processed in order
+type chain []Handler
+
+// Chain returns a Handler that calls the given handlers in order and returns the first
+// response that is not DUNNO. If all handlers return DUNNO, RespDunno is returned. This
+// mirrors the way postfix processes its restriction lists
+func Chain(handlers ...Handler) Handler {
+	return chain(handlers)
+}
+
+// Handle satisfies the Handler interface for the chain
+func (hc chain) Handle(ps *PolicySet) PostfixResp {
+	for _, h := range hc {
+		if h == nil {
+			continue
+		}
+		if r := h.Handle(ps); respAction(r) != string(RespDunno) {
+			return r
+		}
+	}
+	return RespDunno
+}
+
+// HELOCheckHandler is a Handler that validates the HELO/EHLO hostname of the
+// client against a set of toggleable rules. If any of the enabled rules is
+// violated, the configured Action is returned, otherwise the request is handed
+// to the Next handler
+type HELOCheckHandler struct {
+	// RequireFQDN requires the HELO name to be a fully-qualified domain name.
+	// Empty HELO names fail this check, while address literals (like [192.0.2.1])
+	// are accepted
+	RequireFQDN bool
+
+	// RejectBareIP rejects HELO names that are IP addresses without the enclosing
+	// brackets of an address literal
+	RejectBareIP bool
+
+	// RejectOwnHostname rejects HELO names that match one of the OwnHostnames
+	RejectOwnHostname bool
+
+	// OwnHostnames is the list of hostnames that belong to our own mail system
+	OwnHostnames []string
+
+	// Normalize enables the normalization of the HELO name (see NormalizeName) before
+	// the rules are checked
+	Normalize bool
+
+	// Action is the response returned when a rule is violated. Defaults to RespReject
+	Action PostfixResp
+
+	// Next is the Handler that is called when all checks passed. If Next is nil,
+	// RespDunno is returned
+	Next Handler
+}
+
+// Handle satisfies the Handler interface for the HELOCheckHandler
+func (h HELOCheckHandler) Handle(ps *PolicySet) PostfixResp {
+	hn := ps.HELOName
+	if h.Normalize {
+		hn = ps.NormalizedHELOName()
+	}
+	if h.violates(hn) {
+		if h.Action == "" {
+			return RespReject
+		}
+		return h.Action
+	}
+	if h.Next == nil {
+		return RespDunno
+	}
+	return h.Next.Handle(ps)
+}
+
+// violates returns true if the given HELO name violates any of the enabled rules
+func (h HELOCheckHandler) violates(hn string) bool {
+	if h.RejectBareIP && net.ParseIP(hn) != nil {
+		return true
+	}
+	if h.RequireFQDN && !isAddrLiteral(hn) && !isFQDN(hn) {
+		return true
+	}
+	if h.RejectOwnHostname {
+		n := strings.TrimSuffix(hn, ".")
+		for _, o := range h.OwnHostnames {
+			if strings.EqualFold(n, strings.TrimSuffix(o, ".")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isAddrLiteral returns true if the given string is a bracketed address literal
+// as defined in RFC 5321
+func isAddrLiteral(s string) bool {
+	if len(s) < 3 || s[0] != '[' || s[len(s)-1] != ']' {
+		return false
+	}
+	a := strings.TrimPrefix(s[1:len(s)-1], "IPv6:")
+	return net.ParseIP(a) != nil
+}
+
+// isFQDN returns true if the given string is a syntactically valid, fully-qualified
+// domain name
+func isFQDN(s string) bool {
+	s = strings.TrimSuffix(s, ".")
+	if s == "" || len(s) > 253 || net.ParseIP(s) != nil {
+		return false
+	}
+	ls := strings.Split(s, ".")
+	if len(ls) < 2 {
+		return false
+	}
+	for _, l := range ls {
+		if len(l) == 0 || len(l) > 63 || l[0] == '-' || l[len(l)-1] == '-' {
+			return false
+		}
+		for _, c := range l {
+			switch {
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-':
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// DefaultPTRSentinel is the value postfix sends as reverse_client_name if the client IP
+// address has no PTR record
+const DefaultPTRSentinel = "unknown"
+
+// RequirePTRHandler is a Handler that returns the configured Action for clients without
+// a PTR record, i. e. with an empty reverse client name or a reverse client name that
+// equals the Sentinel. All other requests are handed to the Next handler
+type RequirePTRHandler struct {
+	// Sentinel is the reverse client name that indicates a missing PTR record. Defaults
+	// to DefaultPTRSentinel
+	Sentinel string
+
+	// Action is the response returned for clients without a PTR record. Defaults to
+	// RespReject
+	Action PostfixResp
+
+	// Next is the Handler that is called for clients with a PTR record. If Next is nil,
+	// RespDunno is returned
+	Next Handler
+}
+
+// Handle satisfies the Handler interface for the RequirePTRHandler
+func (h RequirePTRHandler) Handle(ps *PolicySet) PostfixResp {
+	s := h.Sentinel
+	if s == "" {
+		s = DefaultPTRSentinel
+	}
+	if ps.ReverseClientName == "" || strings.EqualFold(ps.ReverseClientName, s) {
+		if h.Action == "" {
+			return RespReject
+		}
+		return h.Action
+	}
+	if h.Next == nil {
+		return RespDunno
+	}
+	return h.Next.Handle(ps)
+}
+
+// DefaultMinKeysize is the default minimum encryption key size of the EncryptionPolicyHandler
+const DefaultMinKeysize = 128
+
+// DefaultTLSProtocols is the default list of allowed TLS protocol versions of the
+// EncryptionPolicyHandler
+var DefaultTLSProtocols = []string{"TLSv1.2", "TLSv1.3"}
+
+// EncryptionPolicyHandler is a Handler that enforces a minimum strength for the TLS
+// encryption of the SMTP session. Requests with a key size below MinKeysize or with a TLS
+// protocol version that is not in AllowedProtocols are answered with the configured Action.
+// Plaintext sessions (empty encryption attributes) are answered with the PlaintextAction.
+// All other requests are handed to the Next handler
+type EncryptionPolicyHandler struct {
+	// MinKeysize is the minimum symmetric key size in bits. Defaults to DefaultMinKeysize
+	MinKeysize uint64
+
+	// AllowedProtocols is the list of allowed TLS protocol versions as reported by postfix
+	// (i. e. "TLSv1.2"). The comparison is case-insensitive. Defaults to DefaultTLSProtocols
+	AllowedProtocols []string
+
+	// Action is the response returned for weak encryption. Defaults to RespReject
+	Action PostfixResp
+
+	// PlaintextAction is the response returned for plaintext sessions. If it is empty,
+	// plaintext sessions are handed to the Next handler
+	PlaintextAction PostfixResp
+
+	// Next is the Handler that is called for sufficiently encrypted sessions. If Next is
+	// nil, RespDunno is returned
+	Next Handler
+}
+
+// Handle satisfies the Handler interface for the EncryptionPolicyHandler
+func (h EncryptionPolicyHandler) Handle(ps *PolicySet) PostfixResp {
+	switch {
+	case ps.EncryptionProtocol == "" && ps.EncryptionCipher == "" && ps.EncryptionKeysize == 0:
+		if h.PlaintextAction != "" {
+			return h.PlaintextAction
+		}
+	case h.weak(ps):
+		if h.Action == "" {
+			return RespReject
+		}
+		return h.Action
+	}
+	if h.Next == nil {
+		return RespDunno
+	}
+	return h.Next.Handle(ps)
+}
+
+// weak returns true if the encryption of the given PolicySet does not meet the
+// requirements of the EncryptionPolicyHandler
+func (h EncryptionPolicyHandler) weak(ps *PolicySet) bool {
+	mk := h.MinKeysize
+	if mk == 0 {
+		mk = DefaultMinKeysize
+	}
+	if ps.EncryptionKeysize < mk {
+		return true
+	}
+	ap := h.AllowedProtocols
+	if ap == nil {
+		ap = DefaultTLSProtocols
+	}
+	for _, p := range ap {
+		if strings.EqualFold(p, ps.EncryptionProtocol) {
+			return false
+		}
+	}
+	return true
+}
+
+// RegexSenderHandler is a Handler that returns the configured Action if the envelope sender
+// of the request matches any of its regular expressions. All other requests are handed to
+// the Next handler. Use NewRegexSenderHandler to compile the patterns
+type RegexSenderHandler struct {
+	// Action is the response returned for matching senders. Defaults to RespReject
+	Action PostfixResp
+
+	// Next is the Handler that is called for non-matching senders. If Next is nil,
+	// RespDunno is returned
+	Next Handler
+
+	res []*regexp.Regexp
+}
+
+// NewRegexSenderHandler compiles the given regular expressions and returns a
+// RegexSenderHandler that matches the sender against them. An error is returned if any of
+// the patterns is invalid
+func NewRegexSenderHandler(patterns ...string) (*RegexSenderHandler, error) {
+	h := &RegexSenderHandler{res: make([]*regexp.Regexp, 0, len(patterns))}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile sender pattern %q: %w", p, err)
+		}
+		h.res = append(h.res, re)
+	}
+	return h, nil
+}
+
+// Handle satisfies the Handler interface for the RegexSenderHandler
+func (h *RegexSenderHandler) Handle(ps *PolicySet) PostfixResp {
+	for _, re := range h.res {
+		if re.MatchString(ps.Sender) {
+			if h.Action == "" {
+				return RespReject
+			}
+			return h.Action
+		}
+	}
+	if h.Next == nil {
+		return RespDunno
+	}
+	return h.Next.Handle(ps)
+}
+
+// ScoreHandler is a Handler that maps a policy score to a response. Requests with a score
+// below Low are handed to the Next handler, requests with a score of at least Low are
+// deferred and requests with a score of at least High are rejected. A threshold of zero
+// or less is disabled, so the zero value of the ScoreHandler never defers or rejects.
+// Without a Score function, all requests are handed to the Next handler
+type ScoreHandler struct {
+	// Score calculates the policy score of the request
+	Score func(*PolicySet) int
+
+	// Low is the score at which requests are deferred. Zero or less disables deferring
+	Low int
+
+	// High is the score at which requests are rejected. Zero or less disables rejecting
+	High int
+
+	// DeferMessage is the text of the DEFER response. Defaults to an informative text
+	DeferMessage string
+
+	// RejectMessage is the text of the REJECT response. Defaults to an informative text
+	RejectMessage string
+
+	// Next is the Handler that is called for requests with a score below Low. If Next is
+	// nil, RespDunno is returned
+	Next Handler
+}
+
+// Handle satisfies the Handler interface for the ScoreHandler
+func (h ScoreHandler) Handle(ps *PolicySet) PostfixResp {
+	if h.Score == nil {
+		return h.next(ps)
+	}
+	sc := h.Score(ps)
+	switch {
+	case h.High > 0 && sc >= h.High:
+		if h.RejectMessage == "" {
+			return TextResponseOpt(RespReject, "Policy score too high")
+		}
+		return TextResponseOpt(RespReject, h.RejectMessage)
+	case h.Low > 0 && sc >= h.Low:
+		if h.DeferMessage == "" {
+			return TextResponseOpt(RespDefer, "Policy score too high, please try again later")
+		}
+		return TextResponseOpt(RespDefer, h.DeferMessage)
+	}
+	return h.next(ps)
+}
+
+// next hands the request to the Next handler
+func (h ScoreHandler) next(ps *PolicySet) PostfixResp {
+	if h.Next == nil {
+		return RespDunno
+	}
+	return h.Next.Handle(ps)
+}
+
+// tarpitMargin is the time the TarpitHandler reserves before the deadline of the request
+// context to write the response
+const tarpitMargin = time.Millisecond * 50
+
+// TarpitHandler is a Handler that delays the response of the Next handler for clients
+// that are flagged by the Match function, as cheap deterrent against abusive clients. The
+// delay is aborted when the context of the PolicySet is cancelled and is capped to the
+// deadline of the context (see WithResponseBudget), so that the tarpit never trips the
+// fallback response. Requests of clients that are not flagged are not delayed
+type TarpitHandler struct {
+	// Match returns true if the client of the request should be tarpitted
+	Match func(*PolicySet) bool
+
+	// Delay is the time the response to flagged clients is delayed
+	Delay time.Duration
+
+	// Next is the Handler whose response is delayed. If Next is nil, RespDunno is returned
+	Next Handler
+}
+
+// Handle satisfies the Handler interface for the TarpitHandler
+func (h TarpitHandler) Handle(ps *PolicySet) PostfixResp {
+	r := RespDunno
+	if h.Next != nil {
+		r = h.Next.Handle(ps)
+	}
+	if h.Match == nil || !h.Match(ps) {
+		return r
+	}
+	ctx := ps.Context()
+	d := h.Delay
+	if dl, ok := ctx.Deadline(); ok {
+		if rd := time.Until(dl) - tarpitMargin; rd < d {
+			d = rd
+		}
+	}
+	if d <= 0 {
+		return r
+	}
+	sleepCtx(ctx, d)
+	return r
+}
+
+// sleepCtx blocks for the given duration or until the context is cancelled
+func sleepCtx(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,386 @@
+package pps
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countHandler is a Handler that counts how often it has been called
+type countHandler struct {
+	r PostfixResp
+	n int
+}
+
+// Handle is the function required by the Handler Interface
+func (h *countHandler) Handle(*PolicySet) PostfixResp {
+	h.n++
+	return h.r
+}
+
+// TestBuiltinHandlers tests that the built-in handlers return their expected actions
+func TestBuiltinHandlers(t *testing.T) {
+	testTable := []struct {
+		testName string
+		handler  Handler
+		expResp  PostfixResp
+	}{
+		{`DunnoHandler`, DunnoHandler, RespDunno},
+		{`OKHandler`, OKHandler, RespOk},
+		{`RejectHandler without message`, RejectHandler(""), RespReject},
+		{`RejectHandler with message`, RejectHandler("go away"), "REJECT go away"},
+		{`HandlerFunc`, HandlerFunc(func(*PolicySet) PostfixResp { return RespHold }), RespHold},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			if r := tc.handler.Handle(&PolicySet{}); r != tc.expResp {
+				t.Errorf("unexpected handler response => expected: %s, got: %s", tc.expResp, r)
+			}
+		})
+	}
+}
+
+// TestChainWithBuiltinHandlers tests the Chain() method with the built-in handlers as
+// terminators
+func TestChainWithBuiltinHandlers(t *testing.T) {
+	if r := Chain(DunnoHandler, RejectHandler("denied"), OKHandler).Handle(&PolicySet{}); r != "REJECT denied" {
+		t.Errorf("unexpected chain response => expected: REJECT denied, got: %s", r)
+	}
+}
+
+// TestChain tests the Chain() method with different handler combinations
+func TestChain(t *testing.T) {
+	testTable := []struct {
+		testName string
+		resps    []PostfixResp
+		expResp  PostfixResp
+		expCalls []int
+	}{
+		{`DUNNO then REJECT`, []PostfixResp{RespDunno, RespReject}, RespReject, []int{1, 1}},
+		{`All DUNNO`, []PostfixResp{RespDunno, RespDunno, RespDunno}, RespDunno, []int{1, 1, 1}},
+		{`OK stops the chain`, []PostfixResp{RespOk, RespReject}, RespOk, []int{1, 0}},
+		{`DUNNO with text falls through`, []PostfixResp{TextResponseOpt(RespDunno, "text"), RespDefer},
+			RespDefer, []int{1, 1}},
+		{`Empty chain`, nil, RespDunno, nil},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			var hl []Handler
+			var cl []*countHandler
+			for _, r := range tc.resps {
+				h := &countHandler{r: r}
+				hl = append(hl, h, nil)
+				cl = append(cl, h)
+			}
+			if r := Chain(hl...).Handle(&PolicySet{}); r != tc.expResp {
+				t.Errorf("unexpected chain response => expected: %s, got: %s", tc.expResp, r)
+			}
+			for i, h := range cl {
+				if h.n != tc.expCalls[i] {
+					t.Errorf("unexpected number of calls for handler %d => expected: %d, got: %d",
+						i, tc.expCalls[i], h.n)
+				}
+			}
+		})
+	}
+}
+
+// TestHELOCheckHandler tests the HELOCheckHandler with different HELO names
+func TestHELOCheckHandler(t *testing.T) {
+	h := HELOCheckHandler{
+		RequireFQDN:       true,
+		RejectBareIP:      true,
+		RejectOwnHostname: true,
+		OwnHostnames:      []string{"mx.example.com"},
+	}
+	testTable := []struct {
+		testName string
+		heloName string
+		expResp  PostfixResp
+	}{
+		{`Valid FQDN`, "mail.example.org", RespDunno},
+		{`Valid FQDN with trailing dot`, "mail.example.org.", RespDunno},
+		{`Valid address literal`, "[192.0.2.1]", RespDunno},
+		{`Bare IPv4 address`, "192.0.2.1", RespReject},
+		{`Bare IPv6 address`, "2001:db8::1", RespReject},
+		{`Empty HELO`, "", RespReject},
+		{`Non-FQDN HELO`, "localhost", RespReject},
+		{`Invalid characters`, "mail_server.example.org", RespReject},
+		{`Own hostname`, "MX.example.com", RespReject},
+	}
+
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			r := h.Handle(&PolicySet{HELOName: tc.heloName})
+			if r != tc.expResp {
+				t.Errorf("unexpected HELO check response => expected: %s, got: %s", tc.expResp, r)
+			}
+		})
+	}
+}
+
+// TestHELOCheckHandlerToggles tests that disabled rules of the HELOCheckHandler are not
+// enforced and that the configured action and next handler are used
+func TestHELOCheckHandlerToggles(t *testing.T) {
+	ps := &PolicySet{HELOName: "192.0.2.1"}
+	h := HELOCheckHandler{}
+	if r := h.Handle(ps); r != RespDunno {
+		t.Errorf("HELO check with all rules disabled failed => expected: %s, got: %s", RespDunno, r)
+	}
+	h = HELOCheckHandler{RejectBareIP: true, Action: RespDefer}
+	if r := h.Handle(ps); r != RespDefer {
+		t.Errorf("HELO check with custom action failed => expected: %s, got: %s", RespDefer, r)
+	}
+	h = HELOCheckHandler{RequireFQDN: true, Next: Hi{r: RespOk}}
+	if r := h.Handle(&PolicySet{HELOName: "mail.example.org"}); r != RespOk {
+		t.Errorf("HELO check with next handler failed => expected: %s, got: %s", RespOk, r)
+	}
+}
+
+// TestHELOCheckHandlerNormalize tests the HELOCheckHandler with raw and normalized HELO
+// name matching
+func TestHELOCheckHandlerNormalize(t *testing.T) {
+	ps := &PolicySet{HELOName: " MX.Example.com  "}
+	h := HELOCheckHandler{RejectOwnHostname: true, OwnHostnames: []string{"mx.example.com"}}
+	if r := h.Handle(ps); r != RespDunno {
+		t.Errorf("HELO check with raw name failed => expected: %s, got: %s", RespDunno, r)
+	}
+	h.Normalize = true
+	if r := h.Handle(ps); r != RespReject {
+		t.Errorf("HELO check with normalized name failed => expected: %s, got: %s", RespReject, r)
+	}
+	h = HELOCheckHandler{RequireFQDN: true, Normalize: true}
+	if r := h.Handle(ps); r != RespDunno {
+		t.Errorf("FQDN check with normalized name failed => expected: %s, got: %s", RespDunno, r)
+	}
+}
+
+// TestRequirePTRHandler tests the RequirePTRHandler with present, unknown and empty
+// reverse client names
+func TestRequirePTRHandler(t *testing.T) {
+	testTable := []struct {
+		testName string
+		handler  RequirePTRHandler
+		rcn      string
+		expResp  PostfixResp
+	}{
+		{`Present PTR`, RequirePTRHandler{}, "mail.example.com", RespDunno},
+		{`Present PTR with next handler`, RequirePTRHandler{Next: OKHandler}, "mail.example.com", RespOk},
+		{`Unknown PTR`, RequirePTRHandler{}, "unknown", RespReject},
+		{`Empty PTR`, RequirePTRHandler{}, "", RespReject},
+		{`Unknown PTR with custom action`, RequirePTRHandler{Action: RespDefer}, "unknown", RespDefer},
+		{`Custom sentinel`, RequirePTRHandler{Sentinel: "none"}, "none", RespReject},
+		{`Default sentinel with custom sentinel`, RequirePTRHandler{Sentinel: "none"}, "unknown", RespDunno},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			if r := tc.handler.Handle(&PolicySet{ReverseClientName: tc.rcn}); r != tc.expResp {
+				t.Errorf("unexpected PTR check response => expected: %s, got: %s", tc.expResp, r)
+			}
+		})
+	}
+}
+
+// TestEncryptionPolicyHandler tests the EncryptionPolicyHandler with strong and weak
+// encryption and plaintext sessions
+func TestEncryptionPolicyHandler(t *testing.T) {
+	strong := &PolicySet{EncryptionProtocol: "TLSv1.3", EncryptionCipher: "TLS_AES_256_GCM_SHA384",
+		EncryptionKeysize: 256}
+	weakCipher := &PolicySet{EncryptionProtocol: "TLSv1.2", EncryptionCipher: "DES-CBC3-SHA",
+		EncryptionKeysize: 112}
+	oldProto := &PolicySet{EncryptionProtocol: "TLSv1", EncryptionCipher: "AES256-SHA",
+		EncryptionKeysize: 256}
+	plain := &PolicySet{}
+	testTable := []struct {
+		testName string
+		handler  EncryptionPolicyHandler
+		ps       *PolicySet
+		expResp  PostfixResp
+	}{
+		{`Strong TLS`, EncryptionPolicyHandler{}, strong, RespDunno},
+		{`Strong TLS with next handler`, EncryptionPolicyHandler{Next: OKHandler}, strong, RespOk},
+		{`Weak cipher`, EncryptionPolicyHandler{}, weakCipher, RespReject},
+		{`Weak cipher with custom action`, EncryptionPolicyHandler{Action: RespDefer}, weakCipher, RespDefer},
+		{`Weak cipher with lower minimum`, EncryptionPolicyHandler{MinKeysize: 112}, weakCipher, RespDunno},
+		{`Old protocol`, EncryptionPolicyHandler{}, oldProto, RespReject},
+		{`Old protocol explicitly allowed`, EncryptionPolicyHandler{AllowedProtocols: []string{"tlsv1"}},
+			oldProto, RespDunno},
+		{`Plaintext without action`, EncryptionPolicyHandler{}, plain, RespDunno},
+		{`Plaintext with action`, EncryptionPolicyHandler{PlaintextAction: RespDefer}, plain, RespDefer},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			if r := tc.handler.Handle(tc.ps); r != tc.expResp {
+				t.Errorf("unexpected encryption check response => expected: %s, got: %s", tc.expResp, r)
+			}
+		})
+	}
+}
+
+// TestRegexSenderHandler tests the RegexSenderHandler with matching and non-matching senders
+func TestRegexSenderHandler(t *testing.T) {
+	h, err := NewRegexSenderHandler(`^[a-z0-9]{20,}@`, `(?i)@spam\.example$`)
+	if err != nil {
+		t.Fatalf("failed to create regex sender handler: %s", err)
+	}
+	testTable := []struct {
+		testName string
+		sender   string
+		next     Handler
+		action   PostfixResp
+		expResp  PostfixResp
+	}{
+		{`Random-looking local part`, "x8f7a6s5d4f3g2h1j0k9l8@example.com", nil, "", RespReject},
+		{`Matching domain`, "news@SPAM.example", nil, "", RespReject},
+		{`Matching sender with custom action`, "news@spam.example", nil, RespDiscard, RespDiscard},
+		{`Non-matching sender`, "tester@example.com", nil, "", RespDunno},
+		{`Non-matching sender with next handler`, "tester@example.com", OKHandler, "", RespOk},
+		{`Null sender`, "", nil, "", RespDunno},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			h.Next = tc.next
+			h.Action = tc.action
+			if r := h.Handle(&PolicySet{Sender: tc.sender}); r != tc.expResp {
+				t.Errorf("unexpected regex sender response => expected: %s, got: %s", tc.expResp, r)
+			}
+		})
+	}
+}
+
+// TestNewRegexSenderHandlerInvalid tests that NewRegexSenderHandler fails for an invalid
+// pattern
+func TestNewRegexSenderHandlerInvalid(t *testing.T) {
+	_, err := NewRegexSenderHandler(`^valid@`, `(unclosed`)
+	if err == nil {
+		t.Fatalf("NewRegexSenderHandler with invalid pattern was supposed to fail")
+	}
+	if !strings.Contains(err.Error(), "(unclosed") {
+		t.Errorf("error does not contain the invalid pattern => got: %s", err)
+	}
+}
+
+// TestScoreHandler tests the ScoreHandler in each score band and at the thresholds
+func TestScoreHandler(t *testing.T) {
+	testTable := []struct {
+		testName string
+		score    int
+		msgs     bool
+		next     Handler
+		expResp  PostfixResp
+	}{
+		{`Below low`, 4, false, nil, RespDunno},
+		{`Below low with next handler`, 4, false, OKHandler, RespOk},
+		{`Exactly low`, 5, false, nil, "DEFER Policy score too high, please try again later"},
+		{`Between low and high`, 7, true, nil, "DEFER score 7"},
+		{`Just below high`, 9, true, nil, "DEFER score 9"},
+		{`Exactly high`, 10, false, nil, "REJECT Policy score too high"},
+		{`Above high`, 25, true, nil, "REJECT score 25"},
+		{`Negative score`, -3, false, nil, RespDunno},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			h := ScoreHandler{
+				Score: func(*PolicySet) int { return tc.score },
+				Low:   5,
+				High:  10,
+				Next:  tc.next,
+			}
+			if tc.msgs {
+				h.DeferMessage = fmt.Sprintf("score %d", tc.score)
+				h.RejectMessage = fmt.Sprintf("score %d", tc.score)
+			}
+			if r := h.Handle(&PolicySet{}); r != tc.expResp {
+				t.Errorf("unexpected score response => expected: %s, got: %s", tc.expResp, r)
+			}
+		})
+	}
+}
+
+// TestScoreHandlerZeroValue tests that the zero value of the ScoreHandler and disabled
+// thresholds neither defer nor reject requests
+func TestScoreHandlerZeroValue(t *testing.T) {
+	score := func(*PolicySet) int { return 42 }
+	testTable := []struct {
+		testName string
+		h        ScoreHandler
+		expResp  PostfixResp
+	}{
+		{`Zero value`, ScoreHandler{}, RespDunno},
+		{`Zero value with next handler`, ScoreHandler{Next: OKHandler}, RespOk},
+		{`Nil score with thresholds`, ScoreHandler{Low: 5, High: 10}, RespDunno},
+		{`No thresholds`, ScoreHandler{Score: score}, RespDunno},
+		{`Only low threshold`, ScoreHandler{Score: score, Low: 5},
+			"DEFER Policy score too high, please try again later"},
+		{`Only high threshold`, ScoreHandler{Score: score, High: 10}, "REJECT Policy score too high"},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			if r := tc.h.Handle(&PolicySet{}); r != tc.expResp {
+				t.Errorf("unexpected score response => expected: %s, got: %s", tc.expResp, r)
+			}
+		})
+	}
+}
+
+// TestTarpitHandler tests that the TarpitHandler only delays the responses to flagged
+// clients and that a cancelled context aborts the delay
+func TestTarpitHandler(t *testing.T) {
+	h := TarpitHandler{
+		Match: func(ps *PolicySet) bool { return ps.ClientName == "abuser.example.com" },
+		Delay: time.Millisecond * 300,
+		Next:  RejectHandler(""),
+	}
+	cctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	testTable := []struct {
+		testName string
+		client   string
+		ctx      context.Context
+		delayed  bool
+	}{
+		{`Flagged client`, "abuser.example.com", nil, true},
+		{`Normal client`, "mail.example.com", nil, false},
+		{`Flagged client with cancelled context`, "abuser.example.com", cctx, false},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			st := time.Now()
+			if r := h.Handle(&PolicySet{ClientName: tc.client, ctx: tc.ctx}); r != RespReject {
+				t.Errorf("unexpected response => expected: %s, got: %s", RespReject, r)
+			}
+			if d := time.Since(st); (d >= h.Delay) != tc.delayed {
+				t.Errorf("unexpected response delay => expected delay: %t, took: %s", tc.delayed, d)
+			}
+		})
+	}
+}
+
+// TestTarpitHandlerBudget tests that the tarpit delay is capped to the response budget, so
+// that the delayed response is not replaced by the fallback response
+func TestTarpitHandlerBudget(t *testing.T) {
+	h := TarpitHandler{
+		Match: func(*PolicySet) bool { return true },
+		Delay: time.Second * 2,
+		Next:  RejectHandler(""),
+	}
+	s := New(WithResponseBudget(time.Millisecond * 300))
+	addr, stop := testServer(t, &s, h)
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	st := time.Now()
+	if r := testRequest(t, conn, bufio.NewReader(conn), exampleReq); r != "action=REJECT\n" {
+		t.Errorf("unexpected server response => expected: %q, got: %q", "action=REJECT\n", r)
+	}
+	if d := time.Since(st); d < time.Millisecond*200 || d > time.Millisecond*300 {
+		t.Errorf("unexpected response delay => expected: 200ms-300ms, took: %s", d)
+	}
+}
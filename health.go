@@ -0,0 +1,45 @@
+package pps
+
+// readinessKey is the key that is read from the required stores to check their
+// reachability
+const readinessKey = "pps:readiness"
+
+// WithRequiredStore adds a Store that is required to serve requests. The server is only
+// ready (see Server.Ready) while the Store is reachable. The reachability is checked by
+// reading a probe key from the Store
+func WithRequiredStore(st Store) ServerOpt {
+	return func(s *Server) {
+		s.requiredStores = append(s.requiredStores, st)
+	}
+}
+
+// Healthy returns true while the server is running. It is meant for liveness probes
+func (s *Server) Healthy() bool {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	return len(s.state.ls) > 0
+}
+
+// Ready returns true if the server is able to serve requests. It is meant for readiness
+// probes. The server is not ready while it is not running, while it is draining (see
+// Server.Drain) or shutting down and while any of the required stores (see
+// WithRequiredStore) is unreachable
+func (s *Server) Ready() bool {
+	s.state.mu.Lock()
+	ready := len(s.state.ls) > 0 && !s.state.draining
+	for _, ctx := range s.state.runs {
+		if ctx.Err() != nil {
+			ready = false
+		}
+	}
+	s.state.mu.Unlock()
+	if !ready {
+		return false
+	}
+	for _, st := range s.requiredStores {
+		if _, _, err := st.Get(readinessKey); err != nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,105 @@
+package pps
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// toggleStore is a MemoryStore that can be switched to fail all reads
+type toggleStore struct {
+	*MemoryStore
+	mu   sync.Mutex
+	down bool
+}
+
+// Get satisfies the Store interface for the toggleStore
+func (ts *toggleStore) Get(k string) (string, bool, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.down {
+		return "", false, errStoreDown
+	}
+	return ts.MemoryStore.Get(k)
+}
+
+// setDown switches the toggleStore to fail or succeed
+func (ts *toggleStore) setDown(d bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.down = d
+}
+
+// TestHealthyReady tests that liveness and readiness respond to the store state, drain mode
+// and shutdown of the server
+func TestHealthyReady(t *testing.T) {
+	st := &toggleStore{MemoryStore: NewMemoryStore()}
+	s := New(WithRequiredStore(st))
+	check := func(step string, expHealthy, expReady bool) {
+		t.Helper()
+		if s.Healthy() != expHealthy || s.Ready() != expReady {
+			t.Errorf("%s: unexpected health => expected: healthy=%t ready=%t, got: healthy=%t ready=%t",
+				step, expHealthy, expReady, s.Healthy(), s.Ready())
+		}
+	}
+	check("stopped server", false, false)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create new TCP listener: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), CtxNoLog, true))
+	defer cancel()
+	ec := make(chan error, 1)
+	go func() { ec <- s.RunWithListener(ctx, Hi{}, l) }()
+	for dl := time.Now().Add(time.Second); !s.Healthy() && time.Now().Before(dl); {
+		time.Sleep(time.Millisecond * 10)
+	}
+	check("running server", true, true)
+	st.setDown(true)
+	check("unreachable store", true, false)
+	st.setDown(false)
+	check("recovered store", true, true)
+
+	// An open connection keeps the drained server running
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	time.Sleep(time.Millisecond * 50)
+	if err := s.Drain(); err != nil {
+		t.Fatalf("failed to drain server: %s", err)
+	}
+	check("draining server", true, false)
+	_ = conn.Close()
+	if err := <-ec; err != nil {
+		t.Errorf("could not run server: %s", err)
+	}
+	check("drained server", false, false)
+}
+
+// TestReadyShutdown tests that the server is not ready once its context is cancelled while
+// connections are still open
+func TestReadyShutdown(t *testing.T) {
+	s := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create new TCP listener: %s", err)
+	}
+	ec := make(chan error, 1)
+	go func() { ec <- s.RunWithListener(context.WithValue(ctx, CtxNoLog, true), Hi{}, l) }()
+	for dl := time.Now().Add(time.Second); !s.Ready() && time.Now().Before(dl); {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if !s.Ready() {
+		t.Fatalf("running server is not ready")
+	}
+	cancel()
+	if s.Ready() {
+		t.Errorf("server is still ready after shutdown started")
+	}
+	<-ec
+}
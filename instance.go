@@ -0,0 +1,218 @@
+package pps
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultInstanceTTL is the default time the per-instance state is remembered
+const DefaultInstanceTTL = time.Hour
+
+// InstanceRecipientLimiter is a Handler that limits the number of recipients of a single
+// message. It counts the RCPT queries of each message instance (see PolicySet.Instance)
+// and returns the configured Action for all RCPT queries of the instance once the
+// cumulative number of recipients exceeds MaxRecipients. This catches bulk fan-out that
+// is split over several SMTP transactions or is not covered by per-query limits
+type InstanceRecipientLimiter struct {
+	// Store holds the per-instance recipient counters. Defaults to a MemoryStore of the
+	// InstanceRecipientLimiter
+	Store Store
+
+	// MaxRecipients is the maximum number of recipients per instance
+	MaxRecipients int64
+
+	// TTL is the time the counter of an instance is remembered. Defaults to
+	// DefaultInstanceTTL
+	TTL time.Duration
+
+	// Action is the response for recipients over the limit. Defaults to RespReject with
+	// an informative text
+	Action PostfixResp
+
+	// FailureMode controls the response if the Store fails. Defaults to the store failure
+	// mode of the server (see WithStoreFailureMode)
+	FailureMode StoreFailureMode
+
+	// Next is the Handler that is called for recipients within the limit. If Next is nil,
+	// RespDunno is returned
+	Next Handler
+
+	mem defaultStore
+}
+
+// Handle satisfies the Handler interface for the InstanceRecipientLimiter
+func (l *InstanceRecipientLimiter) Handle(ps *PolicySet) PostfixResp {
+	if ps.Instance == "" || ps.ProtocolState != StateRcpt {
+		return l.next(ps)
+	}
+	ttl := l.TTL
+	if ttl == 0 {
+		ttl = DefaultInstanceTTL
+	}
+	n, err := l.mem.get(l.Store).Incr("rcptlimit:"+ps.Instance, ttl)
+	if (err != nil && !failClosed(ps, l.FailureMode)) || (err == nil && n <= l.MaxRecipients) {
+		return l.next(ps)
+	}
+	if l.Action == "" {
+		return TextResponseOpt(RespReject, "Too many recipients for this message")
+	}
+	return l.Action
+}
+
+// next hands the request to the Next handler
+func (l *InstanceRecipientLimiter) next(ps *PolicySet) PostfixResp {
+	if l.Next == nil {
+		return RespDunno
+	}
+	return l.Next.Handle(ps)
+}
+
+// InstanceMemoizer is a Handler that memoizes the decisions of the Next handler within a
+// message instance (see PolicySet.Instance). Postfix may ask the same question several
+// times for a single message. Requests with the same protocol state, client address,
+// sender and recipient within an instance are answered with the memoized decision
+// instead of invoking the Next handler again. Requests of the same instance are
+// serialized, so that concurrent queries can't produce conflicting decisions within a
+// message. Requests without an instance are always handed to the Next handler
+type InstanceMemoizer struct {
+	// Store holds the memoized decisions. Defaults to a MemoryStore of the
+	// InstanceMemoizer
+	Store Store
+
+	// TTL is the time a decision is memoized. Defaults to DefaultInstanceTTL
+	TTL time.Duration
+
+	// Next is the Handler whose decisions are memoized. If Next is nil, RespDunno is
+	// returned
+	Next Handler
+
+	locks keyedMutex
+	mem   defaultStore
+}
+
+// Handle satisfies the Handler interface for the InstanceMemoizer
+func (m *InstanceMemoizer) Handle(ps *PolicySet) PostfixResp {
+	if ps.Instance == "" {
+		return m.next(ps)
+	}
+	ca := ""
+	if ps.ClientAddress != nil {
+		ca = ps.ClientAddress.String()
+	}
+	k := strings.Join([]string{"memo", ps.Instance, strings.ToUpper(ps.ProtocolState), ca,
+		strings.ToLower(ps.Sender), strings.ToLower(ps.Recipient)}, "\x00")
+	ttl := m.TTL
+	if ttl == 0 {
+		ttl = DefaultInstanceTTL
+	}
+	return memoize(m.mem.get(m.Store), &m.locks, ps.Instance, k, ttl, func() PostfixResp { return m.next(ps) })
+}
+
+// next hands the request to the Next handler
+func (m *InstanceMemoizer) next(ps *PolicySet) PostfixResp {
+	if m.Next == nil {
+		return RespDunno
+	}
+	return m.Next.Handle(ps)
+}
+
+// DefaultReplayTTL is the default time the ReplayGuard remembers an answered request
+const DefaultReplayTTL = time.Minute * 5
+
+// ReplayGuard is a Handler that protects against the duplicate processing of a request,
+// i. e. after a retry of postfix. It remembers the decisions of the Next handler per
+// message instance, protocol state and recipient (see PolicySet.Instance) for a short
+// TTL and answers repeated requests with the remembered decision instead of invoking the
+// Next handler again. Requests without instance or recipient are always handed to the
+// Next handler. Store errors fall back to invoking the Next handler
+type ReplayGuard struct {
+	// Store holds the remembered decisions. Defaults to a MemoryStore of the ReplayGuard
+	Store Store
+
+	// TTL is the time a decision is remembered. Defaults to DefaultReplayTTL
+	TTL time.Duration
+
+	// Next is the Handler whose decisions are remembered. If Next is nil, RespDunno is
+	// returned
+	Next Handler
+
+	locks keyedMutex
+	mem   defaultStore
+}
+
+// Handle satisfies the Handler interface for the ReplayGuard
+func (g *ReplayGuard) Handle(ps *PolicySet) PostfixResp {
+	if ps.Instance == "" || ps.Recipient == "" {
+		return g.next(ps)
+	}
+	k := strings.Join([]string{"replay", ps.Instance, strings.ToUpper(ps.ProtocolState),
+		strings.ToLower(ps.Recipient)}, "\x00")
+	ttl := g.TTL
+	if ttl == 0 {
+		ttl = DefaultReplayTTL
+	}
+	return memoize(g.mem.get(g.Store), &g.locks, k, k, ttl, func() PostfixResp { return g.next(ps) })
+}
+
+// next hands the request to the Next handler
+func (g *ReplayGuard) next(ps *PolicySet) PostfixResp {
+	if g.Next == nil {
+		return RespDunno
+	}
+	return g.Next.Handle(ps)
+}
+
+// memoize returns the decision that is stored under the given key in the given Store. If
+// no decision is stored or the Store fails, the decision is made by calling next and
+// stored for the given TTL. The lookup and the decision are serialized by the mutex of
+// the given lock key
+func memoize(st Store, km *keyedMutex, lk, k string, ttl time.Duration, next func() PostfixResp) PostfixResp {
+	unlock := km.lock(lk)
+	defer unlock()
+	if v, ok, err := st.Get(k); err == nil && ok {
+		return PostfixResp(v)
+	}
+	r := next()
+	_ = st.Set(k, string(r), ttl)
+	return r
+}
+
+// keyedMutex is a set of mutexes that are identified by a key. The zero value is ready to
+// use
+type keyedMutex struct {
+	mu sync.Mutex
+	m  map[string]*refMutex
+}
+
+// refMutex is a reference-counted mutex of a keyedMutex
+type refMutex struct {
+	sync.Mutex
+	n int
+}
+
+// lock locks the mutex of the given key and returns the function to unlock it
+func (km *keyedMutex) lock(k string) func() {
+	km.mu.Lock()
+	if km.m == nil {
+		km.m = make(map[string]*refMutex)
+	}
+	rm, ok := km.m[k]
+	if !ok {
+		rm = &refMutex{}
+		km.m[k] = rm
+	}
+	rm.n++
+	km.mu.Unlock()
+
+	rm.Lock()
+	return func() {
+		rm.Unlock()
+		km.mu.Lock()
+		rm.n--
+		if rm.n == 0 {
+			delete(km.m, k)
+		}
+		km.mu.Unlock()
+	}
+}
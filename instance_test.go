@@ -0,0 +1,207 @@
+package pps
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestInstanceRecipientLimiter simulates a message with many RCPT queries crossing the
+// recipient limit of the instance
+func TestInstanceRecipientLimiter(t *testing.T) {
+	l := &InstanceRecipientLimiter{Store: NewMemoryStore(), MaxRecipients: 3, Action: RespReject}
+	for i := 1; i <= 5; i++ {
+		ps := &PolicySet{
+			ProtocolState: StateRcpt,
+			Instance:      "1234.5678910a.bcdef.0",
+			Recipient:     fmt.Sprintf("rcpt%d@example.com", i),
+		}
+		exp := RespDunno
+		if i > 3 {
+			exp = RespReject
+		}
+		if r := l.Handle(ps); r != exp {
+			t.Errorf("unexpected response for recipient %d => expected: %s, got: %s", i, exp, r)
+		}
+	}
+
+	// Other instances and other protocol states are not affected
+	if r := l.Handle(&PolicySet{ProtocolState: StateRcpt, Instance: "other"}); r != RespDunno {
+		t.Errorf("unexpected response for other instance => expected: %s, got: %s", RespDunno, r)
+	}
+	ps := &PolicySet{ProtocolState: StateData, Instance: "1234.5678910a.bcdef.0"}
+	if r := l.Handle(ps); r != RespDunno {
+		t.Errorf("unexpected response for DATA state => expected: %s, got: %s", RespDunno, r)
+	}
+}
+
+// TestInstanceRecipientLimiterExpiry tests that the per-instance state expires
+func TestInstanceRecipientLimiterExpiry(t *testing.T) {
+	l := &InstanceRecipientLimiter{Store: NewMemoryStore(), MaxRecipients: 1, TTL: time.Millisecond * 50}
+	ps := &PolicySet{ProtocolState: StateRcpt, Instance: "instance"}
+	_ = l.Handle(ps)
+	if r := l.Handle(ps); respAction(r) != string(RespReject) {
+		t.Errorf("recipient over the limit not rejected => got: %s", r)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if r := l.Handle(ps); r != RespDunno {
+		t.Errorf("instance state did not expire => expected: %s, got: %s", RespDunno, r)
+	}
+}
+
+// TestInstanceMemoizer issues duplicate queries within an instance and tests that the
+// Next handler runs once per unique request
+func TestInstanceMemoizer(t *testing.T) {
+	h := &countHandler{r: RespReject}
+	m := &InstanceMemoizer{Store: NewMemoryStore(), Next: h}
+	ps := func(instance, rcpt string) *PolicySet {
+		return &PolicySet{ProtocolState: StateRcpt, Instance: instance, Sender: "tester@example.com",
+			Recipient: rcpt}
+	}
+	testTable := []struct {
+		testName string
+		ps       *PolicySet
+		expCalls int
+	}{
+		{`First query`, ps("instance1", "rcpt1@example.com"), 1},
+		{`Duplicate query`, ps("instance1", "rcpt1@example.com"), 1},
+		{`Duplicate query with different case`, ps("instance1", "RCPT1@example.com"), 1},
+		{`Other recipient`, ps("instance1", "rcpt2@example.com"), 2},
+		{`Other instance`, ps("instance2", "rcpt1@example.com"), 3},
+		{`Without instance`, ps("", "rcpt1@example.com"), 4},
+		{`Without instance again`, ps("", "rcpt1@example.com"), 5},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			if r := m.Handle(tc.ps); r != RespReject {
+				t.Errorf("unexpected response => expected: %s, got: %s", RespReject, r)
+			}
+			if h.n != tc.expCalls {
+				t.Errorf("unexpected number of handler calls => expected: %d, got: %d", tc.expCalls, h.n)
+			}
+		})
+	}
+}
+
+// flipHandler is a Handler that alternates its decision on every call and records the
+// maximum number of concurrent calls
+type flipHandler struct {
+	calls  int64
+	active int64
+	max    int64
+}
+
+// Handle is the function required by the Handler Interface
+func (h *flipHandler) Handle(*PolicySet) PostfixResp {
+	a := atomic.AddInt64(&h.active, 1)
+	defer atomic.AddInt64(&h.active, -1)
+	for {
+		m := atomic.LoadInt64(&h.max)
+		if a <= m || atomic.CompareAndSwapInt64(&h.max, m, a) {
+			break
+		}
+	}
+	time.Sleep(time.Millisecond * 5)
+	if atomic.AddInt64(&h.calls, 1)%2 == 0 {
+		return RespReject
+	}
+	return RespOk
+}
+
+// TestInstanceMemoizerConcurrent issues concurrent queries for the same instance and tests
+// that they are serialized and answered consistently
+func TestInstanceMemoizerConcurrent(t *testing.T) {
+	h := &flipHandler{}
+	m := &InstanceMemoizer{Store: NewMemoryStore(), Next: h}
+	var wg sync.WaitGroup
+	rc := make(chan PostfixResp, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rc <- m.Handle(&PolicySet{ProtocolState: StateRcpt, Instance: "instance1",
+				Recipient: fmt.Sprintf("rcpt%d@example.com", i%2)})
+		}(i)
+	}
+	wg.Wait()
+	close(rc)
+	rs := make(map[PostfixResp]int)
+	for r := range rc {
+		rs[r]++
+	}
+	if h.max != 1 {
+		t.Errorf("queries of the same instance were not serialized => max concurrent calls: %d", h.max)
+	}
+	if h.calls != 2 || rs[RespOk] != 10 || rs[RespReject] != 10 {
+		t.Errorf("inconsistent decisions => calls: %d, responses: %v", h.calls, rs)
+	}
+	if len(m.locks.m) != 0 {
+		t.Errorf("instance locks were not released => got: %d", len(m.locks.m))
+	}
+}
+
+// TestReplayGuard issues duplicate instance+recipient requests and tests that the Next
+// handler runs once per key with a consistent answer
+func TestReplayGuard(t *testing.T) {
+	h := &flipHandler{}
+	g := &ReplayGuard{Store: NewMemoryStore(), Next: h}
+	ps := func(instance, rcpt string) *PolicySet {
+		return &PolicySet{ProtocolState: StateRcpt, Instance: instance, Recipient: rcpt}
+	}
+	testTable := []struct {
+		testName string
+		ps       *PolicySet
+		expResp  PostfixResp
+		expCalls int64
+	}{
+		{`First request`, ps("instance1", "rcpt1@example.com"), RespOk, 1},
+		{`Duplicate request`, ps("instance1", "rcpt1@example.com"), RespOk, 1},
+		{`Duplicate request with different case`, ps("instance1", "RCPT1@example.com"), RespOk, 1},
+		{`Other recipient`, ps("instance1", "rcpt2@example.com"), RespReject, 2},
+		{`Other instance`, ps("instance2", "rcpt1@example.com"), RespOk, 3},
+		{`Without instance`, ps("", "rcpt1@example.com"), RespReject, 4},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			if r := g.Handle(tc.ps); r != tc.expResp {
+				t.Errorf("unexpected response => expected: %s, got: %s", tc.expResp, r)
+			}
+			if h.calls != tc.expCalls {
+				t.Errorf("unexpected number of handler calls => expected: %d, got: %d", tc.expCalls, h.calls)
+			}
+		})
+	}
+}
+
+// TestReplayGuardProtocolState tests that the ReplayGuard doesn't answer a request in a
+// later protocol state with the decision of an earlier one
+func TestReplayGuardProtocolState(t *testing.T) {
+	h := &flipHandler{}
+	g := &ReplayGuard{Store: NewMemoryStore(), Next: h}
+	ps := &PolicySet{ProtocolState: StateRcpt, Instance: "instance1", Recipient: "rcpt1@example.com"}
+	if r := g.Handle(ps); r != RespOk {
+		t.Errorf("unexpected RCPT response => expected: %s, got: %s", RespOk, r)
+	}
+	ps.ProtocolState = StateData
+	if r := g.Handle(ps); r != RespReject || h.calls != 2 {
+		t.Errorf("RCPT decision replayed at DATA => response: %s, calls: %d", r, h.calls)
+	}
+	ps.ProtocolState = StateRcpt
+	if r := g.Handle(ps); r != RespOk || h.calls != 2 {
+		t.Errorf("RCPT decision not replayed => response: %s, calls: %d", r, h.calls)
+	}
+}
+
+// TestReplayGuardTTL tests that the ReplayGuard forgets decisions after the TTL
+func TestReplayGuardTTL(t *testing.T) {
+	h := &flipHandler{}
+	g := &ReplayGuard{Store: NewMemoryStore(), TTL: time.Millisecond * 50, Next: h}
+	ps := &PolicySet{Instance: "instance1", Recipient: "rcpt1@example.com"}
+	_ = g.Handle(ps)
+	time.Sleep(time.Millisecond * 100)
+	if r := g.Handle(ps); r != RespReject || h.calls != 2 {
+		t.Errorf("decision not expired => response: %s, calls: %d", r, h.calls)
+	}
+}
@@ -0,0 +1,82 @@
+package pps
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// WithKeepAliveIdle sets the maximum idle period of a policy connection. Postfix keeps
+// the connection to the policy server open and reuses it for subsequent requests. While
+// the connection is quiet, the server simply waits for the next request. If no request
+// has been received within the given period, the server closes the connection, so that
+// dead but still open sockets don't pile up. Postfix transparently reconnects for the next
+// request. The closed connections are counted in the IdleTimeouts of the Stats. A value of
+// 0 disables the idle limit, which is the default
+func WithKeepAliveIdle(d time.Duration) ServerOpt {
+	return func(s *Server) {
+		s.keepAliveIdle = d
+	}
+}
+
+// WithIdleTimeout sets the maximum idle period of a policy connection between two requests.
+// It is an alias of WithKeepAliveIdle
+func WithIdleTimeout(d time.Duration) ServerOpt {
+	return WithKeepAliveIdle(d)
+}
+
+// WithReadTimeout sets the maximum time to read a complete request once its first byte has
+// arrived. It should match the smtpd_policy_service_timeout of postfix, so that a client
+// that stalls in the middle of a request doesn't occupy the connection after postfix has
+// given up on it. The time to wait for the next request is controlled by the idle timeout
+// (see WithIdleTimeout). A value of 0 disables the read timeout, which is the default
+func WithReadTimeout(d time.Duration) ServerOpt {
+	return func(s *Server) {
+		s.readTimeout = d
+	}
+}
+
+// readMsg reads the next PolicySet from the connection. If an idle limit is configured,
+// the read fails once the connection has been idle for longer than the limit. If a read
+// timeout is configured, the read fails if the request is not complete within the timeout
+// after its first byte has arrived
+func (s *Server) readMsg(ctx context.Context, c *connection) *PolicySet {
+	if s.keepAliveIdle > 0 || s.readTimeout > 0 {
+		var dl time.Time
+		if s.keepAliveIdle > 0 {
+			dl = time.Now().Add(s.keepAliveIdle)
+		}
+		if err := c.conn.SetReadDeadline(dl); err != nil {
+			c.cc = true
+			c.err = err
+			return nil
+		}
+	}
+	ok, err := c.awaitRequest()
+	if !ok {
+		c.cc = true
+		return nil
+	}
+	if err != nil {
+		var ne net.Error
+		if s.keepAliveIdle > 0 && errors.As(err, &ne) && ne.Timeout() {
+			atomic.AddUint64(&s.stats.idleTimeouts, 1)
+		}
+		s.readFailed(c, err)
+		return nil
+	}
+	if s.readTimeout > 0 {
+		if err := c.conn.SetReadDeadline(time.Now().Add(s.readTimeout)); err != nil {
+			c.cc = true
+			c.err = err
+			return nil
+		}
+	}
+	ps := s.processMsg(ctx, c)
+	if ps != nil {
+		ps.readAt = time.Now()
+	}
+	return ps
+}
@@ -0,0 +1,140 @@
+package pps
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestWithKeepAliveIdle tests that a connection is reused after a quiet period shorter
+// than the idle limit and closed after a quiet period longer than the idle limit
+func TestWithKeepAliveIdle(t *testing.T) {
+	s := New(WithKeepAliveIdle(time.Millisecond * 300))
+	addr, stop := testServer(t, &s, Hi{})
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	rb := bufio.NewReader(conn)
+
+	if r := testRequest(t, conn, rb, exampleReq); r != "action=DUNNO\n" {
+		t.Errorf("unexpected server response => expected: %q, got: %q", "action=DUNNO\n", r)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if r := testRequest(t, conn, rb, exampleReq); r != "action=DUNNO\n" {
+		t.Errorf("unexpected server response after quiet period => expected: %q, got: %q",
+			"action=DUNNO\n", r)
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second * 5)); err != nil {
+		t.Fatalf("failed to set deadline on client connection: %s", err)
+	}
+	st := time.Now()
+	if _, err := rb.ReadString('\n'); err != io.EOF {
+		t.Errorf("expected idle connection to be closed by the server => got: %v", err)
+	}
+	if d := time.Since(st); d < time.Millisecond*200 {
+		t.Errorf("idle connection closed too early after %s", d)
+	}
+}
+
+// TestWithReadTimeout tests that a stalled request is aborted after the read timeout, while
+// the wait for the next request is not limited by it
+func TestWithReadTimeout(t *testing.T) {
+	s := New(WithReadTimeout(time.Millisecond * 200))
+	addr, stop := testServer(t, &s, Hi{})
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	rb := bufio.NewReader(conn)
+
+	time.Sleep(time.Millisecond * 400)
+	if r := testRequest(t, conn, rb, exampleReq); r != "action=DUNNO\n" {
+		t.Errorf("unexpected server response after quiet period => expected: %q, got: %q",
+			"action=DUNNO\n", r)
+	}
+	if _, err := conn.Write([]byte("request=smtpd_access_policy\n")); err != nil {
+		t.Fatalf("failed to send partial request to server: %s", err)
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second * 5)); err != nil {
+		t.Fatalf("failed to set deadline on client connection: %s", err)
+	}
+	st := time.Now()
+	if _, err := rb.ReadString('\n'); err != io.EOF {
+		t.Errorf("expected stalled connection to be closed by the server => got: %v", err)
+	}
+	if d := time.Since(st); d > time.Second {
+		t.Errorf("stalled connection closed too late after %s", d)
+	}
+	if n := s.Stats().ReadTimeouts; n != 1 {
+		t.Errorf("unexpected number of read timeouts => expected: 1, got: %d", n)
+	}
+}
+
+// TestWithWriteTimeout tests the configured and the default write timeout
+func TestWithWriteTimeout(t *testing.T) {
+	testTable := []struct {
+		testName string
+		opts     []ServerOpt
+		expTime  time.Duration
+	}{
+		{`Default`, nil, DefaultWriteTimeout},
+		{`Configured`, []ServerOpt{WithWriteTimeout(time.Second * 5)}, time.Second * 5},
+		{`Zero falls back to default`, []ServerOpt{WithWriteTimeout(0)}, DefaultWriteTimeout},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			s := New(tc.opts...)
+			if d := s.Config().WriteTimeout; d != tc.expTime {
+				t.Errorf("unexpected write timeout => expected: %s, got: %s", tc.expTime, d)
+			}
+		})
+	}
+}
+
+// TestWithIdleTimeout tests that idle connections are reaped and that the open connections
+// gauge follows the open connections
+func TestWithIdleTimeout(t *testing.T) {
+	s := New(WithIdleTimeout(time.Millisecond * 200))
+	addr, stop := testServer(t, &s, Hi{})
+	defer stop()
+	var rl []*bufio.Reader
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("failed to connect to running server: %s", err)
+		}
+		defer func() { _ = conn.Close() }()
+		rb := bufio.NewReader(conn)
+		if r := testRequest(t, conn, rb, exampleReq); r != "action=DUNNO\n" {
+			t.Errorf("unexpected server response => expected: %q, got: %q", "action=DUNNO\n", r)
+		}
+		rl = append(rl, rb)
+	}
+	if n := s.Stats().OpenConnections; n != 2 {
+		t.Errorf("unexpected number of open connections => expected: %d, got: %d", 2, n)
+	}
+
+	for _, rb := range rl {
+		if _, err := rb.ReadString('\n'); err != io.EOF {
+			t.Errorf("expected idle connection to be closed by the server => got: %v", err)
+		}
+	}
+	for dl := time.Now().Add(time.Second); s.Stats().OpenConnections > 0 && time.Now().Before(dl); {
+		time.Sleep(time.Millisecond * 10)
+	}
+	st := s.Stats()
+	if st.OpenConnections != 0 {
+		t.Errorf("unexpected number of open connections => expected: %d, got: %d", 0, st.OpenConnections)
+	}
+	if st.IdleTimeouts != 2 {
+		t.Errorf("unexpected number of idle timeouts => expected: %d, got: %d", 2, st.IdleTimeouts)
+	}
+}
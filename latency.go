@@ -0,0 +1,77 @@
+package pps
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the buckets of the decision latency histogram in
+// seconds
+var latencyBuckets = [...]float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// exemplar is the OpenMetrics exemplar of a histogram bucket. It links the last
+// observation of the bucket to its trace
+type exemplar struct {
+	traceID string
+	value   float64
+	time    time.Time
+}
+
+// latencyHistogram is a histogram of the decision latencies of the server. The zero value
+// is ready to use
+type latencyHistogram struct {
+	mu        sync.Mutex
+	counts    [len(latencyBuckets) + 1]uint64
+	exemplars [len(latencyBuckets) + 1]exemplar
+	sum       float64
+	count     uint64
+}
+
+// observe records the given decision latency. If the given trace id is not empty, it is
+// stored as exemplar of the bucket of the latency
+func (h *latencyHistogram) observe(d time.Duration, traceID string) {
+	v := d.Seconds()
+	i := len(latencyBuckets)
+	for bi, ub := range latencyBuckets {
+		if v <= ub {
+			i = bi
+			break
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+	if traceID != "" {
+		h.exemplars[i] = exemplar{traceID: traceID, value: v, time: time.Now()}
+	}
+}
+
+// write writes the histogram as pps_decision_latency_seconds metric to the given writer.
+// Exemplars are only part of the OpenMetrics format and are left out otherwise
+func (h *latencyHistogram) write(w io.Writer, openMetrics bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, _ = fmt.Fprint(w, "# TYPE pps_decision_latency_seconds histogram\n")
+	var c uint64
+	for i := range h.counts {
+		le := "+Inf"
+		if i < len(latencyBuckets) {
+			le = strconv.FormatFloat(latencyBuckets[i], 'g', -1, 64)
+		}
+		c += h.counts[i]
+		_, _ = fmt.Fprintf(w, "pps_decision_latency_seconds_bucket{le=%q} %d", le, c)
+		if e := h.exemplars[i]; openMetrics && e.traceID != "" {
+			_, _ = fmt.Fprintf(w, " # {trace_id=%q} %s %s", e.traceID,
+				strconv.FormatFloat(e.value, 'g', -1, 64),
+				strconv.FormatFloat(float64(e.time.UnixNano())/1e9, 'f', 3, 64))
+		}
+		_, _ = fmt.Fprint(w, "\n")
+	}
+	_, _ = fmt.Fprintf(w, "pps_decision_latency_seconds_sum %s\n", strconv.FormatFloat(h.sum, 'g', -1, 64))
+	_, _ = fmt.Fprintf(w, "pps_decision_latency_seconds_count %d\n", h.count)
+}
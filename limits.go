@@ -0,0 +1,146 @@
+package pps
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrRequestLimit is returned if a request exceeds one of the configured request limits
+// (see WithRequestLimits)
+var ErrRequestLimit = errors.New("request limit exceeded")
+
+// requestLimits holds the limits of a single policy request. A value of 0 disables the
+// corresponding limit
+type requestLimits struct {
+	line  int
+	attrs int
+	size  int
+}
+
+// WithRequestLimits limits the size of the policy requests, so that a misbehaving or
+// malicious client can't make the server consume an unbounded amount of memory by
+// streaming an endless request. maxLine is the maximum length of a single attribute line
+// in bytes, without the line terminator, maxAttrs is the maximum number of attributes of
+// a request and maxSize is the maximum size of a request in bytes. If a request exceeds
+// one of the limits, reading stops and the connection is closed with an error wrapping
+// ErrRequestLimit. A value of 0 disables the corresponding limit. The limits apply to the
+// postfix and the length-prefixed framing, but not to a custom RequestReader
+func WithRequestLimits(maxLine, maxAttrs, maxSize int) ServerOpt {
+	return func(s *Server) {
+		s.reqLimits = requestLimits{line: maxLine, attrs: maxAttrs, size: maxSize}
+	}
+}
+
+// WithRequestLimitBan bans the IP address of a client that exceeded the request limits
+// (see WithRequestLimits) for the given duration. Connections of a banned client are
+// closed right after they have been accepted
+func WithRequestLimitBan(d time.Duration) ServerOpt {
+	return func(s *Server) {
+		if d <= 0 {
+			s.bans = nil
+			return
+		}
+		s.bans = &banList{d: d, now: time.Now, m: make(map[string]time.Time)}
+	}
+}
+
+// limitExceeded counts a connection that exceeded the request limits and bans the client,
+// if configured
+func (s *Server) limitExceeded(c *connection) {
+	atomic.AddUint64(&s.stats.limitHits, 1)
+	if s.bans == nil {
+		return
+	}
+	if ip := addrIP(c.conn.RemoteAddr()); ip != nil {
+		s.bans.ban(ip)
+	}
+}
+
+// lineBound returns the maximum length of the next line of a request, of which size bytes
+// have already been read. The size limit caps the line length, so that a single endless
+// line is not buffered completely before the size limit is checked
+func lineBound(lim requestLimits, size int) int {
+	if lim.size <= 0 {
+		return lim.line
+	}
+	rem := lim.size - size
+	if rem < 1 {
+		// Any further line exceeds the size limit, but a bound of 0 would disable the limit
+		rem = 1
+	}
+	if lim.line <= 0 || rem < lim.line {
+		return rem
+	}
+	return lim.line
+}
+
+// readLine reads a single line from the given reader. If the line, without its line
+// terminator, is longer than max bytes, an error wrapping ErrRequestLimit is returned
+// without reading the rest of the line. A max of 0 disables the limit
+func readLine(r *bufio.Reader, max int) (string, error) {
+	if max <= 0 {
+		return r.ReadString('\n')
+	}
+	var b []byte
+	for {
+		f, err := r.ReadSlice('\n')
+		// The line terminator is not counted towards the limit
+		if len(b)+len(f) > max+2 {
+			return "", fmt.Errorf("%w: line exceeds %d bytes", ErrRequestLimit, max)
+		}
+		b = append(b, f...)
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		l := string(b)
+		if len(strings.TrimRight(l, "\r\n")) > max {
+			return "", fmt.Errorf("%w: line exceeds %d bytes", ErrRequestLimit, max)
+		}
+		return l, err
+	}
+}
+
+// banList holds the IP addresses of the clients that have been banned for exceeding the
+// request limits
+type banList struct {
+	d   time.Duration
+	now func() time.Time
+
+	mu sync.Mutex
+	m  map[string]time.Time
+}
+
+// ban bans the given IP address. Expired bans are removed along the way
+func (b *banList) ban(ip net.IP) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	for k, exp := range b.m {
+		if !now.Before(exp) {
+			delete(b.m, k)
+		}
+	}
+	b.m[ip.String()] = now.Add(b.d)
+}
+
+// banned returns true if the given IP address is currently banned
+func (b *banList) banned(ip net.IP) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	k := ip.String()
+	exp, ok := b.m[k]
+	if !ok {
+		return false
+	}
+	if !b.now().Before(exp) {
+		delete(b.m, k)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,159 @@
+package pps
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestParsePolicySetLimits tests the request limits of the parser
+func TestParsePolicySetLimits(t *testing.T) {
+	long := "sender=" + strings.Repeat("a", 100) + "@example.com\n"
+	tt := []struct {
+		name string
+		req  string
+		lim  requestLimits
+		fail bool
+	}{
+		{"no limits", exampleReq, requestLimits{}, false},
+		{"within limits", exampleReq, requestLimits{line: 128, attrs: 32, size: 4096}, false},
+		{"line too long", long + "\n", requestLimits{line: 64}, true},
+		{"line at the limit", long + "\n", requestLimits{line: len(long) - 1}, false},
+		{"line at the limit with CRLF", strings.TrimSuffix(long, "\n") + "\r\n\r\n",
+			requestLimits{line: len(long) - 1}, false},
+		{"too many attributes", exampleReq, requestLimits{attrs: 3}, true},
+		{"request too large", exampleReq, requestLimits{size: 64}, true},
+		{"endless line", strings.Repeat("a", 4096), requestLimits{line: 128}, true},
+		{"endless line with only a size limit", strings.Repeat("a", 4096), requestLimits{size: 1024}, true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			r := bufio.NewReaderSize(strings.NewReader(tc.req), 16)
+			_, err := parsePolicySet(r, tc.lim, nil)
+			if tc.fail && !errors.Is(err, ErrRequestLimit) {
+				t.Errorf("parsing was supposed to fail with ErrRequestLimit, got: %v", err)
+			}
+			if !tc.fail && err != nil {
+				t.Errorf("parsing failed: %s", err)
+			}
+		})
+	}
+}
+
+// TestReadLengthPrefixedLimits tests that the request limits apply to length-prefixed
+// frames
+func TestReadLengthPrefixedLimits(t *testing.T) {
+	b := make([]byte, 4, 4+len(exampleReq))
+	binary.BigEndian.PutUint32(b, uint32(len(exampleReq)))
+	b = append(b, exampleReq...)
+	if _, err := readLengthPrefixed(bufio.NewReader(bytes.NewReader(b)), requestLimits{size: 64}, nil); !errors.Is(err, ErrRequestLimit) {
+		t.Errorf("oversized frame was supposed to fail with ErrRequestLimit, got: %v", err)
+	}
+	if _, err := readLengthPrefixed(bufio.NewReader(bytes.NewReader(b)), requestLimits{attrs: 3}, nil); !errors.Is(err, ErrRequestLimit) {
+		t.Errorf("frame with too many attributes was supposed to fail with ErrRequestLimit, got: %v", err)
+	}
+	if _, err := readLengthPrefixed(bufio.NewReader(bytes.NewReader(b)), requestLimits{}, nil); err != nil {
+		t.Errorf("reading frame failed: %s", err)
+	}
+}
+
+// TestWithRequestLimits tests that a connection is closed once a request exceeds the
+// request limits and that the client is banned afterwards
+func TestWithRequestLimits(t *testing.T) {
+	b := &syncBuffer{}
+	s := New(WithLogOutput(b), WithRequestLimits(0, 5, 0), WithRequestLimitBan(time.Minute))
+	addr, stop := testServer(t, &s, Hi{r: RespOk})
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if err := conn.SetDeadline(time.Now().Add(time.Second * 5)); err != nil {
+		t.Fatalf("failed to set deadline on client connection: %s", err)
+	}
+	if _, err := conn.Write([]byte(exampleReq)); err != nil {
+		t.Fatalf("failed to send request to server: %s", err)
+	}
+	if _, err := bufio.NewReader(conn).ReadString('\n'); !errors.Is(err, io.EOF) {
+		t.Errorf("connection was supposed to be closed, got: %v", err)
+	}
+	if n := s.Stats().RequestLimitHits; n != 1 {
+		t.Errorf("unexpected number of request limit hits => expected: %d, got: %d", 1, n)
+	}
+
+	bc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to server: %s", err)
+	}
+	defer func() { _ = bc.Close() }()
+	if err := bc.SetDeadline(time.Now().Add(time.Second * 5)); err != nil {
+		t.Fatalf("failed to set deadline on client connection: %s", err)
+	}
+	if _, err := bufio.NewReader(bc).ReadString('\n'); err == nil {
+		t.Errorf("connection of banned client was supposed to be closed")
+	}
+	if !strings.Contains(b.String(), "banned for exceeding the request limits") {
+		t.Errorf("rejection of banned client not logged, got: %s", b.String())
+	}
+}
+
+// TestBanList tests that bans expire after the ban duration
+func TestBanList(t *testing.T) {
+	now := time.Now()
+	bl := &banList{d: time.Minute, now: func() time.Time { return now }, m: make(map[string]time.Time)}
+	ip := net.ParseIP("192.0.2.1")
+	if bl.banned(ip) {
+		t.Errorf("IP was not supposed to be banned")
+	}
+	bl.ban(ip)
+	if !bl.banned(ip) {
+		t.Errorf("IP was supposed to be banned")
+	}
+	if bl.banned(net.ParseIP("192.0.2.2")) {
+		t.Errorf("other IP was not supposed to be banned")
+	}
+	now = now.Add(time.Minute)
+	if bl.banned(ip) {
+		t.Errorf("ban was supposed to be expired")
+	}
+	if len(bl.m) != 0 {
+		t.Errorf("expired ban was supposed to be removed, got: %d entries", len(bl.m))
+	}
+}
+
+// TestParsePolicySetSizeLimitBoundsLine tests that the size limit stops reading a single
+// endless line instead of buffering it completely
+func TestParsePolicySetSizeLimitBoundsLine(t *testing.T) {
+	cr := &countingReader{r: strings.NewReader(strings.Repeat("a", 1<<20))}
+	_, err := parsePolicySet(bufio.NewReaderSize(cr, 64), requestLimits{size: 1024}, nil)
+	if !errors.Is(err, ErrRequestLimit) {
+		t.Fatalf("parsing was supposed to fail with ErrRequestLimit, got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "request exceeds 1024 bytes") {
+		t.Errorf("unexpected error => expected the size limit, got: %s", err)
+	}
+	if cr.n > 2048 {
+		t.Errorf("parser read %d bytes of the endless line, expected at most %d", cr.n, 2048)
+	}
+}
+
+// countingReader is an io.Reader that counts the bytes read from the underlying reader
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+// Read satisfies the io.Reader interface for the countingReader
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
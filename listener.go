@@ -0,0 +1,301 @@
+package pps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrNotRunning is returned if an operation requires a running server
+var ErrNotRunning = errors.New("server is not running")
+
+// filer is implemented by listeners that provide access to their underlying file, like
+// *net.TCPListener and *net.UnixListener
+type filer interface {
+	File() (*os.File, error)
+}
+
+// deadliner is implemented by listeners that support accept deadlines, like
+// *net.TCPListener and *net.UnixListener
+type deadliner interface {
+	SetDeadline(time.Time) error
+}
+
+// WithManualClose disables the automatic closing of the listener when the context of
+// RunWithListener is cancelled. The caller owns the listener and is responsible for
+// closing it, which avoids double-close races when the listener is handed over to
+// another process or supervisor. On cancellation, a pending Accept is interrupted with
+// an accept deadline instead, which is reset before RunWithListener returns. For
+// listeners that do not support deadlines, RunWithListener only returns after the caller
+// has closed the listener. Listeners created by Run are still closed by Run
+func WithManualClose() ServerOpt {
+	return func(s *Server) {
+		s.manualClose = true
+	}
+}
+
+// WithListenAddrs sets the list of addresses that Run listens on, overriding the listening
+// address and port of the server. Addresses are given in the "host:port" form, or as
+// socket path for the "unix" network (see WithNetwork)
+func WithListenAddrs(addrs ...string) ServerOpt {
+	return func(s *Server) {
+		s.listenAddrs = addrs
+	}
+}
+
+// WithListeners sets the listeners that Run serves concurrently, i. e. a TCP listener for
+// remote smtpd instances and a unix socket listener for local ones. The listeners share the
+// Handler and the lifecycle of the server and take precedence over the listening addresses
+// of the server. Like the listener of RunWithListener, they are closed once the context of
+// Run is cancelled, unless they are managed by the caller (see WithManualClose)
+func WithListeners(ls ...net.Listener) ServerOpt {
+	return func(s *Server) {
+		s.listeners = ls
+	}
+}
+
+// WithPartialBind controls the behaviour of Run if one of several listening addresses (see
+// WithListenAddrs) fails to bind. If allow is true, a warning is logged and the server runs
+// with the listeners that could be bound, which helps on hosts with an inconsistent IPv6
+// availability. Otherwise, which is the default, Run fails. Run always fails if none of
+// the addresses could be bound
+func WithPartialBind(allow bool) ServerOpt {
+	return func(s *Server) {
+		s.partialBind = allow
+	}
+}
+
+// bind creates the listeners for the listening addresses of the server. If systemd socket
+// activation is enabled (see WithSystemdSocket), the passed sockets are used instead
+func (s *Server) bind(ctx context.Context) ([]net.Listener, error) {
+	if s.systemd {
+		ls, err := systemdListeners()
+		if err != nil || len(ls) > 0 {
+			return ls, err
+		}
+	}
+	al := s.listenAddrs
+	if len(al) == 0 {
+		a := net.JoinHostPort(s.la, s.lp)
+		if s.ln == "unix" {
+			a = s.la
+		}
+		al = []string{a}
+	}
+	ls := make([]net.Listener, 0, len(al))
+	var lerr error
+	for _, a := range al {
+		lg, err := s.listen(a)
+		if err != nil {
+			if !s.partialBind {
+				for _, l := range ls {
+					_ = l.Close()
+				}
+				return nil, err
+			}
+			s.logf(ctx, LogLevelWarn, "failed to bind listener, continuing without it: %s", err)
+			lerr = err
+			continue
+		}
+		ls = append(ls, lg...)
+	}
+	if len(ls) == 0 {
+		return nil, lerr
+	}
+	return ls, nil
+}
+
+// stopListener stops the given listener from accepting new connections. Unless the
+// listener is managed by the caller (see WithManualClose), the listener is closed
+func (s *Server) stopListener(ctx context.Context, l net.Listener) {
+	if !s.manualClose {
+		if err := l.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			s.logf(ctx, LogLevelError, "failed to close listener: %s", err)
+		}
+		return
+	}
+	if d, ok := l.(deadliner); ok {
+		if err := d.SetDeadline(time.Now()); err != nil {
+			s.logf(ctx, LogLevelError, "failed to interrupt listener: %s", err)
+		}
+	}
+}
+
+// resetDeadline removes the accept deadline from the given listener
+func resetDeadline(l net.Listener) {
+	if d, ok := l.(deadliner); ok {
+		_ = d.SetDeadline(time.Time{})
+	}
+}
+
+// state holds the runtime state of a Server
+type state struct {
+	mu       sync.Mutex
+	ls       []net.Listener
+	runs     []context.Context
+	conns    map[*connection]struct{}
+	draining bool
+	quitting bool
+}
+
+// addConn registers the given connection as open connection of the server. If the server
+// is shutting down, the connection stops reading requests right away
+func (st *state) addConn(c *connection) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.conns == nil {
+		st.conns = make(map[*connection]struct{})
+	}
+	st.conns[c] = struct{}{}
+	if st.quitting {
+		c.stopReading()
+	}
+}
+
+// removeConn removes the given connection from the open connections of the server
+func (st *state) removeConn(c *connection) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.conns, c)
+}
+
+// openConns returns the number of open connections of the server
+func (st *state) openConns() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return len(st.conns)
+}
+
+// addRun registers the context of a running serve loop of the server
+func (st *state) addRun(ctx context.Context) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.runs = append(st.runs, ctx)
+}
+
+// removeRun removes the given context from the running serve loops of the server
+func (st *state) removeRun(ctx context.Context) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for i, r := range st.runs {
+		if r == ctx {
+			st.runs = append(st.runs[:i], st.runs[i+1:]...)
+			return
+		}
+	}
+}
+
+// addListener registers the given listener as active listener of the server
+func (st *state) addListener(l net.Listener) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if len(st.ls) == 0 {
+		st.draining = false
+		st.quitting = false
+	}
+	st.ls = append(st.ls, l)
+}
+
+// isDraining returns true if the server is in drain mode (see Server.Drain)
+func (st *state) isDraining() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.draining
+}
+
+// removeListener removes the given listener from the active listeners of the server
+func (st *state) removeListener(l net.Listener) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for i, al := range st.ls {
+		if al == l {
+			st.ls = append(st.ls[:i], st.ls[i+1:]...)
+			return
+		}
+	}
+}
+
+// Drain puts the server into drain mode. The listeners of the server stop accepting new
+// connections, while the already established connections keep being served until they are
+// closed by the client or the context of the server is cancelled. Run and
+// RunWithListener return once all connections have been closed. This allows "cordon then
+// drain" deployments behind a load balancer. Listeners that are managed by the caller (see
+// WithManualClose) are not closed. If the server is not running, ErrNotRunning is returned
+func (s *Server) Drain() error {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	if len(s.state.ls) == 0 {
+		return ErrNotRunning
+	}
+	s.state.draining = true
+	for _, l := range s.state.ls {
+		s.stopListener(context.Background(), l)
+	}
+	return nil
+}
+
+// shutdownPollInterval is the interval in which Shutdown checks for open connections
+const shutdownPollInterval = time.Millisecond * 10
+
+// Shutdown gracefully shuts down the server. Like Drain, it stops the listeners of the
+// server from accepting new connections. In addition, the server stops reading new requests
+// from the established connections: idle connections are closed right away, while requests
+// whose first byte has already arrived are read, processed and answered before their
+// connection is closed. Shutdown returns once all connections have been closed. If the given
+// context expires before, the remaining connections are closed forcibly and the error of
+// the context is returned. If the server is not running, ErrNotRunning is returned
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.state.mu.Lock()
+	if len(s.state.ls) == 0 && len(s.state.conns) == 0 {
+		s.state.mu.Unlock()
+		return ErrNotRunning
+	}
+	s.state.draining = true
+	s.state.quitting = true
+	for _, l := range s.state.ls {
+		s.stopListener(context.Background(), l)
+	}
+	for c := range s.state.conns {
+		c.stopReading()
+	}
+	s.state.mu.Unlock()
+
+	t := time.NewTicker(shutdownPollInterval)
+	defer t.Stop()
+	for {
+		if s.state.openConns() == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			s.state.mu.Lock()
+			for c := range s.state.conns {
+				_ = c.conn.Close()
+			}
+			s.state.mu.Unlock()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// ListenerFile returns a duplicate of the file descriptor of the active listener of the
+// server. It allows external supervisors to hand the listening socket over to a new
+// process for zero-downtime restarts (see net.FileListener). Closing the returned file
+// does not affect the listener of the server and vice versa
+func (s *Server) ListenerFile() (*os.File, error) {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	if len(s.state.ls) == 0 {
+		return nil, ErrNotRunning
+	}
+	f, ok := s.state.ls[0].(filer)
+	if !ok {
+		return nil, fmt.Errorf("listener of type %T does not support file access", s.state.ls[0])
+	}
+	return f.File()
+}
@@ -0,0 +1,295 @@
+package pps
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestListenerFile retrieves the listener file of a running server and reconstructs a
+// listener from it
+func TestListenerFile(t *testing.T) {
+	s := New()
+	if _, err := s.ListenerFile(); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("unexpected error for stopped server => expected: %s, got: %v", ErrNotRunning, err)
+	}
+
+	addr, stop := testServer(t, &s, Hi{})
+	f, err := s.ListenerFile()
+	for dl := time.Now().Add(time.Second); errors.Is(err, ErrNotRunning) && time.Now().Before(dl); {
+		time.Sleep(time.Millisecond * 10)
+		f, err = s.ListenerFile()
+	}
+	if err != nil {
+		stop()
+		t.Fatalf("failed to retrieve listener file: %s", err)
+	}
+	defer func() { _ = f.Close() }()
+	stop()
+
+	l, err := net.FileListener(f)
+	if err != nil {
+		t.Fatalf("failed to reconstruct listener from file: %s", err)
+	}
+	defer func() { _ = l.Close() }()
+	if l.Addr().String() != addr {
+		t.Errorf("unexpected address of reconstructed listener => expected: %s, got: %s", addr, l.Addr())
+	}
+	cc := make(chan error, 1)
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			_ = c.Close()
+		}
+		cc <- err
+	}()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to reconstructed listener: %s", err)
+	}
+	_ = conn.Close()
+	if err := <-cc; err != nil {
+		t.Errorf("failed to accept connection on reconstructed listener: %s", err)
+	}
+}
+
+// TestWithManualClose tests that the listener stays open after the context has been
+// cancelled if WithManualClose is set and is closed otherwise
+func TestWithManualClose(t *testing.T) {
+	testTable := []struct {
+		testName string
+		opts     []ServerOpt
+		expOpen  bool
+	}{
+		{`Automatic close`, nil, false},
+		{`Manual close`, []ServerOpt{WithManualClose()}, true},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			s := New(tc.opts...)
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("failed to create new TCP listener: %s", err)
+			}
+			defer func() { _ = l.Close() }()
+			ctx, cancel := context.WithCancel(context.WithValue(context.Background(), CtxNoLog, true))
+			ec := make(chan error, 1)
+			go func() { ec <- s.RunWithListener(ctx, Hi{}, l) }()
+			time.Sleep(time.Millisecond * 50)
+			cancel()
+			select {
+			case err := <-ec:
+				if err != nil {
+					t.Errorf("could not run server: %s", err)
+				}
+			case <-time.After(time.Second * 2):
+				t.Fatalf("server did not stop after context cancel")
+			}
+
+			cc := make(chan error, 1)
+			go func() {
+				c, err := l.Accept()
+				if err == nil {
+					_ = c.Close()
+				}
+				cc <- err
+			}()
+			if tc.expOpen {
+				conn, err := net.Dial("tcp", l.Addr().String())
+				if err != nil {
+					t.Fatalf("failed to connect to listener: %s", err)
+				}
+				_ = conn.Close()
+			}
+			select {
+			case err := <-cc:
+				if open := err == nil; open != tc.expOpen {
+					t.Errorf("unexpected listener state => expected open: %t, got error: %v", tc.expOpen, err)
+				}
+			case <-time.After(time.Second * 2):
+				t.Errorf("accept on listener did not return")
+			}
+		})
+	}
+}
+
+// TestDrain tests that a drained server rejects new connections while an established
+// connection is still served
+func TestDrain(t *testing.T) {
+	s := New()
+	if err := s.Drain(); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("unexpected error for stopped server => expected: %s, got: %v", ErrNotRunning, err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create new TCP listener: %s", err)
+	}
+	addr := l.Addr().String()
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), CtxNoLog, true))
+	defer cancel()
+	ec := make(chan error, 1)
+	go func() { ec <- s.RunWithListener(ctx, Hi{}, l) }()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	rb := bufio.NewReader(conn)
+	if r := testRequest(t, conn, rb, exampleReq); r != "action=DUNNO\n" {
+		t.Errorf("unexpected server response => expected: %q, got: %q", "action=DUNNO\n", r)
+	}
+	if err := s.Drain(); err != nil {
+		t.Fatalf("failed to drain server: %s", err)
+	}
+	if nc, err := net.Dial("tcp", addr); err == nil {
+		_ = nc.Close()
+		t.Errorf("new connection to drained server was supposed to fail")
+	}
+	if r := testRequest(t, conn, rb, exampleReq); r != "action=DUNNO\n" {
+		t.Errorf("unexpected server response after drain => expected: %q, got: %q", "action=DUNNO\n", r)
+	}
+
+	select {
+	case <-ec:
+		t.Fatalf("server stopped while a connection was still open")
+	case <-time.After(time.Millisecond * 100):
+	}
+	_ = conn.Close()
+	select {
+	case err := <-ec:
+		if err != nil {
+			t.Errorf("could not run server: %s", err)
+		}
+	case <-time.After(time.Second * 2):
+		t.Errorf("drained server did not stop after the last connection was closed")
+	}
+}
+
+// TestWithPartialBind tests Run with one valid and one invalid listening address under both
+// partial bind policies
+func TestWithPartialBind(t *testing.T) {
+	testTable := []struct {
+		testName string
+		allow    bool
+	}{
+		{`Partial bind allowed`, true},
+		{`Partial bind not allowed`, false},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			va := net.JoinHostPort("127.0.0.1", freePort(t))
+			b := &syncBuffer{}
+			s := New(WithLogOutput(b), WithListenAddrs(va, "192.0.2.1:0"), WithPartialBind(tc.allow))
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ec := make(chan error, 1)
+			go func() { ec <- s.Run(ctx, Hi{}) }()
+
+			if !tc.allow {
+				select {
+				case err := <-ec:
+					if err == nil {
+						t.Errorf("Run with an invalid address was supposed to fail")
+					}
+				case <-time.After(time.Second):
+					t.Errorf("Run did not fail with an invalid address")
+				}
+				return
+			}
+
+			var conn net.Conn
+			var err error
+			for dl := time.Now().Add(time.Second); time.Now().Before(dl); time.Sleep(time.Millisecond * 10) {
+				if conn, err = net.Dial("tcp", va); err == nil {
+					break
+				}
+			}
+			if err != nil {
+				t.Fatalf("failed to connect to running server: %s", err)
+			}
+			if r := testRequest(t, conn, bufio.NewReader(conn), exampleReq); r != "action=DUNNO\n" {
+				t.Errorf("unexpected server response => expected: %q, got: %q", "action=DUNNO\n", r)
+			}
+			_ = conn.Close()
+			cancel()
+			if err := <-ec; err != nil {
+				t.Errorf("could not run server: %s", err)
+			}
+			if !strings.Contains(b.String(), "failed to bind listener") {
+				t.Errorf("bind failure not logged => got: %s", b.String())
+			}
+		})
+	}
+}
+
+// TestWithListenAddrs tests that Run serves all configured listening addresses
+func TestWithListenAddrs(t *testing.T) {
+	al := []string{net.JoinHostPort("127.0.0.1", freePort(t)), net.JoinHostPort("127.0.0.1", freePort(t))}
+	s := New(WithListenAddrs(al...))
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), CtxNoLog, true))
+	ec := make(chan error, 1)
+	go func() { ec <- s.Run(ctx, Hi{r: RespOk}) }()
+	for _, a := range al {
+		var conn net.Conn
+		var err error
+		for dl := time.Now().Add(time.Second); time.Now().Before(dl); time.Sleep(time.Millisecond * 10) {
+			if conn, err = net.Dial("tcp", a); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			t.Errorf("failed to connect to %s: %s", a, err)
+			continue
+		}
+		if r := testRequest(t, conn, bufio.NewReader(conn), exampleReq); r != "action=OK\n" {
+			t.Errorf("unexpected server response on %s => expected: %q, got: %q", a, "action=OK\n", r)
+		}
+		_ = conn.Close()
+	}
+	cancel()
+	if err := <-ec; err != nil {
+		t.Errorf("could not run server: %s", err)
+	}
+}
+
+// TestWithListeners tests that Run serves a TCP and a unix socket listener concurrently and
+// closes both on shutdown
+func TestWithListeners(t *testing.T) {
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create new TCP listener: %s", err)
+	}
+	ul, err := net.Listen("unix", filepath.Join(t.TempDir(), "policy.sock"))
+	if err != nil {
+		t.Fatalf("failed to create new unix socket listener: %s", err)
+	}
+	s := New(WithListeners(tl, ul))
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), CtxNoLog, true))
+	ec := make(chan error, 1)
+	go func() { ec <- s.Run(ctx, Hi{r: RespOk}) }()
+	for _, l := range []net.Listener{tl, ul} {
+		conn, err := net.Dial(l.Addr().Network(), l.Addr().String())
+		if err != nil {
+			t.Errorf("failed to connect to %s: %s", l.Addr(), err)
+			continue
+		}
+		if r := testRequest(t, conn, bufio.NewReader(conn), exampleReq); r != "action=OK\n" {
+			t.Errorf("unexpected server response on %s => expected: %q, got: %q", l.Addr(), "action=OK\n", r)
+		}
+		_ = conn.Close()
+	}
+	cancel()
+	if err := <-ec; err != nil {
+		t.Errorf("could not run server: %s", err)
+	}
+	for _, l := range []net.Listener{tl, ul} {
+		if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+			t.Errorf("listener %s was supposed to be closed, got: %v", l.Addr(), err)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package pps
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// LogLevel represents the severity of a log message of the policy server
+type LogLevel string
+
+// Supported log levels
+const (
+	LogLevelError LogLevel = "ERROR"
+	LogLevelWarn  LogLevel = "WARN"
+	LogLevelInfo  LogLevel = "INFO"
+	LogLevelDebug LogLevel = "DEBUG"
+)
+
+// DefaultLogLevel is the default minimum level of the log messages of the policy server
+const DefaultLogLevel = LogLevelInfo
+
+// severity returns the numeric severity of the LogLevel. Unknown levels are treated like
+// LogLevelInfo
+func (lv LogLevel) severity() int {
+	switch lv {
+	case LogLevelError:
+		return 3
+	case LogLevelWarn:
+		return 2
+	case LogLevelDebug:
+		return 0
+	default:
+		return 1
+	}
+}
+
+// WithLogLevel sets the minimum level of the messages that are logged. Messages below the
+// level are discarded. The default is DefaultLogLevel, which discards the debug messages,
+// like the ones about clients that disconnected early
+func WithLogLevel(lv LogLevel) ServerOpt {
+	return func(s *Server) {
+		s.logLevel = lv
+	}
+}
+
+// defaultLogRedaction is the list of attributes that are redacted in the request log
+var defaultLogRedaction = []string{"sasl_username", "sasl_sender"}
+
+// WithLogOutput overrides the default log output (STDERR) of the policy server
+func WithLogOutput(w io.Writer) ServerOpt {
+	return func(s *Server) {
+		s.lo = w
+	}
+}
+
+// WithLogRequests enables the logging of the parsed PolicySet of each request at info
+// level before the request is handed to the Handler. Only a selection of non-sensitive
+// attributes is logged and the SASL username and sender are redacted by default (see
+// WithLogRedaction)
+func WithLogRequests() ServerOpt {
+	return func(s *Server) {
+		s.logReqs = true
+	}
+}
+
+// WithLogRedaction overrides the list of attributes that are redacted in the request log
+// (see WithLogRequests). Calling it without attributes disables the redaction
+func WithLogRedaction(attrs ...string) ServerOpt {
+	return func(s *Server) {
+		s.logRedact = attrs
+	}
+}
+
+// WithAddressRedactor sets a function that rewrites client addresses before they are
+// logged or sent as AuditEvent. It allows operators to mask or hash the addresses for
+// privacy compliance while keeping log lines correlatable
+func WithAddressRedactor(f func(net.IP) string) ServerOpt {
+	return func(s *Server) {
+		s.addrRedactor = f
+	}
+}
+
+// logAddr returns the log representation of the given client IP
+func (s *Server) logAddr(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	if s.addrRedactor != nil {
+		return s.addrRedactor(ip)
+	}
+	return ip.String()
+}
+
+// logRemoteAddr returns the log representation of the given remote address of a
+// connection
+func (s *Server) logRemoteAddr(a net.Addr) string {
+	if s.addrRedactor == nil || a == nil {
+		return fmt.Sprint(a)
+	}
+	ip := addrIP(a)
+	if ip == nil {
+		return a.String()
+	}
+	ra := s.addrRedactor(ip)
+	if _, p, err := net.SplitHostPort(a.String()); err == nil {
+		return net.JoinHostPort(ra, p)
+	}
+	return ra
+}
+
+// logErr returns the log representation of the given error of the given connection.
+// Network errors include the local and remote address of the connection, so both are
+// redacted the same way as in logRemoteAddr
+func (s *Server) logErr(err error, c net.Conn) string {
+	le := err.Error()
+	if s.addrRedactor == nil {
+		return le
+	}
+	for _, a := range []net.Addr{c.RemoteAddr(), c.LocalAddr()} {
+		if a != nil {
+			le = strings.ReplaceAll(le, a.String(), s.logRemoteAddr(a))
+		}
+	}
+	return le
+}
+
+// logRequest logs the given PolicySet at info level if request logging is enabled
+func (s *Server) logRequest(ctx context.Context, ps *PolicySet) {
+	if !s.logReqs {
+		return
+	}
+	ca := s.logAddr(ps.ClientAddress)
+	al := [][2]string{
+		{"request", ps.Request},
+		{"protocol_state", ps.ProtocolState},
+		{"client_address", ca},
+		{"client_name", ps.ClientName},
+		{"helo_name", ps.HELOName},
+		{"sender", ps.Sender},
+		{"recipient", ps.Recipient},
+		{"recipient_count", strconv.FormatUint(ps.RecipientCount, 10)},
+		{"queue_id", ps.QueueId},
+		{"instance", ps.Instance},
+		{"sasl_method", ps.SASLMethod},
+		{"sasl_username", ps.SASLUsername},
+		{"sasl_sender", ps.SASLSender},
+		{"sasl_sender_matches_envelope", strconv.FormatBool(ps.SASLSenderMatchesEnvelope())},
+	}
+	sl := make([]string, 0, len(al))
+	for _, a := range al {
+		v := a[1]
+		if v != "" && s.redacted(a[0]) {
+			v = redacted
+		}
+		sl = append(sl, fmt.Sprintf("%s=%s", a[0], v))
+	}
+	s.logf(ctx, LogLevelInfo, "request %s: %s", ps.RequestID(), strings.Join(sl, " "))
+}
+
+// redacted returns true if the given attribute is redacted in the request log
+func (s *Server) redacted(a string) bool {
+	for _, r := range s.logRedact {
+		if r == a {
+			return true
+		}
+	}
+	return false
+}
+
+// logf writes a log message with the given level to the log output of the server,
+// unless the level is below the minimum log level of the server (see WithLogLevel) or
+// logging has been disabled via the CtxNoLog context value
+func (s *Server) logf(ctx context.Context, lv LogLevel, f string, v ...interface{}) {
+	if lv.severity() < s.logLevel.severity() {
+		return
+	}
+	if nl, ok := ctx.Value(CtxNoLog).(bool); ok && nl {
+		return
+	}
+	var w io.Writer = os.Stderr
+	if s.lo != nil {
+		w = s.lo
+	}
+	l := log.New(w, fmt.Sprintf("[Server] %s: ", lv), log.Lmsgprefix|log.LstdFlags|log.Lshortfile)
+	_ = l.Output(2, fmt.Sprintf(f, v...))
+}
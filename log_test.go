@@ -0,0 +1,211 @@
+package pps
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer that is safe for concurrent use
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+// Write satisfies the io.Writer interface for the syncBuffer
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+// String returns the content of the syncBuffer
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+// TestWithLogOutput tests the New() method with the WithLogOutput() option
+func TestWithLogOutput(t *testing.T) {
+	b := &syncBuffer{}
+	s := New(WithLogOutput(b))
+	s.logf(context.Background(), LogLevelWarn, "test message %d", 1)
+	if !strings.Contains(b.String(), "[Server] WARN: test message 1") {
+		t.Errorf("log message not written to configured output => got: %s", b.String())
+	}
+}
+
+// TestWithLogLevel tests that messages below the minimum log level are discarded
+func TestWithLogLevel(t *testing.T) {
+	testTable := []struct {
+		testName string
+		opts     []ServerOpt
+		level    LogLevel
+		logged   bool
+	}{
+		{`Debug message with default level`, nil, LogLevelDebug, false},
+		{`Info message with default level`, nil, LogLevelInfo, true},
+		{`Debug message with debug level`, []ServerOpt{WithLogLevel(LogLevelDebug)}, LogLevelDebug, true},
+		{`Warn message with error level`, []ServerOpt{WithLogLevel(LogLevelError)}, LogLevelWarn, false},
+		{`Error message with error level`, []ServerOpt{WithLogLevel(LogLevelError)}, LogLevelError, true},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			b := &syncBuffer{}
+			s := New(append(tc.opts, WithLogOutput(b))...)
+			s.logf(context.Background(), tc.level, "test message")
+			if logged := b.String() != ""; logged != tc.logged {
+				t.Errorf("unexpected logging of %s message => expected: %t, got: %t", tc.level, tc.logged, logged)
+			}
+		})
+	}
+}
+
+// TestLogfNoLog tests that no log message is written if CtxNoLog is set
+func TestLogfNoLog(t *testing.T) {
+	b := &syncBuffer{}
+	s := New(WithLogOutput(b))
+	ctx := context.WithValue(context.Background(), CtxNoLog, true)
+	s.logf(ctx, LogLevelError, "test message")
+	if b.String() != "" {
+		t.Errorf("log message written despite CtxNoLog => got: %s", b.String())
+	}
+}
+
+// TestWithLogRequests tests that requests are logged when enabled and that the SASL
+// username is redacted
+func TestWithLogRequests(t *testing.T) {
+	req := strings.Replace(exampleReq, "sasl_username=\n", "sasl_username=secretuser\n", 1)
+	testTable := []struct {
+		testName  string
+		opts      []ServerOpt
+		logged    bool
+		redaction bool
+	}{
+		{`Request logging enabled`, []ServerOpt{WithLogRequests()}, true, true},
+		{`Request logging disabled`, nil, false, false},
+		{`Request logging without redaction`, []ServerOpt{WithLogRequests(), WithLogRedaction()}, true, false},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			b := &syncBuffer{}
+			s := New(append(tc.opts, WithLogOutput(b))...)
+			addr, stop := testServer(t, &s, Hi{})
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("failed to connect to running server: %s", err)
+			}
+			_ = testRequest(t, conn, bufio.NewReader(conn), req)
+			_ = conn.Close()
+			stop()
+
+			l := b.String()
+			if logged := strings.Contains(l, "[Server] INFO: request "); logged != tc.logged {
+				t.Errorf("unexpected request logging => expected: %t, got: %t (log: %s)", tc.logged, logged, l)
+			}
+			if !tc.logged {
+				return
+			}
+			if !strings.Contains(l, "sasl_sender_matches_envelope=false") {
+				t.Errorf("request log does not contain the SASL envelope match => got: %s", l)
+			}
+			if !strings.Contains(l, "sender=tester@example.com recipient=tester@localhost.tld") {
+				t.Errorf("request log does not contain sender and recipient => got: %s", l)
+			}
+			if r := strings.Contains(l, "sasl_username="+redacted); r != tc.redaction {
+				t.Errorf("unexpected SASL username redaction => expected: %t, got: %t (log: %s)",
+					tc.redaction, r, l)
+			}
+			if strings.Contains(l, "secretuser") == tc.redaction {
+				t.Errorf("unexpected SASL username in request log => got: %s", l)
+			}
+		})
+	}
+}
+
+// TestWithAddressRedactor tests that the client addresses in the request log, the
+// connection logs and the audit events are redacted
+func TestWithAddressRedactor(t *testing.T) {
+	rf := func(ip net.IP) string {
+		s := ip.String()
+		return s[:strings.LastIndexByte(s, '.')] + ".x"
+	}
+	b := &syncBuffer{}
+	ch := make(chan AuditEvent, 1)
+	s := New(WithLogOutput(b), WithLogRequests(), WithAuditChannel(ch), WithAddressRedactor(rf))
+	addr, stop := testServer(t, &s, Hi{})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	_ = testRequest(t, conn, bufio.NewReader(conn), exampleReq)
+	_ = conn.Close()
+	stop()
+
+	l := b.String()
+	if !strings.Contains(l, "client_address=127.0.0.x ") || strings.Contains(l, "127.0.0.1") {
+		t.Errorf("client address not redacted in request log => got: %s", l)
+	}
+	ev := <-ch
+	if ev.Client != nil || ev.ClientRedacted != "127.0.0.x" {
+		t.Errorf("client address not redacted in audit event => got: %s/%s", ev.Client, ev.ClientRedacted)
+	}
+
+	_, pn, _ := net.ParseCIDR("192.0.2.0/24")
+	b = &syncBuffer{}
+	s = New(WithLogOutput(b), WithAllowedPeers(pn), WithAddressRedactor(rf))
+	addr, stop = testServer(t, &s, Hi{})
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	_, _ = conn.Read(make([]byte, 1))
+	_ = conn.Close()
+	stop()
+	if l := b.String(); !strings.Contains(l, "peer 127.0.0.x:") || strings.Contains(l, "127.0.0.1") {
+		t.Errorf("remote address not redacted in connection log => got: %s", l)
+	}
+}
+
+// TestWithAddressRedactorErrors tests that the connection addresses included in logged
+// network errors are redacted
+func TestWithAddressRedactorErrors(t *testing.T) {
+	rf := func(ip net.IP) string {
+		s := ip.String()
+		return s[:strings.LastIndexByte(s, '.')] + ".x"
+	}
+	b := &syncBuffer{}
+	s := New(WithLogOutput(b), WithLogLevel(LogLevelDebug), WithKeepAliveIdle(time.Millisecond*100),
+		WithAddressRedactor(rf))
+	addr, stop := testServer(t, &s, Hi{})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		stop()
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	time.Sleep(time.Millisecond * 300)
+	_ = conn.Close()
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		stop()
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	_ = conn.(*net.TCPConn).SetLinger(0)
+	_ = conn.Close()
+	time.Sleep(time.Millisecond * 100)
+	stop()
+
+	l := b.String()
+	if !strings.Contains(l, "timed out: ") || !strings.Contains(l, "127.0.0.x:") {
+		t.Errorf("expected redacted read timeout in log => got: %s", l)
+	}
+	if strings.Contains(l, "127.0.0.1") {
+		t.Errorf("address not redacted in error log => got: %s", l)
+	}
+}
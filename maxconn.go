@@ -0,0 +1,115 @@
+package pps
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// overflowReadTimeout is the time a connection over the connection limit has to send its
+// request before it is closed without a response
+const overflowReadTimeout = time.Second * 5
+
+// maxOverflowConns is the maximum number of connections over the connection limit that
+// are answered with the overflow response at the same time. Further connections are closed
+// right away, so that a connection storm can't pile up goroutines
+const maxOverflowConns = 16
+
+// WithMaxConnections limits the number of concurrently served connections to n. Once the
+// limit is reached, further connections are handled according to overflow: if overflow is
+// empty, the connections are accepted, but queued until a connection slot is free. Otherwise
+// the request of the connection is answered with the overflow response (i. e.
+// RespDeferIfPermit) and the connection is closed. If too many connections are answered
+// at the same time, further connections are closed right away. Queued connections are
+// closed by Server.Shutdown. The number of connections that hit the limit is reported in
+// the Stats. A value of 0 or below disables the limit, which is the default
+func WithMaxConnections(n int, overflow PostfixResp) ServerOpt {
+	return func(s *Server) {
+		if n <= 0 {
+			s.connSem = nil
+			s.overflowSem = nil
+			return
+		}
+		s.connSem = make(chan struct{}, n)
+		s.connOverflow = overflow
+		s.overflowSem = make(chan struct{}, maxOverflowConns)
+	}
+}
+
+// acquireConn reserves a connection slot for the given connection. It returns false if the
+// connection is not served, because it is over the limit and has been handed to the
+// overflow handling or because the context has been cancelled or the server has been shut
+// down while it was queued. The connection has to be registered with the server state, so
+// that Server.Shutdown can wake it up while it is queued
+func (s *Server) acquireConn(ctx context.Context, c *connection, wg *sync.WaitGroup) bool {
+	if s.connSem == nil {
+		return true
+	}
+	select {
+	case s.connSem <- struct{}{}:
+		return true
+	default:
+	}
+	atomic.AddUint64(&s.stats.connLimitHits, 1)
+	if s.connOverflow != "" {
+		atomic.AddUint64(&s.stats.connRejected, 1)
+		select {
+		case s.overflowSem <- struct{}{}:
+		default:
+			_ = c.conn.Close()
+			return false
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-s.overflowSem }()
+			s.rejectConn(ctx, c)
+		}()
+		return false
+	}
+
+	c.mu.Lock()
+	if c.quit {
+		c.mu.Unlock()
+		_ = c.conn.Close()
+		return false
+	}
+	c.wake = make(chan struct{})
+	wake := c.wake
+	c.mu.Unlock()
+	select {
+	case s.connSem <- struct{}{}:
+		c.mu.Lock()
+		c.wake = nil
+		c.mu.Unlock()
+		return true
+	case <-wake:
+	case <-ctx.Done():
+	}
+	_ = c.conn.Close()
+	return false
+}
+
+// releaseConn frees the connection slot of a served connection
+func (s *Server) releaseConn() {
+	if s.connSem != nil {
+		<-s.connSem
+	}
+}
+
+// rejectConn answers the request of a connection over the connection limit with the
+// overflow response and closes the connection
+func (s *Server) rejectConn(ctx context.Context, c *connection) {
+	defer func() { _ = c.conn.Close() }()
+	s.logf(ctx, LogLevelWarn, "connection limit of %d reached, answering connection from %s with %s",
+		cap(s.connSem), s.logRemoteAddr(c.conn.RemoteAddr()), respAction(s.connOverflow))
+	if err := c.conn.SetReadDeadline(time.Now().Add(overflowReadTimeout)); err != nil {
+		return
+	}
+	ps, err := s.readRequest(c)
+	if err != nil {
+		return
+	}
+	_ = s.writeResp(c, ps, Response{Action: s.connOverflow, Close: true, fallback: true})
+}
@@ -0,0 +1,174 @@
+package pps
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestWithMaxConnections tests that connections over the connection limit are queued or
+// answered with the overflow response
+func TestWithMaxConnections(t *testing.T) {
+	testTable := []struct {
+		testName    string
+		overflow    PostfixResp
+		expResp     string
+		expRejected uint64
+	}{
+		{`Overflow response`, RespDeferIfPermit, "action=DEFER_IF_PERMIT\n", 1},
+		{`Queue`, "", "action=OK\n", 0},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			s := New(WithMaxConnections(1, tc.overflow))
+			addr, stop := testServer(t, &s, Hi{r: RespOk})
+			defer stop()
+
+			first, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("failed to connect to running server: %s", err)
+			}
+			defer func() { _ = first.Close() }()
+			if r := testRequest(t, first, bufio.NewReader(first), exampleReq); r != "action=OK\n" {
+				t.Errorf("unexpected response within limit => expected: %q, got: %q", "action=OK\n", r)
+			}
+
+			second, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("failed to connect to running server: %s", err)
+			}
+			defer func() { _ = second.Close() }()
+			if _, err := second.Write([]byte(exampleReq)); err != nil {
+				t.Fatalf("failed to send request to server: %s", err)
+			}
+			rb := bufio.NewReader(second)
+			if tc.overflow == "" {
+				_ = second.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+				if r, err := rb.ReadString('\n'); err == nil {
+					t.Errorf("queued connection was not supposed to be served, got: %q", r)
+				}
+				_ = first.Close()
+			}
+			_ = second.SetReadDeadline(time.Now().Add(time.Second * 5))
+			if r, _ := rb.ReadString('\n'); r != tc.expResp {
+				t.Errorf("unexpected response over limit => expected: %q, got: %q", tc.expResp, r)
+			}
+
+			st := s.Stats()
+			if st.ConnectionLimitHits != 1 {
+				t.Errorf("unexpected connection limit hits => expected: 1, got: %d", st.ConnectionLimitHits)
+			}
+			if st.ConnectionsRejected != tc.expRejected {
+				t.Errorf("unexpected rejected connections => expected: %d, got: %d", tc.expRejected,
+					st.ConnectionsRejected)
+			}
+		})
+	}
+}
+
+// TestWithMaxConnectionsOverflowBound tests that connections over the connection limit
+// are closed right away once the maximum number of overflow connections is answered
+func TestWithMaxConnectionsOverflowBound(t *testing.T) {
+	s := New(WithMaxConnections(1, RespDeferIfPermit))
+	addr, stop := testServer(t, &s, Hi{r: RespOk})
+	defer stop()
+
+	var conns []net.Conn
+	defer func() {
+		for _, c := range conns {
+			_ = c.Close()
+		}
+	}()
+	for i := 0; i <= maxOverflowConns; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("failed to connect to running server: %s", err)
+		}
+		conns = append(conns, c)
+	}
+	for dl := time.Now().Add(time.Second); s.Stats().ConnectionsRejected < maxOverflowConns &&
+		time.Now().Before(dl); {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	conns = append(conns, c)
+	_ = c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Errorf("connection over the overflow limit was not closed => got: %v", err)
+	}
+	if n := s.Stats().ConnectionsRejected; n != maxOverflowConns+1 {
+		t.Errorf("unexpected rejected connections => expected: %d, got: %d", maxOverflowConns+1, n)
+	}
+}
+
+// TestWithMaxConnectionsShutdown tests that queued connections are registered as open
+// connections and closed right away by Shutdown
+func TestWithMaxConnectionsShutdown(t *testing.T) {
+	s := New(WithMaxConnections(1, ""))
+	h := &drainHandler{started: make(chan struct{}, 1), release: make(chan struct{})}
+	addr, stop := testServer(t, &s, h)
+	defer stop()
+	var once sync.Once
+	release := func() { once.Do(func() { close(h.release) }) }
+	defer release()
+
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = first.Close() }()
+	if _, err := first.Write([]byte(exampleReq)); err != nil {
+		t.Fatalf("failed to send request to server: %s", err)
+	}
+	select {
+	case <-h.started:
+	case <-time.After(time.Second * 5):
+		t.Fatal("handler has not been called")
+	}
+	queued, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = queued.Close() }()
+	for dl := time.Now().Add(time.Second); s.state.openConns() < 2 && time.Now().Before(dl); {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if n := s.state.openConns(); n != 2 {
+		t.Fatalf("queued connection is not registered => expected 2 open connections, got: %d", n)
+	}
+
+	ec := make(chan error, 1)
+	go func() { ec <- s.Shutdown(context.Background()) }()
+	_ = queued.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := queued.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Errorf("queued connection was not closed by Shutdown => got: %v", err)
+	}
+	select {
+	case err := <-ec:
+		t.Errorf("Shutdown returned while a request was in progress => got: %v", err)
+	default:
+	}
+	release()
+	select {
+	case err := <-ec:
+		if err != nil {
+			t.Errorf("Shutdown failed: %s", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Error("Shutdown did not return after the request was answered")
+	}
+}
+
+// isTimeout returns true if the given error is a network timeout
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,78 @@
+package pps
+
+import (
+	"sync"
+)
+
+// WithOnOverload sets a callback that is fired when the number of concurrently active
+// handlers reaches the high-water mark and again when it recovers to the low-water mark
+// (see WithHandlerWatermarks). The callback receives the current number of active handlers
+// and the high-water mark as limit, so a recovery can be identified by current being below
+// limit. The callback is called synchronously on the request path and must not block
+func WithOnOverload(f func(current, limit int)) ServerOpt {
+	return func(s *Server) {
+		s.onOverload = f
+	}
+}
+
+// WithHandlerWatermarks sets the high- and low-water marks of concurrently active handlers
+// for the overload callback (see WithOnOverload). If low is not below high, it is set to
+// high-1
+func WithHandlerWatermarks(high, low int) ServerOpt {
+	return func(s *Server) {
+		if low >= high {
+			low = high - 1
+		}
+		s.hwm, s.lwm = high, low
+	}
+}
+
+// overloadMon tracks the number of concurrently active handlers and fires the overload
+// callback when it crosses the watermarks
+type overloadMon struct {
+	mu   sync.Mutex
+	cur  int
+	over bool
+	high int
+	low  int
+	f    func(current, limit int)
+}
+
+// newOverloadMon returns a new overloadMon. If no callback or high-water mark is given,
+// nil is returned
+func newOverloadMon(high, low int, f func(current, limit int)) *overloadMon {
+	if f == nil || high <= 0 {
+		return nil
+	}
+	return &overloadMon{high: high, low: low, f: f}
+}
+
+// inc increases the number of active handlers and fires the callback if the high-water
+// mark is reached
+func (o *overloadMon) inc() {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.cur++
+	if !o.over && o.cur >= o.high {
+		o.over = true
+		o.f(o.cur, o.high)
+	}
+}
+
+// dec decreases the number of active handlers and fires the callback if the number
+// recovered to the low-water mark
+func (o *overloadMon) dec() {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.cur--
+	if o.over && o.cur <= o.low {
+		o.over = false
+		o.f(o.cur, o.high)
+	}
+}
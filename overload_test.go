@@ -0,0 +1,84 @@
+package pps
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockHandler is a Handler that blocks until its release channel is closed
+type blockHandler struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+// Handle is the function required by the Handler Interface
+func (h blockHandler) Handle(*PolicySet) PostfixResp {
+	h.started <- struct{}{}
+	<-h.release
+	return RespDunno
+}
+
+// TestWithOnOverload drives the handler concurrency past the high-water mark and makes sure
+// that the overload callback fires on overload and on recovery
+func TestWithOnOverload(t *testing.T) {
+	var mu sync.Mutex
+	var events [][2]int
+	cb := func(current, limit int) {
+		mu.Lock()
+		events = append(events, [2]int{current, limit})
+		mu.Unlock()
+	}
+	s := New(WithOnOverload(cb), WithHandlerWatermarks(3, 1))
+	h := blockHandler{started: make(chan struct{}, 3), release: make(chan struct{})}
+	addr, stop := testServer(t, &s, h)
+	defer stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("failed to connect to running server: %s", err)
+		}
+		defer func() { _ = conn.Close() }()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = testRequest(t, conn, bufio.NewReader(conn), exampleReq)
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-h.started:
+		case <-time.After(time.Second * 2):
+			t.Fatalf("handler %d did not start", i)
+		}
+	}
+	if a := s.Stats().ActiveHandlers; a != 3 {
+		t.Errorf("unexpected number of active handlers => expected: 3, got: %d", a)
+	}
+	close(h.release)
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	exp := [][2]int{{3, 3}, {1, 3}}
+	if !reflect.DeepEqual(events, exp) {
+		t.Errorf("unexpected overload events => expected: %v, got: %v", exp, events)
+	}
+}
+
+// TestWithHandlerWatermarks tests the WithHandlerWatermarks() option with an invalid
+// low-water mark and without callback
+func TestWithHandlerWatermarks(t *testing.T) {
+	s := New(WithHandlerWatermarks(5, 10))
+	if s.hwm != 5 || s.lwm != 4 {
+		t.Errorf("unexpected watermarks => expected: 5/4, got: %d/%d", s.hwm, s.lwm)
+	}
+	if s.ovl != nil {
+		t.Errorf("overload monitor created without callback")
+	}
+}
@@ -0,0 +1,50 @@
+package pps
+
+import (
+	"context"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// WithPanicResponse sets the action that is sent if the Handler panics while handling a
+// request. The panic is recovered and logged with its stack trace, the connection and the
+// server keep running and the request is answered with the given action, which is flagged
+// as fallback in the AuditEvent. The default is RespDeferIfPermit, so that the mail is
+// deferred instead of being accepted unchecked
+func WithPanicResponse(r PostfixResp) ServerOpt {
+	return func(s *Server) {
+		s.panicResp = r
+	}
+}
+
+// callHandler hands the PolicySet to the Handler and recovers from a panic of the Handler
+// with the panic response (see WithPanicResponse). If the Handler implements the
+// ResponseHandler interface, HandleResponse is used
+func (s *Server) callHandler(ps *PolicySet, h Handler) (resp Response) {
+	defer s.recoverHandler(ps, &resp)
+	if rh, ok := h.(ResponseHandler); ok {
+		return rh.HandleResponse(ps)
+	}
+	return Response{Action: h.Handle(ps)}
+}
+
+// enrichAndHandle runs the enrichers on the PolicySet and hands it to the Handler. A panic
+// while the request is enriched or prepared for the Handler is recovered with the panic
+// response as well, so that it can't take down the server
+func (s *Server) enrichAndHandle(ctx context.Context, ps *PolicySet, h Handler) (resp Response) {
+	defer s.recoverHandler(ps, &resp)
+	s.enrich(ctx, ps)
+	return s.handle(ps, h)
+}
+
+// recoverHandler recovers from a panic during the handling of the given PolicySet, logs
+// it with its stack trace and replaces the response with the panic response. It must be
+// deferred directly
+func (s *Server) recoverHandler(ps *PolicySet, resp *Response) {
+	if r := recover(); r != nil {
+		atomic.AddUint64(&s.stats.handlerPanics, 1)
+		s.logf(ps.Context(), LogLevelError, "request %s: handler panicked: %v\n%s", ps.RequestID(), r,
+			debug.Stack())
+		*resp = Response{Action: s.panicResp, fallback: true}
+	}
+}
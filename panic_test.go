@@ -0,0 +1,89 @@
+package pps
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// panicHandler is a Handler that panics on every request
+type panicHandler struct{}
+
+// Handle satisfies the Handler interface for the panicHandler
+func (panicHandler) Handle(*PolicySet) PostfixResp {
+	panic("handler failure")
+}
+
+// TestWithPanicResponse tests that a panicking Handler is answered with the panic response
+// and that the connection keeps serving requests
+func TestWithPanicResponse(t *testing.T) {
+	tt := []struct {
+		name string
+		opts []ServerOpt
+		want string
+	}{
+		{"default response", nil, "action=DEFER_IF_PERMIT\n"},
+		{"custom response", []ServerOpt{WithPanicResponse(RespDunno)}, "action=DUNNO\n"},
+		{"with response budget", []ServerOpt{WithResponseBudget(time.Second)}, "action=DEFER_IF_PERMIT\n"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &syncBuffer{}
+			s := New(append(tc.opts, WithLogOutput(b))...)
+			addr, stop := testServer(t, &s, panicHandler{})
+			defer stop()
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("failed to connect to server: %s", err)
+			}
+			defer func() { _ = conn.Close() }()
+			rb := bufio.NewReader(conn)
+			for i := 0; i < 2; i++ {
+				if r := testRequest(t, conn, rb, exampleReq); r != tc.want {
+					t.Errorf("unexpected server response => expected: %q, got: %q", tc.want, r)
+				}
+			}
+			if n := s.Stats().HandlerPanics; n != 2 {
+				t.Errorf("unexpected number of handler panics => expected: %d, got: %d", 2, n)
+			}
+			if !strings.Contains(b.String(), "handler panicked: handler failure") ||
+				!strings.Contains(b.String(), "goroutine") {
+				t.Errorf("handler panic with stack trace not logged, got: %s", b.String())
+			}
+		})
+	}
+}
+
+// TestServer_callHandler tests that the panic response is flagged as fallback
+func TestServer_callHandler(t *testing.T) {
+	s := New(WithLogOutput(&syncBuffer{}))
+	r := s.callHandler(&PolicySet{}, panicHandler{})
+	if r.Action != RespDeferIfPermit || !r.fallback {
+		t.Errorf("unexpected panic response => expected: %s (fallback), got: %s (fallback: %t)",
+			RespDeferIfPermit, r.Action, r.fallback)
+	}
+	if r := s.callHandler(&PolicySet{}, Hi{r: RespOk}); r.Action != RespOk || r.fallback {
+		t.Errorf("unexpected handler response => expected: %s, got: %s (fallback: %t)", RespOk, r.Action,
+			r.fallback)
+	}
+}
+
+// TestServer_enrichAndHandle tests that the enriched PolicySet is handed to the Handler
+// and that a panic while handling it is answered with the panic response
+func TestServer_enrichAndHandle(t *testing.T) {
+	s := New(WithLogOutput(&syncBuffer{}), WithEnricher(func(_ context.Context, ps *PolicySet) {
+		ps.Sender = "enriched@example.com"
+	}))
+	ps := &PolicySet{}
+	r := s.enrichAndHandle(context.Background(), ps, panicHandler{})
+	if r.Action != RespDeferIfPermit || !r.fallback {
+		t.Errorf("unexpected panic response => expected: %s (fallback), got: %s (fallback: %t)",
+			RespDeferIfPermit, r.Action, r.fallback)
+	}
+	if ps.Sender != "enriched@example.com" {
+		t.Errorf("PolicySet was not enriched => got sender: %q", ps.Sender)
+	}
+}
@@ -0,0 +1,103 @@
+package pps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ErrInvalidAllowlist is returned by Run and Serve if the client allowlist of the server
+// contains an invalid network (see WithAllowedClients)
+var ErrInvalidAllowlist = errors.New("invalid client allowlist")
+
+// WithAllowedPeers restricts the policy connections to peers within the given networks.
+// Connections from other peers are closed right after they have been accepted. Networks
+// can be parsed from strings with ParseCIDRs
+func WithAllowedPeers(nets ...*net.IPNet) ServerOpt {
+	return func(s *Server) {
+		for _, n := range nets {
+			if n != nil {
+				s.peers = append(s.peers, n)
+			}
+		}
+	}
+}
+
+// WithAllowedClients restricts the policy connections to clients within the given CIDR
+// notated networks or IP addresses, like "127.0.0.1" or "192.0.2.0/24". Connections from
+// other clients are dropped right after they have been accepted, before any request is
+// parsed. It is the string based variant of WithAllowedPeers and can be combined with it.
+// If one of the networks can't be parsed, Run and Serve fail with an error wrapping
+// ErrInvalidAllowlist instead of serving with an incomplete allowlist
+func WithAllowedClients(cidrs ...string) ServerOpt {
+	return func(s *Server) {
+		nl, err := ParseCIDRs(cidrs...)
+		if err != nil {
+			s.peersErr = fmt.Errorf("%w: %s", ErrInvalidAllowlist, err)
+			return
+		}
+		s.peers = append(s.peers, nl...)
+	}
+}
+
+// WithoutOpenBindWarning suppresses the warning that is logged when the server listens
+// on all interfaces without a peer allowlist (see WithAllowedPeers)
+func WithoutOpenBindWarning() ServerOpt {
+	return func(s *Server) {
+		s.noBindWarn = true
+	}
+}
+
+// peerAllowed returns true if no peer allowlist is configured or if the given address
+// is part of one of the allowed networks
+func (s *Server) peerAllowed(a net.Addr) bool {
+	if len(s.peers) == 0 {
+		return true
+	}
+	ip := addrIP(a)
+	if ip == nil {
+		return false
+	}
+	for _, n := range s.peers {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// warnOpenBind logs a warning if the given listener is bound to all interfaces and no
+// peer allowlist has been configured, since an open policy port can be abused to probe
+// the policy of the mail system
+func (s *Server) warnOpenBind(ctx context.Context, l net.Listener) {
+	if s.noBindWarn || len(s.peers) > 0 {
+		return
+	}
+	ip := addrIP(l.Addr())
+	if ip == nil || !ip.IsUnspecified() {
+		return
+	}
+	s.logf(ctx, LogLevelWarn, "listening on all interfaces (%s) without a peer allowlist. Consider "+
+		"restricting access with WithAllowedPeers or binding to a specific address", l.Addr())
+}
+
+// addrIP returns the IP address of the given net.Addr or nil if it has none
+func addrIP(a net.Addr) net.IP {
+	switch v := a.(type) {
+	case *net.TCPAddr:
+		return v.IP
+	case *net.UDPAddr:
+		return v.IP
+	case *net.IPAddr:
+		return v.IP
+	}
+	if a == nil {
+		return nil
+	}
+	h, _, err := net.SplitHostPort(a.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(h)
+}
@@ -0,0 +1,143 @@
+package pps
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestOpenBindWarning tests that a warning is logged when the server listens on all
+// interfaces without a peer allowlist
+func TestOpenBindWarning(t *testing.T) {
+	lh, err := ParseCIDRs("127.0.0.1")
+	if err != nil {
+		t.Fatalf("failed to parse networks: %s", err)
+	}
+	testTable := []struct {
+		testName string
+		addr     string
+		opts     []ServerOpt
+		expWarn  bool
+	}{
+		{`Default bind without allowlist`, DefaultAddr, nil, true},
+		{`Default bind with allowlist`, DefaultAddr, []ServerOpt{WithAllowedPeers(lh...)}, false},
+		{`Default bind with suppressed warning`, DefaultAddr, []ServerOpt{WithoutOpenBindWarning()}, false},
+		{`Loopback bind without allowlist`, "127.0.0.1", nil, false},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			b := &syncBuffer{}
+			s := New(append(tc.opts, WithLogOutput(b))...)
+			l, err := net.Listen("tcp", net.JoinHostPort(tc.addr, "0"))
+			if err != nil {
+				t.Fatalf("failed to create new TCP listener: %s", err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			if err := s.RunWithListener(ctx, Hi{}, l); err != nil {
+				t.Errorf("could not run server: %s", err)
+			}
+			if w := strings.Contains(b.String(), "without a peer allowlist"); w != tc.expWarn {
+				t.Errorf("unexpected open bind warning => expected: %t, got: %t, log: %s", tc.expWarn, w,
+					b.String())
+			}
+		})
+	}
+}
+
+// TestWithAllowedPeers tests that connections from peers outside of the allowlist are
+// closed without a response
+func TestWithAllowedPeers(t *testing.T) {
+	testTable := []struct {
+		testName string
+		cidr     string
+		allowed  bool
+	}{
+		{`Peer in allowlist`, "127.0.0.0/8", true},
+		{`Peer not in allowlist`, "192.0.2.0/24", false},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			nl, err := ParseCIDRs(tc.cidr)
+			if err != nil {
+				t.Fatalf("failed to parse networks: %s", err)
+			}
+			s := New(WithAllowedPeers(nl...))
+			addr, stop := testServer(t, &s, Hi{})
+			defer stop()
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("failed to connect to running server: %s", err)
+			}
+			defer func() { _ = conn.Close() }()
+			rb := bufio.NewReader(conn)
+			if !tc.allowed {
+				_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
+				_, _ = conn.Write([]byte(exampleReq))
+				if _, err := rb.ReadString('\n'); err != io.EOF && !isConnReset(err) {
+					t.Errorf("expected connection to be closed => got: %v", err)
+				}
+				return
+			}
+			if r := testRequest(t, conn, rb, exampleReq); r != "action=DUNNO\n" {
+				t.Errorf("unexpected server response => expected: %q, got: %q", "action=DUNNO\n", r)
+			}
+		})
+	}
+}
+
+// isConnReset returns true if the given error is caused by a reset connection
+func isConnReset(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "connection reset")
+}
+
+// TestWithAllowedClients tests that connections of clients outside the allowlist are
+// dropped and that an invalid allowlist is refused
+func TestWithAllowedClients(t *testing.T) {
+	testTable := []struct {
+		testName string
+		cidrs    []string
+		allowed  bool
+	}{
+		{`Client address in allowlist`, []string{"192.0.2.1", "127.0.0.1"}, true},
+		{`Client network in allowlist`, []string{"127.0.0.0/8"}, true},
+		{`Client not in allowlist`, []string{"192.0.2.0/24", "2001:db8::/32"}, false},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			s := New(WithAllowedClients(tc.cidrs...))
+			addr, stop := testServer(t, &s, Hi{})
+			defer stop()
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("failed to connect to running server: %s", err)
+			}
+			defer func() { _ = conn.Close() }()
+			rb := bufio.NewReader(conn)
+			if !tc.allowed {
+				_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
+				_, _ = conn.Write([]byte(exampleReq))
+				if _, err := rb.ReadString('\n'); err != io.EOF && !isConnReset(err) {
+					t.Errorf("expected connection to be closed => got: %v", err)
+				}
+				return
+			}
+			if r := testRequest(t, conn, rb, exampleReq); r != "action=DUNNO\n" {
+				t.Errorf("unexpected server response => expected: %q, got: %q", "action=DUNNO\n", r)
+			}
+		})
+	}
+
+	s := New(WithAllowedClients("127.0.0.0/8", "not-a-network"))
+	if err := s.Run(context.Background(), Hi{}); !errors.Is(err, ErrInvalidAllowlist) {
+		t.Errorf("Run was supposed to fail with ErrInvalidAllowlist, got: %v", err)
+	}
+	if err := s.Serve(context.Background(), newPipeListener(), Hi{}); !errors.Is(err, ErrInvalidAllowlist) {
+		t.Errorf("Serve was supposed to fail with ErrInvalidAllowlist, got: %v", err)
+	}
+}
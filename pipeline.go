@@ -0,0 +1,76 @@
+package pps
+
+import (
+	"context"
+)
+
+// WithPipelining enables the concurrent processing of pipelined requests on a single
+// connection. Up to n requests that have been read from a connection are handed to the
+// Handler concurrently, while the responses are still written in request order. A value
+// of 1 or below disables pipelining, which is the default
+func WithPipelining(n int) ServerOpt {
+	return func(s *Server) {
+		s.pipeline = n
+	}
+}
+
+// pipelineResult is the result of a pipelined request
+type pipelineResult struct {
+	ps   *PolicySet
+	resp Response
+}
+
+// servePipelined processes the requests of the connection concurrently and writes the
+// responses in request order
+func (s *Server) servePipelined(ctx context.Context, c *connection, connId string) error {
+	// The queue holds one result channel per request in the order the requests have been
+	// read. Its capacity limits the number of concurrently processed requests
+	q := make(chan chan pipelineResult, s.pipeline)
+	wec := make(chan error, 1)
+	go func() {
+		var werr error
+		closed := false
+		for rc := range q {
+			r := <-rc
+			if closed {
+				c.end()
+				continue
+			}
+			err := s.writeResp(c, r.ps, r.resp)
+			if err != nil && werr == nil {
+				werr = err
+				c.werr = true
+			}
+			if err != nil || r.ps.closeConn || r.resp.Close {
+				// Closing the connection stops the reader as well
+				closed = true
+				_ = c.conn.Close()
+			}
+			c.end()
+		}
+		wec <- werr
+	}()
+
+	for !c.cc {
+		ps := s.readMsg(ctx, c)
+		if ps == nil {
+			continue
+		}
+		ps.PPSConnId = connId
+		c.seq++
+		ps.PPSRequestSeq = c.seq
+		if !c.begin() {
+			break
+		}
+		rc := make(chan pipelineResult, 1)
+		q <- rc
+		go func() {
+			rc <- pipelineResult{ps: ps, resp: s.runRequest(ctx, c, ps)}
+		}()
+	}
+	close(q)
+	if werr := <-wec; werr != nil && c.err == nil {
+		c.err = werr
+	}
+	return c.err
+}
@@ -0,0 +1,76 @@
+package pps
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestWithPipelining pipelines several requests with varying handler latencies and makes
+// sure that the responses come back in request order
+func TestWithPipelining(t *testing.T) {
+	numReqs := 4
+	h := HandlerFunc(func(ps *PolicySet) PostfixResp {
+		var n int
+		_, _ = fmt.Sscanf(ps.Recipient, "rcpt%d@example.com", &n)
+		time.Sleep(time.Millisecond * time.Duration(50*(numReqs-n)))
+		return TextResponseOpt(RespOk, ps.Recipient)
+	})
+	s := New(WithPipelining(numReqs))
+	addr, stop := testServer(t, &s, h)
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	var req strings.Builder
+	for i := 0; i < numReqs; i++ {
+		req.WriteString(strings.Replace(exampleReq, "recipient=tester@localhost.tld",
+			fmt.Sprintf("recipient=rcpt%d@example.com", i), 1))
+	}
+	st := time.Now()
+	if _, err := conn.Write([]byte(req.String())); err != nil {
+		t.Fatalf("failed to send requests to server: %s", err)
+	}
+	rb := bufio.NewReader(conn)
+	for i := 0; i < numReqs; i++ {
+		resp := testRequest(t, conn, rb, "")
+		if exresp := fmt.Sprintf("action=OK rcpt%d@example.com\n", i); resp != exresp {
+			t.Errorf("unexpected server response => expected: %s, got: %s", exresp, resp)
+		}
+	}
+
+	// Serially processed, the requests would take 500ms
+	if el := time.Since(st); el > time.Millisecond*400 {
+		t.Errorf("pipelined requests have not been processed concurrently => took: %s", el)
+	}
+}
+
+// TestWithPipeliningClose tests that a pipelined connection is closed after a handler
+// requested it
+func TestWithPipeliningClose(t *testing.T) {
+	h := HandlerFunc(func(ps *PolicySet) PostfixResp {
+		ps.CloseAfterResponse()
+		return RespOk
+	})
+	s := New(WithPipelining(2))
+	addr, stop := testServer(t, &s, h)
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	rb := bufio.NewReader(conn)
+	if resp := testRequest(t, conn, rb, exampleReq); resp != "action=OK\n" {
+		t.Errorf("unexpected server response => expected: action=OK, got: %s", resp)
+	}
+	if _, err := rb.ReadByte(); err == nil {
+		t.Errorf("connection not closed after response")
+	}
+}
@@ -0,0 +1,322 @@
+package pps
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// NormalizedHELOName returns the HELO name of the PolicySet in normalized form. See
+// NormalizeName for details
+func (ps *PolicySet) NormalizedHELOName() string {
+	return NormalizeName(ps.HELOName)
+}
+
+// NormalizedClientName returns the client name of the PolicySet in normalized form. See
+// NormalizeName for details
+func (ps *PolicySet) NormalizedClientName() string {
+	return NormalizeName(ps.ClientName)
+}
+
+// NormalizedReverseClientName returns the reverse client name of the PolicySet in
+// normalized form. See NormalizeName for details
+func (ps *PolicySet) NormalizedReverseClientName() string {
+	return NormalizeName(ps.ReverseClientName)
+}
+
+// NormalizeName normalizes the given host name for matching. Leading and trailing
+// whitespace is removed, repeated internal whitespace is collapsed into a single
+// space and the name is converted to lower case
+func NormalizeName(n string) string {
+	return strings.ToLower(strings.Join(strings.Fields(n), " "))
+}
+
+// ErrMalformedAttr is returned by ParsePolicySet if a line of the request is not in
+// "key=value" form
+var ErrMalformedAttr = errors.New("malformed policy attribute")
+
+// ParsePolicySet reads a single policy request from the given reader and returns the
+// corresponding PolicySet. A request consists of "key=value" lines and is terminated by an
+// empty line. Attributes that are not known to the policy server are stored in the Extra
+// map of the PolicySet. Empty lines that do not terminate a request, like stray terminators
+// between two requests, are skipped.
+//
+// If the reader reaches EOF before any line has been read, io.EOF is returned. If it reaches
+// EOF in the middle of a request, the partial PolicySet is returned with io.ErrUnexpectedEOF.
+// Malformed lines do not stop the parsing, but the PolicySet is returned together with an
+// error wrapping ErrMalformedAttr once the request has been read completely. This error
+// takes precedence over io.ErrUnexpectedEOF
+func ParsePolicySet(r *bufio.Reader) (*PolicySet, error) {
+	return parsePolicySet(r, requestLimits{}, nil)
+}
+
+// parsePolicySet reads a single policy request from the given reader like ParsePolicySet.
+// If the request exceeds one of the given limits, an error wrapping ErrRequestLimit is
+// returned. If skip is not nil, malformed lines are handed to skip and ignored instead of
+// failing the request with ErrMalformedAttr
+func parsePolicySet(r *bufio.Reader, lim requestLimits, skip func(string)) (*PolicySet, error) {
+	ps := &PolicySet{}
+	var perr error
+	apply := func(l string) {
+		if err := parseAttr(ps, l, nil); err != nil {
+			if skip != nil {
+				skip(l)
+				return
+			}
+			if perr == nil {
+				perr = err
+			}
+		}
+	}
+	n, size := 0, 0
+	for {
+		bound := lineBound(lim, size)
+		l, err := readLine(r, bound)
+		if errors.Is(err, ErrRequestLimit) && bound != lim.line {
+			err = fmt.Errorf("%w: request exceeds %d bytes", ErrRequestLimit, lim.size)
+		}
+		size += len(l)
+		if lim.size > 0 && size > lim.size {
+			return nil, fmt.Errorf("%w: request exceeds %d bytes", ErrRequestLimit, lim.size)
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				if n == 0 && l == "" {
+					return nil, io.EOF
+				}
+				if l != "" {
+					apply(strings.TrimRight(l, "\r\n"))
+				}
+				if perr != nil {
+					return ps, perr
+				}
+				return ps, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		l = strings.TrimRight(l, "\r\n")
+		if l == "" {
+			if n == 0 {
+				continue
+			}
+			return ps, perr
+		}
+		n++
+		if lim.attrs > 0 && n > lim.attrs {
+			return nil, fmt.Errorf("%w: request exceeds %d attributes", ErrRequestLimit, lim.attrs)
+		}
+		apply(l)
+	}
+}
+
+// ParsePolicySets parses consecutive policy requests from the given reader, as they would
+// be sent on a single policy connection, and calls f for each parsed PolicySet. Parsing
+// stops at the end of the input, at the first parser error or if f returns an error. The
+// number of parsed requests is returned. It allows measuring the parser cost without any
+// network overhead
+func ParsePolicySets(r io.Reader, f func(*PolicySet) error) (int, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	n := 0
+	for {
+		ps, err := ParsePolicySet(br)
+		if errors.Is(err, io.EOF) {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+		if f == nil {
+			continue
+		}
+		if err := f(ps); err != nil {
+			return n, err
+		}
+	}
+}
+
+// LoadPolicySetFromFile reads a saved policy request from the file at the given path and
+// returns the corresponding PolicySet. The terminating empty line of the request is optional
+func LoadPolicySetFromFile(p string) (*PolicySet, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open policy request file: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	ps, err := ParsePolicySet(bufio.NewReader(f))
+	switch {
+	case errors.Is(err, io.EOF):
+		return nil, fmt.Errorf("failed to parse policy request file %s: file is empty", p)
+	case err != nil && !errors.Is(err, io.ErrUnexpectedEOF):
+		return nil, fmt.Errorf("failed to parse policy request file %s: %w", p, err)
+	}
+	return ps, nil
+}
+
+// parseAttr applies the given "key=value" line to the PolicySet. If the line is malformed,
+// an error wrapping ErrMalformedAttr is returned, unless an error has already been recorded
+// in perr
+func parseAttr(ps *PolicySet, l string, perr error) error {
+	sl := strings.SplitN(l, "=", 2)
+	if len(sl) != 2 || sl[0] == "" {
+		if perr != nil {
+			return perr
+		}
+		return fmt.Errorf("%w: %q", ErrMalformedAttr, l)
+	}
+	if f, ok := polSetFuncs[sl[0]]; ok {
+		f(ps, sl[1])
+		return perr
+	}
+	if ps.Extra == nil {
+		ps.Extra = make(map[string]string)
+	}
+	ps.Extra[sl[0]] = sl[1]
+	return perr
+}
+
+// SenderDomain returns the lower-case domain part of the envelope sender address. If
+// the sender is empty (null sender) or has no domain part, an empty string is returned
+func (ps *PolicySet) SenderDomain() string {
+	return addrDomain(ps.Sender)
+}
+
+// RecipientDomain returns the lower-case domain part of the envelope recipient address.
+// If the recipient is empty or has no domain part, an empty string is returned
+func (ps *PolicySet) RecipientDomain() string {
+	return addrDomain(ps.Recipient)
+}
+
+// addrDomain returns the lower-case domain part of the given address
+func addrDomain(a string) string {
+	i := strings.LastIndex(a, "@")
+	if i < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSuffix(a[i+1:], "."))
+}
+
+// ClientNetwork returns the network of the client address, masked to v4bits for IPv4 and
+// to v6bits for IPv6 addresses (i. e. 24 and 64). Throttling and greylisting policies can
+// use it to operate at network granularity, which catches clients that rotate their
+// source addresses. If the client address is unknown or the prefix length is out of range,
+// nil is returned
+func (ps *PolicySet) ClientNetwork(v4bits, v6bits int) *net.IPNet {
+	ip, bits, l := ps.ClientAddress.To4(), v4bits, 32
+	if ip == nil {
+		ip, bits, l = ps.ClientAddress.To16(), v6bits, 128
+	}
+	if ip == nil || bits < 0 || bits > l {
+		return nil
+	}
+	m := net.CIDRMask(bits, l)
+	return &net.IPNet{IP: ip.Mask(m), Mask: m}
+}
+
+// SubmissionPorts is the list of server ports that are considered submission ports by
+// PolicySet.IsSubmission. It can be overridden to match the local setup
+var SubmissionPorts = []uint64{587, 465}
+
+// IsSubmission returns true if the request was received on one of the SubmissionPorts
+func (ps *PolicySet) IsSubmission() bool {
+	return ps.IsSubmissionOn(SubmissionPorts...)
+}
+
+// IsSubmissionOn returns true if the request was received on one of the given ports
+func (ps *PolicySet) IsSubmissionOn(ports ...uint64) bool {
+	for _, p := range ports {
+		if ps.ServerPort == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Context returns the connection context of the PolicySet. It carries connection-level
+// information like the byte counters (see BytesReadFromContext). If the PolicySet has not
+// been received by the server, context.Background() is returned
+func (ps *PolicySet) Context() context.Context {
+	if ps.ctx == nil {
+		return context.Background()
+	}
+	return ps.ctx
+}
+
+// CloseAfterResponse signals the server that the connection of the PolicySet won't be
+// reused. After the response has been sent, the server half-closes the write side of the
+// connection (if supported) and closes the connection
+func (ps *PolicySet) CloseAfterResponse() {
+	ps.closeConn = true
+}
+
+// SASLDomain returns the lower-case domain part of the SASL username. If the client is not
+// authenticated or the SASL username has no domain part, an empty string is returned
+func (ps *PolicySet) SASLDomain() string {
+	return addrDomain(ps.SASLUsername)
+}
+
+// SASLSenderMatches returns true if the domain of the SASL username matches the domain of
+// the envelope sender. It returns false if the client is not authenticated, if the SASL
+// username has no domain part or if the sender is the null sender
+func (ps *PolicySet) SASLSenderMatches() bool {
+	sd := ps.SASLDomain()
+	return sd != "" && sd == ps.SenderDomain()
+}
+
+// SASLSenderMatchesEnvelope returns true if the authenticated client sends with a permitted
+// envelope sender. The envelope sender is compared case-insensitively against the SASL
+// sender, or against the SASL username if no SASL sender has been given. It returns false
+// if the client is not authenticated or if the envelope sender is the null sender
+func (ps *PolicySet) SASLSenderMatchesEnvelope() bool {
+	if ps.SASLUsername == "" || ps.Sender == "" {
+		return false
+	}
+	if ps.SASLSender != "" {
+		return strings.EqualFold(ps.SASLSender, ps.Sender)
+	}
+	return strings.EqualFold(ps.SASLUsername, ps.Sender)
+}
+
+// RequestID returns the identifier of the request in the form "<conn_id>#<seq>", where seq
+// is the sequence number of the request within its connection, starting at 1. It allows
+// the correlation of log lines for connections that serve multiple requests
+func (ps *PolicySet) RequestID() string {
+	return fmt.Sprintf("%s#%d", ps.PPSConnId, ps.PPSRequestSeq)
+}
+
+// HasQueueID returns true if postfix has already assigned a queue id to the message of the
+// request. The queue id is usually empty before the DATA protocol state
+func (ps *PolicySet) HasQueueID() bool {
+	return ps.QueueId != ""
+}
+
+// IsProbe returns true if the request looks like an address verification probe rather than
+// a real delivery attempt. Requests are considered probes if they are VRFY queries or if the
+// sender is one of the given address verification senders. The senders have to be full
+// addresses, matching the address_verify_sender of the postfix instances, i. e.
+// "double-bounce@mx.example.com", and are compared case-insensitively. Since anyone can use
+// such a sender, the senders should not be guessable. The null sender is never considered
+// a probe, since it is also used by bounces
+func (ps *PolicySet) IsProbe(senders ...string) bool {
+	if strings.EqualFold(ps.ProtocolState, StateVRFY) {
+		return true
+	}
+	if ps.Sender == "" {
+		return false
+	}
+	for _, s := range senders {
+		if strings.EqualFold(ps.Sender, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,431 @@
+package pps
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestNormalizeName tests the NormalizeName() method and the normalization helpers of
+// the PolicySet
+func TestNormalizeName(t *testing.T) {
+	testTable := []struct {
+		testName string
+		name     string
+		expName  string
+	}{
+		{`Already normalized`, "mail.example.com", "mail.example.com"},
+		{`Mixed case`, "Mail.EXAMPLE.com", "mail.example.com"},
+		{`Surrounding whitespace`, " \tmail.example.com\r\n", "mail.example.com"},
+		{`Repeated internal whitespace`, "mail.example.com  \t server", "mail.example.com server"},
+		{`Empty name`, "", ""},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			ps := &PolicySet{HELOName: tc.name, ClientName: tc.name, ReverseClientName: tc.name}
+			if n := ps.NormalizedHELOName(); n != tc.expName {
+				t.Errorf("unexpected normalized HELO name => expected: %q, got: %q", tc.expName, n)
+			}
+			if n := ps.NormalizedClientName(); n != tc.expName {
+				t.Errorf("unexpected normalized client name => expected: %q, got: %q", tc.expName, n)
+			}
+			if n := ps.NormalizedReverseClientName(); n != tc.expName {
+				t.Errorf("unexpected normalized reverse client name => expected: %q, got: %q", tc.expName, n)
+			}
+		})
+	}
+}
+
+// TestParsePolicySet tests the ParsePolicySet() method with different requests
+func TestParsePolicySet(t *testing.T) {
+	testTable := []struct {
+		testName string
+		req      string
+		expErr   error
+		expSnd   string
+	}{
+		{`Full request`, exampleReq, nil, "tester@example.com"},
+		{`Request with CRLF line endings`, "request=smtpd_access_policy\r\nsender=a@b.c\r\n\r\n", nil, "a@b.c"},
+		{`Empty input`, "", io.EOF, ""},
+		{`Leading blank lines`, "\n\r\nrequest=smtpd_access_policy\nsender=a@b.c\n\n", nil, "a@b.c"},
+		{`Only blank lines`, "\n\n\n", io.EOF, ""},
+		{`Incomplete request`, "request=smtpd_access_policy\nsender=a@b.c", io.ErrUnexpectedEOF, "a@b.c"},
+		{`Malformed attribute`, "request=smtpd_access_policy\nmalformed\nsender=a@b.c\n\n", ErrMalformedAttr,
+			"a@b.c"},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			ps, err := ParsePolicySet(bufio.NewReader(strings.NewReader(tc.req)))
+			if !errors.Is(err, tc.expErr) {
+				t.Errorf("unexpected error => expected: %v, got: %v", tc.expErr, err)
+			}
+			if tc.expSnd == "" {
+				return
+			}
+			if ps == nil {
+				t.Errorf("ParsePolicySet returned no PolicySet")
+				return
+			}
+			if ps.Sender != tc.expSnd {
+				t.Errorf("unexpected sender => expected: %s, got: %s", tc.expSnd, ps.Sender)
+			}
+		})
+	}
+}
+
+// TestParsePolicySetMultiple tests that ParsePolicySet() reads consecutive requests and
+// stores unknown attributes in the Extra map
+func TestParsePolicySetMultiple(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("request=smtpd_access_policy\nfoo=bar\n\nrequest=second\n\n"))
+	ps, err := ParsePolicySet(r)
+	if err != nil {
+		t.Fatalf("failed to parse first request: %s", err)
+	}
+	if ps.Extra["foo"] != "bar" {
+		t.Errorf("unknown attribute not stored in Extra => got: %v", ps.Extra)
+	}
+	ps, err = ParsePolicySet(r)
+	if err != nil {
+		t.Fatalf("failed to parse second request: %s", err)
+	}
+	if ps.Request != "second" {
+		t.Errorf("unexpected request of second PolicySet => expected: second, got: %s", ps.Request)
+	}
+	if _, err := ParsePolicySet(r); !errors.Is(err, io.EOF) {
+		t.Errorf("unexpected error after last request => expected: %v, got: %v", io.EOF, err)
+	}
+}
+
+// TestLoadPolicySetFromFile tests the LoadPolicySetFromFile() method with a fixture file
+func TestLoadPolicySetFromFile(t *testing.T) {
+	ps, err := LoadPolicySetFromFile("testdata/request.txt")
+	if err != nil {
+		t.Fatalf("failed to load policy set from file: %s", err)
+	}
+	if ps.Request != "smtpd_access_policy" {
+		t.Errorf("unexpected request => expected: smtpd_access_policy, got: %s", ps.Request)
+	}
+	if ps.ProtocolState != StateRcpt {
+		t.Errorf("unexpected protocol state => expected: %s, got: %s", StateRcpt, ps.ProtocolState)
+	}
+	if !ps.ClientAddress.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("unexpected client address => expected: 127.0.0.1, got: %s", ps.ClientAddress)
+	}
+	if ps.ClientPort != 45140 {
+		t.Errorf("unexpected client port => expected: 45140, got: %d", ps.ClientPort)
+	}
+	if ps.SASLUsername != "tester@example.com" {
+		t.Errorf("unexpected SASL username => expected: tester@example.com, got: %s", ps.SASLUsername)
+	}
+}
+
+// TestLoadPolicySetFromFileFail tests the LoadPolicySetFromFile() method with a missing and
+// a malformed file
+func TestLoadPolicySetFromFileFail(t *testing.T) {
+	if _, err := LoadPolicySetFromFile("testdata/does_not_exist.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("unexpected error for missing file => expected: %v, got: %v", os.ErrNotExist, err)
+	}
+	if _, err := LoadPolicySetFromFile("testdata/malformed.txt"); !errors.Is(err, ErrMalformedAttr) {
+		t.Errorf("unexpected error for malformed file => expected: %v, got: %v", ErrMalformedAttr, err)
+	}
+}
+
+// TestSenderRecipientDomain tests the SenderDomain() and RecipientDomain() methods
+func TestSenderRecipientDomain(t *testing.T) {
+	testTable := []struct {
+		testName string
+		addr     string
+		expDom   string
+	}{
+		{`Regular address`, "user@Example.COM", "example.com"},
+		{`Quoted local part with @`, `"a@b"@example.com`, "example.com"},
+		{`Null address`, "", ""},
+		{`Address without domain`, "postmaster", ""},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			ps := &PolicySet{Sender: tc.addr, Recipient: tc.addr}
+			if d := ps.SenderDomain(); d != tc.expDom {
+				t.Errorf("unexpected sender domain => expected: %s, got: %s", tc.expDom, d)
+			}
+			if d := ps.RecipientDomain(); d != tc.expDom {
+				t.Errorf("unexpected recipient domain => expected: %s, got: %s", tc.expDom, d)
+			}
+		})
+	}
+}
+
+// TestParsePolicySetAddresses tests that bracketed and zoned IPv6 addresses are parsed
+func TestParsePolicySetAddresses(t *testing.T) {
+	testTable := []struct {
+		testName string
+		addr     string
+		expAddr  string
+	}{
+		{`Plain IPv4 address`, "192.0.2.1", "192.0.2.1"},
+		{`Plain IPv6 address`, "2001:db8::1", "2001:db8::1"},
+		{`Bracketed IPv6 address`, "[2001:db8::1]", "2001:db8::1"},
+		{`Bracketed IPv6 address with prefix`, "[IPv6:2001:db8::1]", "2001:db8::1"},
+		{`Zoned IPv6 address`, "fe80::1%eth0", "fe80::1"},
+		{`Bracketed and zoned IPv6 address`, "[fe80::1%eth0]", "fe80::1"},
+		{`Bracketed IPv4 address`, "[192.0.2.1]", "192.0.2.1"},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			req := fmt.Sprintf("request=smtpd_access_policy\nclient_address=%s\nserver_address=%s\n\n",
+				tc.addr, tc.addr)
+			ps, err := ParsePolicySet(bufio.NewReader(strings.NewReader(req)))
+			if err != nil {
+				t.Fatalf("failed to parse request: %s", err)
+			}
+			exp := net.ParseIP(tc.expAddr)
+			if ps.ClientAddress == nil || !ps.ClientAddress.Equal(exp) {
+				t.Errorf("unexpected client address => expected: %s, got: %s", exp, ps.ClientAddress)
+			}
+			if ps.ServerAddress == nil || !ps.ServerAddress.Equal(exp) {
+				t.Errorf("unexpected server address => expected: %s, got: %s", exp, ps.ServerAddress)
+			}
+		})
+	}
+}
+
+// TestIsSubmission tests the IsSubmission() and IsSubmissionOn() methods
+func TestIsSubmission(t *testing.T) {
+	testTable := []struct {
+		testName string
+		port     uint64
+		expSub   bool
+	}{
+		{`SMTP port 25`, 25, false},
+		{`Submission port 587`, 587, true},
+		{`Submissions port 465`, 465, true},
+		{`Custom port 2525`, 2525, false},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			ps := &PolicySet{ServerPort: tc.port}
+			if s := ps.IsSubmission(); s != tc.expSub {
+				t.Errorf("unexpected submission result => expected: %t, got: %t", tc.expSub, s)
+			}
+		})
+	}
+
+	ps := &PolicySet{ServerPort: 2525}
+	if !ps.IsSubmissionOn(2525, 587) {
+		t.Errorf("custom submission port not detected")
+	}
+	op := SubmissionPorts
+	defer func() { SubmissionPorts = op }()
+	SubmissionPorts = []uint64{2525}
+	if !ps.IsSubmission() {
+		t.Errorf("overridden submission port not detected")
+	}
+	if (&PolicySet{ServerPort: 587}).IsSubmission() {
+		t.Errorf("default submission port detected after override")
+	}
+}
+
+// TestSASLSenderMatches tests the SASLSenderMatches() method
+func TestSASLSenderMatches(t *testing.T) {
+	testTable := []struct {
+		testName string
+		user     string
+		sender   string
+		expMatch bool
+	}{
+		{`Matching domain`, "user@example.com", "other@Example.COM", true},
+		{`Mismatching domain`, "user@example.com", "user@example.org", false},
+		{`Sub-domain does not match`, "user@example.com", "user@mail.example.com", false},
+		{`SASL username without domain`, "user", "user@example.com", false},
+		{`Not authenticated`, "", "user@example.com", false},
+		{`Null sender`, "user@example.com", "", false},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			ps := &PolicySet{SASLUsername: tc.user, Sender: tc.sender}
+			if m := ps.SASLSenderMatches(); m != tc.expMatch {
+				t.Errorf("unexpected SASL sender match => expected: %t, got: %t", tc.expMatch, m)
+			}
+		})
+	}
+}
+
+// TestSASLSenderMatchesEnvelope tests the SASLSenderMatchesEnvelope() method
+func TestSASLSenderMatchesEnvelope(t *testing.T) {
+	testTable := []struct {
+		testName   string
+		user       string
+		saslSender string
+		sender     string
+		expMatch   bool
+	}{
+		{`Username matches sender`, "user@example.com", "", "User@Example.com", true},
+		{`Username does not match sender`, "user@example.com", "", "other@example.com", false},
+		{`SASL sender matches sender`, "user@example.com", "alias@example.com", "alias@example.com", true},
+		{`SASL sender takes precedence`, "user@example.com", "alias@example.com", "user@example.com", false},
+		{`Not authenticated`, "", "", "user@example.com", false},
+		{`Not authenticated with SASL sender`, "", "user@example.com", "user@example.com", false},
+		{`Null sender`, "user@example.com", "", "", false},
+		{`Null sender with SASL sender`, "user@example.com", "user@example.com", "", false},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			ps := &PolicySet{SASLUsername: tc.user, SASLSender: tc.saslSender, Sender: tc.sender}
+			if m := ps.SASLSenderMatchesEnvelope(); m != tc.expMatch {
+				t.Errorf("unexpected SASL envelope match => expected: %t, got: %t", tc.expMatch, m)
+			}
+		})
+	}
+}
+
+// TestPolicySet_RequestID tests the RequestID() method
+func TestPolicySet_RequestID(t *testing.T) {
+	ps := &PolicySet{PPSConnId: "c1", PPSRequestSeq: 3}
+	if id := ps.RequestID(); id != "c1#3" {
+		t.Errorf("unexpected request id => expected: %s, got: %s", "c1#3", id)
+	}
+}
+
+// TestParsePolicySets tests the ParsePolicySets() method with multiple consecutive requests
+func TestParsePolicySets(t *testing.T) {
+	var sl []string
+	n, err := ParsePolicySets(strings.NewReader(strings.Repeat(exampleReq, 3)), func(ps *PolicySet) error {
+		sl = append(sl, ps.Sender)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("failed to parse policy sets: %s", err)
+	}
+	if n != 3 || len(sl) != 3 {
+		t.Errorf("unexpected number of parsed policy sets => expected: 3, got: %d/%d", n, len(sl))
+	}
+	if sl[0] != "tester@example.com" {
+		t.Errorf("unexpected sender => expected: tester@example.com, got: %s", sl[0])
+	}
+
+	ferr := errors.New("stop")
+	n, err = ParsePolicySets(strings.NewReader(strings.Repeat(exampleReq, 3)), func(*PolicySet) error {
+		return ferr
+	})
+	if !errors.Is(err, ferr) || n != 1 {
+		t.Errorf("unexpected result for failing callback => expected: 1/%s, got: %d/%v", ferr, n, err)
+	}
+	if _, err := ParsePolicySets(strings.NewReader("request=smtpd_access_policy\nmalformed\n\n"), nil); !errors.Is(err, ErrMalformedAttr) {
+		t.Errorf("unexpected error for malformed request => expected: %s, got: %v", ErrMalformedAttr, err)
+	}
+}
+
+// largeReq returns a policy request with the given number of additional unknown attributes
+func largeReq(n int) string {
+	var sb strings.Builder
+	sb.WriteString(strings.TrimSuffix(exampleReq, "\n"))
+	for i := 0; i < n; i++ {
+		sb.WriteString(fmt.Sprintf("x_attr_%d=value number %d\n", i, i))
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+// benchmarkParse measures the throughput of ParsePolicySets with the given request
+func benchmarkParse(b *testing.B, req string) {
+	const batch = 100
+	in := strings.Repeat(req, batch)
+	b.SetBytes(int64(len(in)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n, err := ParsePolicySets(strings.NewReader(in), nil)
+		if err != nil || n != batch {
+			b.Fatalf("failed to parse policy sets => parsed: %d, error: %v", n, err)
+		}
+	}
+}
+
+// BenchmarkParseSmall measures the parser throughput for a typical postfix request
+func BenchmarkParseSmall(b *testing.B) {
+	benchmarkParse(b, exampleReq)
+}
+
+// BenchmarkParseLarge measures the parser throughput for a request with many attributes
+func BenchmarkParseLarge(b *testing.B) {
+	benchmarkParse(b, largeReq(200))
+}
+
+// TestPolicySet_HasQueueID tests the HasQueueID() method
+func TestPolicySet_HasQueueID(t *testing.T) {
+	if (&PolicySet{}).HasQueueID() {
+		t.Errorf("HasQueueID returned true for an empty queue id")
+	}
+	if !(&PolicySet{QueueId: "4Xyz1234abc"}).HasQueueID() {
+		t.Errorf("HasQueueID returned false for a present queue id")
+	}
+}
+
+// TestPolicySet_ClientNetwork tests the ClientNetwork() method with IPv4 and IPv6 client
+// addresses
+func TestPolicySet_ClientNetwork(t *testing.T) {
+	testTable := []struct {
+		testName string
+		ip       string
+		v4bits   int
+		v6bits   int
+		expNet   string
+	}{
+		{`IPv4 /24`, "192.0.2.123", 24, 64, "192.0.2.0/24"},
+		{`IPv4 /32`, "192.0.2.123", 32, 64, "192.0.2.123/32"},
+		{`IPv4-mapped IPv6`, "::ffff:192.0.2.123", 24, 64, "192.0.2.0/24"},
+		{`IPv6 /64`, "2001:db8:1:2:3:4:5:6", 24, 64, "2001:db8:1:2::/64"},
+		{`IPv6 /48`, "2001:db8:1:2:3:4:5:6", 24, 48, "2001:db8:1::/48"},
+		{`Missing client address`, "", 24, 64, ""},
+		{`Prefix length out of range`, "192.0.2.123", 33, 64, ""},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			n := (&PolicySet{ClientAddress: net.ParseIP(tc.ip)}).ClientNetwork(tc.v4bits, tc.v6bits)
+			if tc.expNet == "" {
+				if n != nil {
+					t.Errorf("unexpected client network => expected: nil, got: %s", n)
+				}
+				return
+			}
+			if n == nil || n.String() != tc.expNet {
+				t.Errorf("unexpected client network => expected: %s, got: %s", tc.expNet, n)
+			}
+		})
+	}
+}
+
+// TestPolicySet_IsProbe tests the IsProbe() method with probe-like and real requests
+func TestPolicySet_IsProbe(t *testing.T) {
+	testTable := []struct {
+		testName string
+		ps       PolicySet
+		expProbe bool
+	}{
+		{`Real request`, PolicySet{ProtocolState: StateRcpt, Sender: "tester@example.com",
+			Recipient: "rcpt@example.com"}, false},
+		{`VRFY query`, PolicySet{ProtocolState: StateVRFY, Recipient: "rcpt@example.com"}, true},
+		{`Null sender at RCPT`, PolicySet{ProtocolState: StateRcpt, Recipient: "rcpt@example.com"}, false},
+		{`Null sender at MAIL`, PolicySet{ProtocolState: StateMail}, false},
+		{`Verification sender`, PolicySet{ProtocolState: StateRcpt, Sender: "Double-Bounce@mx.example.org",
+			Recipient: "rcpt@example.com"}, true},
+		{`Verification local part at other domain`, PolicySet{ProtocolState: StateRcpt,
+			Sender: "double-bounce@attacker.example", Recipient: "rcpt@example.com"}, false},
+		{`Verification sender without domain`, PolicySet{ProtocolState: StateRcpt, Sender: "double-bounce",
+			Recipient: "rcpt@example.com"}, false},
+		{`Similar sender`, PolicySet{ProtocolState: StateRcpt, Sender: "double-bounce-test@example.com",
+			Recipient: "rcpt@example.com"}, false},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			if p := tc.ps.IsProbe("double-bounce@mx.example.org"); p != tc.expProbe {
+				t.Errorf("unexpected probe detection => expected: %t, got: %t", tc.expProbe, p)
+			}
+		})
+	}
+}
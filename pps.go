@@ -3,12 +3,18 @@ package pps
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net"
-	"os"
+	"runtime/pprof"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/xid"
@@ -20,6 +26,9 @@ const DefaultAddr = "0.0.0.0"
 // DefaultPort is the default port the server is listening on
 const DefaultPort = "10005"
 
+// DefaultNetwork is the default network the server is listening on
+const DefaultNetwork = "tcp"
+
 // CtxKey represents the different key ids for values added to contexts
 type CtxKey int
 
@@ -30,6 +39,36 @@ const (
 	// CtxNoLog lets the user control wether the server should log to
 	// STDERR or not
 	CtxNoLog
+
+	// ctxConnCounters represents the byte counters in the connection context
+	ctxConnCounters
+
+	// ctxDispatched represents the connection that has been handed to a Dispatcher in
+	// the connection context
+	ctxDispatched
+
+	// ctxStoreFailure represents the store failure mode in the connection context
+	ctxStoreFailure
+
+	// ctxTLSState represents the TLS connection state in the connection context
+	ctxTLSState
+
+	// ctxRemoteAddr represents the remote address in the connection context
+	ctxRemoteAddr
+
+	// ctxWorkers represents the worker pool in the server context (see WithWorkers)
+	ctxWorkers
+
+	// CtxTraceID holds the trace id of a tracing context as string. If it is present in
+	// the context of a request, it is attached to the decision (see WithTraceID)
+	CtxTraceID
+)
+
+// pprof label keys that are attached to the goroutine during the handler execution
+const (
+	LabelConnID        = "pps_conn_id"
+	LabelClientAddr    = "pps_client_addr"
+	LabelProtocolState = "pps_protocol_state"
 )
 
 // PostfixResp is a possible response value for the policy request
@@ -77,7 +116,7 @@ var polSetFuncs = map[string]polSetFunc{
 		}
 	},
 	"client_address": func(ps *PolicySet, v string) {
-		ca := net.ParseIP(v)
+		ca := parseAddr(v)
 		ps.ClientAddress = ca
 	},
 	"client_name":         func(ps *PolicySet, v string) { ps.ClientName = v },
@@ -104,7 +143,7 @@ var polSetFuncs = map[string]polSetFunc{
 		}
 	},
 	"etrn_domain":              func(ps *PolicySet, v string) { ps.ETRNDomain = v },
-	"stress":                   func(ps *PolicySet, v string) { ps.Stress = v == "yes" },
+	"stress":                   func(ps *PolicySet, v string) { ps.Stress = strings.EqualFold(v, "yes") },
 	"ccert_pubkey_fingerprint": func(ps *PolicySet, v string) { ps.CCertPubkeyFingerprint = v },
 	"client_port": func(ps *PolicySet, v string) {
 		cp, err := strconv.ParseUint(v, 10, 64)
@@ -114,7 +153,7 @@ var polSetFuncs = map[string]polSetFunc{
 	},
 	"policy_context": func(ps *PolicySet, v string) { ps.PolicyContext = v },
 	"server_address": func(ps *PolicySet, v string) {
-		sa := net.ParseIP(v)
+		sa := parseAddr(v)
 		ps.ServerAddress = sa
 	},
 	"server_port": func(ps *PolicySet, v string) {
@@ -125,6 +164,20 @@ var polSetFuncs = map[string]polSetFunc{
 	},
 }
 
+// parseAddr parses the given IP address. Surrounding brackets, an "IPv6:" prefix and
+// an IPv6 scope/zone (like %eth0) are removed before parsing
+func parseAddr(v string) net.IP {
+	v = strings.TrimSpace(v)
+	if strings.HasPrefix(v, "[") && strings.HasSuffix(v, "]") {
+		v = v[1 : len(v)-1]
+	}
+	v = strings.TrimPrefix(v, "IPv6:")
+	if i := strings.IndexByte(v, '%'); i >= 0 {
+		v = v[:i]
+	}
+	return net.ParseIP(v)
+}
+
 // PolicySet is a set information provided by the postfix policyd request
 type PolicySet struct {
 	// Postfix version 2.1 and later
@@ -173,22 +226,146 @@ type PolicySet struct {
 	ServerPort    uint64
 
 	// postfix-policy-server specific values
-	PPSConnId string
+	PPSConnId     string
+	PPSRequestSeq uint64
+
+	// Extra holds all attributes of the request that are not known to the policy server
+	Extra map[string]string
+
+	ctx        context.Context
+	closeConn  bool
+	outOfOrder bool
+
+	// readAt is the time the request has been read completely (see WithResponseBudget)
+	readAt time.Time
 }
 
 // connection represents an incoming policy server connection
 type connection struct {
 	conn net.Conn
-	rs   *bufio.Scanner
+	rb   *bufio.Reader
 	h    Handler
 	err  error
 	cc   bool
+	seq  uint64
+
+	// dec is the JSON decoder of the connection (see FramingJSON)
+	dec *json.Decoder
+
+	// malformed holds the malformed lines that have been skipped while reading the
+	// current request
+	malformed []string
+
+	// gone holds the read error of a connection that has been closed by the client
+	gone error
+
+	// werr is true if the connection has been closed because of a write error
+	werr bool
+
+	// mu guards the number of requests in flight and the shutdown flag of the connection
+	// (see WithShutdownResponse)
+	mu      sync.Mutex
+	busy    int
+	closing bool
+
+	// idle is true while the connection waits for the first byte of the next request and
+	// quit stops the reading of further requests (see Server.Shutdown)
+	idle bool
+	quit bool
+
+	// wake is closed if the connection is stopped while it is queued for a connection
+	// slot (see WithMaxConnections)
+	wake chan struct{}
 }
 
 // Server defines a new policy server with corresponding settings
 type Server struct {
 	lp string
 	la string
+	ln string
+	lo io.Writer
+
+	logLevel LogLevel
+
+	listenAddrs []string
+	listeners   []net.Listener
+	partialBind bool
+	systemd     bool
+	reusePort   int
+	proxyHops   int
+
+	logReqs   bool
+	logRedact []string
+
+	addrRedactor func(net.IP) string
+
+	acceptLimit   *tokenBucket
+	stageCheck    bool
+	stageDefaults map[string]PostfixResp
+	probeDunno    bool
+	probeSenders  []string
+	stressResp    PostfixResp
+	shutdownResp  PostfixResp
+	unknownResp   PostfixResp
+	panicResp     PostfixResp
+
+	clientLimit      *clientLimiter
+	connSem          chan struct{}
+	connOverflow     PostfixResp
+	overflowSem      chan struct{}
+	stateOrder       *stateOrder
+	stateOrderAction PostfixResp
+	tlsMin           uint16
+	tlsSuites        []uint16
+	tlsConf          *tls.Config
+	runTimeout       time.Duration
+	pipeline         int
+	workers          int
+	reqLimits        requestLimits
+	bans             *banList
+
+	secretAttr   string
+	secret       string
+	secretAction PostfixResp
+
+	adminAddr      string
+	requiredStores []Store
+
+	auditCh chan<- AuditEvent
+	traceFn func(*PolicySet) string
+	webhook *webhook
+
+	peers        []*net.IPNet
+	peersErr     error
+	trustedUsers map[string]struct{}
+	noBindWarn   bool
+
+	manualClose bool
+	dispatch    Dispatcher
+	errHandler  func(context.Context, error)
+
+	readTimeout   time.Duration
+	writeTimeout  time.Duration
+	keepAliveIdle time.Duration
+	framing       Framing
+	reqReader     RequestReader
+	readBuf       int
+	writeBuf      int
+	respBudget    time.Duration
+	enrichers     []Enricher
+	enrichTimeout time.Duration
+	storeFail     StoreFailureMode
+
+	verdictMap     map[Verdict]PostfixResp
+	verdictDefault PostfixResp
+
+	onOverload func(current, limit int)
+	hwm, lwm   int
+	ovl        *overloadMon
+
+	top   *topTracker
+	stats *stats
+	state *state
 }
 
 // polSetFunc is a function alias that tries to fit a given value into a PolicySet
@@ -206,8 +383,16 @@ type Handler interface {
 // New returns a new server object
 func New(options ...ServerOpt) Server {
 	s := Server{
-		lp: DefaultPort,
-		la: DefaultAddr,
+		lp:           DefaultPort,
+		la:           DefaultAddr,
+		ln:           DefaultNetwork,
+		secretAction: RespDefer,
+		panicResp:    RespDeferIfPermit,
+		writeTimeout: DefaultWriteTimeout,
+		logRedact:    defaultLogRedaction,
+		logLevel:     DefaultLogLevel,
+		stats:        &stats{},
+		state:        &state{},
 	}
 	for _, o := range options {
 		if o == nil {
@@ -215,6 +400,7 @@ func New(options ...ServerOpt) Server {
 		}
 		o(&s)
 	}
+	s.ovl = newOverloadMon(s.hwm, s.lwm, s.onOverload)
 
 	return s
 }
@@ -233,6 +419,64 @@ func WithAddr(a string) ServerOpt {
 	}
 }
 
+// WithNetwork overrides the default network of the policy server listener. Supported
+// networks are "tcp", "tcp4", "tcp6" and "unix". For the "unix" network, the listening
+// address is the path of the socket and the listening port is ignored
+func WithNetwork(n string) ServerOpt {
+	return func(s *Server) {
+		s.ln = n
+	}
+}
+
+// WithAcceptRateLimit limits the rate at which new connections are accepted to perSec
+// connections per second, allowing bursts of up to burst connections. When the limit is
+// exceeded, the accept loop waits before accepting the next connection
+func WithAcceptRateLimit(perSec float64, burst int) ServerOpt {
+	return func(s *Server) {
+		if perSec <= 0 {
+			s.acceptLimit = nil
+			return
+		}
+		s.acceptLimit = newTokenBucket(perSec, burst)
+	}
+}
+
+// WithRunTimeout stops the server automatically after the given duration. The timeout
+// composes with the context handed to Run, so the server stops on whichever fires first.
+// This is useful for short-lived test or diagnostic runs
+func WithRunTimeout(d time.Duration) ServerOpt {
+	return func(s *Server) {
+		s.runTimeout = d
+	}
+}
+
+// WithUnknownRequestResponse sets the response for requests without a request type, i. e.
+// requests that only consist of attributes unknown to the server. Such requests are not
+// handed to the Handler, but answered with the given response and logged with a warning,
+// so that the client does not wait for a response that never comes. Defaults to RespDunno
+func WithUnknownRequestResponse(r PostfixResp) ServerOpt {
+	return func(s *Server) {
+		s.unknownResp = r
+	}
+}
+
+// unknownRequest returns the response for a request without a request type (see
+// WithUnknownRequestResponse)
+func (s *Server) unknownRequest(ps *PolicySet) Response {
+	ks := make([]string, 0, len(ps.Extra))
+	for k := range ps.Extra {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	r := s.unknownResp
+	if r == "" {
+		r = RespDunno
+	}
+	s.logf(ps.Context(), LogLevelWarn, "request %s: no recognized request type, answering with %s "+
+		"(unknown attributes: %s)", ps.RequestID(), respAction(r), strings.Join(ks, ","))
+	return Response{Action: r, fallback: true}
+}
+
 // SetPort will override the listening port on an already existing policy server
 func (s *Server) SetPort(p string) {
 	s.lp = p
@@ -243,104 +487,422 @@ func (s *Server) SetAddr(a string) {
 	s.la = a
 }
 
-// Run starts a server based on the Server object
+// Run starts a server based on the Server object. It creates the listener for the listening
+// address of the server and serves it like Serve. If the given context is already
+// cancelled, Run returns the context error without binding the listener. If several
+// listening addresses or listeners are configured (see WithListenAddrs and WithListeners),
+// Run serves all of them concurrently
 func (s *Server) Run(ctx context.Context, h Handler) error {
-	sa := net.JoinHostPort(s.la, s.lp)
-	l, err := net.Listen("tcp", sa)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if s.peersErr != nil {
+		return s.peersErr
+	}
+	if err := s.checkTLSConfig(); err != nil {
+		return err
+	}
+	if len(s.listeners) > 0 {
+		return s.serve(ctx, h, s.tlsListeners(s.listeners))
+	}
+	ls, err := s.bind(ctx)
 	if err != nil {
 		return err
 	}
-	return s.RunWithListener(ctx, h, l)
+	ls = s.tlsListeners(ls)
+	if s.manualClose {
+		defer func() {
+			for _, l := range ls {
+				_ = l.Close()
+			}
+		}()
+	}
+	return s.serve(ctx, h, ls)
 }
 
-// RunWithListener starts a server based on the Server object with a given network listener
+// RunWithListener starts a server based on the Server object with a given network listener.
+// It is equivalent to Serve
 func (s *Server) RunWithListener(ctx context.Context, h Handler, l net.Listener) error {
-	el := log.New(os.Stderr, "[Server] ERROR: ", log.Lmsgprefix|log.LstdFlags|log.Lshortfile)
-	noLog := false
-	ok, nlv := ctx.Value(CtxNoLog).(bool)
-	if ok {
-		noLog = nlv
+	return s.Serve(ctx, l, h)
+}
+
+// Serve accepts and serves the policy connections of the given listener with the given
+// Handler until the context is cancelled. It allows callers to bring their own listener,
+// i. e. a TLS listener, a listener of a systemd socket or an in-memory listener in tests.
+// The listener is closed once the context is cancelled, unless it is managed by the caller
+// (see WithManualClose). Temporary accept errors, like running out of file descriptors,
+// are retried with an exponential backoff. If the listener fails permanently, Serve
+// returns an error wrapping ErrListenerFailed
+func (s *Server) Serve(ctx context.Context, l net.Listener, h Handler) error {
+	return s.serve(ctx, h, []net.Listener{l})
+}
+
+// serve accepts and serves the connections of the given listeners until the context is
+// cancelled
+func (s *Server) serve(ctx context.Context, h Handler, ls []net.Listener) error {
+	if s.peersErr != nil {
+		return s.peersErr
+	}
+	if s.runTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.runTimeout)
+		defer cancel()
+	}
+	if s.adminAddr != "" {
+		stop, err := s.startAdmin(ctx)
+		if err != nil {
+			return err
+		}
+		defer stop()
 	}
 
-	go func() {
-		<-ctx.Done()
-		if err := l.Close(); err != nil && !noLog {
-			el.Printf("failed to close listener: %s", err)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var ferr error
+	var errOnce sync.Once
+
+	s.state.addRun(ctx)
+	defer s.state.removeRun(ctx)
+	if s.workers > 0 {
+		p := newWorkerPool(s.workers)
+		defer p.stop()
+		ctx = context.WithValue(ctx, ctxWorkers, p)
+	}
+	var wg sync.WaitGroup
+	for _, l := range ls {
+		s.warnOpenBind(ctx, l)
+		s.state.addListener(l)
+		defer s.state.removeListener(l)
+		go func(l net.Listener) {
+			<-ctx.Done()
+			s.stopListener(ctx, l)
+		}(l)
+		if s.manualClose {
+			defer resetDeadline(l)
 		}
-	}()
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			if err := s.acceptLoop(ctx, h, l, &wg); err != nil {
+				errOnce.Do(func() { ferr = err })
+				cancel()
+			}
+		}(l)
+	}
+	wg.Wait()
 
-	// Accept new connections
+	return ferr
+}
+
+// acceptLoop accepts new connections on the given listener and serves them. The
+// connection handlers are tracked by the given WaitGroup. Temporary accept errors are
+// retried with an exponential backoff. An error is only returned if the listener failed
+// permanently
+func (s *Server) acceptLoop(ctx context.Context, h Handler, l net.Listener, wg *sync.WaitGroup) error {
+	var backoff time.Duration
 	for {
+		if s.acceptLimit != nil {
+			if err := s.acceptLimit.wait(ctx); err != nil {
+				return nil
+			}
+		}
 		c, err := l.Accept()
 		if err != nil {
-			if !noLog {
-				el.Printf("failed to accept new connection: %s", err)
+			if ctx.Err() != nil || s.state.isDraining() {
+				return nil
 			}
-			break
+			if isTemporary(err) {
+				backoff = nextAcceptBackoff(backoff)
+				s.logf(ctx, LogLevelError, "failed to accept new connection, retrying in %s: %s", backoff, err)
+				sleepCtx(ctx, backoff)
+				continue
+			}
+			s.logf(ctx, LogLevelError, "failed to accept new connection: %s", err)
+			return fmt.Errorf("%w: %s", ErrListenerFailed, err)
 		}
-		conn := &connection{
-			conn: c,
-			rs:   bufio.NewScanner(c),
-			h:    h,
+		backoff = 0
+		if !s.peerAllowed(c.RemoteAddr()) {
+			s.logf(ctx, LogLevelWarn, "rejected connection from peer %s: not in the list of allowed peers",
+				s.logRemoteAddr(c.RemoteAddr()))
+			_ = c.Close()
+			continue
 		}
-
+		if s.bans != nil && s.bans.banned(addrIP(c.RemoteAddr())) {
+			s.logf(ctx, LogLevelWarn, "rejected connection from peer %s: banned for exceeding the request limits",
+				s.logRemoteAddr(c.RemoteAddr()))
+			_ = c.Close()
+			continue
+		}
+		if err := s.setSocketBuffers(c); err != nil {
+			s.logf(ctx, LogLevelWarn, "failed to set socket buffers on connection from %s: %s",
+				s.logRemoteAddr(c.RemoteAddr()), err)
+		}
+		cc := &countConn{Conn: c}
+		atomic.AddUint64(&s.stats.connections, 1)
 		connId := xid.New()
 		conCtx := context.WithValue(ctx, ctxConnId, connId)
-		ec := make(chan error, 1)
-		go func() { ec <- connHandler(conCtx, conn) }()
-		select {
-		case <-conCtx.Done():
-			<-ec
-			return ctx.Err()
-		case err := <-ec:
-			return err
+		conCtx = context.WithValue(conCtx, ctxConnCounters, cc)
+		conCtx = context.WithValue(conCtx, ctxRemoteAddr, c.RemoteAddr())
+		if s.storeFail != 0 {
+			conCtx = context.WithValue(conCtx, ctxStoreFailure, s.storeFail)
 		}
-	}
 
-	return nil
+		conn := &connection{
+			conn: cc,
+			rb:   bufio.NewReader(cc),
+			h:    h,
+		}
+		s.state.addConn(conn)
+		if !s.acquireConn(ctx, conn, wg) {
+			s.state.removeConn(conn)
+			if ctx.Err() != nil {
+				return nil
+			}
+			continue
+		}
+		wg.Add(1)
+		release := func() {
+			s.state.removeConn(conn)
+			s.releaseConn()
+			wg.Done()
+		}
+		if s.dispatch != nil {
+			s.dispatch(context.WithValue(conCtx, ctxDispatched, &dispatched{conn: conn, release: release}), cc)
+			continue
+		}
+		go func() {
+			defer release()
+			if err := s.connHandler(conCtx, conn); err != nil {
+				s.logConnErr(ctx, conn, connId.String(), err)
+			}
+		}()
+	}
 }
 
 // connHandler processes the incoming policy connection request and hands it to the
 // Handle function of the Handler interface
-func connHandler(ctx context.Context, c *connection) error {
+func (s *Server) connHandler(ctx context.Context, c *connection) (err error) {
 	connId, ok := ctx.Value(ctxConnId).(xid.ID)
 	if !ok {
 		return fmt.Errorf("failed to retrieve connection id from context")
 	}
+	defer func() { _ = c.conn.Close() }()
+	defer func() {
+		if r := recover(); r != nil {
+			s.stats.terminated(TerminationPanic)
+			panic(r)
+		}
+		s.stats.terminated(s.terminationCause(ctx, c, err))
+	}()
+	ctx, err = s.readProxyHeaders(ctx, c)
+	if err != nil {
+		return err
+	}
+	ctx, err = s.tlsHandshake(ctx, c)
+	if err != nil {
+		return err
+	}
 
-	for !c.cc {
-		ps := &PolicySet{PPSConnId: connId.String()}
-		processMsg(c, ps)
-		if ps.Request != "" {
-			resp := c.h.Handle(ps)
-			if err := c.conn.SetWriteDeadline(time.Now().Add(time.Second)); err != nil {
-				c.err = fmt.Errorf("failed to set write deadline on connection: %s", err.Error())
-			}
-			sResp := fmt.Sprintf("action=%s\n\n", resp)
-			if _, err := c.conn.Write([]byte(sResp)); err != nil {
-				c.err = fmt.Errorf("failed to write response on connection: %s", err.Error())
+	// Close the connection as soon as the server is shutting down
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			if s.shutdownResp == "" {
+				_ = c.conn.Close()
+				return
 			}
+			c.shutdown()
+		case <-done:
 		}
+	}()
+
+	defer s.logEarlyDisconnect(ctx, c, connId.String())
+	if s.pipeline > 1 {
+		err = s.servePipelined(ctx, c, connId.String())
+	} else {
+		err = s.serveSequential(ctx, c, connId.String())
 	}
-	return c.err
+	if err != nil && s.errHandler != nil {
+		s.errHandler(ctx, fmt.Errorf("connection %s: %w", connId, err))
+	}
+	return err
 }
 
-// processMsg processes the incoming policy message and updates the given PolicySet
-func processMsg(c *connection, ps *PolicySet) {
-	for c.rs.Scan() {
-		l := c.rs.Text()
-		if l == "" {
+// serveSequential processes the requests of the connection one after another
+func (s *Server) serveSequential(ctx context.Context, c *connection, connId string) error {
+	for !c.cc {
+		ps := s.readMsg(ctx, c)
+		if ps == nil {
+			continue
+		}
+		ps.PPSConnId = connId
+		c.seq++
+		ps.PPSRequestSeq = c.seq
+		if !c.begin() {
 			break
 		}
-		sl := strings.SplitN(l, "=", 2)
-		if f, ok := polSetFuncs[sl[0]]; ok {
-			f(ps, sl[1])
+		resp := s.runRequest(ctx, c, ps)
+		if err := s.writeResp(c, ps, resp); err != nil {
+			c.err = err
+			c.werr = true
+			c.cc = true
+		}
+		c.end()
+		if ps.closeConn || resp.Close {
+			c.cc = true
 		}
 	}
-	if err := c.rs.Err(); err != nil {
-		if _, ok := err.(*net.OpError); ok {
+	return c.err
+}
+
+// processRequest hands the PolicySet to the Handler and returns the response. If the
+// Handler has been preempted by the response budget, the returned channel is closed once
+// it has returned and the Handler counts as active until then. Otherwise, the returned
+// channel is nil
+func (s *Server) processRequest(ctx context.Context, c *connection, ps *PolicySet) (Response, <-chan struct{}) {
+	st := time.Now()
+	atomic.AddInt64(&s.stats.activeHandlers, 1)
+	s.ovl.inc()
+	s.logRequest(ctx, ps)
+	if s.top != nil {
+		s.top.record(ps.ClientAddress)
+	}
+	var resp Response
+	var pending <-chan struct{}
+	pprof.Do(ctx, requestLabels(ps), func(lctx context.Context) {
+		ps.ctx = lctx
+		if ps.Request == "" {
+			resp = s.unknownRequest(ps)
 			return
 		}
+		resp, pending = s.handleWithBudget(ps, c.h)
+	})
+	resp = s.shutdownResponse(ctx, resp)
+	if pending == nil {
+		s.handlerDone()
+	} else {
+		go func() {
+			<-pending
+			s.handlerDone()
+		}()
+	}
+	atomic.AddUint64(&s.stats.requests, 1)
+	lat := time.Since(st)
+	s.stats.latency.observe(lat, s.traceID(ps))
+	s.audit(ps, resp, lat)
+	if s.stageCheck && !validStageAction(ps.ProtocolState, resp.Action) {
+		s.logf(ctx, LogLevelWarn, "connection %s: handler returned action %q which is not effective "+
+			"in protocol state %q", ps.RequestID(), resp.action(), ps.ProtocolState)
+	}
+	return resp, pending
+}
+
+// handlerDone marks a Handler that has been counted as active in processRequest as done
+func (s *Server) handlerDone() {
+	s.ovl.dec()
+	atomic.AddInt64(&s.stats.activeHandlers, -1)
+}
+
+// writeResp writes the response for the given PolicySet to the connection. If the handler
+// requested it, the write side of the connection is half-closed afterwards
+func (s *Server) writeResp(c *connection, ps *PolicySet, resp Response) error {
+	var err error
+	if derr := c.conn.SetWriteDeadline(time.Now().Add(s.writeTimeout)); derr != nil {
+		err = fmt.Errorf("failed to set write deadline on connection: %w", derr)
+	}
+	if werr := writeFull(c.conn, s.renderResp(resp)); werr != nil {
+		err = fmt.Errorf("failed to write response on connection: %w", werr)
+		var ne net.Error
+		if errors.As(werr, &ne) && ne.Timeout() {
+			atomic.AddUint64(&s.stats.writeTimeouts, 1)
+			err = fmt.Errorf("failed to write response on connection: %w: %s", ErrWriteTimeout, werr)
+		}
+	}
+	if ps.closeConn || resp.Close {
+		closeWrite(c.conn)
+	}
+	return err
+}
+
+// requestLabels returns the pprof labels for the given PolicySet. The labels are attached
+// to the goroutine while the handler is running, so goroutine profiles can be attributed to
+// specific requests
+func requestLabels(ps *PolicySet) pprof.LabelSet {
+	ca := ""
+	if ps.ClientAddress != nil {
+		ca = ps.ClientAddress.String()
+	}
+	return pprof.Labels(LabelConnID, ps.PPSConnId, LabelClientAddr, ca, LabelProtocolState, ps.ProtocolState)
+}
+
+// handle runs the server-side checks for the given PolicySet and hands it to the Handler
+// (see callHandler)
+func (s *Server) handle(ps *PolicySet, h Handler) Response {
+	if s.secretAttr != "" && !s.validSecret(ps) {
+		return Response{Action: s.secretAction}
+	}
+	if s.stateOrder != nil && !s.checkStateOrder(ps) && s.stateOrderAction != "" {
+		return Response{Action: s.stateOrderAction}
+	}
+	if s.stressResp != "" && ps.UnderStress() {
+		return Response{Action: s.stressResp, fallback: true}
+	}
+	if r, ok := s.stageDefault(ps); ok {
+		return Response{Action: r}
+	}
+	if s.probeDunno && ps.IsProbe(s.probeSenders...) {
+		return Response{Action: RespDunno}
+	}
+	if s.trustedSASLUser(ps) {
+		return Response{Action: RespOk}
+	}
+	if s.clientLimit != nil && ps.ClientAddress != nil {
+		k := ps.ClientAddress.String()
+		if !s.clientLimit.acquire(k) {
+			return Response{Action: s.clientLimit.shed, fallback: true}
+		}
+		defer s.clientLimit.release(k)
+	}
+	return s.callHandler(ps, h)
+}
+
+// processMsg reads the incoming policy message from the connection and returns the
+// corresponding PolicySet. If the connection has been closed or the message could not
+// be read, nil is returned and the connection is flagged for closing. Malformed lines of
+// the request are logged and skipped, so that the request is still answered
+func (s *Server) processMsg(ctx context.Context, c *connection) *PolicySet {
+	ps, err := s.readRequest(c)
+	if len(c.malformed) > 0 && err == nil {
+		connId, _ := ctx.Value(ctxConnId).(xid.ID)
+		s.logf(ctx, LogLevelWarn, "connection %s: skipped %d malformed request line(s), first: %q",
+			connId.String(), len(c.malformed), c.malformed[0])
+	}
+	if err == nil {
+		return ps
+	}
+	if errors.Is(err, ErrRequestLimit) {
+		s.limitExceeded(c)
+	}
+	s.readFailed(c, err)
+	return nil
+}
+
+// readFailed classifies the read error of the connection and flags the connection for
+// closing
+func (s *Server) readFailed(c *connection, err error) {
+	// The client closed the connection or the read failed
+	c.cc = true
+	var ne net.Error
+	var oe *net.OpError
+	switch {
+	case errors.As(err, &ne) && ne.Timeout():
+		atomic.AddUint64(&s.stats.readTimeouts, 1)
+		c.err = fmt.Errorf("%w: %s", ErrReadTimeout, err)
+	case isDisconnect(err) || errors.As(err, &oe):
+		c.gone = err
+	default:
 		c.err = err
 	}
 }
@@ -358,3 +920,23 @@ func TextResponseNonOpt(rt PostfixTextResp, t string) PostfixResp {
 	r := PostfixResp(fmt.Sprintf("%s %s", rt, t))
 	return r
 }
+
+// RespRaw returns the given string as PostfixResp verbatim. It allows the use of postfix
+// actions that are not (yet) provided as constants by this package. The caller is
+// responsible for the correctness of the action, the server only replaces line breaks
+// before sending it to the postfix server
+func RespRaw(s string) PostfixResp {
+	return PostfixResp(s)
+}
+
+// sanitizeResp replaces all line breaks in the given PostfixResp, so that it can't break
+// the framing of the response
+func sanitizeResp(r PostfixResp) PostfixResp {
+	return PostfixResp(strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(string(r)))
+}
+
+// respAction returns the upper-case action keyword of the given PostfixResp without any
+// additional text
+func respAction(r PostfixResp) string {
+	return strings.ToUpper(strings.SplitN(strings.TrimSpace(string(r)), " ", 2)[0])
+}
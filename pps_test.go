@@ -3,9 +3,12 @@ package pps
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"runtime/pprof"
+	"strings"
 	"testing"
 	"time"
 )
@@ -55,6 +58,49 @@ policy_context=
 
 `
 
+// testServer starts the given server on a local ephemeral TCP port and returns the
+// listening address and a function that stops the server and waits for it to return.
+// Logging is disabled unless a log output has been configured for the server
+func testServer(t *testing.T, s *Server, h Handler) (string, func()) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create new TCP listener: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	vctx := context.WithValue(ctx, CtxNoLog, s.lo == nil)
+	ec := make(chan error, 1)
+	go func() { ec <- s.RunWithListener(vctx, h, l) }()
+	return l.Addr().String(), func() {
+		cancel()
+		if err := <-ec; err != nil {
+			t.Errorf("could not run server: %s", err)
+		}
+	}
+}
+
+// testRequest sends the given request on the connection and returns the first line
+// of the server response
+func testRequest(t *testing.T, conn net.Conn, rb *bufio.Reader, req string) string {
+	t.Helper()
+	if err := conn.SetDeadline(time.Now().Add(time.Second * 5)); err != nil {
+		t.Errorf("failed to set deadline on client connection: %s", err)
+	}
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Errorf("failed to send request to server: %s", err)
+		return ""
+	}
+	resp, err := rb.ReadString('\n')
+	if err != nil {
+		t.Errorf("failed to read response from server: %s", err)
+		return ""
+	}
+	if _, err := rb.ReadString('\n'); err != nil {
+		t.Errorf("failed to read response terminator from server: %s", err)
+	}
+	return resp
+}
+
 // TestNew tests the New() method
 func TestNew(t *testing.T) {
 	s := New()
@@ -451,3 +497,209 @@ func TestRunDialTextResponseNonOpt(t *testing.T) {
 		})
 	}
 }
+
+// TestRunWithRunTimeout tests that Run returns cleanly after the configured run timeout
+// and that the timeout composes with the context
+func TestRunWithRunTimeout(t *testing.T) {
+	testTable := []struct {
+		testName   string
+		runTimeout time.Duration
+		ctxTimeout time.Duration
+		expDur     time.Duration
+	}{
+		{`Run timeout fires first`, time.Millisecond * 100, time.Second * 5, time.Millisecond * 100},
+		{`Context fires first`, time.Second * 5, time.Millisecond * 100, time.Millisecond * 100},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			s := New(WithAddr("127.0.0.1"), WithPort("0"), WithRunTimeout(tc.runTimeout))
+			ctx, cancel := context.WithTimeout(context.Background(), tc.ctxTimeout)
+			defer cancel()
+			vctx := context.WithValue(ctx, CtxNoLog, true)
+			st := time.Now()
+			if err := s.Run(vctx, Hi{}); err != nil {
+				t.Errorf("could not run server: %s", err)
+			}
+			if el := time.Since(st); el < tc.expDur || el > tc.expDur+time.Second {
+				t.Errorf("unexpected run duration => expected: %s, got: %s", tc.expDur, el)
+			}
+		})
+	}
+}
+
+// TestRunDialRespRaw tests that arbitrary actions set via RespRaw() are rendered correctly
+// and that line breaks are sanitized
+func TestRunDialRespRaw(t *testing.T) {
+	testTable := []struct {
+		testName string
+		response PostfixResp
+		expResp  string
+	}{
+		{`Arbitrary action`, RespRaw("BCC archive@example.com"), "action=BCC archive@example.com\n"},
+		{`Reply code action`, RespRaw("450 4.7.1 Try again later"), "action=450 4.7.1 Try again later\n"},
+		{`Action with line breaks`, RespRaw("REJECT first\nsecond\r\nthird"), "action=REJECT first second third\n"},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			s := New()
+			addr, stop := testServer(t, &s, Hi{r: tc.response})
+			defer stop()
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("failed to connect to running server: %s", err)
+			}
+			defer func() { _ = conn.Close() }()
+			resp := testRequest(t, conn, bufio.NewReader(conn), exampleReq)
+			if resp != tc.expResp {
+				t.Errorf("unexpected server response => expected: %q, got: %q", tc.expResp, resp)
+			}
+		})
+	}
+}
+
+// TestRunCancelledContext tests that Run returns promptly without binding the listener if
+// the context is already cancelled
+func TestRunCancelledContext(t *testing.T) {
+	s := New(WithAddr("127.0.0.1"), WithPort("44470"))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	vctx := context.WithValue(ctx, CtxNoLog, true)
+
+	st := time.Now()
+	if err := s.Run(vctx, Hi{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error for cancelled context => expected: %s, got: %v", context.Canceled, err)
+	}
+	if el := time.Since(st); el > time.Millisecond*100 {
+		t.Errorf("Run did not return promptly => took: %s", el)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:44470")
+	if err != nil {
+		t.Errorf("port is still bound after Run returned: %s", err)
+		return
+	}
+	_ = l.Close()
+}
+
+// TestRunDialPprofLabels tests that the pprof labels are set during the handler execution
+func TestRunDialPprofLabels(t *testing.T) {
+	lc := make(chan map[string]string, 1)
+	h := HandlerFunc(func(ps *PolicySet) PostfixResp {
+		l := make(map[string]string)
+		pprof.ForLabels(ps.Context(), func(k, v string) bool {
+			l[k] = v
+			return true
+		})
+		lc <- l
+		return RespDunno
+	})
+	s := New()
+	addr, stop := testServer(t, &s, h)
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = testRequest(t, conn, bufio.NewReader(conn), exampleReq)
+
+	l := <-lc
+	if l[LabelConnID] == "" {
+		t.Errorf("connection id label not set => got: %v", l)
+	}
+	if l[LabelClientAddr] != "127.0.0.1" {
+		t.Errorf("unexpected client address label => expected: 127.0.0.1, got: %s", l[LabelClientAddr])
+	}
+	if l[LabelProtocolState] != StateRcpt {
+		t.Errorf("unexpected protocol state label => expected: %s, got: %s", StateRcpt,
+			l[LabelProtocolState])
+	}
+}
+
+// TestRunDialStrayBlankLines tests that blank lines around a request neither cause empty
+// dispatches nor desync the following requests
+func TestRunDialStrayBlankLines(t *testing.T) {
+	h := &countHandler{r: RespOk}
+	s := New()
+	addr, stop := testServer(t, &s, h)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		stop()
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	rb := bufio.NewReader(conn)
+	if r := testRequest(t, conn, rb, "\n\r\n"+exampleReq+"\n\n"); r != "action=OK\n" {
+		t.Errorf("unexpected response => expected: %q, got: %q", "action=OK\n", r)
+	}
+	if r := testRequest(t, conn, rb, exampleReq); r != "action=OK\n" {
+		t.Errorf("unexpected response => expected: %q, got: %q", "action=OK\n", r)
+	}
+	_ = conn.Close()
+	stop()
+	if h.n != 2 {
+		t.Errorf("unexpected number of dispatches => expected: 2, got: %d", h.n)
+	}
+}
+
+// TestRunDialUnknownAttributesOnly tests that requests which only consist of unknown
+// attributes are answered promptly without invoking the Handler and are logged
+func TestRunDialUnknownAttributesOnly(t *testing.T) {
+	testTable := []struct {
+		testName string
+		opts     []ServerOpt
+		expResp  string
+	}{
+		{`Default response`, nil, "action=DUNNO\n"},
+		{`Configured response`, []ServerOpt{WithUnknownRequestResponse(RespDefer)}, "action=DEFER\n"},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			h := &countHandler{r: RespOk}
+			b := &syncBuffer{}
+			s := New(append(tc.opts, WithLogOutput(b))...)
+			addr, stop := testServer(t, &s, h)
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				stop()
+				t.Fatalf("failed to connect to running server: %s", err)
+			}
+			rb := bufio.NewReader(conn)
+			if r := testRequest(t, conn, rb, "foo=bar\nbaz=qux\n\n"); r != tc.expResp {
+				t.Errorf("unexpected response => expected: %q, got: %q", tc.expResp, r)
+			}
+			_ = conn.Close()
+			stop()
+			if h.n != 0 {
+				t.Errorf("unexpected number of dispatches => expected: 0, got: %d", h.n)
+			}
+			l := b.String()
+			if !strings.Contains(l, "no recognized request type") || !strings.Contains(l, "baz,foo") {
+				t.Errorf("unexpected log => expected warning with unknown attributes, got: %s", l)
+			}
+		})
+	}
+}
+
+// TestMalformedLineIsSkipped tests that a request with a malformed line is still answered
+// and that the malformed line is logged
+func TestMalformedLineIsSkipped(t *testing.T) {
+	b := &syncBuffer{}
+	s := New(WithLogOutput(b))
+	addr, stop := testServer(t, &s, senderHandler{sender: "spam@example.com"})
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	rb := bufio.NewReader(conn)
+	req := "request=smtpd_access_policy\nprotocol_state=RCPT\nmalformed line\nsender=spam@example.com\n\n"
+	for i := 0; i < 2; i++ {
+		exp := "action=REJECT sender spam@example.com rejected\n"
+		if r := testRequest(t, conn, rb, req); r != exp {
+			t.Errorf("unexpected server response => expected: %q, got: %q", exp, r)
+		}
+	}
+	if !strings.Contains(b.String(), `skipped 1 malformed request line(s), first: "malformed line"`) {
+		t.Errorf("malformed line not logged, got: %s", b.String())
+	}
+}
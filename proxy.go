@@ -0,0 +1,117 @@
+package pps
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderTimeout is the maximum time to receive the PROXY protocol headers of a
+// connection
+const proxyHeaderTimeout = time.Second * 5
+
+// maxProxyHeaderLen is the maximum length of a PROXY protocol v1 header including the
+// line break
+const maxProxyHeaderLen = 107
+
+// ErrProxyHeader is returned if a connection does not start with the expected PROXY
+// protocol headers
+var ErrProxyHeader = errors.New("invalid PROXY protocol header")
+
+// WithTrustedProxyHops enables the PROXY protocol (version 1) for policy connections that
+// are relayed through n trusted proxies. Every proxy in the chain prepends its own header,
+// so the connection is expected to start with exactly n PROXY headers, and the source
+// address of the innermost header is the origin of the connection (see
+// RemoteAddrFromContext). Connections with malformed or insufficient headers are closed.
+// Headers with the UNKNOWN protocol keep the address of the previous hop. The PROXY
+// protocol is not supported on TLS listeners. A value of 0 disables the PROXY protocol,
+// which is the default
+func WithTrustedProxyHops(n int) ServerOpt {
+	return func(s *Server) {
+		s.proxyHops = n
+	}
+}
+
+// RemoteAddrFromContext returns the remote address of the policy connection of the given
+// connection context (see PolicySet.Context). If the PROXY protocol is enabled (see
+// WithTrustedProxyHops), this is the origin address of the connection. If the context is
+// not a connection context, nil is returned
+func RemoteAddrFromContext(ctx context.Context) net.Addr {
+	a, _ := ctx.Value(ctxRemoteAddr).(net.Addr)
+	return a
+}
+
+// readProxyHeaders reads the PROXY protocol headers of the trusted proxies from the
+// connection and returns the connection context with the origin address
+func (s *Server) readProxyHeaders(ctx context.Context, c *connection) (context.Context, error) {
+	if s.proxyHops <= 0 {
+		return ctx, nil
+	}
+	if err := c.conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout)); err != nil {
+		return ctx, fmt.Errorf("failed to set read deadline on connection: %w", err)
+	}
+	defer func() { _ = c.conn.SetReadDeadline(time.Time{}) }()
+	a := RemoteAddrFromContext(ctx)
+	for i := 0; i < s.proxyHops; i++ {
+		pa, err := readProxyHeader(c.rb)
+		if err != nil {
+			return ctx, fmt.Errorf("PROXY header %d of %d: %w", i+1, s.proxyHops, err)
+		}
+		if pa != nil {
+			a = pa
+		}
+	}
+	return context.WithValue(ctx, ctxRemoteAddr, a), nil
+}
+
+// readProxyHeader reads a single PROXY protocol v1 header from the given reader and
+// returns its source address. For the UNKNOWN protocol, nil is returned
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	p, err := r.Peek(6)
+	if err != nil {
+		return nil, err
+	}
+	if string(p) != "PROXY " {
+		return nil, ErrProxyHeader
+	}
+	var sb strings.Builder
+	for sb.Len() < maxProxyHeaderLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == '\n' {
+			return parseProxyHeader(strings.TrimSuffix(sb.String(), "\r"))
+		}
+		sb.WriteByte(b)
+	}
+	return nil, fmt.Errorf("%w: header exceeds %d bytes", ErrProxyHeader, maxProxyHeaderLen)
+}
+
+// parseProxyHeader parses the given PROXY protocol v1 header line without line break
+func parseProxyHeader(l string) (net.Addr, error) {
+	f := strings.Split(l, " ")
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: %q", ErrProxyHeader, l)
+	}
+	ip := net.ParseIP(f[2])
+	if ip == nil || (ip.To4() != nil) != (f[1] == "TCP4") || net.ParseIP(f[3]) == nil {
+		return nil, fmt.Errorf("%w: invalid address in %q", ErrProxyHeader, l)
+	}
+	sp, err := strconv.ParseUint(f[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid source port in %q", ErrProxyHeader, l)
+	}
+	if _, err := strconv.ParseUint(f[5], 10, 16); err != nil {
+		return nil, fmt.Errorf("%w: invalid destination port in %q", ErrProxyHeader, l)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(sp)}, nil
+}
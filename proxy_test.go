@@ -0,0 +1,118 @@
+package pps
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestWithTrustedProxyHops tests that the origin address is resolved from a chain of PROXY
+// headers and that connections with malformed or insufficient headers are closed
+func TestWithTrustedProxyHops(t *testing.T) {
+	const (
+		outer = "PROXY TCP4 198.51.100.7 192.0.2.10 40000 10005\r\n"
+		inner = "PROXY TCP4 203.0.113.5 198.51.100.7 50000 10005\r\n"
+	)
+	testTable := []struct {
+		testName string
+		hops     int
+		headers  string
+		expAddr  string
+	}{
+		{`Chain of two proxies`, 2, outer + inner, "203.0.113.5:50000"},
+		{`Single proxy`, 1, outer, "198.51.100.7:40000"},
+		{`Untrusted inner header is not evaluated`, 1, outer + inner, "198.51.100.7:40000"},
+		{`UNKNOWN protocol keeps previous hop`, 2, outer + "PROXY UNKNOWN\r\n", "198.51.100.7:40000"},
+		{`IPv6 origin`, 1, "PROXY TCP6 2001:db8::1 2001:db8::2 50000 10005\r\n", "[2001:db8::1]:50000"},
+		{`Insufficient headers`, 2, outer, ""},
+		{`Missing header`, 1, "", ""},
+		{`Malformed header`, 1, "PROXY TCP4 203.0.113.5\r\n", ""},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			ac := make(chan string, 1)
+			h := HandlerFunc(func(ps *PolicySet) PostfixResp {
+				ac <- RemoteAddrFromContext(ps.Context()).String()
+				return RespOk
+			})
+			s := New(WithTrustedProxyHops(tc.hops))
+			addr, stop := testServer(t, &s, h)
+			defer stop()
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("failed to connect to running server: %s", err)
+			}
+			defer func() { _ = conn.Close() }()
+			if _, err := conn.Write([]byte(tc.headers + exampleReq)); err != nil {
+				t.Fatalf("failed to send request to server: %s", err)
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+			r, err := bufio.NewReader(conn).ReadString('\n')
+			if tc.expAddr == "" {
+				if err == nil {
+					t.Errorf("connection with invalid PROXY headers was not closed => got: %q", r)
+				}
+				return
+			}
+			if r != "action=OK\n" {
+				t.Errorf("unexpected server response => expected: %q, got: %q (%v)", "action=OK\n", r, err)
+			}
+			if a := <-ac; a != tc.expAddr {
+				t.Errorf("unexpected origin address => expected: %s, got: %s", tc.expAddr, a)
+			}
+		})
+	}
+}
+
+// TestRemoteAddrFromContextWithoutProxy tests that the remote address of the connection is
+// available without PROXY protocol
+func TestRemoteAddrFromContextWithoutProxy(t *testing.T) {
+	ac := make(chan net.Addr, 1)
+	h := HandlerFunc(func(ps *PolicySet) PostfixResp {
+		ac <- RemoteAddrFromContext(ps.Context())
+		return RespOk
+	})
+	s := New()
+	addr, stop := testServer(t, &s, h)
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = testRequest(t, conn, bufio.NewReader(conn), exampleReq)
+	if a := <-ac; a == nil || a.String() != conn.LocalAddr().String() {
+		t.Errorf("unexpected remote address => expected: %s, got: %v", conn.LocalAddr(), a)
+	}
+}
+
+// TestParseProxyHeader tests the parsing of PROXY protocol v1 header lines
+func TestParseProxyHeader(t *testing.T) {
+	testTable := []struct {
+		testName   string
+		line       string
+		shouldFail bool
+	}{
+		{`Valid TCP4`, "PROXY TCP4 192.0.2.1 192.0.2.2 1234 25", false},
+		{`Valid TCP6`, "PROXY TCP6 2001:db8::1 2001:db8::2 1234 25", false},
+		{`UNKNOWN`, "PROXY UNKNOWN 192.0.2.1 192.0.2.2 1234 25", false},
+		{`Protocol mismatch`, "PROXY TCP4 2001:db8::1 2001:db8::2 1234 25", true},
+		{`Invalid address`, "PROXY TCP4 192.0.2.300 192.0.2.2 1234 25", true},
+		{`Invalid port`, "PROXY TCP4 192.0.2.1 192.0.2.2 70000 25", true},
+		{`Unsupported protocol`, "PROXY UDP4 192.0.2.1 192.0.2.2 1234 25", true},
+		{`Missing fields`, "PROXY TCP4 192.0.2.1", true},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			_, err := parseProxyHeader(tc.line)
+			if tc.shouldFail != (err != nil) {
+				t.Errorf("unexpected result => expected failure: %t, got: %v", tc.shouldFail, err)
+			}
+			if err != nil && !errors.Is(err, ErrProxyHeader) {
+				t.Errorf("error does not wrap ErrProxyHeader => got: %s", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package pps
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestWithAcceptRateLimit tests the New() method with the WithAcceptRateLimit() option
+func TestWithAcceptRateLimit(t *testing.T) {
+	s := New(WithAcceptRateLimit(10, 5))
+	if s.acceptLimit == nil {
+		t.Errorf("policy server creation failed: accept rate limit not set")
+		return
+	}
+	if s.acceptLimit.rate != 10 || s.acceptLimit.burst != 5 {
+		t.Errorf("policy server creation failed: accept rate limit mismatch => Expected: 10/5, got: %v/%v",
+			s.acceptLimit.rate, s.acceptLimit.burst)
+	}
+	s = New(WithAcceptRateLimit(0, 5))
+	if s.acceptLimit != nil {
+		t.Errorf("policy server creation failed: accept rate limit set for rate of 0")
+	}
+}
+
+// TestAcceptRateLimitBurst drives a burst of connections against a rate limited server and
+// makes sure that the accept rate stays near the configured limit
+func TestAcceptRateLimitBurst(t *testing.T) {
+	rate := 20.0
+	numConns := 10
+	s := New(WithAcceptRateLimit(rate, 1))
+	addr, stop := testServer(t, &s, Hi{})
+	defer stop()
+
+	var wg sync.WaitGroup
+	st := time.Now()
+	for i := 0; i < numConns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Errorf("failed to connect to running server: %s", err)
+				return
+			}
+			defer func() { _ = conn.Close() }()
+			resp := testRequest(t, conn, bufio.NewReader(conn), exampleReq)
+			if exresp := fmt.Sprintf("action=%s\n", RespDunno); resp != exresp {
+				t.Errorf("unexpected server response => expected: %s, got: %s", exresp, resp)
+			}
+		}()
+	}
+	wg.Wait()
+	el := time.Since(st)
+
+	// The first connection is served from the burst, all others have to wait for a token
+	minDur := time.Duration(float64(numConns-1) / rate * float64(time.Second))
+	if el < minDur-time.Millisecond*50 {
+		t.Errorf("accept rate limit exceeded => expected at least: %s, got: %s", minDur, el)
+	}
+	if el > minDur*3 {
+		t.Errorf("accept rate limit too strict => expected at most: %s, got: %s", minDur*3, el)
+	}
+}
@@ -0,0 +1,228 @@
+package pps
+
+import (
+	"net"
+	"sort"
+	"sync"
+)
+
+// PolicySetRecorder wraps a PolicySet and records which of its attributes are read
+// through the getter methods. It is meant as a debugging aid for handler authors
+// who want to find out which attributes their handlers actually depend on
+type PolicySetRecorder struct {
+	ps  *PolicySet
+	mu  sync.Mutex
+	acc map[string]struct{}
+}
+
+// NewPolicySetRecorder returns a new PolicySetRecorder for the given PolicySet
+func NewPolicySetRecorder(ps *PolicySet) *PolicySetRecorder {
+	return &PolicySetRecorder{ps: ps, acc: make(map[string]struct{})}
+}
+
+// PolicySet returns the underlying PolicySet. Accessing the PolicySet directly is
+// not recorded
+func (r *PolicySetRecorder) PolicySet() *PolicySet {
+	return r.ps
+}
+
+// Accessed returns the sorted list of postfix attribute names that have been read
+// through the recorder
+func (r *PolicySetRecorder) Accessed() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	al := make([]string, 0, len(r.acc))
+	for a := range r.acc {
+		al = append(al, a)
+	}
+	sort.Strings(al)
+	return al
+}
+
+// Reset clears the list of accessed attributes
+func (r *PolicySetRecorder) Reset() {
+	r.mu.Lock()
+	r.acc = make(map[string]struct{})
+	r.mu.Unlock()
+}
+
+// record marks the given attribute as accessed
+func (r *PolicySetRecorder) record(a string) {
+	r.mu.Lock()
+	r.acc[a] = struct{}{}
+	r.mu.Unlock()
+}
+
+// Request returns the "request" attribute of the PolicySet
+func (r *PolicySetRecorder) Request() string {
+	r.record("request")
+	return r.ps.Request
+}
+
+// ProtocolState returns the "protocol_state" attribute of the PolicySet
+func (r *PolicySetRecorder) ProtocolState() string {
+	r.record("protocol_state")
+	return r.ps.ProtocolState
+}
+
+// ProtocolName returns the "protocol_name" attribute of the PolicySet
+func (r *PolicySetRecorder) ProtocolName() string {
+	r.record("protocol_name")
+	return r.ps.ProtocolName
+}
+
+// HELOName returns the "helo_name" attribute of the PolicySet
+func (r *PolicySetRecorder) HELOName() string {
+	r.record("helo_name")
+	return r.ps.HELOName
+}
+
+// QueueId returns the "queue_id" attribute of the PolicySet
+func (r *PolicySetRecorder) QueueId() string {
+	r.record("queue_id")
+	return r.ps.QueueId
+}
+
+// Sender returns the "sender" attribute of the PolicySet
+func (r *PolicySetRecorder) Sender() string {
+	r.record("sender")
+	return r.ps.Sender
+}
+
+// Recipient returns the "recipient" attribute of the PolicySet
+func (r *PolicySetRecorder) Recipient() string {
+	r.record("recipient")
+	return r.ps.Recipient
+}
+
+// RecipientCount returns the "recipient_count" attribute of the PolicySet
+func (r *PolicySetRecorder) RecipientCount() uint64 {
+	r.record("recipient_count")
+	return r.ps.RecipientCount
+}
+
+// ClientAddress returns the "client_address" attribute of the PolicySet
+func (r *PolicySetRecorder) ClientAddress() net.IP {
+	r.record("client_address")
+	return r.ps.ClientAddress
+}
+
+// ClientName returns the "client_name" attribute of the PolicySet
+func (r *PolicySetRecorder) ClientName() string {
+	r.record("client_name")
+	return r.ps.ClientName
+}
+
+// ReverseClientName returns the "reverse_client_name" attribute of the PolicySet
+func (r *PolicySetRecorder) ReverseClientName() string {
+	r.record("reverse_client_name")
+	return r.ps.ReverseClientName
+}
+
+// Instance returns the "instance" attribute of the PolicySet
+func (r *PolicySetRecorder) Instance() string {
+	r.record("instance")
+	return r.ps.Instance
+}
+
+// SASLMethod returns the "sasl_method" attribute of the PolicySet
+func (r *PolicySetRecorder) SASLMethod() string {
+	r.record("sasl_method")
+	return r.ps.SASLMethod
+}
+
+// SASLUsername returns the "sasl_username" attribute of the PolicySet
+func (r *PolicySetRecorder) SASLUsername() string {
+	r.record("sasl_username")
+	return r.ps.SASLUsername
+}
+
+// SASLSender returns the "sasl_sender" attribute of the PolicySet
+func (r *PolicySetRecorder) SASLSender() string {
+	r.record("sasl_sender")
+	return r.ps.SASLSender
+}
+
+// Size returns the "size" attribute of the PolicySet
+func (r *PolicySetRecorder) Size() uint64 {
+	r.record("size")
+	return r.ps.Size
+}
+
+// CCertSubject returns the "ccert_subject" attribute of the PolicySet
+func (r *PolicySetRecorder) CCertSubject() string {
+	r.record("ccert_subject")
+	return r.ps.CCertSubject
+}
+
+// CCertIssuer returns the "ccert_issuer" attribute of the PolicySet
+func (r *PolicySetRecorder) CCertIssuer() string {
+	r.record("ccert_issuer")
+	return r.ps.CCertIssuer
+}
+
+// CCertFingerprint returns the "ccert_fingerprint" attribute of the PolicySet
+func (r *PolicySetRecorder) CCertFingerprint() string {
+	r.record("ccert_fingerprint")
+	return r.ps.CCertFingerprint
+}
+
+// EncryptionProtocol returns the "encryption_protocol" attribute of the PolicySet
+func (r *PolicySetRecorder) EncryptionProtocol() string {
+	r.record("encryption_protocol")
+	return r.ps.EncryptionProtocol
+}
+
+// EncryptionCipher returns the "encryption_cipher" attribute of the PolicySet
+func (r *PolicySetRecorder) EncryptionCipher() string {
+	r.record("encryption_cipher")
+	return r.ps.EncryptionCipher
+}
+
+// EncryptionKeysize returns the "encryption_keysize" attribute of the PolicySet
+func (r *PolicySetRecorder) EncryptionKeysize() uint64 {
+	r.record("encryption_keysize")
+	return r.ps.EncryptionKeysize
+}
+
+// ETRNDomain returns the "etrn_domain" attribute of the PolicySet
+func (r *PolicySetRecorder) ETRNDomain() string {
+	r.record("etrn_domain")
+	return r.ps.ETRNDomain
+}
+
+// Stress returns the "stress" attribute of the PolicySet
+func (r *PolicySetRecorder) Stress() bool {
+	r.record("stress")
+	return r.ps.Stress
+}
+
+// CCertPubkeyFingerprint returns the "ccert_pubkey_fingerprint" attribute of the PolicySet
+func (r *PolicySetRecorder) CCertPubkeyFingerprint() string {
+	r.record("ccert_pubkey_fingerprint")
+	return r.ps.CCertPubkeyFingerprint
+}
+
+// ClientPort returns the "client_port" attribute of the PolicySet
+func (r *PolicySetRecorder) ClientPort() uint64 {
+	r.record("client_port")
+	return r.ps.ClientPort
+}
+
+// PolicyContext returns the "policy_context" attribute of the PolicySet
+func (r *PolicySetRecorder) PolicyContext() string {
+	r.record("policy_context")
+	return r.ps.PolicyContext
+}
+
+// ServerAddress returns the "server_address" attribute of the PolicySet
+func (r *PolicySetRecorder) ServerAddress() net.IP {
+	r.record("server_address")
+	return r.ps.ServerAddress
+}
+
+// ServerPort returns the "server_port" attribute of the PolicySet
+func (r *PolicySetRecorder) ServerPort() uint64 {
+	r.record("server_port")
+	return r.ps.ServerPort
+}
@@ -0,0 +1,42 @@
+package pps
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+// TestPolicySetRecorder tests that the PolicySetRecorder reports the attributes that a
+// sample handler read
+func TestPolicySetRecorder(t *testing.T) {
+	ps := &PolicySet{
+		Sender:        "tester@example.com",
+		ClientAddress: net.ParseIP("192.0.2.1"),
+		HELOName:      "mail.example.com",
+	}
+	sh := func(r *PolicySetRecorder) PostfixResp {
+		if r.ClientAddress().IsLoopback() {
+			return RespOk
+		}
+		if r.Sender() == "" || r.Sender() == "spammer@example.com" {
+			return RespReject
+		}
+		return RespDunno
+	}
+
+	r := NewPolicySetRecorder(ps)
+	if resp := sh(r); resp != RespDunno {
+		t.Errorf("unexpected handler response => expected: %s, got: %s", RespDunno, resp)
+	}
+	exp := []string{"client_address", "sender"}
+	if acc := r.Accessed(); !reflect.DeepEqual(acc, exp) {
+		t.Errorf("unexpected accessed attributes => expected: %v, got: %v", exp, acc)
+	}
+	if r.PolicySet() != ps {
+		t.Errorf("recorder returned unexpected PolicySet")
+	}
+	r.Reset()
+	if acc := r.Accessed(); len(acc) != 0 {
+		t.Errorf("accessed attributes not reset => got: %v", acc)
+	}
+}
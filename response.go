@@ -0,0 +1,57 @@
+package pps
+
+import (
+	"bytes"
+)
+
+// Response is the structured representation of a response to the postfix server
+type Response struct {
+	// Action is the postfix action of the response
+	Action PostfixResp
+
+	// Message is an optional text that is appended to the Action
+	Message string
+
+	// Extra holds additional lines (usually "name=value" attributes) that are sent after
+	// the action line. Note that the postfix policy client only evaluates the action
+	// attribute, so Extra is meant for protocol extensions and non-postfix clients
+	Extra []string
+
+	// Close signals the server to close the connection after the response has been sent
+	// (see PolicySet.CloseAfterResponse)
+	Close bool
+
+	// fallback is true if the Response has been decided by a fallback path of the server
+	// instead of the Handler
+	fallback bool
+}
+
+// ResponseHandler is an optional interface for a Handler that returns a structured Response
+// instead of a plain PostfixResp. If a Handler implements the ResponseHandler interface, the
+// server calls HandleResponse instead of Handle
+type ResponseHandler interface {
+	HandleResponse(*PolicySet) Response
+}
+
+// action returns the Action of the Response with the optional Message appended
+func (r Response) action() PostfixResp {
+	if r.Message == "" {
+		return r.Action
+	}
+	return TextResponseOpt(r.Action, r.Message)
+}
+
+// render returns the wire representation of the Response. Line breaks in the action and
+// in the extra lines are sanitized and the response is terminated by an empty line
+func (r Response) render() []byte {
+	var b bytes.Buffer
+	b.WriteString("action=")
+	b.WriteString(string(sanitizeResp(r.action())))
+	b.WriteByte('\n')
+	for _, e := range r.Extra {
+		b.WriteString(string(sanitizeResp(PostfixResp(e))))
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
@@ -0,0 +1,75 @@
+package pps
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// TestResponseRender tests the render() method for each combination of the Response fields
+func TestResponseRender(t *testing.T) {
+	testTable := []struct {
+		testName string
+		resp     Response
+		expWire  string
+	}{
+		{`Action only`, Response{Action: RespDunno}, "action=DUNNO\n\n"},
+		{`Action with message`, Response{Action: RespReject, Message: "go away"}, "action=REJECT go away\n\n"},
+		{`Action with extra lines`, Response{Action: RespOk, Extra: []string{"foo=bar", "baz=qux"}},
+			"action=OK\nfoo=bar\nbaz=qux\n\n"},
+		{`Action with message and extra lines`, Response{Action: RespDefer, Message: "later",
+			Extra: []string{"foo=bar"}}, "action=DEFER later\nfoo=bar\n\n"},
+		{`Close does not change the wire format`, Response{Action: RespOk, Close: true}, "action=OK\n\n"},
+		{`Line breaks are sanitized`, Response{Action: RespReject, Message: "a\nb", Extra: []string{"c\r\nd"}},
+			"action=REJECT a b\nc d\n\n"},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			if w := string(tc.resp.render()); w != tc.expWire {
+				t.Errorf("unexpected rendered response => expected: %q, got: %q", tc.expWire, w)
+			}
+		})
+	}
+}
+
+// respHandler is a Handler that also implements the ResponseHandler interface
+type respHandler struct {
+	r Response
+}
+
+// Handle is the function required by the Handler Interface
+func (h respHandler) Handle(*PolicySet) PostfixResp {
+	return RespDunno
+}
+
+// HandleResponse is the function required by the ResponseHandler Interface
+func (h respHandler) HandleResponse(*PolicySet) Response {
+	return h.r
+}
+
+// TestRunDialResponseHandler tests that the server prefers the ResponseHandler interface and
+// closes the connection if requested by the Response
+func TestRunDialResponseHandler(t *testing.T) {
+	s := New()
+	h := respHandler{r: Response{Action: RespReject, Message: "rich response", Extra: []string{"foo=bar"},
+		Close: true}}
+	addr, stop := testServer(t, &s, h)
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if _, err := conn.Write([]byte(exampleReq)); err != nil {
+		t.Fatalf("failed to send request to server: %s", err)
+	}
+	b, err := io.ReadAll(bufio.NewReader(conn))
+	if err != nil && !errors.Is(err, io.EOF) {
+		t.Errorf("failed to read response from server: %s", err)
+	}
+	if exp := "action=REJECT rich response\nfoo=bar\n\n"; string(b) != exp {
+		t.Errorf("unexpected server response => expected: %q, got: %q", exp, string(b))
+	}
+}
@@ -0,0 +1,47 @@
+package pps
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// WithReusePort sets the number of listening sockets that Run opens per TCP listening
+// address. On Linux, the sockets are bound with SO_REUSEPORT to the same address, each
+// socket is served by its own accept loop and the kernel distributes the incoming
+// connections between them. This removes the single accept loop as a bottleneck on busy
+// mail gateways. On other platforms and for unix sockets, a single socket is opened
+func WithReusePort(n int) ServerOpt {
+	return func(s *Server) {
+		s.reusePort = n
+	}
+}
+
+// listen binds the listeners for the given listening address. If WithReusePort is set
+// and supported, the configured number of sockets is bound to the address
+func (s *Server) listen(a string) ([]net.Listener, error) {
+	if s.reusePort <= 1 || !reusePortSupported || !strings.HasPrefix(s.ln, "tcp") {
+		l, err := net.Listen(s.ln, a)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+
+	lc := net.ListenConfig{Control: reusePortControl}
+	ls := make([]net.Listener, 0, s.reusePort)
+	for i := 0; i < s.reusePort; i++ {
+		l, err := lc.Listen(context.Background(), s.ln, a)
+		if err != nil {
+			for _, l := range ls {
+				_ = l.Close()
+			}
+			return nil, err
+		}
+		// Bind the remaining sockets to the actual address, in case an ephemeral port
+		// has been requested
+		a = l.Addr().String()
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
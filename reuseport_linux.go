@@ -0,0 +1,26 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le && !sparc64
+// +build linux,!mips,!mipsle,!mips64,!mips64le,!sparc64
+
+package pps
+
+import (
+	"syscall"
+)
+
+// soReusePort is the SO_REUSEPORT socket option, which is missing in the syscall package
+// for most Linux architectures
+const soReusePort = 0xf
+
+// reusePortSupported reports whether WithReusePort is supported on this platform
+const reusePortSupported = true
+
+// reusePortControl sets SO_REUSEPORT on the socket before it is bound
+func reusePortControl(_, _ string, rc syscall.RawConn) error {
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,16 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le || sparc64
+// +build !linux mips mipsle mips64 mips64le sparc64
+
+package pps
+
+import (
+	"syscall"
+)
+
+// reusePortSupported reports whether WithReusePort is supported on this platform
+const reusePortSupported = false
+
+// reusePortControl is a no-op on platforms without SO_REUSEPORT support
+func reusePortControl(_, _ string, _ syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,84 @@
+package pps
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestServer_listen tests that WithReusePort binds the configured number of sockets to
+// the same address on supported platforms and a single socket otherwise
+func TestServer_listen(t *testing.T) {
+	tt := []struct {
+		name string
+		n    int
+		ln   string
+		want int
+	}{
+		{"no reuse", 0, "tcp", 1},
+		{"single socket", 1, "tcp", 1},
+		{"four sockets", 4, "tcp", 4},
+		{"four sockets on tcp4", 4, "tcp4", 4},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			s := New(WithNetwork(tc.ln), WithReusePort(tc.n))
+			ls, err := s.listen("127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("failed to bind listeners: %s", err)
+			}
+			defer func() {
+				for _, l := range ls {
+					_ = l.Close()
+				}
+			}()
+			want := tc.want
+			if !reusePortSupported {
+				want = 1
+			}
+			if len(ls) != want {
+				t.Fatalf("unexpected number of listeners => expected: %d, got: %d", want, len(ls))
+			}
+			for _, l := range ls[1:] {
+				if l.Addr().String() != ls[0].Addr().String() {
+					t.Errorf("listener bound to unexpected address => expected: %s, got: %s",
+						ls[0].Addr(), l.Addr())
+				}
+			}
+		})
+	}
+}
+
+// TestWithReusePort tests that Run serves requests with several SO_REUSEPORT sockets
+func TestWithReusePort(t *testing.T) {
+	a := net.JoinHostPort("127.0.0.1", freePort(t))
+	s := New(WithListenAddrs(a), WithReusePort(4))
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), CtxNoLog, true))
+	ec := make(chan error, 1)
+	go func() { ec <- s.Run(ctx, Hi{r: RespOk}) }()
+	for i := 0; i < 16; i++ {
+		var conn net.Conn
+		var err error
+		for dl := time.Now().Add(time.Second); time.Now().Before(dl); time.Sleep(time.Millisecond * 10) {
+			if conn, err = net.Dial("tcp", a); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			t.Fatalf("failed to connect to %s: %s", a, err)
+		}
+		if r := testRequest(t, conn, bufio.NewReader(conn), exampleReq); r != "action=OK\n" {
+			t.Errorf("unexpected server response => expected: %q, got: %q", "action=OK\n", r)
+		}
+		_ = conn.Close()
+	}
+	cancel()
+	if err := <-ec; err != nil {
+		t.Errorf("could not run server: %s", err)
+	}
+	if s.Config().ReusePort != 4 {
+		t.Errorf("unexpected ReusePort in config => expected: %d, got: %d", 4, s.Config().ReusePort)
+	}
+}
@@ -0,0 +1,36 @@
+package pps
+
+import (
+	"crypto/subtle"
+)
+
+// WithSharedSecret requires every policy request to carry the given secret in the
+// attribute with the name attr. The attribute can either be "policy_context" (see the
+// policy_context parameter of check_policy_service) or any custom attribute that is not
+// otherwise known to the policy server. Requests with a missing or non-matching secret
+// are not handed to the Handler but answered with the shared secret action (RespDefer
+// by default, see WithSharedSecretAction)
+func WithSharedSecret(attr, secret string) ServerOpt {
+	return func(s *Server) {
+		s.secretAttr = attr
+		s.secret = secret
+	}
+}
+
+// WithSharedSecretAction overrides the response that is sent for requests that failed
+// the shared secret check
+func WithSharedSecretAction(r PostfixResp) ServerOpt {
+	return func(s *Server) {
+		s.secretAction = r
+	}
+}
+
+// validSecret returns true if the PolicySet carries the configured shared secret. The
+// comparison is performed in constant time
+func (s *Server) validSecret(ps *PolicySet) bool {
+	v := ps.Extra[s.secretAttr]
+	if s.secretAttr == "policy_context" {
+		v = ps.PolicyContext
+	}
+	return subtle.ConstantTimeCompare([]byte(v), []byte(s.secret)) == 1
+}
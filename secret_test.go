@@ -0,0 +1,46 @@
+package pps
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// TestWithSharedSecret tests the WithSharedSecret() option with matching and non-matching
+// secrets
+func TestWithSharedSecret(t *testing.T) {
+	testTable := []struct {
+		testName string
+		attr     string
+		reqAttr  string
+		opts     []ServerOpt
+		expResp  PostfixResp
+	}{
+		{`Matching policy_context`, "policy_context", "policy_context=s3cret", nil, RespOk},
+		{`Non-matching policy_context`, "policy_context", "policy_context=wrong", nil, RespDefer},
+		{`Matching custom attribute`, "pps_token", "pps_token=s3cret", nil, RespOk},
+		{`Non-matching custom attribute`, "pps_token", "pps_token=s3cre", nil, RespDefer},
+		{`Missing custom attribute`, "pps_token", "other=s3cret", nil, RespDefer},
+		{`Non-matching with custom action`, "pps_token", "pps_token=wrong",
+			[]ServerOpt{WithSharedSecretAction(RespReject)}, RespReject},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			s := New(append(tc.opts, WithSharedSecret(tc.attr, "s3cret"))...)
+			addr, stop := testServer(t, &s, Hi{r: RespOk})
+			defer stop()
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("failed to connect to running server: %s", err)
+			}
+			defer func() { _ = conn.Close() }()
+			req := strings.Replace(exampleReq, "policy_context=\n", tc.reqAttr+"\n", 1)
+			resp := testRequest(t, conn, bufio.NewReader(conn), req)
+			if exresp := fmt.Sprintf("action=%s\n", tc.expResp); resp != exresp {
+				t.Errorf("unexpected server response => expected: %s, got: %s", exresp, resp)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package pps
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// ListenAndServe listens on the TCP address addr (in the form "host:port") and serves the
+// policy requests with the given Handler. An empty host or port falls back to DefaultAddr
+// and DefaultPort. The server is stopped on SIGINT or SIGTERM, in which case nil is
+// returned. Additional ServerOpt can be given to configure the server
+func ListenAndServe(addr string, h Handler, options ...ServerOpt) error {
+	return listenAndServe(addr, h, nil, options...)
+}
+
+// ListenAndServeTLS acts like ListenAndServe, but serves the policy requests over TLS
+// with the certificate and private key in the given PEM files
+func ListenAndServeTLS(addr, certFile, keyFile string, h Handler, options ...ServerOpt) error {
+	c, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS key pair: %w", err)
+	}
+	return listenAndServe(addr, h, &tls.Config{Certificates: []tls.Certificate{c}}, options...)
+}
+
+// listenAndServe runs a new server on the given address until a termination signal is
+// received. If a TLS config is given, the listener is wrapped in a TLS listener
+func listenAndServe(addr string, h Handler, tc *tls.Config, options ...ServerOpt) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("failed to parse listen address %q: %w", addr, err)
+	}
+	if host == "" {
+		host = DefaultAddr
+	}
+	if port == "" {
+		port = DefaultPort
+	}
+	s := New(append([]ServerOpt{WithAddr(host), WithPort(port)}, options...)...)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	l, err := net.Listen("tcp", net.JoinHostPort(s.la, s.lp))
+	if err != nil {
+		return err
+	}
+	if tc != nil {
+		l = tls.NewListener(l, s.tlsConfig(tc))
+	}
+	return s.RunWithListener(ctx, h, l)
+}
@@ -0,0 +1,142 @@
+package pps
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// freePort returns a TCP port that is currently unused on the loopback interface
+func freePort(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create new TCP listener: %s", err)
+	}
+	defer func() { _ = l.Close() }()
+	_, p, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to parse listener address: %s", err)
+	}
+	return p
+}
+
+// TestListenAndServe starts ListenAndServe on an ephemeral port, sends a request and
+// shuts the server down with SIGTERM
+func TestListenAndServe(t *testing.T) {
+	addr := net.JoinHostPort("127.0.0.1", freePort(t))
+	ec := make(chan error, 1)
+	go func() { ec <- ListenAndServe(addr, Hi{r: RespOk}, WithLogOutput(&syncBuffer{})) }()
+
+	var conn net.Conn
+	var err error
+	for dl := time.Now().Add(time.Second * 2); time.Now().Before(dl); time.Sleep(time.Millisecond * 10) {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	if r := testRequest(t, conn, bufio.NewReader(conn), exampleReq); r != "action=OK\n" {
+		t.Errorf("unexpected server response => expected: %q, got: %q", "action=OK\n", r)
+	}
+	_ = conn.Close()
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatalf("failed to send signal: %s", err)
+	}
+	select {
+	case err := <-ec:
+		if err != nil {
+			t.Errorf("ListenAndServe returned an error: %s", err)
+		}
+	case <-time.After(time.Second * 2):
+		t.Errorf("ListenAndServe did not return after SIGTERM")
+	}
+}
+
+// TestListenAndServeErrors tests ListenAndServe and ListenAndServeTLS with invalid
+// arguments
+func TestListenAndServeErrors(t *testing.T) {
+	if err := ListenAndServe("127.0.0.1", Hi{}); err == nil {
+		t.Errorf("ListenAndServe with address without port was supposed to fail")
+	}
+	nf := filepath.Join(t.TempDir(), "missing.pem")
+	if err := ListenAndServeTLS("127.0.0.1:0", nf, nf, Hi{}); err == nil {
+		t.Errorf("ListenAndServeTLS with missing key pair was supposed to fail")
+	}
+}
+
+// pipeListener is an in-memory net.Listener that serves the server ends of net.Pipe
+// connections
+type pipeListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+// newPipeListener returns a new pipeListener
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+// Accept satisfies the net.Listener interface for the pipeListener
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close satisfies the net.Listener interface for the pipeListener
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+// Addr satisfies the net.Listener interface for the pipeListener
+func (l *pipeListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: "pipe", Net: "pipe"}
+}
+
+// dial returns the client end of a new connection to the pipeListener
+func (l *pipeListener) dial() net.Conn {
+	c, sc := net.Pipe()
+	l.conns <- sc
+	return c
+}
+
+// TestServe tests that Serve serves the connections of an injected in-memory listener
+func TestServe(t *testing.T) {
+	l := newPipeListener()
+	s := New()
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), CtxNoLog, true))
+	ec := make(chan error, 1)
+	go func() { ec <- s.Serve(ctx, l, Hi{r: RespOk}) }()
+
+	conn := l.dial()
+	rb := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		if r := testRequest(t, conn, rb, exampleReq); r != "action=OK\n" {
+			t.Errorf("unexpected server response => expected: %q, got: %q", "action=OK\n", r)
+		}
+	}
+	_ = conn.Close()
+	cancel()
+	if err := <-ec; err != nil {
+		t.Errorf("Serve failed: %s", err)
+	}
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("listener was supposed to be closed, got: %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package pps
+
+import (
+	"bytes"
+	"context"
+	"io"
+)
+
+// WithShutdownResponse sets the action that is sent for requests that are still in flight
+// when the server is shutting down. Instead of closing the connections immediately, the
+// server waits for the in-flight requests, whose context is cancelled, answers them with
+// the given action (i. e. RespDefer) and closes the connections afterwards. Idle
+// connections are still closed immediately. By default, the connections are closed as
+// soon as the server is shutting down
+func WithShutdownResponse(r PostfixResp) ServerOpt {
+	return func(s *Server) {
+		s.shutdownResp = r
+	}
+}
+
+// shutdownResponse returns the shutdown response for a request that was in flight when the
+// context has been cancelled (see WithShutdownResponse)
+func (s *Server) shutdownResponse(ctx context.Context, resp Response) Response {
+	if s.shutdownResp == "" || ctx.Err() == nil {
+		return resp
+	}
+	return Response{Action: s.shutdownResp, Close: true, fallback: true}
+}
+
+// begin marks a request of the connection as in flight. It returns false if the connection
+// is shutting down and no further request should be processed
+func (c *connection) begin() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closing {
+		return false
+	}
+	c.busy++
+	return true
+}
+
+// end marks a request of the connection as finished and closes the connection if it is
+// shutting down and no other request is in flight
+func (c *connection) end() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.busy--
+	if c.closing && c.busy == 0 {
+		_ = c.conn.Close()
+	}
+}
+
+// shutdown closes the connection, or defers the closing until all requests in flight have
+// been answered
+func (c *connection) shutdown() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closing = true
+	if c.busy == 0 {
+		_ = c.conn.Close()
+	}
+}
+
+// awaitRequest waits for the first byte of the next request of the connection. It returns
+// false if the connection stops reading requests (see Server.Shutdown) and the read error
+// if the connection failed while waiting
+func (c *connection) awaitRequest() (bool, error) {
+	c.mu.Lock()
+	if c.quit {
+		c.mu.Unlock()
+		return false, nil
+	}
+	if c.buffered() {
+		c.mu.Unlock()
+		return true, nil
+	}
+	c.idle = true
+	c.mu.Unlock()
+
+	_, err := c.rb.Peek(1)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.idle = false
+	return true, err
+}
+
+// buffered returns true if data of the next request has already been buffered
+func (c *connection) buffered() bool {
+	if c.rb.Buffered() > 0 {
+		return true
+	}
+	if c.dec == nil {
+		return false
+	}
+	b, _ := io.ReadAll(c.dec.Buffered())
+	return len(bytes.TrimSpace(b)) > 0
+}
+
+// stopReading stops the connection from reading further requests. An idle or queued
+// connection is closed right away, otherwise the connection is closed after the current
+// request
+func (c *connection) stopReading() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.quit = true
+	if c.idle {
+		_ = c.conn.Close()
+	}
+	if c.wake != nil {
+		close(c.wake)
+		c.wake = nil
+	}
+}
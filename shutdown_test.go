@@ -0,0 +1,185 @@
+package pps
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// shutdownHandler is a Handler that signals the start of a request and waits for the
+// cancellation of the request context before it responds
+type shutdownHandler struct {
+	started chan struct{}
+	r       PostfixResp
+}
+
+// Handle is the function required by the Handler Interface
+func (h shutdownHandler) Handle(ps *PolicySet) PostfixResp {
+	h.started <- struct{}{}
+	<-ps.Context().Done()
+	return h.r
+}
+
+// TestWithShutdownResponse tests that a request in flight during the shutdown of the server
+// is answered with the shutdown response instead of the response of the handler
+func TestWithShutdownResponse(t *testing.T) {
+	testTable := []struct {
+		testName string
+		shutResp PostfixResp
+		expResp  string
+	}{
+		{`Shutdown response DEFER`, RespDefer, "action=DEFER\n"},
+		{`Shutdown response DEFER_IF_PERMIT`, RespDeferIfPermit, "action=DEFER_IF_PERMIT\n"},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			s := New(WithShutdownResponse(tc.shutResp))
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("failed to create new TCP listener: %s", err)
+			}
+			ctx, cancel := context.WithCancel(context.WithValue(context.Background(), CtxNoLog, true))
+			defer cancel()
+			ec := make(chan error, 1)
+			h := shutdownHandler{started: make(chan struct{}, 1), r: RespOk}
+			go func() { ec <- s.RunWithListener(ctx, h, l) }()
+
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatalf("failed to connect to server: %s", err)
+			}
+			defer func() { _ = conn.Close() }()
+			if _, err := conn.Write([]byte(exampleReq)); err != nil {
+				t.Fatalf("failed to send request to server: %s", err)
+			}
+			select {
+			case <-h.started:
+			case <-time.After(time.Second * 5):
+				t.Fatal("handler has not been called")
+			}
+			cancel()
+
+			_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
+			resp, _ := bufio.NewReader(conn).ReadString('\n')
+			if resp != tc.expResp {
+				t.Errorf("unexpected response => expected: %q, got: %q", tc.expResp, resp)
+			}
+			if err := <-ec; err != nil {
+				t.Errorf("server returned error: %s", err)
+			}
+		})
+	}
+}
+
+// drainHandler is a Handler that signals the start of a request and waits for its release
+// before it responds
+type drainHandler struct {
+	calls   int64
+	started chan struct{}
+	release chan struct{}
+}
+
+// Handle is the function required by the Handler Interface
+func (h *drainHandler) Handle(*PolicySet) PostfixResp {
+	atomic.AddInt64(&h.calls, 1)
+	h.started <- struct{}{}
+	<-h.release
+	return RespOk
+}
+
+// TestServer_Shutdown tests that Shutdown lets the request in progress finish, but doesn't
+// read any further request on the same connection, and closes idle connections
+func TestServer_Shutdown(t *testing.T) {
+	s := New()
+	if err := s.Shutdown(context.Background()); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Shutdown on stopped server => expected: %s, got: %v", ErrNotRunning, err)
+	}
+	h := &drainHandler{started: make(chan struct{}, 2), release: make(chan struct{})}
+	addr, stop := testServer(t, &s, h)
+	defer stop()
+
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to server: %s", err)
+	}
+	defer func() { _ = idle.Close() }()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if _, err := conn.Write([]byte(exampleReq)); err != nil {
+		t.Fatalf("failed to send request to server: %s", err)
+	}
+	select {
+	case <-h.started:
+	case <-time.After(time.Second * 5):
+		t.Fatal("handler has not been called")
+	}
+	for dl := time.Now().Add(time.Second); s.state.openConns() < 2 && time.Now().Before(dl); {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	ec := make(chan error, 1)
+	go func() { ec <- s.Shutdown(context.Background()) }()
+	for dl := time.Now().Add(time.Second); !s.state.isDraining() && time.Now().Before(dl); {
+		time.Sleep(time.Millisecond * 10)
+	}
+	_ = idle.SetDeadline(time.Now().Add(time.Second * 5))
+	if _, err := idle.Read(make([]byte, 1)); err == nil {
+		t.Errorf("idle connection was supposed to be closed")
+	}
+	if _, err := conn.Write([]byte(exampleReq)); err != nil {
+		t.Fatalf("failed to send request to server: %s", err)
+	}
+	close(h.release)
+
+	_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
+	rb := bufio.NewReader(conn)
+	if resp, err := rb.ReadString('\n'); err != nil || resp != "action=OK\n" {
+		t.Errorf("request in progress => expected: %q, got: %q (%v)", "action=OK\n", resp, err)
+	}
+	_, _ = rb.ReadString('\n')
+	if resp, err := rb.ReadString('\n'); err == nil {
+		t.Errorf("second request was not supposed to be answered, got: %q", resp)
+	}
+	if err := <-ec; err != nil {
+		t.Errorf("Shutdown failed: %s", err)
+	}
+	if n := atomic.LoadInt64(&h.calls); n != 1 {
+		t.Errorf("unexpected number of handler calls => expected: 1, got: %d", n)
+	}
+}
+
+// TestServer_ShutdownTimeout tests that Shutdown closes the remaining connections once its
+// context expires
+func TestServer_ShutdownTimeout(t *testing.T) {
+	s := New()
+	h := &drainHandler{started: make(chan struct{}, 1), release: make(chan struct{})}
+	addr, stop := testServer(t, &s, h)
+	defer stop()
+	defer close(h.release)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if _, err := conn.Write([]byte(exampleReq)); err != nil {
+		t.Fatalf("failed to send request to server: %s", err)
+	}
+	<-h.started
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown => expected: %s, got: %v", context.DeadlineExceeded, err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("connection was supposed to be closed")
+	}
+}
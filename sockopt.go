@@ -0,0 +1,35 @@
+package pps
+
+import (
+	"net"
+)
+
+// WithSocketBuffers sets the size of the kernel read and write buffers of accepted TCP
+// connections (see net.TCPConn.SetReadBuffer). Since policy requests and responses are
+// small, smaller buffers can reduce the memory usage at very high connection counts. A
+// size of 0 keeps the operating system default. Non-TCP connections are not affected
+func WithSocketBuffers(read, write int) ServerOpt {
+	return func(s *Server) {
+		s.readBuf = read
+		s.writeBuf = write
+	}
+}
+
+// setSocketBuffers applies the configured socket buffer sizes to the given connection
+func (s *Server) setSocketBuffers(c net.Conn) error {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if s.readBuf > 0 {
+		if err := tc.SetReadBuffer(s.readBuf); err != nil {
+			return err
+		}
+	}
+	if s.writeBuf > 0 {
+		if err := tc.SetWriteBuffer(s.writeBuf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+//go:build !windows
+// +build !windows
+
+package pps
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"syscall"
+	"testing"
+)
+
+// sockBuf returns the given socket buffer size option of the connection
+func sockBuf(t *testing.T, c net.Conn, opt int) int {
+	t.Helper()
+	cc, ok := c.(*countConn)
+	if ok {
+		c = cc.Conn
+	}
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		t.Fatalf("connection of type %T is not a TCP connection", c)
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		t.Fatalf("failed to access raw connection: %s", err)
+	}
+	var v int
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		v, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, opt)
+	}); err != nil {
+		t.Fatalf("failed to control raw connection: %s", err)
+	}
+	if serr != nil {
+		t.Fatalf("failed to read socket option: %s", serr)
+	}
+	return v
+}
+
+// TestWithSocketBuffers tests that the socket buffer sizes are applied to accepted
+// connections and that requests still round-trip
+func TestWithSocketBuffers(t *testing.T) {
+	const size = 8192
+	def := New()
+	type bufs struct{ read, write int }
+	bc := make(chan bufs, 1)
+	var s Server
+	s = New(WithSocketBuffers(size, size), WithDispatcher(func(ctx context.Context, c net.Conn) {
+		bc <- bufs{read: sockBuf(t, c, syscall.SO_RCVBUF), write: sockBuf(t, c, syscall.SO_SNDBUF)}
+		go func() { _ = s.ServeConn(ctx, c) }()
+	}))
+	addr, stop := testServer(t, &s, Hi{})
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if r := testRequest(t, conn, bufio.NewReader(conn), exampleReq); r != "action=DUNNO\n" {
+		t.Errorf("unexpected server response => expected: %q, got: %q", "action=DUNNO\n", r)
+	}
+
+	// Linux doubles the requested size to allow for bookkeeping overhead
+	b := <-bc
+	if b.read < size || b.read > size*2 {
+		t.Errorf("unexpected socket read buffer size => expected: %d, got: %d", size, b.read)
+	}
+	if b.write < size || b.write > size*2 {
+		t.Errorf("unexpected socket write buffer size => expected: %d, got: %d", size, b.write)
+	}
+	if c := def.Config(); c.SocketReadBuffer != 0 || c.SocketWriteBuffer != 0 {
+		t.Errorf("unexpected default socket buffers => got: %d/%d", c.SocketReadBuffer, c.SocketWriteBuffer)
+	}
+}
@@ -0,0 +1,184 @@
+package pps
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Postfix protocol states as sent in the "protocol_state" attribute
+const (
+	StateConnect      = "CONNECT"
+	StateEHLO         = "EHLO"
+	StateHELO         = "HELO"
+	StateMail         = "MAIL"
+	StateRcpt         = "RCPT"
+	StateData         = "DATA"
+	StateEndOfMessage = "END-OF-MESSAGE"
+	StateVRFY         = "VRFY"
+	StateETRN         = "ETRN"
+)
+
+// stageActions maps actions that only take effect within a mail transaction to the
+// protocol states in which they are effective. Actions that are not listed are
+// considered valid in every protocol state.
+//
+//	HOLD, DISCARD, FILTER, REDIRECT: MAIL, RCPT, DATA, END-OF-MESSAGE
+//	PREPEND:                         MAIL, RCPT, DATA
+var stageActions = map[string][]string{
+	string(RespHold):         {StateMail, StateRcpt, StateData, StateEndOfMessage},
+	string(RespDiscard):      {StateMail, StateRcpt, StateData, StateEndOfMessage},
+	string(TextRespFilter):   {StateMail, StateRcpt, StateData, StateEndOfMessage},
+	string(TextRespRedirect): {StateMail, StateRcpt, StateData, StateEndOfMessage},
+	string(TextRespPrepend):  {StateMail, StateRcpt, StateData},
+}
+
+// stateRanks maps the protocol states of a mail transaction to their position within the
+// transaction. VRFY, ETRN and unknown states can occur at any time and are not listed
+var stateRanks = map[string]int{
+	StateConnect:      1,
+	StateEHLO:         2,
+	StateHELO:         2,
+	StateMail:         3,
+	StateRcpt:         4,
+	StateData:         5,
+	StateEndOfMessage: 6,
+}
+
+// WithStateOrderCheck enables the validation of the protocol state order within a message
+// instance (see PolicySet.Instance). Postfix sends the protocol states of an instance in
+// transaction order (CONNECT, EHLO, MAIL, RCPT, DATA, END-OF-MESSAGE). A request with a
+// protocol state that goes back in this order indicates a misbehaving client or proxy. It
+// is logged with a warning and flagged (see PolicySet.StateOutOfOrder). If action is not
+// empty, the request is answered with the action instead of invoking the Handler.
+// Requests without an instance are not validated
+func WithStateOrderCheck(action PostfixResp) ServerOpt {
+	return func(s *Server) {
+		s.stateOrder = &stateOrder{ttl: DefaultInstanceTTL, now: time.Now}
+		s.stateOrderAction = action
+	}
+}
+
+// StateOutOfOrder returns true if the protocol state of the request goes back in the
+// transaction order of its message instance (see WithStateOrderCheck)
+func (ps *PolicySet) StateOutOfOrder() bool {
+	return ps.outOfOrder
+}
+
+// checkStateOrder validates the protocol state order of the given PolicySet and flags it
+// if it is out of order. It returns false for requests that are out of order
+func (s *Server) checkStateOrder(ps *PolicySet) bool {
+	if s.stateOrder.check(ps.Instance, strings.ToUpper(ps.ProtocolState)) {
+		return true
+	}
+	ps.outOfOrder = true
+	s.logf(ps.Context(), LogLevelWarn, "request %s: protocol state %s is out of order for instance %s",
+		ps.RequestID(), ps.ProtocolState, ps.Instance)
+	return false
+}
+
+// stateOrder tracks the latest protocol state of the message instances
+type stateOrder struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu    sync.Mutex
+	m     map[string]stateOrderEntry
+	swept time.Time
+}
+
+// stateOrderEntry is the latest protocol state of a message instance
+type stateOrderEntry struct {
+	rank int
+	seen time.Time
+}
+
+// check records the protocol state of the given instance. It returns false if the state
+// goes back in the transaction order of the instance. Instances that have not been seen
+// for the TTL are forgotten
+func (so *stateOrder) check(instance, state string) bool {
+	rank, ok := stateRanks[state]
+	if instance == "" || !ok {
+		return true
+	}
+	now := so.now()
+	so.mu.Lock()
+	defer so.mu.Unlock()
+	if so.m == nil {
+		so.m = make(map[string]stateOrderEntry)
+	}
+	if now.Sub(so.swept) >= so.ttl {
+		for k, e := range so.m {
+			if now.Sub(e.seen) >= so.ttl {
+				delete(so.m, k)
+			}
+		}
+		so.swept = now
+	}
+	e, ok := so.m[instance]
+	if ok && now.Sub(e.seen) < so.ttl && rank < e.rank {
+		e.seen = now
+		so.m[instance] = e
+		return false
+	}
+	so.m[instance] = stateOrderEntry{rank: rank, seen: now}
+	return true
+}
+
+// WithStageActionValidation enables the validation of the handler responses against the
+// protocol state of the request. If a handler returns an action that is not effective in
+// the current protocol state (i. e. HOLD at CONNECT), a warning is logged. See stageActions
+// for the list of validated actions and their valid protocol states
+func WithStageActionValidation() ServerOpt {
+	return func(s *Server) {
+		s.stageCheck = true
+	}
+}
+
+// WithStageDefault answers all requests in the given protocol state with the given
+// response without invoking the Handler (i. e. DUNNO at CONNECT), so that the Handler is
+// only called for the protocol states it is interested in. The protocol state is compared
+// case-insensitively. The option can be given multiple times for different states
+func WithStageDefault(state string, resp PostfixResp) ServerOpt {
+	return func(s *Server) {
+		if s.stageDefaults == nil {
+			s.stageDefaults = make(map[string]PostfixResp)
+		}
+		s.stageDefaults[strings.ToUpper(state)] = resp
+	}
+}
+
+// WithProbeDunno answers address verification probes (see PolicySet.IsProbe) with
+// RespDunno without invoking the Handler, so that probes do not trip greylisting or rate
+// limits. senders are the full address verification sender addresses of the postfix
+// instances (see address_verify_sender). Without senders, only VRFY queries are answered
+func WithProbeDunno(senders ...string) ServerOpt {
+	return func(s *Server) {
+		s.probeDunno = true
+		s.probeSenders = senders
+	}
+}
+
+// stageDefault returns the default response for the protocol state of the given PolicySet
+func (s *Server) stageDefault(ps *PolicySet) (PostfixResp, bool) {
+	if len(s.stageDefaults) == 0 {
+		return "", false
+	}
+	r, ok := s.stageDefaults[strings.ToUpper(ps.ProtocolState)]
+	return r, ok
+}
+
+// validStageAction returns false if the given response is not effective in the given
+// protocol state
+func validStageAction(state string, r PostfixResp) bool {
+	vs, ok := stageActions[respAction(r)]
+	if !ok || state == "" {
+		return true
+	}
+	for _, v := range vs {
+		if strings.EqualFold(v, state) {
+			return true
+		}
+	}
+	return false
+}
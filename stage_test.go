@@ -0,0 +1,200 @@
+package pps
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestValidStageAction tests the validStageAction() method with different protocol states
+// and actions
+func TestValidStageAction(t *testing.T) {
+	testTable := []struct {
+		testName string
+		state    string
+		resp     PostfixResp
+		valid    bool
+	}{
+		{`HOLD at CONNECT`, StateConnect, RespHold, false},
+		{`HOLD at RCPT`, StateRcpt, RespHold, true},
+		{`HOLD with text at EHLO`, StateEHLO, TextResponseOpt(RespHold, "text"), false},
+		{`DISCARD at END-OF-MESSAGE`, StateEndOfMessage, RespDiscard, true},
+		{`PREPEND at END-OF-MESSAGE`, StateEndOfMessage, TextResponseNonOpt(TextRespPrepend, "X-Test: 1"), false},
+		{`REJECT at CONNECT`, StateConnect, RespReject, true},
+		{`HOLD without state`, "", RespHold, true},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			if v := validStageAction(tc.state, tc.resp); v != tc.valid {
+				t.Errorf("unexpected stage validation result => expected: %t, got: %t", tc.valid, v)
+			}
+		})
+	}
+}
+
+// TestWithStageActionValidation tests that a warning is logged if a handler returns HOLD
+// at CONNECT
+func TestWithStageActionValidation(t *testing.T) {
+	testTable := []struct {
+		testName string
+		state    string
+		opts     []ServerOpt
+		warn     bool
+	}{
+		{`HOLD at CONNECT`, StateConnect, []ServerOpt{WithStageActionValidation()}, true},
+		{`HOLD at RCPT`, StateRcpt, []ServerOpt{WithStageActionValidation()}, false},
+		{`HOLD at CONNECT without validation`, StateConnect, nil, false},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			b := &syncBuffer{}
+			s := New(append(tc.opts, WithLogOutput(b))...)
+			addr, stop := testServer(t, &s, Hi{r: RespHold})
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("failed to connect to running server: %s", err)
+			}
+			req := strings.Replace(exampleReq, "protocol_state=RCPT", "protocol_state="+tc.state, 1)
+			_ = testRequest(t, conn, bufio.NewReader(conn), req)
+			_ = conn.Close()
+			stop()
+
+			w := strings.Contains(b.String(), "[Server] WARN: ")
+			if w != tc.warn {
+				t.Errorf("unexpected stage validation warning => expected: %t, got: %t (log: %s)",
+					tc.warn, w, b.String())
+			}
+		})
+	}
+}
+
+// TestWithStageDefault tests that requests in protocol states with a default response are
+// answered without invoking the Handler
+func TestWithStageDefault(t *testing.T) {
+	s := New(WithStageDefault("connect", RespDunno), WithStageDefault(StateEHLO, RespOk))
+	testTable := []struct {
+		testName string
+		state    string
+		expResp  PostfixResp
+		expCalls int
+	}{
+		{`CONNECT short-circuits`, StateConnect, RespDunno, 0},
+		{`EHLO short-circuits`, StateEHLO, RespOk, 0},
+		{`RCPT reaches the handler`, StateRcpt, RespReject, 1},
+		{`Empty state reaches the handler`, "", RespReject, 1},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			h := &countHandler{r: RespReject}
+			if r := s.handle(&PolicySet{ProtocolState: tc.state}, h); r.Action != tc.expResp {
+				t.Errorf("unexpected response => expected: %s, got: %s", tc.expResp, r.Action)
+			}
+			if h.n != tc.expCalls {
+				t.Errorf("unexpected number of handler calls => expected: %d, got: %d", tc.expCalls, h.n)
+			}
+		})
+	}
+}
+
+// TestWithProbeDunno tests that probes are answered with DUNNO without invoking the Handler
+func TestWithProbeDunno(t *testing.T) {
+	testTable := []struct {
+		testName string
+		opts     []ServerOpt
+		sender   string
+		expResp  PostfixResp
+		expCalls int
+	}{
+		{`Probe with option`, []ServerOpt{WithProbeDunno("double-bounce@example.org")},
+			"double-bounce@example.org", RespDunno, 0},
+		{`Real request with option`, []ServerOpt{WithProbeDunno("double-bounce@example.org")},
+			"tester@example.com", RespReject, 1},
+		{`Foreign verification sender with option`, []ServerOpt{WithProbeDunno("double-bounce@example.org")},
+			"double-bounce@attacker.example", RespReject, 1},
+		{`Null sender with option`, []ServerOpt{WithProbeDunno("double-bounce@example.org")}, "",
+			RespReject, 1},
+		{`Probe without option`, nil, "double-bounce@example.org", RespReject, 1},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			s := New(tc.opts...)
+			h := &countHandler{r: RespReject}
+			ps := &PolicySet{ProtocolState: StateRcpt, Sender: tc.sender, Recipient: "rcpt@example.com"}
+			if r := s.handle(ps, h); r.Action != tc.expResp {
+				t.Errorf("unexpected response => expected: %s, got: %s", tc.expResp, r.Action)
+			}
+			if h.n != tc.expCalls {
+				t.Errorf("unexpected number of handler calls => expected: %d, got: %d", tc.expCalls, h.n)
+			}
+		})
+	}
+}
+
+// TestWithStateOrderCheck tests that protocol states that go back in the transaction order
+// of their instance are flagged and answered with the configured action
+func TestWithStateOrderCheck(t *testing.T) {
+	testTable := []struct {
+		testName string
+		action   PostfixResp
+		instance string
+		states   []string
+		expResp  PostfixResp
+		expFlag  bool
+	}{
+		{`In order`, RespReject, "1a.2b.3c", []string{StateConnect, StateEHLO, StateMail, StateRcpt, StateRcpt,
+			StateData}, RespOk, false},
+		{`VRFY within the transaction`, RespReject, "1a.2b.3c", []string{StateMail, StateRcpt, StateVRFY,
+			StateRcpt}, RespOk, false},
+		{`RCPT before MAIL`, RespReject, "1a.2b.3c", []string{StateRcpt, StateMail}, RespReject, true},
+		{`EHLO after DATA without action`, "", "1a.2b.3c", []string{StateData, "ehlo"}, RespOk, true},
+		{`Different instances`, RespReject, "", []string{StateRcpt, StateMail}, RespOk, false},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			var buf syncBuffer
+			s := New(WithStateOrderCheck(tc.action), WithLogOutput(&buf))
+			h := &countHandler{r: RespOk}
+			var r Response
+			var ps *PolicySet
+			for i, st := range tc.states {
+				inst := tc.instance
+				if inst == "" {
+					inst = fmt.Sprintf("instance-%d", i)
+				}
+				ps = &PolicySet{ProtocolState: st, Instance: inst}
+				r = s.handle(ps, h)
+			}
+			if r.Action != tc.expResp {
+				t.Errorf("unexpected response => expected: %s, got: %s", tc.expResp, r.Action)
+			}
+			if ps.StateOutOfOrder() != tc.expFlag {
+				t.Errorf("unexpected out of order flag => expected: %t, got: %t", tc.expFlag, ps.StateOutOfOrder())
+			}
+			if logged := strings.Contains(buf.String(), "out of order"); logged != tc.expFlag {
+				t.Errorf("unexpected warning => expected: %t, got: %t", tc.expFlag, logged)
+			}
+		})
+	}
+}
+
+// TestStateOrderTTL tests that instances are forgotten after the TTL
+func TestStateOrderTTL(t *testing.T) {
+	now := time.Now()
+	so := &stateOrder{ttl: time.Minute, now: func() time.Time { return now }}
+	if !so.check("1a.2b.3c", StateRcpt) {
+		t.Errorf("first state of an instance was not supposed to be out of order")
+	}
+	if so.check("1a.2b.3c", StateMail) {
+		t.Errorf("MAIL after RCPT was supposed to be out of order")
+	}
+	now = now.Add(time.Minute * 2)
+	if !so.check("other", StateRcpt) || len(so.m) != 1 {
+		t.Errorf("expired instance was supposed to be removed, got: %d instances", len(so.m))
+	}
+	if !so.check("1a.2b.3c", StateMail) {
+		t.Errorf("MAIL of an expired instance was not supposed to be out of order")
+	}
+}
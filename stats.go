@@ -0,0 +1,153 @@
+package pps
+
+import (
+	"sync/atomic"
+)
+
+// Termination causes of a policy connection as reported in Stats.Terminations
+const (
+	// TerminationEOF is a connection that has been closed by the client
+	TerminationEOF = "eof"
+
+	// TerminationReset is a connection that has been reset by the client
+	TerminationReset = "reset"
+
+	// TerminationReadTimeout is a connection whose read deadline has been exceeded
+	TerminationReadTimeout = "read_timeout"
+
+	// TerminationWriteError is a connection whose response could not be written
+	TerminationWriteError = "write_error"
+
+	// TerminationPanic is a connection that has been terminated by a panic outside of the
+	// Handler. Panics of the Handler are recovered (see WithPanicResponse)
+	TerminationPanic = "panic"
+
+	// TerminationShutdown is a connection that has been closed by the shutdown of the server
+	TerminationShutdown = "shutdown"
+
+	// TerminationServerClose is a connection that has been closed by the server after a
+	// response (see PolicySet.CloseAfterResponse)
+	TerminationServerClose = "server_close"
+
+	// TerminationError is a connection that has been terminated by any other error, i. e. a
+	// failed TLS handshake
+	TerminationError = "error"
+)
+
+// terminationCauses is the list of termination causes that are counted by the server
+var terminationCauses = []string{TerminationEOF, TerminationReset, TerminationReadTimeout,
+	TerminationWriteError, TerminationPanic, TerminationShutdown, TerminationServerClose,
+	TerminationError}
+
+// Stats is a snapshot of the runtime counters of a Server
+type Stats struct {
+	// Connections is the number of accepted connections
+	Connections uint64 `json:"connections"`
+
+	// Requests is the number of handled policy requests
+	Requests uint64 `json:"requests"`
+
+	// ActiveHandlers is the number of currently active handlers
+	ActiveHandlers int64 `json:"active_handlers"`
+
+	// AuditDropped is the number of audit events that have been dropped because the
+	// audit channel was full
+	AuditDropped uint64 `json:"audit_dropped"`
+
+	// WriteTimeouts is the number of responses that could not be written within the write
+	// deadline (see ErrWriteTimeout)
+	WriteTimeouts uint64 `json:"write_timeouts"`
+
+	// ReadTimeouts is the number of connections that have been closed because their read
+	// deadline was exceeded (see ErrReadTimeout)
+	ReadTimeouts uint64 `json:"read_timeouts"`
+
+	// IdleTimeouts is the number of connections that have been closed because no request
+	// has been received within the idle timeout (see WithIdleTimeout). These connections
+	// are included in the ReadTimeouts
+	IdleTimeouts uint64 `json:"idle_timeouts"`
+
+	// OpenConnections is the number of currently open policy connections
+	OpenConnections int64 `json:"open_connections"`
+
+	// ConnectionLimitHits is the number of connections that found the connection limit
+	// reached and have been queued or answered with the overflow response (see
+	// WithMaxConnections)
+	ConnectionLimitHits uint64 `json:"connection_limit_hits"`
+
+	// ConnectionsRejected is the number of connections that have been answered with the
+	// overflow response of the connection limit
+	ConnectionsRejected uint64 `json:"connections_rejected"`
+
+	// HandlerPanics is the number of requests whose Handler panicked and that have been
+	// answered with the panic response (see WithPanicResponse)
+	HandlerPanics uint64 `json:"handler_panics"`
+
+	// RequestLimitHits is the number of connections that have been closed because a request
+	// exceeded the request limits (see WithRequestLimits)
+	RequestLimitHits uint64 `json:"request_limit_hits"`
+
+	// Terminations is the number of terminated connections by their termination cause
+	// (see TerminationEOF and the related constants)
+	Terminations map[string]uint64 `json:"terminations"`
+}
+
+// stats holds the runtime counters of a Server
+type stats struct {
+	connections   uint64
+	requests      uint64
+	auditDropped  uint64
+	writeTimeouts uint64
+	readTimeouts  uint64
+	connLimitHits uint64
+	connRejected  uint64
+	handlerPanics uint64
+	limitHits     uint64
+	idleTimeouts  uint64
+
+	activeHandlers int64
+
+	// terminations holds the counters of the terminationCauses by index
+	terminations [8]uint64
+
+	// latency holds the decision latencies of the requests
+	latency latencyHistogram
+}
+
+// terminated counts the termination of a connection with the given cause
+func (st *stats) terminated(cause string) {
+	for i, tc := range terminationCauses {
+		if tc == cause {
+			atomic.AddUint64(&st.terminations[i], 1)
+			return
+		}
+	}
+}
+
+// Stats returns a snapshot of the runtime counters of the Server
+func (s *Server) Stats() Stats {
+	return Stats{
+		Connections:         atomic.LoadUint64(&s.stats.connections),
+		Requests:            atomic.LoadUint64(&s.stats.requests),
+		ActiveHandlers:      atomic.LoadInt64(&s.stats.activeHandlers),
+		AuditDropped:        atomic.LoadUint64(&s.stats.auditDropped),
+		WriteTimeouts:       atomic.LoadUint64(&s.stats.writeTimeouts),
+		ReadTimeouts:        atomic.LoadUint64(&s.stats.readTimeouts),
+		IdleTimeouts:        atomic.LoadUint64(&s.stats.idleTimeouts),
+		OpenConnections:     int64(s.state.openConns()),
+		ConnectionLimitHits: atomic.LoadUint64(&s.stats.connLimitHits),
+		ConnectionsRejected: atomic.LoadUint64(&s.stats.connRejected),
+		HandlerPanics:       atomic.LoadUint64(&s.stats.handlerPanics),
+		RequestLimitHits:    atomic.LoadUint64(&s.stats.limitHits),
+		Terminations:        s.stats.terminationCounts(),
+	}
+}
+
+// terminationCounts returns the termination counters by their cause
+func (st *stats) terminationCounts() map[string]uint64 {
+	m := make(map[string]uint64, len(terminationCauses))
+	for i, tc := range terminationCauses {
+		m[tc] = atomic.LoadUint64(&st.terminations[i])
+	}
+	return m
+}
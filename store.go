@@ -0,0 +1,178 @@
+package pps
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Store is a key/value store with expiring keys that holds the state of the stateful
+// handlers (like the Greylister). A ttl of 0 means that the key does not expire
+type Store interface {
+	// Get returns the value stored for the given key. If the key does not exist or has
+	// expired, ok is false
+	Get(key string) (value string, ok bool, err error)
+
+	// Set stores the value for the given key with the given ttl
+	Set(key, value string, ttl time.Duration) error
+
+	// Incr increments the counter stored for the given key by one and returns the new
+	// value. If the key does not exist, it is created with the given ttl. Incrementing an
+	// existing key does not change its ttl
+	Incr(key string, ttl time.Duration) (int64, error)
+}
+
+// StoreFailureMode controls how the stateful handlers respond if their Store fails
+type StoreFailureMode int
+
+// Supported store failure modes. The zero value of a handler's FailureMode falls back to
+// the mode of the server (see WithStoreFailureMode), which defaults to FailOpen
+const (
+	// FailOpen hands the request to the Next handler of a stateful handler if the store
+	// fails, so that an infrastructure outage does not block the mail flow
+	FailOpen StoreFailureMode = iota + 1
+
+	// FailClosed answers the request with the restrictive action of a stateful handler if
+	// the store fails
+	FailClosed
+)
+
+// String satisfies the fmt.Stringer interface for the StoreFailureMode
+func (m StoreFailureMode) String() string {
+	switch m {
+	case FailOpen:
+		return "fail-open"
+	case FailClosed:
+		return "fail-closed"
+	default:
+		return "default"
+	}
+}
+
+// WithStoreFailureMode sets the store failure mode of all stateful handlers that do not
+// set their own FailureMode
+func WithStoreFailureMode(m StoreFailureMode) ServerOpt {
+	return func(s *Server) {
+		s.storeFail = m
+	}
+}
+
+// failClosed returns true if a stateful handler with the given failure mode should
+// respond with its restrictive action to a store failure while processing the given
+// PolicySet
+func failClosed(ps *PolicySet, m StoreFailureMode) bool {
+	if m == 0 {
+		m, _ = ps.Context().Value(ctxStoreFailure).(StoreFailureMode)
+	}
+	return m == FailClosed
+}
+
+// sweepInterval is the number of writes after which the MemoryStore removes expired keys
+const sweepInterval = 1024
+
+// MemoryStore is an in-memory implementation of the Store interface
+type MemoryStore struct {
+	mu sync.Mutex
+	m  map[string]memEntry
+	w  int
+}
+
+// memEntry is a value stored in the MemoryStore
+type memEntry struct {
+	v   string
+	exp time.Time
+}
+
+// NewMemoryStore returns a new, empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{m: make(map[string]memEntry)}
+}
+
+// Get satisfies the Store interface for the MemoryStore
+func (ms *MemoryStore) Get(k string) (string, bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	e, ok := ms.get(k, time.Now())
+	return e.v, ok, nil
+}
+
+// Set satisfies the Store interface for the MemoryStore
+func (ms *MemoryStore) Set(k, v string, ttl time.Duration) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	now := time.Now()
+	ms.set(k, memEntry{v: v, exp: expiry(now, ttl)}, now)
+	return nil
+}
+
+// Incr satisfies the Store interface for the MemoryStore
+func (ms *MemoryStore) Incr(k string, ttl time.Duration) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	now := time.Now()
+	e, ok := ms.get(k, now)
+	if !ok {
+		e = memEntry{v: "0", exp: expiry(now, ttl)}
+	}
+	n, err := strconv.ParseInt(e.v, 10, 64)
+	if err != nil {
+		n = 0
+	}
+	n++
+	e.v = strconv.FormatInt(n, 10)
+	ms.set(k, e, now)
+	return n, nil
+}
+
+// get returns the non-expired entry for the given key. The caller must hold the lock
+func (ms *MemoryStore) get(k string, now time.Time) (memEntry, bool) {
+	e, ok := ms.m[k]
+	if !ok {
+		return memEntry{}, false
+	}
+	if !e.exp.IsZero() && !now.Before(e.exp) {
+		delete(ms.m, k)
+		return memEntry{}, false
+	}
+	return e, true
+}
+
+// set stores the entry for the given key and regularly removes expired entries. The
+// caller must hold the lock
+func (ms *MemoryStore) set(k string, e memEntry, now time.Time) {
+	ms.m[k] = e
+	ms.w++
+	if ms.w < sweepInterval {
+		return
+	}
+	ms.w = 0
+	for mk, me := range ms.m {
+		if !me.exp.IsZero() && !now.Before(me.exp) {
+			delete(ms.m, mk)
+		}
+	}
+}
+
+// defaultStore lazily creates the MemoryStore of a stateful handler that has no Store set.
+// The zero value is ready to use
+type defaultStore struct {
+	once sync.Once
+	ms   *MemoryStore
+}
+
+// get returns the given Store or, if it is nil, the lazily created MemoryStore
+func (d *defaultStore) get(st Store) Store {
+	if st != nil {
+		return st
+	}
+	d.once.Do(func() { d.ms = NewMemoryStore() })
+	return d.ms
+}
+
+// expiry returns the expiry time for the given ttl. A ttl of 0 returns the zero time
+func expiry(now time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
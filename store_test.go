@@ -0,0 +1,186 @@
+package pps
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestMemoryStore tests the Get() and Set() methods of the MemoryStore
+func TestMemoryStore(t *testing.T) {
+	ms := NewMemoryStore()
+	if _, ok, err := ms.Get("missing"); ok || err != nil {
+		t.Errorf("unexpected result for missing key => ok: %t, err: %v", ok, err)
+	}
+	if err := ms.Set("key", "value", 0); err != nil {
+		t.Errorf("failed to set key: %s", err)
+	}
+	if v, ok, err := ms.Get("key"); !ok || err != nil || v != "value" {
+		t.Errorf("unexpected result for existing key => value: %s, ok: %t, err: %v", v, ok, err)
+	}
+	if err := ms.Set("exp", "value", time.Millisecond*50); err != nil {
+		t.Errorf("failed to set key: %s", err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if _, ok, _ := ms.Get("exp"); ok {
+		t.Errorf("expired key still present in store")
+	}
+}
+
+// TestMemoryStoreIncr tests the Incr() method of the MemoryStore
+func TestMemoryStoreIncr(t *testing.T) {
+	ms := NewMemoryStore()
+	for i := int64(1); i <= 3; i++ {
+		n, err := ms.Incr("counter", time.Millisecond*100)
+		if err != nil {
+			t.Errorf("failed to increment counter: %s", err)
+		}
+		if n != i {
+			t.Errorf("unexpected counter value => expected: %d, got: %d", i, n)
+		}
+	}
+	time.Sleep(time.Millisecond * 150)
+	if n, _ := ms.Incr("counter", time.Millisecond*100); n != 1 {
+		t.Errorf("counter did not expire => expected: 1, got: %d", n)
+	}
+}
+
+// TestMemoryStoreSweep tests that expired keys are removed from the MemoryStore
+func TestMemoryStoreSweep(t *testing.T) {
+	ms := NewMemoryStore()
+	_ = ms.Set("exp", "value", time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	for i := 0; i < sweepInterval; i++ {
+		_ = ms.Set("key", "value", 0)
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, ok := ms.m["exp"]; ok {
+		t.Errorf("expired key has not been removed from the store")
+	}
+}
+
+// failingStore is a Store that fails all operations
+type failingStore struct{}
+
+// errStoreDown is the error returned by the failingStore
+var errStoreDown = errors.New("store is down")
+
+// Get satisfies the Store interface for the failingStore
+func (failingStore) Get(string) (string, bool, error) { return "", false, errStoreDown }
+
+// Set satisfies the Store interface for the failingStore
+func (failingStore) Set(string, string, time.Duration) error { return errStoreDown }
+
+// Incr satisfies the Store interface for the failingStore
+func (failingStore) Incr(string, time.Duration) (int64, error) { return 0, errStoreDown }
+
+// TestStoreFailureMode tests the stateful handlers with a failing store in both failure
+// modes
+func TestStoreFailureMode(t *testing.T) {
+	ps := &PolicySet{ProtocolState: StateRcpt, Instance: "instance", ClientAddress: net.ParseIP("192.0.2.1"),
+		Sender: "tester@example.com", Recipient: "rcpt@example.com"}
+	testTable := []struct {
+		testName string
+		handler  func(StoreFailureMode) Handler
+	}{
+		{`Greylister`, func(m StoreFailureMode) Handler {
+			return &Greylister{Store: failingStore{}, Action: RespDefer, FailureMode: m}
+		}},
+		{`InstanceRecipientLimiter`, func(m StoreFailureMode) Handler {
+			return &InstanceRecipientLimiter{Store: failingStore{}, MaxRecipients: 10, Action: RespDefer,
+				FailureMode: m}
+		}},
+		{`DistinctRecipientLimiter`, func(m StoreFailureMode) Handler {
+			return &DistinctRecipientLimiter{Store: failingStore{}, MaxRecipients: 10, Action: RespDefer,
+				FailureMode: m}
+		}},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			if r := tc.handler(0).Handle(ps); r != RespDunno {
+				t.Errorf("unexpected response for default mode => expected: %s, got: %s", RespDunno, r)
+			}
+			if r := tc.handler(FailOpen).Handle(ps); r != RespDunno {
+				t.Errorf("unexpected response for fail-open => expected: %s, got: %s", RespDunno, r)
+			}
+			if r := tc.handler(FailClosed).Handle(ps); r != RespDefer {
+				t.Errorf("unexpected response for fail-closed => expected: %s, got: %s", RespDefer, r)
+			}
+		})
+	}
+}
+
+// TestWithStoreFailureMode tests that the server-wide store failure mode is used by the
+// stateful handlers that do not set their own failure mode
+func TestWithStoreFailureMode(t *testing.T) {
+	testTable := []struct {
+		testName string
+		mode     StoreFailureMode
+		handler  StoreFailureMode
+		expResp  string
+	}{
+		{`Server fail-open`, FailOpen, 0, "action=DUNNO\n"},
+		{`Server fail-closed`, FailClosed, 0, "action=DEFER\n"},
+		{`Handler overrides server`, FailClosed, FailOpen, "action=DUNNO\n"},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			s := New(WithStoreFailureMode(tc.mode))
+			addr, stop := testServer(t, &s, &Greylister{Store: failingStore{}, Action: RespDefer,
+				FailureMode: tc.handler})
+			defer stop()
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("failed to connect to running server: %s", err)
+			}
+			defer func() { _ = conn.Close() }()
+			if r := testRequest(t, conn, bufio.NewReader(conn), exampleReq); r != tc.expResp {
+				t.Errorf("unexpected server response => expected: %q, got: %q", tc.expResp, r)
+			}
+		})
+	}
+}
+
+// TestDefaultStore tests that the stateful handlers without a Store fall back to their
+// own MemoryStore instead of panicking
+func TestDefaultStore(t *testing.T) {
+	ps := &PolicySet{
+		ProtocolState: StateRcpt,
+		ClientAddress: net.ParseIP("192.0.2.1"),
+		Sender:        "sender@example.com",
+		Recipient:     "rcpt@example.org",
+		Instance:      "instance1",
+	}
+	testTable := []struct {
+		testName string
+		h        Handler
+		expResp  PostfixResp
+	}{
+		{`Greylister`, &Greylister{}, RespDeferIfPermit},
+		{`InstanceRecipientLimiter`, &InstanceRecipientLimiter{MaxRecipients: 2}, RespDunno},
+		{`InstanceMemoizer`, &InstanceMemoizer{}, RespDunno},
+		{`ReplayGuard`, &ReplayGuard{}, RespDunno},
+		{`DistinctRecipientLimiter`, &DistinctRecipientLimiter{MaxRecipients: 1}, RespDunno},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			for i := 0; i < 2; i++ {
+				if r := tc.h.Handle(ps); respAction(r) != string(tc.expResp) {
+					t.Errorf("unexpected response => expected: %s, got: %s", tc.expResp, r)
+				}
+			}
+		})
+	}
+}
+
+// TestStoreFailureMode_String tests the String() method of the StoreFailureMode
+func TestStoreFailureMode_String(t *testing.T) {
+	for m, exp := range map[StoreFailureMode]string{0: "default", FailOpen: "fail-open", FailClosed: "fail-closed"} {
+		if s := m.String(); s != exp {
+			t.Errorf("unexpected store failure mode string => expected: %s, got: %s", exp, s)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package pps
+
+// UnderStress returns true if postfix signals that its smtpd processes are under stress
+// (see the postfix STRESS_README). Handlers can use it to relax expensive checks while
+// postfix is overloaded
+func (ps *PolicySet) UnderStress() bool {
+	return ps.Stress
+}
+
+// WithStressFallback answers all requests with the given response without invoking the
+// Handler while postfix signals stress (see PolicySet.UnderStress). This reduces the load
+// of the policy server during an overload of postfix. Responses of the stress fallback are
+// flagged as fallback in the AuditEvent
+func WithStressFallback(r PostfixResp) ServerOpt {
+	return func(s *Server) {
+		s.stressResp = r
+	}
+}
@@ -0,0 +1,69 @@
+package pps
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+// TestPolicySet_UnderStress tests the UnderStress() method of the PolicySet
+func TestPolicySet_UnderStress(t *testing.T) {
+	testTable := []struct {
+		testName string
+		stress   string
+		expRes   bool
+	}{
+		{`Stressed`, "yes", true},
+		{`Stressed upper-case`, "YES", true},
+		{`Not stressed`, "", false},
+		{`Unexpected value`, "no", false},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			req := strings.Replace(exampleReq, "stress=\n", "stress="+tc.stress+"\n", 1)
+			ps, err := ParsePolicySet(bufio.NewReader(strings.NewReader(req)))
+			if err != nil {
+				t.Fatalf("failed to parse request: %s", err)
+			}
+			if ps.UnderStress() != tc.expRes {
+				t.Errorf("unexpected UnderStress result => expected: %t, got: %t", tc.expRes, ps.UnderStress())
+			}
+		})
+	}
+}
+
+// TestWithStressFallback tests that the stress fallback response is only sent while
+// postfix signals stress
+func TestWithStressFallback(t *testing.T) {
+	testTable := []struct {
+		testName string
+		stress   string
+		expResp  string
+		expCalls int
+	}{
+		{`Stressed`, "yes", "action=DEFER_IF_PERMIT\n", 0},
+		{`Not stressed`, "", "action=REJECT\n", 1},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			h := &countHandler{r: RespReject}
+			s := New(WithStressFallback(RespDeferIfPermit))
+			addr, stop := testServer(t, &s, h)
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				stop()
+				t.Fatalf("failed to connect to running server: %s", err)
+			}
+			req := strings.Replace(exampleReq, "stress=\n", "stress="+tc.stress+"\n", 1)
+			if r := testRequest(t, conn, bufio.NewReader(conn), req); r != tc.expResp {
+				t.Errorf("unexpected server response => expected: %q, got: %q", tc.expResp, r)
+			}
+			_ = conn.Close()
+			stop()
+			if h.n != tc.expCalls {
+				t.Errorf("unexpected number of handler calls => expected: %d, got: %d", tc.expCalls, h.n)
+			}
+		})
+	}
+}
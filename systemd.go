@@ -0,0 +1,70 @@
+package pps
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Environment variables of the systemd socket activation protocol (see sd_listen_fds(3))
+const (
+	envListenPID     = "LISTEN_PID"
+	envListenFDs     = "LISTEN_FDS"
+	envListenFDNames = "LISTEN_FDNAMES"
+)
+
+// systemdListenFDsStart is the first file descriptor that is passed by systemd
+// (SD_LISTEN_FDS_START)
+var systemdListenFDsStart = 3
+
+// WithSystemdSocket enables systemd socket activation. If the process has been started by
+// systemd with listening sockets (see systemd.socket(5)), Run serves the passed sockets
+// instead of binding its own listeners. The daemon can then be started on demand and
+// restarted without losing the listening sockets. If no sockets have been passed, Run
+// binds its listeners as usual. The socket activation environment variables are unset
+// after the sockets have been taken over, so that they are not inherited by child
+// processes
+func WithSystemdSocket() ServerOpt {
+	return func(s *Server) {
+		s.systemd = true
+	}
+}
+
+// systemdListeners returns the listeners that have been passed by systemd socket
+// activation. If the process has not been socket activated, nil is returned
+func systemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv(envListenPID))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv(envListenFDs))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv(envListenFDNames), ":")
+	for _, e := range []string{envListenPID, envListenFDs, envListenFDNames} {
+		_ = os.Unsetenv(e)
+	}
+
+	ls := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		fd := systemdListenFDsStart + i
+		name := fmt.Sprintf("LISTEN_FD_%d", fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			for _, l := range ls {
+				_ = l.Close()
+			}
+			return nil, fmt.Errorf("failed to use systemd socket %s: %w", name, err)
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
@@ -0,0 +1,91 @@
+//go:build !windows
+// +build !windows
+
+package pps
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// TestWithSystemdSocket tests that Run serves the socket passed by systemd socket activation
+// and unsets the activation environment
+func TestWithSystemdSocket(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create new TCP listener: %s", err)
+	}
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("failed to get listener file: %s", err)
+	}
+	// The duplicated descriptor is owned by the server once it has taken over the socket
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatalf("failed to duplicate listener file: %s", err)
+	}
+	_ = f.Close()
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	start := systemdListenFDsStart
+	systemdListenFDsStart = fd
+	defer func() { systemdListenFDsStart = start }()
+	t.Setenv(envListenPID, fmt.Sprint(os.Getpid()))
+	t.Setenv(envListenFDs, "1")
+	t.Setenv(envListenFDNames, "policy")
+
+	s := New(WithSystemdSocket(), WithAddr("127.0.0.1"), WithPort(freePort(t)))
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), CtxNoLog, true))
+	ec := make(chan error, 1)
+	go func() { ec <- s.Run(ctx, Hi{r: RespOk}) }()
+	defer func() {
+		cancel()
+		if err := <-ec; err != nil {
+			t.Errorf("could not run server: %s", err)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to systemd socket: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if r := testRequest(t, conn, bufio.NewReader(conn), exampleReq); r != "action=OK\n" {
+		t.Errorf("unexpected server response => expected: %q, got: %q", "action=OK\n", r)
+	}
+	for _, e := range []string{envListenPID, envListenFDs, envListenFDNames} {
+		if v, ok := os.LookupEnv(e); ok {
+			t.Errorf("environment variable %s was supposed to be unset, got: %q", e, v)
+		}
+	}
+}
+
+// TestSystemdListenersNotActivated tests that no listeners are returned if the process has
+// not been socket activated
+func TestSystemdListenersNotActivated(t *testing.T) {
+	testTable := []struct {
+		testName string
+		pid      string
+		fds      string
+	}{
+		{`No activation`, "", ""},
+		{`Different process`, fmt.Sprint(os.Getpid() + 1), "1"},
+		{`No sockets`, fmt.Sprint(os.Getpid()), "0"},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			t.Setenv(envListenPID, tc.pid)
+			t.Setenv(envListenFDs, tc.fds)
+			ls, err := systemdListeners()
+			if err != nil || ls != nil {
+				t.Errorf("systemdListeners => expected no listeners, got: %v (%v)", ls, err)
+			}
+		})
+	}
+}
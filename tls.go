@@ -0,0 +1,192 @@
+package pps
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// ErrTLSPolicy is returned if the TLS version or the cipher suite of a policy connection
+// does not satisfy the TLS policy of the server (see WithMinTLSVersion)
+var ErrTLSPolicy = errors.New("TLS policy violation")
+
+// ErrTLSConfig is returned by Run if the TLS config of the server (see WithTLSConfig)
+// does not provide a server certificate
+var ErrTLSConfig = errors.New("TLS config without server certificate")
+
+// tlsVersions maps the supported TLS versions to their names
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// tlsVersionName returns the name of the given TLS version or its hex value if the version
+// is unknown, like tls.VersionName of newer Go versions
+func tlsVersionName(v uint16) string {
+	if n, ok := tlsVersions[v]; ok {
+		return n
+	}
+	return fmt.Sprintf("0x%04X", v)
+}
+
+// tlsHandshakeTimeout is the maximum duration of the TLS handshake of a policy connection
+const tlsHandshakeTimeout = time.Second * 10
+
+// TLSConnectionStateFromContext returns the TLS connection state of the policy connection
+// of the given connection context (see PolicySet.Context). It is only available if the
+// policy listener uses TLS (see ListenAndServeTLS and tls.NewListener) and allows handlers
+// to authenticate the policy client, i. e. by its client certificate in a mutual TLS
+// setup. Note that this is the TLS state of the connection between postfix and the policy
+// server, not the TLS state of the SMTP client that postfix reports in the PolicySet. If
+// the connection does not use TLS, false is returned
+func TLSConnectionStateFromContext(ctx context.Context) (tls.ConnectionState, bool) {
+	cs, ok := ctx.Value(ctxTLSState).(tls.ConnectionState)
+	return cs, ok
+}
+
+// WithMinTLSVersion sets the minimum TLS version (i. e. tls.VersionTLS12) of the policy
+// connections and optionally restricts the cipher suites that are accepted for TLS 1.2 and
+// below. The cipher suites of TLS 1.3 are not configurable. ListenAndServeTLS refuses
+// handshakes below the policy. Connections of TLS listeners that are passed to
+// RunWithListener are checked after the handshake and closed if they do not satisfy the
+// policy
+func WithMinTLSVersion(v uint16, suites ...uint16) ServerOpt {
+	return func(s *Server) {
+		s.tlsMin = v
+		s.tlsSuites = suites
+	}
+}
+
+// WithTLSConfig makes Run serve the policy connections over TLS with the given TLS config,
+// so that the policy traffic between postfix and a remote policy server is not sent in
+// plaintext. Clients can be authenticated with their client certificates by setting the
+// ClientAuth (i. e. tls.RequireAndVerifyClientCert) and the ClientCAs of the config. The
+// client certificate is available to the Handler via TLSConnectionStateFromContext. The
+// TLS policy of the server (see WithMinTLSVersion) is applied to a copy of the config.
+// It applies to all listeners of Run, including systemd sockets and the listeners of
+// WithListeners, while the listener of Serve has to be wrapped by the caller
+func WithTLSConfig(tc *tls.Config) ServerOpt {
+	return func(s *Server) {
+		s.tlsConf = tc
+	}
+}
+
+// checkTLSConfig returns ErrTLSConfig if the TLS config of the server does not provide a
+// server certificate
+func (s *Server) checkTLSConfig() error {
+	tc := s.tlsConf
+	if tc == nil || len(tc.Certificates) > 0 || tc.GetCertificate != nil || tc.GetConfigForClient != nil {
+		return nil
+	}
+	return ErrTLSConfig
+}
+
+// tlsListeners returns the given listeners wrapped in TLS listeners with the TLS config of
+// the server (see WithTLSConfig)
+func (s *Server) tlsListeners(ls []net.Listener) []net.Listener {
+	if s.tlsConf == nil {
+		return ls
+	}
+	tc := s.tlsConfig(s.tlsConf)
+	tl := make([]net.Listener, len(ls))
+	for i, l := range ls {
+		tl[i] = &tlsListener{Listener: l, config: tc}
+	}
+	return tl
+}
+
+// tlsListener is a TLS listener like the one of tls.NewListener, which keeps the accept
+// deadline and the file of the underlying listener accessible (see WithManualClose and
+// Server.ListenerFile)
+type tlsListener struct {
+	net.Listener
+	config *tls.Config
+}
+
+// Accept satisfies the net.Listener interface for the tlsListener
+func (l *tlsListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Server(c, l.config), nil
+}
+
+// SetDeadline sets the accept deadline of the underlying listener
+func (l *tlsListener) SetDeadline(t time.Time) error {
+	d, ok := l.Listener.(deadliner)
+	if !ok {
+		return fmt.Errorf("listener of type %T does not support deadlines", l.Listener)
+	}
+	return d.SetDeadline(t)
+}
+
+// File returns a duplicate of the file descriptor of the underlying listener
+func (l *tlsListener) File() (*os.File, error) {
+	f, ok := l.Listener.(filer)
+	if !ok {
+		return nil, fmt.Errorf("listener of type %T does not support file access", l.Listener)
+	}
+	return f.File()
+}
+
+// tlsConfig returns a copy of the given TLS config with the TLS policy of the server
+// applied (see WithMinTLSVersion)
+func (s *Server) tlsConfig(tc *tls.Config) *tls.Config {
+	tc = tc.Clone()
+	if s.tlsMin > tc.MinVersion {
+		tc.MinVersion = s.tlsMin
+	}
+	if len(s.tlsSuites) > 0 {
+		tc.CipherSuites = s.tlsSuites
+	}
+	return tc
+}
+
+// checkTLSPolicy returns an error wrapping ErrTLSPolicy if the given connection state does
+// not satisfy the TLS policy of the server
+func (s *Server) checkTLSPolicy(cs tls.ConnectionState) error {
+	if cs.Version < s.tlsMin {
+		return fmt.Errorf("%w: %s is below the minimum version %s", ErrTLSPolicy,
+			tlsVersionName(cs.Version), tlsVersionName(s.tlsMin))
+	}
+	if len(s.tlsSuites) == 0 || cs.Version >= tls.VersionTLS13 {
+		return nil
+	}
+	for _, cp := range s.tlsSuites {
+		if cs.CipherSuite == cp {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: cipher suite %s is not allowed", ErrTLSPolicy,
+		tls.CipherSuiteName(cs.CipherSuite))
+}
+
+// tlsHandshake completes the TLS handshake of the connection, if it is a TLS connection,
+// and returns the connection context with the TLS connection state
+func (s *Server) tlsHandshake(ctx context.Context, c *connection) (context.Context, error) {
+	nc := c.conn
+	if cc, ok := nc.(*countConn); ok {
+		nc = cc.Conn
+	}
+	tc, ok := nc.(*tls.Conn)
+	if !ok {
+		return ctx, nil
+	}
+	hctx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+	defer cancel()
+	if err := tc.HandshakeContext(hctx); err != nil {
+		return ctx, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	cs := tc.ConnectionState()
+	if err := s.checkTLSPolicy(cs); err != nil {
+		return ctx, err
+	}
+	return context.WithValue(ctx, ctxTLSState, cs), nil
+}
@@ -0,0 +1,375 @@
+package pps
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testCert creates a certificate from the given template that is signed by the given
+// parent. If parent is nil, a self-signed certificate is created
+func testCert(t *testing.T, tmpl *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	pc, pk := tmpl, interface{}(k)
+	if parent != nil {
+		pc, pk = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, pc, &k.PublicKey, pk)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %s", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: k, Leaf: leaf}
+}
+
+// TestTLSConnectionStateFromContext tests that the handler can read the client certificate
+// of a mutual TLS policy connection
+func TestTLSConnectionStateFromContext(t *testing.T) {
+	ca := testCert(t, &x509.Certificate{
+		Subject: pkix.Name{CommonName: "Test CA"}, IsCA: true, BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageCertSign,
+	}, nil)
+	srv := testCert(t, &x509.Certificate{
+		Subject: pkix.Name{CommonName: "policy server"}, IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+	cli := testCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "postfix.example.com"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &ca)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create new TCP listener: %s", err)
+	}
+	l = tls.NewListener(l, &tls.Config{
+		Certificates: []tls.Certificate{srv},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	cnc := make(chan string, 1)
+	h := HandlerFunc(func(ps *PolicySet) PostfixResp {
+		cs, ok := TLSConnectionStateFromContext(ps.Context())
+		if !ok || len(cs.PeerCertificates) == 0 {
+			cnc <- ""
+			return RespReject
+		}
+		cnc <- cs.PeerCertificates[0].Subject.CommonName
+		return RespOk
+	})
+	s := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	ec := make(chan error, 1)
+	go func() { ec <- s.RunWithListener(context.WithValue(ctx, CtxNoLog, true), h, l) }()
+	defer func() {
+		cancel()
+		if err := <-ec; err != nil {
+			t.Errorf("could not run server: %s", err)
+		}
+	}()
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		Certificates: []tls.Certificate{cli},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	})
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if r := testRequest(t, conn, bufio.NewReader(conn), exampleReq); r != "action=OK\n" {
+		t.Errorf("unexpected server response => expected: %q, got: %q", "action=OK\n", r)
+	}
+	if cn := <-cnc; cn != "postfix.example.com" {
+		t.Errorf("unexpected peer certificate => expected: postfix.example.com, got: %q", cn)
+	}
+}
+
+// TestTLSConnectionStateFromContextPlain tests that no TLS connection state is available on
+// plaintext policy connections
+func TestTLSConnectionStateFromContextPlain(t *testing.T) {
+	okc := make(chan bool, 1)
+	h := HandlerFunc(func(ps *PolicySet) PostfixResp {
+		_, ok := TLSConnectionStateFromContext(ps.Context())
+		okc <- ok
+		return RespDunno
+	})
+	s := New()
+	addr, stop := testServer(t, &s, h)
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = testRequest(t, conn, bufio.NewReader(conn), exampleReq)
+	if <-okc {
+		t.Errorf("TLS connection state available on a plaintext connection")
+	}
+}
+
+// TestWithMinTLSVersion tests that handshakes below the minimum TLS version are refused,
+// while compliant handshakes succeed
+func TestWithMinTLSVersion(t *testing.T) {
+	srv := testCert(t, &x509.Certificate{
+		Subject: pkix.Name{CommonName: "policy server"}, IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Leaf)
+
+	s := New(WithMinTLSVersion(tls.VersionTLS13))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create new TCP listener: %s", err)
+	}
+	l = tls.NewListener(l, s.tlsConfig(&tls.Config{Certificates: []tls.Certificate{srv}}))
+	ctx, cancel := context.WithCancel(context.Background())
+	ec := make(chan error, 1)
+	go func() { ec <- s.RunWithListener(context.WithValue(ctx, CtxNoLog, true), Hi{r: RespOk}, l) }()
+	defer func() {
+		cancel()
+		if err := <-ec; err != nil {
+			t.Errorf("could not run server: %s", err)
+		}
+	}()
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: pool, MaxVersion: tls.VersionTLS12})
+	if err == nil {
+		_ = conn.Close()
+		t.Errorf("TLS 1.2 handshake was supposed to be refused")
+	}
+	conn, err = tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS13})
+	if err != nil {
+		t.Fatalf("TLS 1.3 handshake failed: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if r := testRequest(t, conn, bufio.NewReader(conn), exampleReq); r != "action=OK\n" {
+		t.Errorf("unexpected server response => expected: %q, got: %q", "action=OK\n", r)
+	}
+}
+
+// TestWithMinTLSVersionListener tests that connections of a TLS listener that do not satisfy
+// the TLS policy of the server are closed after the handshake
+func TestWithMinTLSVersionListener(t *testing.T) {
+	srv := testCert(t, &x509.Certificate{
+		Subject: pkix.Name{CommonName: "policy server"}, IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Leaf)
+	testTable := []struct {
+		testName string
+		options  []ServerOpt
+		client   *tls.Config
+		expResp  string
+	}{
+		{`TLS 1.2 below minimum version`, []ServerOpt{WithMinTLSVersion(tls.VersionTLS13)},
+			&tls.Config{MaxVersion: tls.VersionTLS12}, ""},
+		{`TLS 1.3 satisfies minimum version`, []ServerOpt{WithMinTLSVersion(tls.VersionTLS13)},
+			&tls.Config{MinVersion: tls.VersionTLS13}, "action=OK\n"},
+		{`Cipher suite not allowed`, []ServerOpt{WithMinTLSVersion(tls.VersionTLS12,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256)},
+			&tls.Config{MaxVersion: tls.VersionTLS12,
+				CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305}}, ""},
+		{`Cipher suite allowed`, []ServerOpt{WithMinTLSVersion(tls.VersionTLS12,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256)},
+			&tls.Config{MaxVersion: tls.VersionTLS12,
+				CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}}, "action=OK\n"},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			s := New(tc.options...)
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("failed to create new TCP listener: %s", err)
+			}
+			l = tls.NewListener(l, &tls.Config{Certificates: []tls.Certificate{srv}})
+			ctx, cancel := context.WithCancel(context.Background())
+			ec := make(chan error, 1)
+			go func() { ec <- s.RunWithListener(context.WithValue(ctx, CtxNoLog, true), Hi{r: RespOk}, l) }()
+			defer func() {
+				cancel()
+				if err := <-ec; err != nil {
+					t.Errorf("could not run server: %s", err)
+				}
+			}()
+
+			tc.client.RootCAs = pool
+			conn, err := tls.Dial("tcp", l.Addr().String(), tc.client)
+			if err != nil {
+				t.Fatalf("failed to connect to running server: %s", err)
+			}
+			defer func() { _ = conn.Close() }()
+			_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
+			if _, err := conn.Write([]byte(exampleReq)); err != nil && tc.expResp != "" {
+				t.Fatalf("failed to send request to server: %s", err)
+			}
+			resp, _ := bufio.NewReader(conn).ReadString('\n')
+			if resp != tc.expResp {
+				t.Errorf("unexpected server response => expected: %q, got: %q", tc.expResp, resp)
+			}
+		})
+	}
+}
+
+// TestWithTLSConfig tests that Run serves the policy connections over TLS and refuses
+// clients without a valid client certificate if mutual authentication is required
+func TestWithTLSConfig(t *testing.T) {
+	ca := testCert(t, &x509.Certificate{
+		Subject: pkix.Name{CommonName: "Test CA"}, IsCA: true, BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageCertSign,
+	}, nil)
+	srv := testCert(t, &x509.Certificate{
+		Subject: pkix.Name{CommonName: "policy server"}, IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+	cli := testCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "postfix.example.com"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &ca)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	addr := net.JoinHostPort("127.0.0.1", freePort(t))
+	s := New(WithListenAddrs(addr), WithTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{srv},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}))
+	if !s.Config().TLS {
+		t.Errorf("TLS was supposed to be enabled in the server config")
+	}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), CtxNoLog, true))
+	ec := make(chan error, 1)
+	go func() { ec <- s.Run(ctx, Hi{r: RespOk}) }()
+	defer func() {
+		cancel()
+		if err := <-ec; err != nil {
+			t.Errorf("could not run server: %s", err)
+		}
+	}()
+
+	var conn *tls.Conn
+	var err error
+	for dl := time.Now().Add(time.Second); time.Now().Before(dl); time.Sleep(time.Millisecond * 10) {
+		conn, err = tls.Dial("tcp", addr, &tls.Config{Certificates: []tls.Certificate{cli}, RootCAs: pool})
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if r := testRequest(t, conn, bufio.NewReader(conn), exampleReq); r != "action=OK\n" {
+		t.Errorf("unexpected server response => expected: %q, got: %q", "action=OK\n", r)
+	}
+
+	nc, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool})
+	if err != nil {
+		return
+	}
+	defer func() { _ = nc.Close() }()
+	if err := nc.SetDeadline(time.Now().Add(time.Second * 5)); err != nil {
+		t.Fatalf("failed to set deadline on client connection: %s", err)
+	}
+	_, _ = nc.Write([]byte(exampleReq))
+	if _, err := bufio.NewReader(nc).ReadString('\n'); err == nil {
+		t.Errorf("connection without client certificate was supposed to be refused")
+	}
+}
+
+// TestWithTLSConfigNoCertificate tests that Run refuses a TLS config without a server
+// certificate
+func TestWithTLSConfigNoCertificate(t *testing.T) {
+	s := New(WithListenAddrs("127.0.0.1:0"), WithTLSConfig(&tls.Config{}))
+	if err := s.Run(context.Background(), Hi{}); !errors.Is(err, ErrTLSConfig) {
+		t.Errorf("Run was supposed to fail with ErrTLSConfig, got: %v", err)
+	}
+}
+
+// TestWithTLSConfigListeners tests that the listeners of WithListeners are served over TLS
+// as well
+func TestWithTLSConfigListeners(t *testing.T) {
+	srv := testCert(t, &x509.Certificate{
+		Subject: pkix.Name{CommonName: "policy server"}, IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Leaf)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create new TCP listener: %s", err)
+	}
+	s := New(WithListeners(l), WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{srv}}))
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), CtxNoLog, true))
+	ec := make(chan error, 1)
+	go func() { ec <- s.Run(ctx, Hi{r: RespOk}) }()
+	defer func() {
+		cancel()
+		if err := <-ec; err != nil {
+			t.Errorf("could not run server: %s", err)
+		}
+	}()
+
+	pc, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = pc.Close() }()
+	_ = pc.SetDeadline(time.Now().Add(time.Second * 5))
+	_, _ = pc.Write([]byte(exampleReq))
+	if r, err := bufio.NewReader(pc).ReadString('\n'); err == nil {
+		t.Errorf("plaintext request was supposed to be refused, got: %q", r)
+	}
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatalf("TLS handshake failed: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if r := testRequest(t, conn, bufio.NewReader(conn), exampleReq); r != "action=OK\n" {
+		t.Errorf("unexpected server response => expected: %q, got: %q", "action=OK\n", r)
+	}
+}
+
+// TestTLSVersionName tests the names of known and unknown TLS versions
+func TestTLSVersionName(t *testing.T) {
+	testTable := []struct {
+		version uint16
+		expName string
+	}{
+		{tls.VersionTLS10, "TLS 1.0"},
+		{tls.VersionTLS12, "TLS 1.2"},
+		{tls.VersionTLS13, "TLS 1.3"},
+		{0x0300, "0x0300"},
+	}
+	for _, tc := range testTable {
+		if n := tlsVersionName(tc.version); n != tc.expName {
+			t.Errorf("unexpected TLS version name => expected: %s, got: %s", tc.expName, n)
+		}
+	}
+}
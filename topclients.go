@@ -0,0 +1,117 @@
+package pps
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ClientStat is the number of requests of a client address (see Server.TopClients)
+type ClientStat struct {
+	Client   net.IP
+	Requests uint64
+}
+
+// WithTopClients enables the tracking of the clients with the most requests over a rolling
+// window, which helps to identify the source of a reception spike (see Server.TopClients).
+// At most capacity client addresses are tracked per window. If the capacity is exceeded,
+// the least active client is replaced, so that the memory stays bounded while the counts
+// of the busiest clients stay accurate (Space-Saving algorithm)
+func WithTopClients(capacity int, window time.Duration) ServerOpt {
+	return func(s *Server) {
+		if capacity <= 0 || window <= 0 {
+			s.top = nil
+			return
+		}
+		s.top = &topTracker{capacity: capacity, window: window, now: time.Now}
+	}
+}
+
+// TopClients returns up to n client addresses with the most requests in the current and
+// the previous window, ordered by their number of requests. If the tracking is not enabled
+// (see WithTopClients), nil is returned
+func (s *Server) TopClients(n int) []ClientStat {
+	if s.top == nil {
+		return nil
+	}
+	return s.top.topN(n)
+}
+
+// topTracker counts the requests per client address in tumbling windows
+type topTracker struct {
+	capacity int
+	window   time.Duration
+	now      func() time.Time
+
+	mu    sync.Mutex
+	start time.Time
+	cur   map[string]uint64
+	prev  map[string]uint64
+}
+
+// record counts a request of the given client address
+func (tt *topTracker) record(ip net.IP) {
+	if ip == nil {
+		return
+	}
+	k := ip.String()
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	tt.rotate()
+	if _, ok := tt.cur[k]; !ok && len(tt.cur) >= tt.capacity {
+		mk, mc := "", uint64(0)
+		for ck, c := range tt.cur {
+			if mk == "" || c < mc {
+				mk, mc = ck, c
+			}
+		}
+		delete(tt.cur, mk)
+		tt.cur[k] = mc
+	}
+	tt.cur[k]++
+}
+
+// rotate starts a new window if the current one has passed
+func (tt *topTracker) rotate() {
+	now := tt.now()
+	switch d := now.Sub(tt.start); {
+	case tt.cur == nil || d >= 2*tt.window:
+		tt.prev = nil
+	case d >= tt.window:
+		tt.prev = tt.cur
+	default:
+		return
+	}
+	tt.cur = make(map[string]uint64)
+	tt.start = now
+}
+
+// topN returns the n client addresses with the most requests
+func (tt *topTracker) topN(n int) []ClientStat {
+	tt.mu.Lock()
+	tt.rotate()
+	m := make(map[string]uint64, len(tt.cur)+len(tt.prev))
+	for k, c := range tt.prev {
+		m[k] += c
+	}
+	for k, c := range tt.cur {
+		m[k] += c
+	}
+	tt.mu.Unlock()
+
+	cl := make([]ClientStat, 0, len(m))
+	for k, c := range m {
+		cl = append(cl, ClientStat{Client: net.ParseIP(k), Requests: c})
+	}
+	sort.Slice(cl, func(i, j int) bool {
+		if cl[i].Requests != cl[j].Requests {
+			return cl[i].Requests > cl[j].Requests
+		}
+		return cl[i].Client.String() < cl[j].Client.String()
+	})
+	if n >= 0 && len(cl) > n {
+		cl = cl[:n]
+	}
+	return cl
+}
@@ -0,0 +1,84 @@
+package pps
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestServer_TopClients tests that the busiest client addresses are reported first
+func TestServer_TopClients(t *testing.T) {
+	s := New(WithTopClients(10, time.Minute))
+	addr, stop := testServer(t, &s, Hi{})
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	rb := bufio.NewReader(conn)
+	for ip, n := range map[string]int{"192.0.2.1": 2, "192.0.2.2": 5, "2001:db8::1": 1, "192.0.2.3": 3} {
+		req := strings.Replace(exampleReq, "client_address=127.0.0.1",
+			fmt.Sprintf("client_address=%s", ip), 1)
+		for i := 0; i < n; i++ {
+			testRequest(t, conn, rb, req)
+		}
+	}
+
+	tc := s.TopClients(2)
+	if len(tc) != 2 {
+		t.Fatalf("TopClients failed => expected 2 entries, got: %d", len(tc))
+	}
+	if !tc[0].Client.Equal(net.ParseIP("192.0.2.2")) || tc[0].Requests != 5 {
+		t.Errorf("TopClients failed => expected 192.0.2.2 with 5 requests at the top, got: %s with %d",
+			tc[0].Client, tc[0].Requests)
+	}
+	if !tc[1].Client.Equal(net.ParseIP("192.0.2.3")) || tc[1].Requests != 3 {
+		t.Errorf("TopClients failed => expected 192.0.2.3 with 3 requests second, got: %s with %d",
+			tc[1].Client, tc[1].Requests)
+	}
+	if n := len(s.TopClients(-1)); n != 4 {
+		t.Errorf("TopClients failed => expected 4 tracked clients, got: %d", n)
+	}
+}
+
+// TestServer_TopClientsDisabled tests that TopClients returns nil if tracking is disabled
+func TestServer_TopClientsDisabled(t *testing.T) {
+	s := New()
+	if tc := s.TopClients(10); tc != nil {
+		t.Errorf("TopClients failed => expected nil, got: %v", tc)
+	}
+}
+
+// TestTopTracker tests the bounded capacity and the rolling window of the topTracker
+func TestTopTracker(t *testing.T) {
+	now := time.Now()
+	tt := &topTracker{capacity: 2, window: time.Minute, now: func() time.Time { return now }}
+	for i := 0; i < 10; i++ {
+		tt.record(net.ParseIP("192.0.2.1"))
+	}
+	for i := 1; i <= 5; i++ {
+		tt.record(net.IPv4(198, 51, 100, byte(i)))
+	}
+	if n := len(tt.cur); n != 2 {
+		t.Errorf("topTracker failed => expected 2 tracked clients, got: %d", n)
+	}
+	tc := tt.topN(1)
+	if len(tc) != 1 || !tc[0].Client.Equal(net.ParseIP("192.0.2.1")) || tc[0].Requests != 10 {
+		t.Errorf("topTracker failed => expected 192.0.2.1 with 10 requests at the top, got: %v", tc)
+	}
+
+	now = now.Add(time.Minute)
+	tt.record(net.ParseIP("192.0.2.9"))
+	if tc := tt.topN(1); len(tc) != 1 || tc[0].Requests != 10 {
+		t.Errorf("topTracker failed => expected previous window to be included, got: %v", tc)
+	}
+	now = now.Add(time.Minute * 2)
+	if tc := tt.topN(10); len(tc) != 0 {
+		t.Errorf("topTracker failed => expected empty result after expiry, got: %v", tc)
+	}
+}
@@ -0,0 +1,24 @@
+package pps
+
+// WithTraceID sets a function that extracts the trace id of a request, i. e. from an
+// attribute that has been added by an Enricher. Without such a function, the trace id is
+// taken from the CtxTraceID value of the request context, i. e. of a tracing context that
+// has been passed to Run or ServeConn. The trace id is attached to the AuditEvent of the
+// decision and as OpenMetrics exemplar to the decision latency histogram of the /metrics
+// endpoint (see WithAdminHTTP), so that a slow decision links to its trace. If no trace
+// id is available, the decision is recorded without it
+func WithTraceID(f func(*PolicySet) string) ServerOpt {
+	return func(s *Server) {
+		s.traceFn = f
+	}
+}
+
+// traceID returns the trace id of the given PolicySet or an empty string if no trace id
+// is available
+func (s *Server) traceID(ps *PolicySet) string {
+	if s.traceFn != nil {
+		return s.traceFn(ps)
+	}
+	id, _ := ps.Context().Value(CtxTraceID).(string)
+	return id
+}
@@ -0,0 +1,117 @@
+package pps
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestWithTraceID tests that the trace id of a request and the decision latency are
+// recorded in the audit event and that requests without trace id degrade gracefully
+func TestWithTraceID(t *testing.T) {
+	testTable := []struct {
+		testName   string
+		traceID    string
+		expTraceID string
+	}{
+		{`Request with trace id`, "4bf92f3577b34da6a3ce929d0e0e4736", "4bf92f3577b34da6a3ce929d0e0e4736"},
+		{`Request without trace id`, "", ""},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			ch := make(chan AuditEvent, 1)
+			tracer := func(_ context.Context, ps *PolicySet) {
+				if tc.traceID == "" {
+					return
+				}
+				ps.Extra = map[string]string{"trace_id": tc.traceID}
+			}
+			s := New(WithAuditChannel(ch), WithEnricher(tracer),
+				WithTraceID(func(ps *PolicySet) string { return ps.Extra["trace_id"] }))
+			addr, stop := testServer(t, &s, sleepHandler{d: time.Millisecond * 20, r: RespDunno})
+			defer stop()
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("failed to connect to running server: %s", err)
+			}
+			defer func() { _ = conn.Close() }()
+			_ = testRequest(t, conn, bufio.NewReader(conn), exampleReq)
+
+			select {
+			case ev := <-ch:
+				if ev.TraceID != tc.expTraceID {
+					t.Errorf("unexpected audit event trace id => expected: %q, got: %q", tc.expTraceID, ev.TraceID)
+				}
+				if ev.Latency < time.Millisecond*20 {
+					t.Errorf("unexpected audit event latency => expected at least 20ms, got: %s", ev.Latency)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("no audit event received")
+			}
+		})
+	}
+}
+
+// TestDecisionLatencyExemplar tests that the decision latency histogram of the /metrics
+// endpoint carries the trace id of a tracing context as OpenMetrics exemplar and that
+// decisions without trace id are recorded without exemplar
+func TestDecisionLatencyExemplar(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testTable := []struct {
+		testName    string
+		traceID     string
+		expExemplar bool
+	}{
+		{`Request with tracing context`, traceID, true},
+		{`Request without tracing context`, "", false},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			var s Server
+			s = New(WithDispatcher(func(ctx context.Context, c net.Conn) {
+				if tc.traceID != "" {
+					ctx = context.WithValue(ctx, CtxTraceID, tc.traceID)
+				}
+				go func() { _ = s.ServeConn(ctx, c) }()
+			}))
+			addr, stop := testServer(t, &s, Hi{})
+			defer stop()
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("failed to connect to running server: %s", err)
+			}
+			defer func() { _ = conn.Close() }()
+			_ = testRequest(t, conn, bufio.NewReader(conn), exampleReq)
+
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+			rr := httptest.NewRecorder()
+			s.adminHandler().ServeHTTP(rr, req)
+			b := rr.Body.String()
+			if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/openmetrics-text") {
+				t.Errorf("unexpected content type => got: %s", ct)
+			}
+			if !strings.Contains(b, "pps_decision_latency_seconds_count 1\n") || !strings.HasSuffix(b, "# EOF\n") {
+				t.Errorf("decision latency not recorded in OpenMetrics format => got: %s", b)
+			}
+			ex := `# {trace_id="` + traceID + `"} `
+			if strings.Contains(b, ex) != tc.expExemplar {
+				t.Errorf("unexpected exemplar => expected: %t, got: %s", tc.expExemplar, b)
+			}
+			if !strings.Contains(b, "# TYPE pps_requests counter\npps_requests_total 1\n") {
+				t.Errorf("unexpected OpenMetrics counter => got: %s", b)
+			}
+
+			rr = httptest.NewRecorder()
+			s.adminHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+			if b := rr.Body.String(); strings.Contains(b, "trace_id") || strings.Contains(b, "# EOF") {
+				t.Errorf("exemplar in Prometheus text format => got: %s", b)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package pps
+
+import (
+	"strings"
+)
+
+// WithTrustedSASLUsers sets a list of SASL usernames that bypass all checks. Requests of
+// clients that authenticated as one of the trusted users are answered with RespOk without
+// invoking the Handler. The domain part of the usernames is compared case-insensitively.
+// This is meant for service accounts that need unconditional relay
+func WithTrustedSASLUsers(users ...string) ServerOpt {
+	return func(s *Server) {
+		if s.trustedUsers == nil {
+			s.trustedUsers = make(map[string]struct{}, len(users))
+		}
+		for _, u := range users {
+			if u != "" {
+				s.trustedUsers[normalizeSASLUser(u)] = struct{}{}
+			}
+		}
+	}
+}
+
+// trustedSASLUser returns true if the client of the given PolicySet authenticated as one
+// of the trusted SASL users
+func (s *Server) trustedSASLUser(ps *PolicySet) bool {
+	if len(s.trustedUsers) == 0 || ps.SASLUsername == "" {
+		return false
+	}
+	_, ok := s.trustedUsers[normalizeSASLUser(ps.SASLUsername)]
+	return ok
+}
+
+// normalizeSASLUser lower-cases the domain part of the given SASL username
+func normalizeSASLUser(u string) string {
+	i := strings.LastIndexByte(u, '@')
+	if i < 0 {
+		return u
+	}
+	return u[:i+1] + strings.ToLower(u[i+1:])
+}
@@ -0,0 +1,34 @@
+package pps
+
+import (
+	"testing"
+)
+
+// TestWithTrustedSASLUsers tests that trusted SASL users bypass the Handler
+func TestWithTrustedSASLUsers(t *testing.T) {
+	s := New(WithTrustedSASLUsers("relay@Example.com", "svc"))
+	testTable := []struct {
+		testName string
+		user     string
+		expResp  PostfixResp
+		expCalls int
+	}{
+		{`Trusted user`, "relay@example.com", RespOk, 0},
+		{`Trusted user with different domain case`, "relay@EXAMPLE.COM", RespOk, 0},
+		{`Trusted user without domain`, "svc", RespOk, 0},
+		{`Local part is case-sensitive`, "Relay@example.com", RespReject, 1},
+		{`Untrusted user`, "user@example.com", RespReject, 1},
+		{`Unauthenticated request`, "", RespReject, 1},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			h := &countHandler{r: RespReject}
+			if r := s.handle(&PolicySet{SASLUsername: tc.user}, h); r.Action != tc.expResp {
+				t.Errorf("unexpected response => expected: %s, got: %s", tc.expResp, r.Action)
+			}
+			if h.n != tc.expCalls {
+				t.Errorf("unexpected number of handler calls => expected: %d, got: %d", tc.expCalls, h.n)
+			}
+		})
+	}
+}
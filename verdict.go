@@ -0,0 +1,62 @@
+package pps
+
+// Verdict is an application-level policy decision that is translated into a PostfixResp
+// by the server (see WithVerdictMap)
+type Verdict string
+
+// Predefined verdicts
+const (
+	VerdictClean      Verdict = "clean"
+	VerdictSuspicious Verdict = "suspicious"
+	VerdictSpam       Verdict = "spam"
+)
+
+// DefaultVerdictMap is the mapping of verdicts to responses that is used if no custom
+// mapping has been set via WithVerdictMap
+var DefaultVerdictMap = map[Verdict]PostfixResp{
+	VerdictClean:      RespDunno,
+	VerdictSuspicious: RespDeferIfPermit,
+	VerdictSpam:       RespReject,
+}
+
+// VerdictHandler is an alternative to the Handler interface for handlers that return
+// application-level verdicts instead of postfix actions. A VerdictHandler is turned into
+// a Handler via Server.AdaptVerdictHandler
+type VerdictHandler interface {
+	HandleVerdict(*PolicySet) Verdict
+}
+
+// WithVerdictMap overrides the DefaultVerdictMap for the translation of verdicts into
+// responses
+func WithVerdictMap(m map[Verdict]PostfixResp) ServerOpt {
+	return func(s *Server) {
+		s.verdictMap = m
+	}
+}
+
+// WithVerdictDefault sets the response for verdicts that are not part of the verdict
+// mapping. Defaults to RespDunno
+func WithVerdictDefault(r PostfixResp) ServerOpt {
+	return func(s *Server) {
+		s.verdictDefault = r
+	}
+}
+
+// AdaptVerdictHandler returns a Handler that translates the verdicts of the given
+// VerdictHandler into responses, based on the verdict mapping of the Server
+func (s *Server) AdaptVerdictHandler(vh VerdictHandler) Handler {
+	m := s.verdictMap
+	if m == nil {
+		m = DefaultVerdictMap
+	}
+	d := s.verdictDefault
+	if d == "" {
+		d = RespDunno
+	}
+	return HandlerFunc(func(ps *PolicySet) PostfixResp {
+		if r, ok := m[vh.HandleVerdict(ps)]; ok {
+			return r
+		}
+		return d
+	})
+}
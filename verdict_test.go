@@ -0,0 +1,47 @@
+package pps
+
+import (
+	"testing"
+)
+
+// verdictHandler is a VerdictHandler that returns the verdict from the sender attribute
+type verdictHandler struct{}
+
+// HandleVerdict is the function required by the VerdictHandler Interface
+func (verdictHandler) HandleVerdict(ps *PolicySet) Verdict {
+	return Verdict(ps.Sender)
+}
+
+// TestAdaptVerdictHandler tests the translation of several verdicts into responses
+func TestAdaptVerdictHandler(t *testing.T) {
+	cm := map[Verdict]PostfixResp{
+		VerdictSpam:       TextResponseOpt(RespReject, "spam detected"),
+		"virus":           RespDiscard,
+		VerdictSuspicious: RespHold,
+	}
+	testTable := []struct {
+		testName string
+		opts     []ServerOpt
+		verdict  Verdict
+		expResp  PostfixResp
+	}{
+		{`Default map clean`, nil, VerdictClean, RespDunno},
+		{`Default map suspicious`, nil, VerdictSuspicious, RespDeferIfPermit},
+		{`Default map spam`, nil, VerdictSpam, RespReject},
+		{`Default map unmapped`, nil, "unknown", RespDunno},
+		{`Custom map spam`, []ServerOpt{WithVerdictMap(cm)}, VerdictSpam, "REJECT spam detected"},
+		{`Custom map custom verdict`, []ServerOpt{WithVerdictMap(cm)}, "virus", RespDiscard},
+		{`Custom map unmapped`, []ServerOpt{WithVerdictMap(cm)}, VerdictClean, RespDunno},
+		{`Custom map unmapped with default`, []ServerOpt{WithVerdictMap(cm), WithVerdictDefault(RespOk)},
+			VerdictClean, RespOk},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			s := New(tc.opts...)
+			h := s.AdaptVerdictHandler(verdictHandler{})
+			if r := h.Handle(&PolicySet{Sender: string(tc.verdict)}); r != tc.expResp {
+				t.Errorf("unexpected verdict response => expected: %s, got: %s", tc.expResp, r)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package pps
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// DefaultWatchDebounce is the time the FileWatcher waits after the last change of the
+// watched file before it reads the file
+const DefaultWatchDebounce = time.Millisecond * 250
+
+// FileWatcher watches a file for changes and hands its content to a callback function
+// whenever it changed. It is meant for file-backed handlers (domain lists, access maps,
+// allowlists) that should pick up changes without a restart
+type FileWatcher struct {
+	path     string
+	debounce time.Duration
+	onChange func([]byte) error
+	w        *fsnotify.Watcher
+
+	mu   sync.Mutex
+	err  error
+	stop chan struct{}
+	done chan struct{}
+}
+
+// WatchFile reads the file at the given path, hands its content to onChange and then
+// watches the file for changes via fsnotify. Once a change has been detected, the content
+// is only read after the file did not change for DefaultWatchDebounce, to avoid reading
+// partially written files. The directory of the file is watched, so that files that are
+// replaced via rename (as most editors and config management tools do) are detected as
+// well.
+//
+// An error is returned if the initial read, the initial onChange call or the setup of the
+// watch fail. Errors of later reloads are available via the Err method of the returned
+// FileWatcher
+func WatchFile(path string, onChange func([]byte) error) (*FileWatcher, error) {
+	return watchFile(path, DefaultWatchDebounce, onChange)
+}
+
+// watchFile starts a new FileWatcher with the given debounce time
+func watchFile(path string, db time.Duration, onChange func([]byte) error) (*FileWatcher, error) {
+	fw := &FileWatcher{
+		path:     filepath.Clean(path),
+		debounce: db,
+		onChange: onChange,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := fw.load(); err != nil {
+		return nil, err
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file watcher: %w", err)
+	}
+	if err := w.Add(filepath.Dir(fw.path)); err != nil {
+		_ = w.Close()
+		return nil, fmt.Errorf("failed to watch directory of file: %w", err)
+	}
+	fw.w = w
+	go fw.watch()
+	return fw, nil
+}
+
+// Err returns the error of the last reload or nil if it succeeded
+func (fw *FileWatcher) Err() error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	return fw.err
+}
+
+// Close stops watching the file
+func (fw *FileWatcher) Close() {
+	select {
+	case <-fw.stop:
+	default:
+		close(fw.stop)
+	}
+	<-fw.done
+}
+
+// watch handles the events of the watched directory until the FileWatcher is closed.
+// Events of the watched file restart the debounce timer, the file is read once the timer
+// expires
+func (fw *FileWatcher) watch() {
+	defer close(fw.done)
+	defer func() { _ = fw.w.Close() }()
+	t := time.NewTimer(fw.debounce)
+	if !t.Stop() {
+		<-t.C
+	}
+	defer t.Stop()
+	for {
+		select {
+		case <-fw.stop:
+			return
+		case ev, ok := <-fw.w.Events:
+			if !ok {
+				return
+			}
+			// Attribute changes don't change the content of the file
+			if filepath.Clean(ev.Name) != fw.path || ev.Op == fsnotify.Chmod {
+				continue
+			}
+			if !t.Stop() {
+				select {
+				case <-t.C:
+				default:
+				}
+			}
+			t.Reset(fw.debounce)
+		case err, ok := <-fw.w.Errors:
+			if !ok {
+				return
+			}
+			fw.setErr(fmt.Errorf("failed to watch file: %w", err))
+		case <-t.C:
+			if _, err := os.Stat(fw.path); err != nil {
+				// The file has been removed and not (yet) been replaced
+				continue
+			}
+			fw.setErr(fw.load())
+		}
+	}
+}
+
+// setErr stores the error of the last reload
+func (fw *FileWatcher) setErr(err error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.err = err
+}
+
+// load reads the file and hands the content to the onChange callback
+func (fw *FileWatcher) load() error {
+	b, err := os.ReadFile(fw.path)
+	if err != nil {
+		return fmt.Errorf("failed to read watched file: %w", err)
+	}
+	if err := fw.onChange(b); err != nil {
+		return fmt.Errorf("failed to process watched file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package pps
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestWatchFile tests that the reload callback fires with the new content when the watched
+// file is written to or replaced
+func TestWatchFile(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "watched.txt")
+	if err := os.WriteFile(p, []byte("initial"), 0o600); err != nil {
+		t.Fatalf("failed to write watched file: %s", err)
+	}
+	ch := make(chan string, 10)
+	fw, err := watchFile(p, time.Millisecond*30, func(b []byte) error {
+		ch <- string(b)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to watch file: %s", err)
+	}
+	defer fw.Close()
+	expectContent(t, ch, "initial")
+
+	// Write to the file in place
+	if err := os.WriteFile(p, []byte("updated content"), 0o600); err != nil {
+		t.Fatalf("failed to update watched file: %s", err)
+	}
+	expectContent(t, ch, "updated content")
+
+	// Rewrite the file in place with content of the same size
+	if err := os.WriteFile(p, []byte("changed content"), 0o600); err != nil {
+		t.Fatalf("failed to update watched file: %s", err)
+	}
+	expectContent(t, ch, "changed content")
+
+	// Replace the file via rename
+	tp := filepath.Join(filepath.Dir(p), "watched.tmp")
+	if err := os.WriteFile(tp, []byte("replaced"), 0o600); err != nil {
+		t.Fatalf("failed to write replacement file: %s", err)
+	}
+	if err := os.Rename(tp, p); err != nil {
+		t.Fatalf("failed to replace watched file: %s", err)
+	}
+	expectContent(t, ch, "replaced")
+}
+
+// TestWatchFileFail tests that WatchFile fails for a missing file and a failing initial
+// callback and that reload errors are reported
+func TestWatchFileFail(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "watched.txt")
+	if _, err := WatchFile(p, func([]byte) error { return nil }); err == nil {
+		t.Errorf("watching a missing file succeeded")
+	}
+	if err := os.WriteFile(p, []byte("content"), 0o600); err != nil {
+		t.Fatalf("failed to write watched file: %s", err)
+	}
+	ce := errors.New("callback error")
+	if _, err := WatchFile(p, func([]byte) error { return ce }); !errors.Is(err, ce) {
+		t.Errorf("unexpected error for failing callback => expected: %s, got: %v", ce, err)
+	}
+
+	n := 0
+	fw, err := watchFile(p, time.Millisecond*10, func([]byte) error {
+		n++
+		if n > 1 {
+			return ce
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to watch file: %s", err)
+	}
+	defer fw.Close()
+	if err := os.WriteFile(p, []byte("changed content"), 0o600); err != nil {
+		t.Fatalf("failed to update watched file: %s", err)
+	}
+	dl := time.Now().Add(time.Second * 2)
+	for fw.Err() == nil && time.Now().Before(dl) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if !errors.Is(fw.Err(), ce) {
+		t.Errorf("reload error not reported => expected: %s, got: %v", ce, fw.Err())
+	}
+}
+
+// expectContent waits for the given content on the channel
+func expectContent(t *testing.T, ch <-chan string, exp string) {
+	t.Helper()
+	select {
+	case c := <-ch:
+		if c != exp {
+			t.Errorf("unexpected file content => expected: %s, got: %s", exp, c)
+		}
+	case <-time.After(time.Second * 2):
+		t.Errorf("reload callback did not fire for content: %s", exp)
+	}
+}
@@ -0,0 +1,97 @@
+package pps
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	// webhookRetries is the number of retries for a failed webhook delivery
+	webhookRetries = 3
+
+	// webhookConcurrency is the maximum number of concurrent webhook deliveries. Decisions
+	// that exceed this limit are dropped
+	webhookConcurrency = 16
+)
+
+// webhook posts decision records to an HTTP endpoint
+type webhook struct {
+	url    string
+	filter func(PostfixResp) bool
+	client *http.Client
+	sem    chan struct{}
+	retry  time.Duration
+}
+
+// WithDecisionWebhook enables the delivery of decisions to the given URL. For each decision
+// that matches the filter, the AuditEvent is POSTed as JSON object to the URL. Deliveries are
+// asynchronous and do not block the response to postfix. Failed deliveries are retried up to
+// 3 times. If the filter is nil, all decisions are delivered
+func WithDecisionWebhook(url string, filter func(PostfixResp) bool) ServerOpt {
+	return func(s *Server) {
+		s.webhook = &webhook{
+			url:    url,
+			filter: filter,
+			client: &http.Client{Timeout: time.Second * 10},
+			sem:    make(chan struct{}, webhookConcurrency),
+			retry:  time.Second,
+		}
+	}
+}
+
+// notifyWebhook delivers the given AuditEvent to the decision webhook in the background if
+// it matches the filter of the webhook. If too many deliveries are pending, the event is
+// dropped
+func (s *Server) notifyWebhook(ev AuditEvent) {
+	w := s.webhook
+	if w == nil || (w.filter != nil && !w.filter(ev.Action)) {
+		return
+	}
+	select {
+	case w.sem <- struct{}{}:
+	default:
+		s.logf(context.Background(), LogLevelWarn, "dropped decision webhook for connection %s: too many "+
+			"pending deliveries", ev.ConnID)
+		return
+	}
+	go func() {
+		defer func() { <-w.sem }()
+		if err := w.deliver(ev); err != nil {
+			s.logf(context.Background(), LogLevelWarn, "connection %s: %s", ev.ConnID, err)
+		}
+	}()
+}
+
+// deliver posts the given AuditEvent to the webhook URL and retries failed deliveries
+func (w *webhook) deliver(ev AuditEvent) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("failed to marshal decision record: %w", err)
+	}
+	for i := 0; ; i++ {
+		err = w.post(b)
+		if err == nil || i >= webhookRetries {
+			return err
+		}
+		time.Sleep(w.retry * time.Duration(i+1))
+	}
+}
+
+// post sends a single POST request with the given JSON body to the webhook URL
+func (w *webhook) post(b []byte) error {
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("failed to deliver decision record: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("failed to deliver decision record: unexpected status %s", resp.Status)
+	}
+	return nil
+}
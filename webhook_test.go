@@ -0,0 +1,90 @@
+package pps
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestWithDecisionWebhook tests that the decision webhook fires for REJECT decisions but
+// not for DUNNO decisions
+func TestWithDecisionWebhook(t *testing.T) {
+	ec := make(chan AuditEvent, 10)
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev AuditEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Errorf("failed to decode decision record: %s", err)
+		}
+		ec <- ev
+	}))
+	defer hs.Close()
+
+	rejectOnly := func(r PostfixResp) bool { return respAction(r) == string(RespReject) }
+	testTable := []struct {
+		testName string
+		resp     PostfixResp
+		fired    bool
+	}{
+		{`REJECT fires the webhook`, TextResponseOpt(RespReject, "go away"), true},
+		{`DUNNO does not fire the webhook`, RespDunno, false},
+	}
+	for _, tc := range testTable {
+		t.Run(tc.testName, func(t *testing.T) {
+			s := New(WithDecisionWebhook(hs.URL, rejectOnly))
+			addr, stop := testServer(t, &s, Hi{r: tc.resp})
+			defer stop()
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("failed to connect to running server: %s", err)
+			}
+			defer func() { _ = conn.Close() }()
+			_ = testRequest(t, conn, bufio.NewReader(conn), exampleReq)
+
+			select {
+			case ev := <-ec:
+				if !tc.fired {
+					t.Errorf("unexpected webhook delivery => got: %+v", ev)
+				}
+				if ev.Action != tc.resp || ev.Sender != "tester@example.com" || ev.ConnID == "" {
+					t.Errorf("unexpected decision record => got: %+v", ev)
+				}
+			case <-time.After(time.Millisecond * 500):
+				if tc.fired {
+					t.Errorf("webhook did not fire")
+				}
+			}
+		})
+	}
+}
+
+// TestWithDecisionWebhookRetry tests that failed webhook deliveries are retried
+func TestWithDecisionWebhookRetry(t *testing.T) {
+	var calls int64
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer hs.Close()
+	s := New(WithDecisionWebhook(hs.URL, nil))
+	s.webhook.retry = time.Millisecond
+	if err := s.webhook.deliver(AuditEvent{Action: RespReject}); err != nil {
+		t.Errorf("webhook delivery failed: %s", err)
+	}
+	if n := atomic.LoadInt64(&calls); n != 3 {
+		t.Errorf("unexpected number of webhook deliveries => expected: 3, got: %d", n)
+	}
+
+	atomic.StoreInt64(&calls, -100)
+	if err := s.webhook.deliver(AuditEvent{Action: RespReject}); err == nil {
+		t.Errorf("webhook delivery was supposed to fail")
+	}
+	if n := atomic.LoadInt64(&calls); n != -100+webhookRetries+1 {
+		t.Errorf("unexpected number of webhook deliveries => expected: %d, got: %d", webhookRetries+1, n+100)
+	}
+}
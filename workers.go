@@ -0,0 +1,122 @@
+package pps
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// WithWorkers enables the worker pool mode. The connections keep reading and parsing
+// their requests and writing the responses on their own goroutines, but the processing
+// of the requests (the enrichers and the Handler) is done by a fixed pool of n workers
+// for all connections. This bounds the number of concurrently processed requests under
+// high connection volume. Requests that arrive while all workers are busy wait for a free
+// worker. If n is 0 or below, the pool is sized by GOMAXPROCS. By default, no worker pool
+// is used
+func WithWorkers(n int) ServerOpt {
+	return func(s *Server) {
+		if n <= 0 {
+			n = runtime.GOMAXPROCS(0)
+		}
+		s.workers = n
+	}
+}
+
+// workerPool is a fixed pool of goroutines that run the submitted jobs
+type workerPool struct {
+	jobs chan func()
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newWorkerPool starts a new workerPool with n workers
+func newWorkerPool(n int) *workerPool {
+	p := &workerPool{jobs: make(chan func()), done: make(chan struct{})}
+	p.wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer p.wg.Done()
+			for {
+				select {
+				case f := <-p.jobs:
+					f()
+				case <-p.done:
+					return
+				}
+			}
+		}()
+	}
+	return p
+}
+
+// run runs the given job on a free worker. Once the pool has been stopped, the job is run
+// on the calling goroutine
+func (p *workerPool) run(f func()) {
+	select {
+	case p.jobs <- f:
+	case <-p.done:
+		f()
+	}
+}
+
+// runBefore runs the given job on a free worker like run, unless no worker becomes free
+// before the given deadline. It returns false if the job has not been run
+func (p *workerPool) runBefore(f func(), dl time.Time) bool {
+	t := time.NewTimer(time.Until(dl))
+	defer t.Stop()
+	select {
+	case p.jobs <- f:
+	case <-p.done:
+		f()
+	case <-t.C:
+		return false
+	}
+	return true
+}
+
+// stop stops the workers of the pool once they have finished their current jobs. Workers
+// that are occupied by a preempted Handler are released right away (see runRequest)
+func (p *workerPool) stop() {
+	close(p.done)
+	p.wg.Wait()
+}
+
+// runRequest processes the given PolicySet on the worker pool of the server, if one is
+// configured, or on the calling goroutine otherwise. A Handler that has been preempted by
+// the response budget keeps its worker until it returns or the pool is stopped, so that
+// stuck Handlers can't exceed the size of the pool. The time a request waits for a free
+// worker counts towards the response budget (see WithResponseBudget)
+func (s *Server) runRequest(ctx context.Context, c *connection, ps *PolicySet) Response {
+	p, ok := ctx.Value(ctxWorkers).(*workerPool)
+	if !ok {
+		resp, _ := s.processRequest(ctx, c, ps)
+		return resp
+	}
+	rc := make(chan Response, 1)
+	job := func() {
+		resp, pending := s.processRequest(ctx, c, ps)
+		rc <- resp
+		if pending == nil {
+			return
+		}
+		// Once the pool is stopped, the worker no longer waits for the preempted
+		// Handler, so that it can't keep the server from returning
+		select {
+		case <-pending:
+		case <-p.done:
+		}
+	}
+	if s.respBudget <= 0 {
+		p.run(job)
+		return <-rc
+	}
+	// If the response budget passes while the request waits for a free worker, the
+	// request is processed on the calling goroutine, which answers it with the fallback
+	// response right away
+	if !p.runBefore(job, s.budgetDeadline(ps)) {
+		resp, _ := s.processRequest(ctx, c, ps)
+		return resp
+	}
+	return <-rc
+}
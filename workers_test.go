@@ -0,0 +1,96 @@
+package pps
+
+import (
+	"bufio"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestWithWorkers tests that the requests of many connections are all answered, while no
+// more handlers than workers run concurrently
+func TestWithWorkers(t *testing.T) {
+	s := New(WithWorkers(2))
+	h := &flipHandler{}
+	addr, stop := testServer(t, &s, h)
+	defer stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Errorf("failed to connect to running server: %s", err)
+				return
+			}
+			defer func() { _ = conn.Close() }()
+			rb := bufio.NewReader(conn)
+			for j := 0; j < 5; j++ {
+				if r := testRequest(t, conn, rb, exampleReq); r != "action=OK\n" && r != "action=REJECT\n" {
+					t.Errorf("unexpected response => got: %q", r)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt64(&h.calls); n != 40 {
+		t.Errorf("unexpected number of handler calls => expected: 40, got: %d", n)
+	}
+	if m := atomic.LoadInt64(&h.max); m > 2 {
+		t.Errorf("too many concurrent handlers => expected at most 2, got: %d", m)
+	}
+}
+
+// TestWithWorkersDefault tests that the worker pool is sized by GOMAXPROCS by default
+func TestWithWorkersDefault(t *testing.T) {
+	s := New(WithWorkers(0))
+	if n := s.Config().Workers; n != runtime.GOMAXPROCS(0) {
+		t.Errorf("unexpected number of workers => expected: %d, got: %d", runtime.GOMAXPROCS(0), n)
+	}
+}
+
+// TestWorkerPoolStopped tests that jobs submitted to a stopped pool still run
+func TestWorkerPoolStopped(t *testing.T) {
+	p := newWorkerPool(1)
+	p.stop()
+	ran := false
+	p.run(func() { ran = true })
+	if !ran {
+		t.Errorf("job submitted to a stopped pool did not run")
+	}
+}
+
+// TestWithWorkersStopPreempted tests that a worker occupied by a preempted Handler doesn't
+// keep the server from returning
+func TestWithWorkersStopPreempted(t *testing.T) {
+	h := &drainHandler{started: make(chan struct{}, 1), release: make(chan struct{})}
+	defer close(h.release)
+	s := New(WithResponseBudget(time.Millisecond*50), WithWorkers(1))
+	addr, stop := testServer(t, &s, h)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		stop()
+		t.Fatalf("failed to connect to running server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if r := testRequest(t, conn, bufio.NewReader(conn), exampleReq); r != "action=DUNNO\n" {
+		t.Errorf("unexpected server response => expected: %q, got: %q", "action=DUNNO\n", r)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 2):
+		t.Errorf("server did not return while a preempted Handler occupied a worker")
+	}
+}